@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+)
+
+// handleAdmin serves the admin endpoints on mux, to clients with one of keys.
+// They can change what the server answers with, so unlike the profiles they
+// are never open: with no keys, they aren't served at all.
+func handleAdmin(mux *http.ServeMux, keys []string, cache *cachedProvider, geocoder Geocoder) {
+	if len(keys) == 0 {
+		return
+	}
+	mux.Handle("/admin/cache/flush", requireKey(keys, flushHandler(cache, geocoder)))
+}
+
+// flushHandler serves POST /admin/cache/flush, which forgets the cached
+// results and geocodes of the city given as a form value, or of every place
+// if none is, and answers with how many entries it forgot.
+func flushHandler(cache *cachedProvider, geocoder Geocoder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var q *query
+		if city := r.FormValue("city"); city != "" {
+			p, err := parsePlace(city)
+			if err != nil {
+				http.Error(w, err.Error(), errorStatus(err))
+				return
+			}
+			q = &p
+		}
+
+		style, err := keyStyleFromRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		results := cache.flush(q)
+		geocodes := 0
+		if g, ok := geocoder.(*cachedGeocoder); ok {
+			geocodes = g.flush(q)
+		}
+
+		respond(w, r, struct {
+			Cleared  int `json:"cleared"`
+			Results  int `json:"results"`
+			Geocodes int `json:"geocodes"`
+		}{results + geocodes, results, geocodes}, style)
+	}
+}
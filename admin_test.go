@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCacheFlush(t *testing.T) {
+	paris, oslo := coordinates{48.8566, 2.3522}, coordinates{59.91, 10.75}
+
+	tests := []struct {
+		name               string
+		city               string // to flush, or empty for all
+		wantResults        int
+		wantGeocodes       int
+		wantRefetched      []string // of the cities looked up before
+		wantGeocodedAfresh []string
+	}{
+		{"one city", "Paris", 1, 1, []string{"Paris"}, []string{"Paris"}},
+		{"every city", "", 2, 2, []string{"Paris", "Oslo"}, []string{"Paris", "Oslo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			alpha := fakes.add("alpha", 285)
+			stub := &stubGeocoder{coords: map[string]coordinates{"Paris": paris, "Oslo": oslo}}
+			geocoder := newCachedGeocoder(stub, 0)
+			cfg := testConfig(t)
+			cfg.apiKeys = []string{"KEY"}
+			_, ts := newTestServer(t, cfg, geocoder, fakes.providers()...)
+
+			get := func(city string) {
+				t.Helper()
+				req, _ := http.NewRequest("GET", ts.URL+"/weather/"+city, nil)
+				req.Header.Set("X-API-Key", "KEY")
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+			for _, city := range []string{"Paris", "Oslo"} {
+				get(city)
+				if _, _, err := geocoder.geocode(context.Background(), city, "", ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			looked, geocoded := alpha.calls.Load(), stub.calls.Load()
+
+			form := url.Values{}
+			if tt.city != "" {
+				form.Set("city", tt.city)
+			}
+			req, _ := http.NewRequest("POST", ts.URL+"/admin/cache/flush", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-API-Key", "KEY")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got struct{ Cleared, Results, Geocodes int }
+			err = json.NewDecoder(resp.Body).Decode(&got)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d, %v", resp.StatusCode, err)
+			}
+			if got.Results != tt.wantResults || got.Geocodes != tt.wantGeocodes || got.Cleared != tt.wantResults+tt.wantGeocodes {
+				t.Errorf("cleared %+v, want %d results and %d geocodes", got, tt.wantResults, tt.wantGeocodes)
+			}
+
+			for _, city := range []string{"Paris", "Oslo"} {
+				get(city)
+				if _, _, err := geocoder.geocode(context.Background(), city, "", ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := alpha.calls.Load() - looked; n != int32(len(tt.wantRefetched)) {
+				t.Errorf("%d lookups after flushing, want %d: %v fetched afresh", n, len(tt.wantRefetched), tt.wantRefetched)
+			}
+			if n := stub.calls.Load() - geocoded; n != int32(len(tt.wantGeocodedAfresh)) {
+				t.Errorf("%d geocodes after flushing, want %d: %v geocoded afresh", n, len(tt.wantGeocodedAfresh), tt.wantGeocodedAfresh)
+			}
+		})
+	}
+}
+
+func TestCacheFlushGuarded(t *testing.T) {
+	tests := []struct {
+		name    string
+		apiKeys []string
+		method  string
+		key     string
+		want    int
+	}{
+		{"no key", []string{"KEY"}, "POST", "", http.StatusUnauthorized},
+		{"wrong key", []string{"KEY"}, "POST", "NOT", http.StatusUnauthorized},
+		{"GET", []string{"KEY"}, "GET", "KEY", http.StatusMethodNotAllowed},
+		{"no keys configured", nil, "POST", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.apiKeys = tt.apiKeys
+			_, ts := newTestServer(t, cfg, nil, &fakeProvider{name: "alpha", kelvin: 285})
+
+			req, _ := http.NewRequest(tt.method, ts.URL+"/admin/cache/flush", nil)
+			if tt.key != "" {
+				req.Header.Set("X-API-Key", tt.key)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import "strings"
+
+type airport struct {
+	city     string
+	lat, lon float64
+}
+
+// airports maps the IATA codes of major airports to their locations.
+var airports = map[string]airport{
+	"AMS": {"Amsterdam", 52.3105, 4.7683},
+	"ATL": {"Atlanta", 33.6407, -84.4277},
+	"BCN": {"Barcelona", 41.2974, 2.0833},
+	"BKK": {"Bangkok", 13.6900, 100.7501},
+	"BOS": {"Boston", 42.3656, -71.0096},
+	"CDG": {"Paris", 49.0097, 2.5479},
+	"DEN": {"Denver", 39.8561, -104.6737},
+	"DFW": {"Dallas", 32.8998, -97.0403},
+	"DXB": {"Dubai", 25.2532, 55.3657},
+	"FRA": {"Frankfurt", 50.0379, 8.5622},
+	"GRU": {"São Paulo", -23.4356, -46.4731},
+	"HKG": {"Hong Kong", 22.3080, 113.9185},
+	"HND": {"Tokyo", 35.5494, 139.7798},
+	"IAD": {"Washington", 38.9531, -77.4565},
+	"ICN": {"Seoul", 37.4602, 126.4407},
+	"IST": {"Istanbul", 41.2753, 28.7519},
+	"JFK": {"New York", 40.6413, -73.7781},
+	"JNB": {"Johannesburg", -26.1367, 28.2411},
+	"LAX": {"Los Angeles", 33.9416, -118.4085},
+	"LHR": {"London", 51.4700, -0.4543},
+	"MAD": {"Madrid", 40.4983, -3.5676},
+	"MEX": {"Mexico City", 19.4361, -99.0719},
+	"MIA": {"Miami", 25.7959, -80.2870},
+	"MUC": {"Munich", 48.3537, 11.7750},
+	"NRT": {"Tokyo", 35.7720, 140.3929},
+	"ORD": {"Chicago", 41.9742, -87.9073},
+	"PEK": {"Beijing", 40.0799, 116.6031},
+	"SEA": {"Seattle", 47.4502, -122.3088},
+	"SFO": {"San Francisco", 37.6213, -122.3790},
+	"SIN": {"Singapore", 1.3644, 103.9915},
+	"SYD": {"Sydney", -33.9399, 151.1753},
+	"YYZ": {"Toronto", 43.6777, -79.6248},
+}
+
+// lookupAirport finds an airport by its IATA code, case-insensitively.
+func lookupAirport(code string) (airport, bool) {
+	a, ok := airports[strings.ToUpper(strings.TrimSpace(code))]
+	return a, ok
+}
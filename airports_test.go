@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestLookupAirport(t *testing.T) {
+	tests := []struct {
+		code     string
+		city     string
+		lat, lon float64
+		found    bool
+	}{
+		{"JFK", "New York", 40.6413, -73.7781, true},
+		{"lhr", "London", 51.4700, -0.4543, true},
+		{" CDG ", "Paris", 49.0097, 2.5479, true},
+		{"XXX", "", 0, 0, false},
+		{"JFKX", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			a, ok := lookupAirport(tt.code)
+			if ok != tt.found {
+				t.Fatalf("found %v, want %v", ok, tt.found)
+			}
+			if !ok {
+				return
+			}
+			if a.city != tt.city || a.lat != tt.lat || a.lon != tt.lon {
+				t.Errorf("got %+v, want %s at %v,%v", a, tt.city, tt.lat, tt.lon)
+			}
+		})
+	}
+}
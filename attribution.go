@@ -0,0 +1,26 @@
+package main
+
+// attributedProvider is implemented by providers whose terms require their
+// data to be credited wherever it is shown. Attribution is the credit, as in
+// "Powered by Dark Sky".
+type attributedProvider interface {
+	Attribution() string
+}
+
+// attributions are the credits due to those of providers named in sources,
+// in the order of sources. Providers that require none are left out.
+func attributions(providers []weatherProvider, sources []string) []string {
+	var credits []string
+	for _, name := range sources {
+		for _, p := range providers {
+			if p.Name() != name {
+				continue
+			}
+			if a, ok := p.(attributedProvider); ok {
+				credits = append(credits, a.Attribution())
+			}
+			break
+		}
+	}
+	return credits
+}
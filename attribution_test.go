@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAttributions(t *testing.T) {
+	providers := []weatherProvider{
+		openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}, weatherbit{keys: newKeyRing("KEY")},
+		&fakeProvider{name: "fake"},
+	}
+
+	tests := []struct {
+		name    string
+		sources []string
+		want    string
+	}{
+		{"in source order", []string{"darkSky", "openWeatherMap"}, "[Powered by Dark Sky Weather data provided by OpenWeather]"},
+		{"one requiring none", []string{"fake", "weatherbit"}, "[Weather data by Weatherbit.io]"},
+		{"none requiring any", []string{"fake"}, "[]"},
+		{"unknown source", []string{"accuWeather"}, "[]"},
+	}
+	for _, tt := range tests {
+		if got := fmt.Sprint(attributions(providers, tt.sources)); got != tt.want {
+			t.Errorf("%s: attributions %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAttributionsServed(t *testing.T) {
+	servePayloads(t, map[string]string{
+		"api.openweathermap.org": `{"main": {"temp": 285}}`,
+		"api.weatherbit.io":      `{"data": [{"temp": 12}], "count": 1}`,
+	})
+
+	tests := []struct {
+		name      string
+		providers []weatherProvider
+		want      string
+	}{
+		{"contributing providers", []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, weatherbit{keys: newKeyRing("KEY")}},
+			"[Weather data provided by OpenWeather Weather data by Weatherbit.io]"},
+		{"a provider requiring none", []weatherProvider{&fakeProvider{name: "fake", kelvin: 285}, weatherbit{keys: newKeyRing("KEY")}},
+			"[Weather data by Weatherbit.io]"},
+		{"a failing provider left out", []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, &fakeProvider{name: "darkSky", err: errors.New("down")}},
+			"[Weather data provided by OpenWeather]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.minProviders = 1
+			// The default client now goes upstream, so the server is asked directly.
+			s, _ := newTestServer(t, cfg, nil, tt.providers...)
+
+			for _, path := range []string{"/weather/Paris", "/conditions/Paris"} {
+				rec := httptest.NewRecorder()
+				s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+				var got struct {
+					Attributions []string `json:"attributions"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatalf("%s: %v", path, err)
+				}
+				if fmt.Sprint(got.Attributions) != tt.want {
+					t.Errorf("%s: attributions %q, want %s", path, got.Attributions, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultProvider is implemented by providers that report where their
+// temperature came from, such as multiWeatherProvider.
+type resultProvider interface {
+	aggregate(ctx context.Context, q query) (result, error)
+}
+
+// cachedProvider wraps a resultProvider, remembering each query's result for
+// ttl and coalescing concurrent lookups of the same place into a single
+// upstream call. Upstreams that say their data is fresh for less than ttl,
+// with a Cache-Control max-age, have their shortest say instead. It holds at
+// most maxCacheEntries places, so its memory stays bounded whatever places
+// are asked after.
+type cachedProvider struct {
+	provider resultProvider
+	ttl      time.Duration
+	metrics  *cacheMetrics
+
+	// maxStale, if set, is how long past its ttl a result may still be
+	// served, marked stale, when a fresh lookup fails. An outdated
+	// temperature is more use to most clients than an error. Results an
+	// upstream said not to cache at all are never served stale.
+	maxStale time.Duration
+
+	// mu guards ttl and maxStale too, which setTTL may change at any time.
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	flights flightGroup
+}
+
+const maxCacheEntries = 10000
+
+type cacheEntry struct {
+	result  result
+	fetched time.Time
+	ttl     time.Duration
+}
+
+type cacheMetrics struct {
+	hits      *counter
+	misses    *counter
+	coalesced *counter
+	stale     *counter
+}
+
+func newCacheMetrics(r *metricsRegistry) *cacheMetrics {
+	return &cacheMetrics{
+		hits:      r.newCounter("weather_cache_hits_total", "Temperature lookups served from cache."),
+		misses:    r.newCounter("weather_cache_misses_total", "Temperature lookups not found in cache."),
+		coalesced: r.newCounter("weather_cache_coalesced_total", "Lookups that shared another request's in-flight upstream call."),
+		stale:     r.newCounter("weather_cache_stale_total", "Lookups that failed and were served a stale cached result instead."),
+	}
+}
+
+func newCachedProvider(p resultProvider, ttl time.Duration, m *cacheMetrics) *cachedProvider {
+	return &cachedProvider{
+		provider: p,
+		ttl:      ttl,
+		metrics:  m,
+		entries:  map[string]cacheEntry{},
+	}
+}
+
+func (c *cachedProvider) Name() string { return "cache" }
+
+// setTTL changes how long results are cached, and served stale after that,
+// from the next lookup on. Results already cached keep the ttl they were
+// stored with.
+func (c *cachedProvider) setTTL(ttl, maxStale time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl, c.maxStale = ttl, maxStale
+}
+
+func (c *cachedProvider) temperature(ctx context.Context, city string) (float64, error) {
+	q, err := parsePlace(city)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.aggregate(ctx, q)
+	return res.temp.Kelvin(), err
+}
+
+func (c *cachedProvider) aggregate(ctx context.Context, q query) (result, error) {
+	return c.aggregateWithin(ctx, q, 0)
+}
+
+// aggregateWithin is aggregate, but if maxAge is set no result older than
+// that is served, fresh or stale: an older one is looked up again, however
+// long the cache would have kept it.
+func (c *cachedProvider) aggregateWithin(ctx context.Context, q query, maxAge time.Duration) (result, error) {
+	key := q.key()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	maxStale := c.maxStale
+	c.mu.Unlock()
+
+	if ok && maxAge > 0 && time.Since(e.fetched) >= maxAge {
+		ok = false
+	}
+
+	if ok && time.Since(e.fetched) < e.ttl {
+		c.metrics.hits.inc()
+		res := e.result
+		res.cached, res.fetched = true, e.fetched
+		return res, nil
+	}
+	c.metrics.misses.inc()
+
+	res, err := c.fetch(ctx, key, q)
+	if err != nil && ok && e.ttl > 0 && time.Since(e.fetched) < e.ttl+maxStale {
+		log.Printf("cache: serving stale result for %s: %v", q, err)
+		c.metrics.stale.inc()
+		res = e.result
+		res.cached, res.stale, res.fetched = true, true, e.fetched
+		return res, nil
+	}
+
+	return res, err
+}
+
+// refresh looks q up afresh, whether or not its cached result has expired,
+// and caches what it finds.
+func (c *cachedProvider) refresh(ctx context.Context, q query) (result, error) {
+	return c.fetch(ctx, q.key(), q)
+}
+
+// maxLookupTime bounds a shared upstream lookup. No one caller going away
+// cancels it, so without a bound an upstream that never answers would hold
+// up every later lookup of its place for good.
+const maxLookupTime = 30 * time.Second
+
+// fetch looks q up from the provider, caching the result under key.
+// Concurrent fetches of one key share a single upstream call. A caller whose
+// ctx is done stops waiting for it, but the call carries on for the others.
+func (c *cachedProvider) fetch(ctx context.Context, key string, q query) (result, error) {
+	// The upstream call is shared, so it must not be canceled just because
+	// the request that happened to start it goes away.
+	shared := context.WithoutCancel(ctx)
+
+	res, err, joined := c.flights.do(ctx, key, func() (result, error) {
+		ctx, cancel := context.WithTimeout(shared, maxLookupTime)
+		defer cancel()
+
+		ctx, fresh := withFreshness(ctx)
+		res, err := c.provider.aggregate(ctx, q)
+		if err != nil {
+			return result{}, err
+		}
+
+		res.fetched = time.Now()
+		c.mu.Lock()
+		ttl := c.ttl
+		if maxAge, ok := fresh.maxAge(); ok && maxAge < ttl {
+			ttl = maxAge
+		}
+		c.store(key, cacheEntry{result: res, fetched: res.fetched, ttl: ttl})
+		c.mu.Unlock()
+
+		return res, nil
+	})
+	if joined {
+		c.metrics.coalesced.inc()
+	}
+	return res, err
+}
+
+// store caches e under key. To make room for a new place in a full cache,
+// the entries too old to be served even stale are swept out, and failing
+// that the oldest entry is evicted. The caller must hold c.mu.
+func (c *cachedProvider) store(key string, e cacheEntry) {
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCacheEntries {
+		c.sweep()
+		if len(c.entries) >= maxCacheEntries {
+			c.evict()
+		}
+	}
+	c.entries[key] = e
+}
+
+// sweep forgets the entries that can no longer be served, fresh or stale.
+// The caller must hold c.mu.
+func (c *cachedProvider) sweep() {
+	for key, e := range c.entries {
+		age := time.Since(e.fetched)
+		if age >= e.ttl && (e.ttl == 0 || age >= e.ttl+c.maxStale) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// evict forgets the entry fetched longest ago. The caller must hold c.mu.
+func (c *cachedProvider) evict() {
+	var oldest string
+	var when time.Time
+	for key, e := range c.entries {
+		if oldest == "" || e.fetched.Before(when) {
+			oldest, when = key, e.fetched
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// flush forgets the cached results for q, whatever their region bias, or
+// for every place if q is nil, and reports how many it forgot.
+func (c *cachedProvider) flush(q *query) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key := range c.entries {
+		if q == nil || key == q.key() || strings.HasPrefix(key, q.address()+"~") {
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// flightGroup deduplicates concurrent calls sharing a key, so that only one
+// of them does the work and the rest wait for its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done   chan struct{} // closed once result and err are set
+	result result
+	err    error
+}
+
+// do runs fn for key unless a call for key is already in flight, in which
+// case it waits for that call and returns its result with joined set. If ctx
+// is done first, do returns ctx's error at once, and the call runs on for
+// whoever else is waiting on it.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (result, error)) (res result, err error, joined bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flight{}
+	}
+
+	f, joined := g.calls[key]
+	if !joined {
+		f = &flight{done: make(chan struct{})}
+		g.calls[key] = f
+		go func() {
+			f.result, f.err = fn()
+
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, f.err, joined
+	case <-ctx.Done():
+		return result{}, ctx.Err(), joined
+	}
+}
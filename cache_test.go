@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resultFunc adapts a function into a resultProvider, counting its calls.
+type resultFunc struct {
+	fn    func(ctx context.Context, q query) (result, error)
+	calls atomic.Int32
+}
+
+func (f *resultFunc) aggregate(ctx context.Context, q query) (result, error) {
+	f.calls.Add(1)
+	return f.fn(ctx, q)
+}
+
+// fixedResult is a resultProvider always answering with temp.
+func fixedResult(temp Temperature) *resultFunc {
+	return &resultFunc{fn: func(context.Context, query) (result, error) {
+		return result{temp: temp, sources: []string{"fixed"}}, nil
+	}}
+}
+
+// newTestCache is a cache in front of p with counters of its own.
+func newTestCache(p resultProvider, ttl time.Duration) *cachedProvider {
+	return newCachedProvider(p, ttl, newCacheMetrics(&metricsRegistry{}))
+}
+
+// counts are a cache's counters, in the order hits, misses and coalesced.
+func counts(c *cachedProvider) [3]uint64 {
+	m := c.metrics
+	return [3]uint64{m.hits.get(), m.misses.get(), m.coalesced.get()}
+}
+
+func TestCacheCounters(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T) *cachedProvider
+		want [3]uint64
+	}{
+		{"miss then hit", func(t *testing.T) *cachedProvider {
+			c := newTestCache(fixedResult(280), time.Minute)
+			for i := 0; i < 2; i++ {
+				if _, err := c.aggregate(context.Background(), query{city: "Paris"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return c
+		}, [3]uint64{1, 1, 0}},
+		{"expired entry", func(t *testing.T) *cachedProvider {
+			c := newTestCache(fixedResult(280), time.Nanosecond)
+			for i := 0; i < 2; i++ {
+				if _, err := c.aggregate(context.Background(), query{city: "Paris"}); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			return c
+		}, [3]uint64{0, 2, 0}},
+		{"coalesced lookups", func(t *testing.T) *cachedProvider {
+			release := make(chan struct{})
+			p := &resultFunc{fn: func(context.Context, query) (result, error) {
+				<-release
+				return result{temp: 280}, nil
+			}}
+			c := newTestCache(p, time.Minute)
+
+			var wg sync.WaitGroup
+			for i := 0; i < 3; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := c.aggregate(context.Background(), query{city: "Paris"}); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			// Let every lookup miss and join the flight before it lands.
+			for c.metrics.misses.get() < 3 {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(10 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if n := p.calls.Load(); n != 1 {
+				t.Errorf("provider asked %d times, want once", n)
+			}
+			return c
+		}, [3]uint64{0, 3, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.run(t)
+			if got := counts(c); got != tt.want {
+				t.Errorf("hits, misses, coalesced = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheCountersServed(t *testing.T) {
+	r := &metricsRegistry{}
+	c := newCachedProvider(fixedResult(280), time.Minute, newCacheMetrics(r))
+	for i := 0; i < 2; i++ {
+		if _, err := c.aggregate(context.Background(), query{city: "Paris"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		"weather_cache_hits_total 1\n",
+		"weather_cache_misses_total 1\n",
+		"weather_cache_coalesced_total 0\n",
+		"# TYPE weather_cache_hits_total counter\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("/metrics lacks %q:\n%s", want, rec.Body)
+		}
+	}
+}
+
+func TestCacheStaysBounded(t *testing.T) {
+	c := newTestCache(fixedResult(280), time.Minute)
+	c.maxStale = time.Minute
+
+	c.mu.Lock()
+	c.store("expired", cacheEntry{fetched: time.Now().Add(-time.Hour), ttl: time.Minute})
+	c.store("oldest", cacheEntry{fetched: time.Now().Add(-30 * time.Second), ttl: time.Minute})
+	for i := 0; len(c.entries) < maxCacheEntries; i++ {
+		c.store(strconv.Itoa(i), cacheEntry{fetched: time.Now(), ttl: time.Minute})
+	}
+	c.mu.Unlock()
+
+	tests := []struct {
+		key  string
+		gone []string
+	}{
+		{"first new place", []string{"expired"}},
+		{"second new place", []string{"expired", "oldest"}},
+	}
+	for _, tt := range tests {
+		if _, err := c.aggregate(context.Background(), query{city: tt.key}); err != nil {
+			t.Fatal(err)
+		}
+
+		c.mu.Lock()
+		if n := len(c.entries); n != maxCacheEntries {
+			t.Errorf("after %s: %d entries, want %d", tt.key, n, maxCacheEntries)
+		}
+		if _, ok := c.entries[tt.key]; !ok {
+			t.Errorf("after %s: not cached", tt.key)
+		}
+		for _, key := range tt.gone {
+			if _, ok := c.entries[key]; ok {
+				t.Errorf("after %s: %s still cached", tt.key, key)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+func TestCacheWaitersCanGiveUp(t *testing.T) {
+	release := make(chan struct{})
+	p := &resultFunc{fn: func(ctx context.Context, q query) (result, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("shared lookup has no deadline")
+		}
+		<-release
+		return result{temp: 280}, nil
+	}}
+	c := newTestCache(p, time.Minute)
+	paris := query{city: "Paris"}
+
+	// Both the caller that starts the lookup and one that joins it return
+	// when their own context is done, however long the upstream takes.
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		_, err := c.aggregate(ctx, paris)
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("caller %d: error %v, want %v", i, err, context.DeadlineExceeded)
+		}
+	}
+
+	// The lookup carries on without them, and its result is cached.
+	close(release)
+	for c.metrics.hits.get() == 0 {
+		if _, err := c.aggregate(context.Background(), paris); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := p.calls.Load(); n != 1 {
+		t.Errorf("provider asked %d times, want once", n)
+	}
+}
+
+func TestCacheHonorsUpstreamMaxAge(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl []string // of each upstream response
+		wantTTL      time.Duration
+		wantCalls    int32 // after two lookups
+	}{
+		{"no header", nil, time.Hour, 1},
+		{"longer max-age", []string{"public, max-age=86400"}, time.Hour, 1},
+		{"shorter max-age", []string{"max-age=60"}, time.Minute, 1},
+		{"shortest of several", []string{"max-age=600", "max-age=120"}, 2 * time.Minute, 1},
+		{"no-store", []string{"no-store"}, 0, 2},
+		{"zero max-age", []string{"max-age=0"}, 0, 2},
+		{"malformed", []string{"max-age=soon"}, time.Hour, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var urls []string
+			for _, cc := range tt.cacheControl {
+				cc := cc
+				ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Cache-Control", cc)
+					fmt.Fprint(w, `{}`)
+				}))
+				t.Cleanup(ts.Close)
+				urls = append(urls, ts.URL)
+			}
+			p := &resultFunc{fn: func(ctx context.Context, q query) (result, error) {
+				for _, u := range urls {
+					var v struct{}
+					if err := getJSON(ctx, u, &v); err != nil {
+						return result{}, err
+					}
+				}
+				return result{temp: 285, sources: []string{"fake"}}, nil
+			}}
+
+			c := newTestCache(p, time.Hour)
+			paris := query{city: "Paris"}
+			for i := 0; i < 2; i++ {
+				if _, err := c.aggregate(context.Background(), paris); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := c.entries[paris.key()].ttl; got != tt.wantTTL {
+				t.Errorf("cached for %s, want %s", got, tt.wantTTL)
+			}
+			if got := p.calls.Load(); got != tt.wantCalls {
+				t.Errorf("%d upstream lookups, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestStaleServedWhenProvidersFail(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration // of the cached entry
+		maxStale time.Duration
+		stale    bool
+	}{
+		{"within max stale", 30 * time.Second, time.Hour, true},
+		{"stale serving off", 30 * time.Second, 0, false},
+		{"past max stale", 30 * time.Second, 10 * time.Second, false},
+		{"upstream said not to cache", 0, time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			failing := &resultFunc{fn: func(context.Context, query) (result, error) {
+				return result{}, errors.New("provider down")
+			}}
+			c := newTestCache(failing, 30*time.Second)
+			c.maxStale = tt.maxStale
+
+			// A result for Paris, cached a minute ago and so expired.
+			paris := query{city: "Paris"}
+			c.entries[paris.key()] = cacheEntry{
+				result:  result{temp: 285, sources: []string{"alpha"}},
+				fetched: time.Now().Add(-time.Minute),
+				ttl:     tt.ttl,
+			}
+
+			res, err := c.aggregate(context.Background(), paris)
+			if !tt.stale {
+				if err == nil {
+					t.Fatalf("served %v, want the lookup's error", res.temp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.stale || res.temp != 285 {
+				t.Errorf("served %v, stale %t; want the cached 285 K, marked stale", res.temp, res.stale)
+			}
+			if got := c.metrics.stale.get(); got != 1 {
+				t.Errorf("%d stale results counted, want 1", got)
+			}
+		})
+	}
+}
+
+func TestStaleResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxStale  time.Duration
+		want      int
+		wantCache string
+	}{
+		{"within max stale", time.Hour, http.StatusOK, "stale"},
+		{"stale serving off", 0, http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			fakes := fakeRegistry{}
+			fakes.add("alpha", 0).err = errors.New("provider down")
+			fakes.add("beta", 0).err = errors.New("provider down")
+			cfg := testConfig(t)
+			cfg.cacheTTL, cfg.maxStale = 30*time.Second, tt.maxStale
+			s, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+			// A result for Paris, cached a minute ago and so expired.
+			q, err := queryFromRequest(httptest.NewRequest("GET", "/weather/Paris", nil), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.cache.mu.Lock()
+			s.cache.entries[q.key()] = cacheEntry{
+				result:  result{temp: 285, sources: []string{"alpha"}},
+				fetched: time.Now().Add(-time.Minute),
+				ttl:     cfg.cacheTTL,
+			}
+			s.cache.mu.Unlock()
+
+			resp, err := http.Get(ts.URL + "/weather/Paris")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if got := resp.Header.Get("X-Cache"); got != tt.wantCache {
+				t.Errorf("X-Cache %q, want %q", got, tt.wantCache)
+			}
+			if stale := strings.HasPrefix(resp.Header.Get("Warning"), "110 "); stale != (tt.wantCache == "stale") {
+				t.Errorf("Warning %q", resp.Header.Get("Warning"))
+			}
+		})
+	}
+}
+
+func TestAgeHeader(t *testing.T) {
+	fakes := fakeRegistry{}
+	alpha := fakes.add("alpha", 285)
+	cfg := testConfig(t)
+	cfg.cacheTTL = time.Minute
+	s, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+	tests := []struct {
+		name      string
+		fetchedAt time.Duration // before the request, to backdate the cached result by
+		wantCache string
+		wantAge   string
+		wantCalls int32
+	}{
+		{"fresh fetch", 0, "miss", "0", 1},
+		{"cached a moment ago", 0, "hit", "0", 1},
+		{"cached 42s ago", 42 * time.Second, "hit", "42", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.fetchedAt > 0 {
+				s.cache.mu.Lock()
+				for key, e := range s.cache.entries {
+					e.fetched = time.Now().Add(-tt.fetchedAt)
+					s.cache.entries[key] = e
+				}
+				s.cache.mu.Unlock()
+			}
+
+			resp, err := http.Get(ts.URL + "/weather/Paris")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("X-Cache"); got != tt.wantCache {
+				t.Errorf("X-Cache %q, want %q", got, tt.wantCache)
+			}
+			if got := resp.Header.Get("Age"); got != tt.wantAge {
+				t.Errorf("Age %q, want %q", got, tt.wantAge)
+			}
+			if n := alpha.calls.Load(); n != tt.wantCalls {
+				t.Errorf("%d lookups, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestMaxAgeRefetches(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantCache  string
+		wantCalls  int32
+		wantK      float64
+	}{
+		{"younger than max_age", "?max_age=60", http.StatusOK, "hit", 0, 280},
+		{"older than max_age", "?max_age=10", http.StatusOK, "miss", 1, 290},
+		{"no max_age", "", http.StatusOK, "hit", 0, 280},
+		{"zero", "?max_age=0", http.StatusBadRequest, "", 0, 0},
+		{"malformed", "?max_age=soon", http.StatusBadRequest, "", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			alpha := fakes.add("alpha", 290)
+			cfg := testConfig(t)
+			cfg.cacheTTL = 5 * time.Minute
+			s, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+			// A reading of Paris, cached 30 seconds ago.
+			q, err := queryFromRequest(httptest.NewRequest("GET", "/weather/Paris", nil), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.cache.mu.Lock()
+			s.cache.store(q.key(), cacheEntry{
+				result:  result{temp: 280, sources: []string{"alpha"}, readings: 1},
+				fetched: time.Now().Add(-30 * time.Second),
+				ttl:     cfg.cacheTTL,
+			})
+			s.cache.mu.Unlock()
+
+			var got struct {
+				Temperature struct{ K float64 }
+			}
+			resp, err := http.Get(ts.URL + "/weather/Paris" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode == http.StatusOK {
+				json.NewDecoder(resp.Body).Decode(&got)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if n := alpha.calls.Load(); n != tt.wantCalls {
+				t.Errorf("%d lookups, want %d", n, tt.wantCalls)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if x := resp.Header.Get("X-Cache"); x != tt.wantCache {
+				t.Errorf("X-Cache %q, want %q", x, tt.wantCache)
+			}
+			if got.Temperature.K != tt.wantK {
+				t.Errorf("%v K, want %v K", got.Temperature.K, tt.wantK)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// savedEntry is a cache entry as written to the cache file. It keeps the
+// whole result, explanation, weights and provider statuses included, so that
+// a restored entry answers just as it did before the restart.
+type savedEntry struct {
+	Key         string            `json:"key"`
+	Kelvin      float64           `json:"kelvin"`
+	Sources     []string          `json:"sources"`
+	Readings    int               `json:"readings"`
+	Spread      float64           `json:"spread"`
+	Celsius     *float64          `json:"celsius,omitempty"`
+	Failed      []providerFailure `json:"failed,omitempty"`
+	Explanation *explanation      `json:"explanation,omitempty"`
+	Statuses    []providerStatus  `json:"statuses,omitempty"`
+	Fetched     time.Time         `json:"fetched"`
+	TTL         time.Duration     `json:"ttl"`
+}
+
+// save writes the cache's unexpired entries to the file at path, so that a
+// restarted server can start warm, and reports how many it wrote. The file
+// is written whole and then renamed into place, so a crash midway never
+// leaves half of one.
+func (c *cachedProvider) save(path string) (int, error) {
+	c.mu.Lock()
+	saved := make([]savedEntry, 0, len(c.entries))
+	for key, e := range c.entries {
+		if time.Since(e.fetched) >= e.ttl {
+			continue
+		}
+		saved = append(saved, savedEntry{
+			Key:         key,
+			Kelvin:      e.result.temp.Kelvin(),
+			Sources:     e.result.sources,
+			Readings:    e.result.readings,
+			Spread:      e.result.spread,
+			Celsius:     e.result.celsius,
+			Failed:      e.result.failed,
+			Explanation: e.result.explanation,
+			Statuses:    e.result.statuses,
+			Fetched:     e.fetched,
+			TTL:         e.ttl,
+		})
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return 0, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return 0, err
+	}
+	return len(saved), os.Rename(tmp, path)
+}
+
+// load reads the entries save wrote to the file at path back into the cache,
+// discarding any that have expired since, and reports how many it kept. A
+// missing file loads nothing.
+func (c *cachedProvider) load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var saved []savedEntry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, s := range saved {
+		if time.Since(s.Fetched) >= s.TTL {
+			continue
+		}
+		c.store(s.Key, cacheEntry{
+			result: result{
+				temp:        Temperature(s.Kelvin),
+				sources:     s.Sources,
+				readings:    s.Readings,
+				spread:      s.Spread,
+				celsius:     s.Celsius,
+				failed:      s.Failed,
+				explanation: s.Explanation,
+				statuses:    s.Statuses,
+				fetched:     s.Fetched,
+			},
+			fetched: s.Fetched,
+			ttl:     s.TTL,
+		})
+		n++
+	}
+	return n, nil
+}
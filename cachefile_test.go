@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	cfg := testConfig(t)
+	cfg.cacheTTL, cfg.minProviders = time.Minute, 1
+
+	before := fakeRegistry{}
+	before.add("alpha", 280)
+	before.add("beta", 0).err = errors.New("provider down")
+	s, ts := newTestServer(t, cfg, nil, before.providers()...)
+	getJSONResponse(t, ts.URL+"/weather/Paris", &struct{}{})
+	if n, err := s.cache.save(path); n != 1 || err != nil {
+		t.Fatalf("saved %d entries, %v; want 1", n, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	// The restarted server's providers would answer differently, if asked.
+	after := fakeRegistry{}
+	alpha := after.add("alpha", 300)
+	after.add("beta", 300)
+	s, ts = newTestServer(t, cfg, nil, after.providers()...)
+	if n, err := s.cache.load(path); n != 1 || err != nil {
+		t.Fatalf("loaded %d entries, %v; want 1", n, err)
+	}
+
+	var got struct {
+		Temperature struct{ K float64 }
+		Sources     []string
+		Partial     bool
+		Failed      []struct{ Provider, Error string }
+		Explanation *struct {
+			Readings []struct {
+				Provider string
+				Weight   *float64
+			}
+		}
+		Debug []struct{ Provider string }
+	}
+	resp := getJSONResponse(t, ts.URL+"/weather/Paris?explain=true&debug=true", &got)
+	if x := resp.Header.Get("X-Cache"); x != "hit" {
+		t.Errorf("X-Cache %q, want hit", x)
+	}
+	if n := alpha.calls.Load(); n != 0 {
+		t.Errorf("%d lookups after loading, want none", n)
+	}
+	if got.Temperature.K != 280 || len(got.Sources) != 1 || got.Sources[0] != "alpha" {
+		t.Errorf("served %v K from %v, want the saved 280 K from alpha", got.Temperature.K, got.Sources)
+	}
+	if !got.Partial || len(got.Failed) != 1 || got.Failed[0].Provider != "beta" {
+		t.Errorf("partial %v, failed %v; want beta's failure saved too", got.Partial, got.Failed)
+	}
+	if e := got.Explanation; e == nil || len(e.Readings) == 0 || e.Readings[0].Provider != "alpha" ||
+		e.Readings[0].Weight == nil || *e.Readings[0].Weight != 1 {
+		t.Errorf("explanation %+v, want alpha's reading and weight saved too", e)
+	}
+	if len(got.Debug) != 2 || got.Debug[0].Provider != "alpha" || got.Debug[1].Provider != "beta" {
+		t.Errorf("debug %+v, want alpha's and beta's statuses saved too", got.Debug)
+	}
+}
+
+func TestCacheLoad(t *testing.T) {
+	fresh := `{"key":"paris","kelvin":285,"sources":["alpha"],"readings":1,"fetched":"` +
+		time.Now().Add(-time.Second).Format(time.RFC3339Nano) + `","ttl":60000000000}`
+	expired := `{"key":"oslo","kelvin":270,"sources":["alpha"],"readings":1,"fetched":"` +
+		time.Now().Add(-2*time.Minute).Format(time.RFC3339Nano) + `","ttl":60000000000}`
+
+	tests := []struct {
+		name     string
+		contents string // of the file, or empty for none
+		want     int
+		wantErr  bool
+	}{
+		{"no file", "", 0, false},
+		{"fresh and expired entries", "[" + fresh + "," + expired + "]", 1, false},
+		{"nothing saved", "[]", 0, false},
+		{"malformed", "[{", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			if tt.contents != "" {
+				if err := os.WriteFile(path, []byte(tt.contents), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := newCachedProvider(nil, time.Minute, newCacheMetrics(&metricsRegistry{}))
+			n, err := c.load(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %v", err, tt.wantErr)
+			}
+			if n != tt.want || len(c.entries) != tt.want {
+				t.Errorf("loaded %d entries, holding %d; want %d", n, len(c.entries), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import "strings"
+
+// Capabilities is the set of things a provider is able to report. Endpoints
+// route lookups only to providers capable of answering them, rather than
+// finding out by trial and error.
+type Capabilities uint
+
+const (
+	// capTemperature is looking up the current temperature of a place.
+	capTemperature Capabilities = 1 << iota
+
+	// capCoordinates is looking up weather by latitude and longitude, rather
+	// than by name. See coordinateProvider.
+	capCoordinates
+
+	// capConditions is reporting current conditions beyond the temperature.
+	// See conditionsProvider.
+	capConditions
+
+	// capSunTimes is reporting today's sunrise and sunset.
+	capSunTimes
+
+	// capCloudCover is reporting how cloudy it is.
+	capCloudCover
+
+	// capHistory is looking up the weather on a past day. See
+	// historyProvider.
+	capHistory
+
+	// capPressure is reporting barometric pressure.
+	capPressure
+
+	// capUVIndex is reporting the strength of the sun's ultraviolet light.
+	capUVIndex
+
+	// capVisibility is reporting how far one can see.
+	capVisibility
+
+	// capPrecipitation is reporting the chance of rain or snow.
+	capPrecipitation
+
+	// capAccumulation is reporting how much rain or snow is falling.
+	capAccumulation
+
+	// capMoonPhase is reporting the phase of the moon.
+	capMoonPhase
+
+	// capWind is reporting the wind speed.
+	capWind
+
+	// capHumidity is reporting the relative humidity.
+	capHumidity
+)
+
+// conditionMeasurements are the capabilities a conditionsProvider may or may
+// not have, depending on which fields of Conditions it fills in.
+const conditionMeasurements = capSunTimes | capCloudCover | capPressure | capUVIndex | capVisibility | capPrecipitation | capAccumulation | capMoonPhase | capWind | capHumidity
+
+var capabilityNames = []string{"temperature", "coordinates", "conditions", "sun_times", "cloud_cover", "history", "pressure", "uv_index", "visibility", "precipitation", "accumulation", "moon_phase", "wind", "humidity"}
+
+func (c Capabilities) has(want Capabilities) bool {
+	return c&want == want
+}
+
+// String lists the capabilities in c, as in "temperature|coordinates".
+func (c Capabilities) String() string {
+	var names []string
+	for i, name := range capabilityNames {
+		if c.has(1 << uint(i)) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// capabilitiesOf reports what p can do. Providers may declare their
+// capabilities with a capabilities method; those that don't are assumed
+// capable of whatever the optional interfaces they implement provide.
+// Either way, p can't claim to do something it has no method for.
+func capabilitiesOf(p weatherProvider) Capabilities {
+	implemented := capTemperature
+	if _, ok := p.(coordinateProvider); ok {
+		implemented |= capCoordinates
+	}
+	if _, ok := p.(conditionsProvider); ok {
+		implemented |= capConditions | conditionMeasurements
+	}
+	if _, ok := p.(historyProvider); ok {
+		implemented |= capHistory
+	}
+
+	if d, ok := p.(interface{ capabilities() Capabilities }); ok {
+		return d.capabilities() & implemented
+	}
+
+	// Without a declaration, we can't tell which conditions are reported.
+	return implemented &^ conditionMeasurements
+}
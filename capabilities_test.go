@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// overclaiming declares that it can report conditions, without the method to.
+type overclaiming struct{ *fakeProvider }
+
+func (overclaiming) capabilities() Capabilities {
+	return capTemperature | capConditions | capCloudCover
+}
+
+func TestProviderCapabilities(t *testing.T) {
+	tests := []struct {
+		provider weatherProvider
+		want     string
+	}{
+		{openWeatherMap{}, "temperature|coordinates|conditions|sun_times|cloud_cover|pressure|visibility|accumulation|wind|humidity"},
+		{weatherUnderground{}, "temperature|coordinates|conditions|pressure|visibility|wind|humidity"},
+		{darkSky{}, "temperature|coordinates|conditions|sun_times|cloud_cover|history|pressure|uv_index|visibility|precipitation|accumulation|moon_phase|wind|humidity"},
+		{weatherbit{}, "temperature|coordinates|conditions|cloud_cover|pressure|uv_index|visibility|wind|humidity"},
+		{mockProvider{}, "temperature|coordinates"},
+		{&fakeProvider{name: "fake"}, "temperature"},
+		{overclaiming{&fakeProvider{name: "overclaiming"}}, "temperature"},
+	}
+	for _, tt := range tests {
+		if got := capabilitiesOf(tt.provider).String(); got != tt.want {
+			t.Errorf("%s: capabilities %s, want %s", tt.provider.Name(), got, tt.want)
+		}
+	}
+}
+
+func TestIncapableProvidersSkipped(t *testing.T) {
+	servePayloads(t, map[string]string{
+		"api.openweathermap.org": `{"main": {"temp": 285}}`,
+	})
+	fake := &fakeProvider{name: "fake", kelvin: 300}
+	w := multiWeatherProvider{providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, fake}}
+
+	res, err := w.conditions(context.Background(), query{city: "Paris"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Kelvin != 285 || len(res.sources) != 1 || res.sources[0] != "openWeatherMap" {
+		t.Errorf("conditions %v K from %v, want 285 K from openWeatherMap alone", res.Kelvin, res.sources)
+	}
+	if n := fake.calls.Load(); n != 0 {
+		t.Errorf("a provider without conditions asked %d times", n)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// validate reports everything wrong with cfg that would stop the server from
+// working as configured, rather than just the first thing.
+func (cfg Config) validate() []error {
+	var errs []error
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		add("a TLS certificate and key must be set together")
+	}
+	if cfg.minKelvin >= cfg.maxKelvin {
+		add("WEATHER_MIN_KELVIN (%g) must be below WEATHER_MAX_KELVIN (%g)", cfg.minKelvin, cfg.maxKelvin)
+	}
+	if _, err := parseProxies(cfg.trustedProxies); err != nil {
+		add("WEATHER_TRUSTED_PROXIES: %v", err)
+	}
+	if _, err := parseRounding(string(cfg.rounding)); err != nil {
+		add("WEATHER_ROUNDING: %v", err)
+	}
+	if _, err := parseUnit(cfg.defaultUnit); err != nil {
+		add("WEATHER_DEFAULT_UNIT: %v", err)
+	}
+	if cfg.trendThreshold < 0 {
+		add("WEATHER_TREND_THRESHOLD must not be negative")
+	}
+	if cfg.modeResolution < 0 {
+		add("WEATHER_MODE_RESOLUTION must not be negative")
+	}
+	if cfg.geocodeRegion != "" {
+		if _, err := parseRegion(cfg.geocodeRegion); err != nil {
+			add("WEATHER_GEOCODE_REGION: %v", err)
+		}
+	}
+	if cfg.maxCityLength <= 0 {
+		add("WEATHER_MAX_CITY_LENGTH must be positive")
+	}
+	if cfg.minProviders < 0 {
+		add("WEATHER_MIN_PROVIDERS must not be negative")
+	}
+	if cfg.successWindow <= 0 {
+		add("WEATHER_SUCCESS_WINDOW must be positive")
+	}
+	if cfg.streamInterval <= 0 {
+		add("WEATHER_STREAM_INTERVAL must be positive")
+	}
+	if cfg.geocodeTimeout < 0 {
+		add("WEATHER_GEOCODE_TIMEOUT must not be negative")
+	}
+	if cfg.maxStreams < 0 {
+		add("WEATHER_MAX_STREAMS must not be negative")
+	}
+	if !(cfg.clusterRadius >= 0) {
+		add("WEATHER_CLUSTER_RADIUS must not be negative")
+	}
+	if cfg.connectTimeout < 0 {
+		add("WEATHER_CONNECT_TIMEOUT must not be negative")
+	}
+	if cfg.tlsHandshakeTimeout < 0 {
+		add("WEATHER_TLS_HANDSHAKE_TIMEOUT must not be negative")
+	}
+	if cfg.upstreamTimeout < 0 {
+		add("WEATHER_UPSTREAM_TIMEOUT must not be negative")
+	}
+	if _, err := newResolver(cfg.dnsServer); err != nil {
+		add("WEATHER_DNS_SERVER: %v", err)
+	}
+	if _, err := parseStatuses(cfg.retryStatuses); err != nil {
+		add("WEATHER_RETRY_STATUSES: %v", err)
+	}
+	if cfg.prewarmInterval <= 0 {
+		add("WEATHER_PREWARM_INTERVAL must be positive")
+	} else if _, err := parsePrewarm(cfg.prewarm, cfg.prewarmInterval); err != nil {
+		add("WEATHER_PREWARM: %v", err)
+	}
+	if cfg.alertThresholds != "" {
+		if _, err := parseThresholds(cfg.alertThresholds); err != nil {
+			add("WEATHER_ALERT_THRESHOLDS: %v", err)
+		}
+		if cfg.alertWebhook == "" {
+			errs = append(errs, errNoWebhook)
+		}
+	}
+	if cfg.defaultCity != "" {
+		if _, err := parsePlace(cfg.defaultCity); err != nil {
+			add("WEATHER_DEFAULT_CITY: %v", err)
+		}
+	}
+
+	if !cfg.mock {
+		for _, name := range cfg.providers {
+			if !(Config{providers: providerNames}).queries(name) {
+				add("WEATHER_PROVIDERS: unknown provider %q; want one of %s", name, strings.Join(providerNames, ", "))
+			}
+		}
+		if len(cfg.providers) == 0 {
+			// Without a list, Weatherbit is queried only if its key is set.
+			cfg.providers = []string{"openWeatherMap", "weatherUnderground", "darkSky"}
+		}
+
+		// Only the providers queried need their keys.
+		for _, k := range []struct{ provider, name, value string }{
+			{"openWeatherMap", "OPEN_WEATHER_MAP_KEY", cfg.openWeatherMapKey},
+			{"weatherUnderground", "WEATHER_UNDERGROUND_KEY", cfg.weatherUndergroundKey},
+			{"darkSky", "DARK_SKY_KEY", cfg.darkSkyKey},
+			{"weatherbit", "WEATHERBIT_KEY", cfg.weatherbitKey},
+		} {
+			if cfg.queries(k.provider) && k.value == "" {
+				add("%s is not set", k.name)
+			}
+		}
+
+		// Dark Sky needs addresses geocoded.
+		if cfg.queries("darkSky") {
+			if g, err := newGeocoders(cfg.geocoders, cfg.googleGeocodeKey, cfg.geocodeTimeout); err != nil {
+				add("WEATHER_GEOCODERS: %v", err)
+			} else if len(g) == 0 {
+				add("no geocoder is usable: set GOOGLE_GEOCODE_KEY, or list openMeteo in WEATHER_GEOCODERS")
+			}
+		}
+	}
+
+	return errs
+}
+
+// probeCity is looked up to check that a provider is reachable and accepts
+// its key.
+const probeCity = "London"
+
+// probe makes one lookup from p, to check that it works.
+func probe(ctx context.Context, p weatherProvider) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	_, err := p.temperature(ctx, probeCity)
+	return err
+}
+
+// checkConfig validates cfg and probes each provider, reporting on each to
+// out. It reports whether the server is fit to run: the configuration is
+// valid, and enough providers work to meet minProviders, or all of them if
+// that is unset.
+func checkConfig(ctx context.Context, cfg Config, providers []weatherProvider, out io.Writer) bool {
+	ok := true
+
+	errs := cfg.validate()
+	for _, err := range errs {
+		fmt.Fprintf(out, "config: %v\n", err)
+	}
+	if len(errs) == 0 {
+		fmt.Fprintln(out, "config: ok")
+	} else {
+		ok = false
+	}
+
+	working := 0
+	for _, p := range providers {
+		err := probe(ctx, p)
+		if err == nil {
+			working++
+			fmt.Fprintf(out, "%s: ok\n", p.Name())
+			continue
+		}
+
+		var status *statusError
+		if errors.As(err, &status) && (status.code == 401 || status.code == 403) {
+			fmt.Fprintf(out, "%s: key rejected: %v\n", p.Name(), err)
+		} else {
+			fmt.Fprintf(out, "%s: failed (%s): %v\n", p.Name(), classifyError(err), err)
+		}
+	}
+
+	need := cfg.minProviders
+	if need <= 0 || need > len(providers) {
+		need = len(providers)
+	}
+	if working < need {
+		fmt.Fprintf(out, "only %d of %d providers work; %d needed\n", working, len(providers), need)
+		ok = false
+	}
+
+	return ok
+}
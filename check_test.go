@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// validConfig is a configuration validate finds nothing wrong with: the
+// defaults, with every provider's key set.
+func validConfig(t *testing.T) Config {
+	t.Helper()
+	cfg := testConfig(t)
+	cfg.openWeatherMapKey = "owm"
+	cfg.weatherUndergroundKey = "wu"
+	cfg.darkSkyKey = "ds"
+	cfg.googleGeocodeKey = "google"
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(*Config)
+		wants []string
+	}{
+		{"valid", func(*Config) {}, nil},
+		{"mock needs no keys", func(c *Config) {
+			c.mock, c.openWeatherMapKey, c.weatherUndergroundKey, c.darkSkyKey, c.googleGeocodeKey = true, "", "", "", ""
+		}, nil},
+		{"missing keys", func(c *Config) { c.darkSkyKey, c.openWeatherMapKey = "", "" }, []string{"OPEN_WEATHER_MAP_KEY is not set", "DARK_SKY_KEY is not set"}},
+		{"no geocoder", func(c *Config) { c.geocoders, c.googleGeocodeKey = []string{"google"}, "" }, []string{"no geocoder is usable"}},
+		{"unknown provider", func(c *Config) { c.providers = []string{"darkSky", "accuWeather"} }, []string{`unknown provider "accuWeather"`}},
+		{"keys only for providers queried", func(c *Config) {
+			c.providers, c.openWeatherMapKey, c.darkSkyKey = []string{"weatherUnderground"}, "", ""
+		}, nil},
+		{"weatherbit listed without a key", func(c *Config) { c.providers = []string{"weatherbit"} }, []string{"WEATHERBIT_KEY is not set"}},
+		{"no geocoder needed without dark sky", func(c *Config) { c.providers, c.googleGeocodeKey = []string{"openWeatherMap"}, "" }, nil},
+		{"unknown geocoder", func(c *Config) { c.geocoders = []string{"bing"} }, []string{`WEATHER_GEOCODERS: unknown geocoder "bing"`}},
+		{"inverted range", func(c *Config) { c.minKelvin, c.maxKelvin = 300, 200 }, []string{"WEATHER_MIN_KELVIN (300) must be below WEATHER_MAX_KELVIN (200)"}},
+		{"half TLS", func(c *Config) { c.tlsCert = "cert.pem" }, []string{"a TLS certificate and key must be set together"}},
+		{"unknown rounding", func(c *Config) { c.rounding = "half-down" }, []string{`WEATHER_ROUNDING: unknown rounding "half-down"`}},
+		{"no city length", func(c *Config) { c.maxCityLength = 0 }, []string{"WEATHER_MAX_CITY_LENGTH must be positive"}},
+		{"long region", func(c *Config) { c.geocodeRegion = "USA" }, []string{"WEATHER_GEOCODE_REGION"}},
+		{"negative stream cap", func(c *Config) { c.maxStreams = -1 }, []string{"WEATHER_MAX_STREAMS must not be negative"}},
+		{"unknown default unit", func(c *Config) { c.defaultUnit = "rankine" }, []string{"WEATHER_DEFAULT_UNIT: unknown unit"}},
+		{"thresholds without a webhook", func(c *Config) { c.alertThresholds = "Oslo=0" }, []string{errNoWebhook.Error()}},
+		{
+			"several at once",
+			func(c *Config) { c.minProviders, c.successWindow, c.defaultCity = -1, 0, "London,,UK" },
+			[]string{"WEATHER_MIN_PROVIDERS must not be negative", "WEATHER_SUCCESS_WINDOW must be positive", "WEATHER_DEFAULT_CITY"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			tt.edit(&cfg)
+			errs := cfg.validate()
+
+			var got []string
+			for _, err := range errs {
+				got = append(got, err.Error())
+			}
+			if len(got) != len(tt.wants) {
+				t.Fatalf("errors %q, want %d", got, len(tt.wants))
+			}
+			for i, want := range tt.wants {
+				if !strings.Contains(got[i], want) {
+					t.Errorf("error %q, want one containing %q", got[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	errRejected := &statusError{code: 401}
+	errDown := errors.New("connection refused")
+
+	tests := []struct {
+		name         string
+		minProviders int
+		errs         [2]error // of alpha and beta
+		wantOK       bool
+		wantLines    []string
+	}{
+		{"all working", 0, [2]error{nil, nil}, true, []string{"config: ok", "alpha: ok", "beta: ok"}},
+		{"key rejected", 0, [2]error{nil, errRejected}, false, []string{"alpha: ok", "beta: key rejected", "only 1 of 2 providers work; 2 needed"}},
+		{"enough working", 1, [2]error{errDown, nil}, true, []string{"alpha: failed (other): connection refused", "beta: ok"}},
+		{"none working", 1, [2]error{errDown, errRejected}, false, []string{"only 0 of 2 providers work; 1 needed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			cfg.minProviders = tt.minProviders
+			fakes := []*fakeProvider{{name: "alpha", kelvin: 285, err: tt.errs[0]}, {name: "beta", kelvin: 285, err: tt.errs[1]}}
+
+			var out strings.Builder
+			if ok := checkConfig(context.Background(), cfg, []weatherProvider{fakes[0], fakes[1]}, &out); ok != tt.wantOK {
+				t.Errorf("ok %v, want %v", ok, tt.wantOK)
+			}
+			for _, line := range tt.wantLines {
+				if !strings.Contains(out.String(), line) {
+					t.Errorf("report lacks %q:\n%s", line, out.String())
+				}
+			}
+			for i, f := range fakes {
+				if n := f.calls.Load(); n != 1 {
+					t.Errorf("provider %d probed %d times, want once", i, n)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// errUnsupportedQuery is reported for a provider unable to answer a query,
+// such as one by coordinates.
+var errUnsupportedQuery = errors.New("provider cannot answer this query")
+
+// comparison is one provider's answer to a lookup: its reading, or why it
+// has none. Status is the HTTP status of the provider's last response, if it
+// sent any, such as a 200 whose body was nonetheless of no use.
+type comparison struct {
+	Provider    string       `json:"provider"`
+	Status      int          `json:"status,omitempty"`
+	Temperature *Temperature `json:"temperature,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// compare asks every provider for the temperature at q, and reports each
+// one's answer side by side, in provider order. Unlike aggregate, it never
+// fails: a provider that errs, or doesn't answer in time, just has its error
+// in its row.
+func (w multiWeatherProvider) compare(ctx context.Context, q query) []comparison {
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+
+	rows := make([]comparison, len(w.providers))
+	var wg sync.WaitGroup
+	for i, p := range w.providers {
+		rows[i].Provider = p.Name()
+		if !q.supportedBy(p) {
+			rows[i].Error = errUnsupportedQuery.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(row *comparison, p weatherProvider) {
+			defer wg.Done()
+			ctx, status := withStatus(ctx)
+			c, err := w.fetchFrom(ctx, p, func(ctx context.Context, p weatherProvider) (Conditions, error) {
+				k, err := q.temperature(ctx, p)
+				return Conditions{Kelvin: k}, err
+			})
+			row.Status = status.code()
+			if err != nil {
+				row.Error = err.Error()
+				return
+			}
+			t := Temperature(c.Kelvin)
+			row.Temperature = &t
+		}(&rows[i], p)
+	}
+	wg.Wait()
+	return rows
+}
+
+// compareHandler serves /compare/, listing every provider's reading for a
+// place, or its error. It answers 200 whenever the request itself is sound,
+// however many providers fail.
+func compareHandler(live *liveProviders) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := live.load()
+		q, err := queryFromRequest(r, current.cfg.defaultCity)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		style, err := keyStyleFromRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rows := current.multi.compare(r.Context(), q)
+
+		respond(w, r, struct {
+			City      string       `json:"city"`
+			Providers []comparison `json:"providers"`
+		}{
+			City:      q.address(),
+			Providers: rows,
+		}, style)
+	}
+}
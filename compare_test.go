@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompareListsEveryProvider(t *testing.T) {
+	errDown := errors.New("provider down")
+
+	tests := []struct {
+		name    string
+		kelvins []float64 // 0 for a provider that fails
+	}{
+		{"all answering", []float64{280, 290, 300}},
+		{"one failing", []float64{280, 0, 300}},
+		{"all failing", []float64{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			names := []string{"alpha", "beta", "gamma"}
+			for i, k := range tt.kelvins {
+				if f := fakes.add(names[i], k); k == 0 {
+					f.err = errDown
+				}
+			}
+			_, ts := newTestServer(t, testConfig(t), nil, fakes.providers()...)
+
+			var got struct {
+				City      string
+				Providers []struct {
+					Provider    string
+					Temperature *struct{ K float64 }
+					Error       string
+				}
+			}
+			resp := getJSONResponse(t, ts.URL+"/compare/Paris", &got)
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d, want 200", resp.StatusCode)
+			}
+			if got.City != "Paris" || len(got.Providers) != len(tt.kelvins) {
+				t.Fatalf("compared %+v, want a row for each of %d providers of Paris", got, len(tt.kelvins))
+			}
+			for i, row := range got.Providers {
+				switch want := tt.kelvins[i]; {
+				case row.Provider != names[i]:
+					t.Errorf("row %d is %q, want %q", i, row.Provider, names[i])
+				case want == 0 && (row.Temperature != nil || row.Error != errDown.Error()):
+					t.Errorf("%s: %+v, want only the error %q", row.Provider, row, errDown)
+				case want != 0 && (row.Temperature == nil || row.Temperature.K != want || row.Error != ""):
+					t.Errorf("%s: %+v, want only a reading of %v K", row.Provider, row, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareStatuses(t *testing.T) {
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "api.openweathermap.org":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "api.wunderground.com":
+			fmt.Fprint(w, `{"current_observation": {"temp_c": 12}}`)
+		case "api.weatherbit.io":
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	// The default client now goes upstream, so the server is asked directly.
+	s, _ := newTestServer(t, testConfig(t), nil,
+		openWeatherMap{keys: newKeyRing("KEY")}, weatherUnderground{keys: newKeyRing("KEY")},
+		weatherbit{keys: newKeyRing("KEY")}, &fakeProvider{name: "fake", kelvin: 285})
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/compare/Paris", nil))
+
+	var got struct {
+		Providers []struct {
+			Provider string
+			Status   int
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"openWeatherMap": 503, "weatherUnderground": 200, "weatherbit": 400, "fake": 0}
+	if len(got.Providers) != len(want) {
+		t.Fatalf("compared %+v, want a row for each of %d providers", got.Providers, len(want))
+	}
+	for _, row := range got.Providers {
+		if row.Status != want[row.Provider] {
+			t.Errorf("%s: status %d, want %d", row.Provider, row.Status, want[row.Provider])
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Conditions is what a provider reports about the weather at a place. Only
+// Kelvin is always set; any other field a provider doesn't supply is nil.
+type Conditions struct {
+	Kelvin float64
+
+	// Native is the temperature as the provider reported it, before any
+	// conversion to Kelvin, if the provider says.
+	Native *nativeReading
+
+	// FeelsLike is the apparent temperature, in Kelvin, as the provider
+	// reckons it from humidity and wind. Merged conditions without one from
+	// any provider reckon it themselves; see apparentTemperature.
+	FeelsLike *float64
+
+	Sunrise *time.Time
+	Sunset  *time.Time
+
+	// TimeZone is the place's IANA time zone, as in "Europe/Paris", if the
+	// provider names it. Failing that, UTCOffset is its offset from UTC, in
+	// seconds east, if the provider knows that.
+	TimeZone  string
+	UTCOffset *int
+
+	CloudCover *float64 // percent of the sky, 0-100
+	Pressure   *float64 // sea-level barometric pressure, hPa
+	UVIndex    *float64
+	Visibility *float64 // meters
+	WindSpeed  *float64 // m/s
+	Humidity   *float64 // relative humidity, percent, 0-100
+
+	PrecipProbability *float64 // chance of rain or snow, percent, 0-100
+
+	// Rain and Snow are how much has fallen in the last hour, or is falling
+	// an hour, in mm of water. SnowAccumulation is the depth of snow expected
+	// to settle today, in mm.
+	Rain             *float64
+	Snow             *float64
+	SnowAccumulation *float64
+
+	// StationDistance is how far, in meters, the station the reading was
+	// observed at is from the place asked after, for providers that say
+	// where their station is.
+	StationDistance *float64
+
+	// MoonPhase is the fraction of the lunation that has passed today: 0 is
+	// the new moon, 0.5 the full moon.
+	MoonPhase *float64
+
+	// Summary describes the weather in words, such as "light rain", in the
+	// language the query asked for if the provider can. It is empty if the
+	// provider has no description.
+	Summary string
+}
+
+// conditionsProvider is implemented by providers that report more than just
+// the temperature.
+type conditionsProvider interface {
+	conditions(ctx context.Context, q query) (Conditions, error)
+}
+
+// conditionsResult is the merged conditions from several providers.
+type conditionsResult struct {
+	Conditions
+	sources []string
+
+	// summaries are each provider's own Summary, in provider order, since
+	// descriptions in words can't be merged. Providers without one are
+	// left out.
+	summaries []providerSummary
+
+	// reportedFeelsLike is the mean of the providers' own FeelsLike, or nil
+	// if none reported one and FeelsLike was reckoned instead.
+	reportedFeelsLike *float64
+}
+
+// providerSummary is the Summary one provider gave.
+type providerSummary struct {
+	Provider string `json:"provider"`
+	Summary  string `json:"summary"`
+}
+
+// conditions queries every provider able to report conditions for q, and
+// merges their answers: the temperature is averaged as in aggregate, other
+// measurements are averaged across the providers that supplied them, the
+// station distance is the nearest any reported, and the remaining fields are
+// taken from the first provider, in order, that did.
+func (w multiWeatherProvider) conditions(ctx context.Context, q query) (conditionsResult, error) {
+	supports := func(p weatherProvider) bool {
+		return capabilitiesOf(p).has(capConditions) && q.supportedBy(p)
+	}
+
+	obs, _, err := w.collect(ctx, supports, func(ctx context.Context, p weatherProvider) (Conditions, error) {
+		return p.(conditionsProvider).conditions(ctx, q)
+	})
+	if err != nil {
+		return conditionsResult{}, err
+	}
+
+	merged := Conditions{
+		Kelvin:     w.average(obs).Kelvin(),
+		FeelsLike:  meanOf(obs, func(c Conditions) *float64 { return c.FeelsLike }),
+		CloudCover: meanOf(obs, func(c Conditions) *float64 { return c.CloudCover }),
+		Pressure:   meanOf(obs, func(c Conditions) *float64 { return c.Pressure }),
+		UVIndex:    meanOf(obs, func(c Conditions) *float64 { return c.UVIndex }),
+		Visibility: meanOf(obs, func(c Conditions) *float64 { return c.Visibility }),
+		WindSpeed:  meanOf(obs, func(c Conditions) *float64 { return c.WindSpeed }),
+		Humidity:   meanOf(obs, func(c Conditions) *float64 { return c.Humidity }),
+
+		PrecipProbability: meanOf(obs, func(c Conditions) *float64 { return c.PrecipProbability }),
+
+		Rain:             meanOf(obs, func(c Conditions) *float64 { return c.Rain }),
+		Snow:             meanOf(obs, func(c Conditions) *float64 { return c.Snow }),
+		SnowAccumulation: meanOf(obs, func(c Conditions) *float64 { return c.SnowAccumulation }),
+	}
+	for _, o := range obs {
+		if merged.Sunrise == nil {
+			merged.Sunrise = o.Sunrise
+		}
+		if merged.Sunset == nil {
+			merged.Sunset = o.Sunset
+		}
+		if merged.TimeZone == "" {
+			merged.TimeZone = o.TimeZone
+		}
+		if merged.UTCOffset == nil {
+			merged.UTCOffset = o.UTCOffset
+		}
+		if merged.MoonPhase == nil {
+			merged.MoonPhase = o.MoonPhase
+		}
+		// The nearest station tells how local the best reading is.
+		if d := o.StationDistance; d != nil && (merged.StationDistance == nil || *d < *merged.StationDistance) {
+			merged.StationDistance = d
+		}
+		if merged.Summary == "" {
+			merged.Summary = o.Summary
+		}
+	}
+
+	var summaries []providerSummary
+	for _, o := range obs {
+		if o.Summary != "" {
+			summaries = append(summaries, providerSummary{o.provider, o.Summary})
+		}
+	}
+
+	// Providers' apparent temperatures allow for more than ours can, such as
+	// the sun, so ours is only the fallback.
+	reported := merged.FeelsLike
+	if merged.FeelsLike == nil {
+		merged.FeelsLike = apparentTemperature(merged.Kelvin, merged.WindSpeed, merged.Humidity)
+	}
+
+	return conditionsResult{Conditions: merged, sources: sourcesOf(obs), summaries: summaries, reportedFeelsLike: reported}, nil
+}
+
+// meanOf averages the field that get picks out of each observation, over the
+// observations where it is set. It is nil if none have it.
+func meanOf(obs []observation, get func(Conditions) *float64) *float64 {
+	sum, n := 0.0, 0
+	for _, o := range obs {
+		if v := get(o.Conditions); v != nil {
+			sum += *v
+			n++
+		}
+	}
+
+	if n == 0 {
+		return nil
+	}
+	mean := sum / float64(n)
+	return &mean
+}
+
+// fractionToPercent converts a 0-1 fraction, as some providers report
+// proportions, to a 0-100 percentage. It passes nil through.
+func fractionToPercent(f *float64) *float64 {
+	if f == nil {
+		return nil
+	}
+	p := *f * 100
+	return &p
+}
+
+// Pressures are reported in hectopascals, which are the same as millibars.
+// Providers reporting in other units are converted.
+
+const hPaPerInHg = 33.8639 // hPa in an inch of mercury at 0°C
+
+func inHgToHPa(in float64) float64 { return in * hPaPerInHg }
+
+// Visibility is reported in meters.
+
+func kmToMeters(km float64) float64 { return km * 1000 }
+
+// Rain and snow are reported in millimeters.
+
+// cmToMMPtr converts an optional depth, passing nil through.
+func cmToMMPtr(cm *float64) *float64 {
+	if cm == nil {
+		return nil
+	}
+	mm := *cm * 10
+	return &mm
+}
+
+// kmToMetersPtr converts an optional distance, passing nil through.
+func kmToMetersPtr(km *float64) *float64 {
+	if km == nil {
+		return nil
+	}
+	m := kmToMeters(*km)
+	return &m
+}
+
+// Wind speeds are reported in meters a second.
+
+func kphToMS(kph float64) float64 { return kph / 3.6 }
+
+// beaufortScale are the lowest wind speeds, in m/s, of forces 1 through 12
+// of the Beaufort scale.
+var beaufortScale = []float64{0.5, 1.6, 3.4, 5.5, 8.0, 10.8, 13.9, 17.2, 20.8, 24.5, 28.5, 32.7}
+
+// beaufort is the Beaufort force, 0-12, of a wind speed in m/s.
+func beaufort(speed float64) int {
+	force := 0
+	for force < len(beaufortScale) && speed >= beaufortScale[force] {
+		force++
+	}
+	return force
+}
+
+// apparentTemperature is how warm air at kelvin feels, as the US National
+// Weather Service reckons it: the heat index in humid heat, from 80°F, and
+// the wind chill in wind from 3 mph and cold to 50°F. Between the two, it is
+// the air temperature. It is nil if neither humidity nor the wind speed is
+// known, or the one needed for the heat index or wind chill isn't.
+func apparentTemperature(kelvin float64, windSpeed, humidity *float64) *float64 {
+	f := kelvinToFahrenheit(kelvin)
+	feels := kelvin
+	switch {
+	case windSpeed == nil && humidity == nil:
+		return nil
+	case f >= 80:
+		if humidity == nil {
+			return nil
+		}
+		// Rothfusz's regression, in °F and percent.
+		rh := *humidity
+		feels = fahrenheitToKelvin(-42.379 + 2.04901523*f + 10.14333127*rh -
+			0.22475541*f*rh - 0.00683783*f*f - 0.05481717*rh*rh +
+			0.00122874*f*f*rh + 0.00085282*f*rh*rh - 0.00000199*f*f*rh*rh)
+	case f <= 50:
+		if windSpeed == nil {
+			return nil
+		}
+		if mph := *windSpeed * 3600 / 1609.344; mph >= 3 {
+			v := math.Pow(mph, 0.16)
+			feels = fahrenheitToKelvin(35.74 + 0.6215*f - 35.75*v + 0.4275*f*v)
+		}
+	}
+	return &feels
+}
+
+// moonPhases name the phases of the moon, in order from the new moon.
+var moonPhases = []string{
+	"new moon", "waxing crescent", "first quarter", "waxing gibbous",
+	"full moon", "waning gibbous", "last quarter", "waning crescent",
+}
+
+// moonPhaseName names the phase a MoonPhase fraction falls in. Each of the
+// new, quarter and full moons covers the sixteenth of the lunation either
+// side of its exact fraction; the crescents and gibbous moons the rest.
+func moonPhaseName(phase float64) string {
+	i := int(math.Floor(phase*8+0.5)) % 8
+	if i < 0 {
+		i += 8
+	}
+	return moonPhases[i]
+}
+
+// timeZone names the time zone of c: its IANA name if known, and otherwise
+// its UTC offset, as in "+05:30". It is empty if neither is known.
+func (c Conditions) timeZone() string {
+	if c.TimeZone != "" || c.UTCOffset == nil {
+		return c.TimeZone
+	}
+
+	sign, off := '+', *c.UTCOffset
+	if off < 0 {
+		sign, off = '-', -off
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, off/3600, off%3600/60)
+}
+
+// unixTime converts a Unix timestamp to a time in loc. A zero timestamp,
+// which is what an absent field decodes to, yields nil.
+func unixTime(sec int64, loc *time.Location) *time.Time {
+	if sec == 0 {
+		return nil
+	}
+
+	t := time.Unix(sec, 0).In(loc)
+	return &t
+}
+
+// conditionsHandler serves /conditions/, reporting everything the providers
+// know about a place's weather.
+func conditionsHandler(live *liveProviders) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := live.load()
+		q, err := queryFromRequest(r, current.cfg.defaultCity)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		q.lang = langFromRequest(r)
+
+		style, err := keyStyleFromRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res, err := current.multi.conditions(r.Context(), q)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		var moon string
+		if res.MoonPhase != nil {
+			moon = moonPhaseName(*res.MoonPhase)
+		}
+		var force *int
+		if res.WindSpeed != nil {
+			f := beaufort(*res.WindSpeed)
+			force = &f
+		}
+		var feelsLike, reportedFeelsLike *Temperature
+		if res.FeelsLike != nil {
+			t := Temperature(*res.FeelsLike)
+			feelsLike = &t
+		}
+		if res.reportedFeelsLike != nil {
+			t := Temperature(*res.reportedFeelsLike)
+			reportedFeelsLike = &t
+		}
+
+		respond(w, r, struct {
+			City              string            `json:"city"`
+			Temperature       Temperature       `json:"temperature"`
+			FeelsLike         *Temperature      `json:"feels_like,omitempty"`
+			ReportedFeelsLike *Temperature      `json:"feels_like_reported,omitempty"`
+			Sunrise           *time.Time        `json:"sunrise,omitempty"`
+			Sunset            *time.Time        `json:"sunset,omitempty"`
+			TimeZone          string            `json:"timezone,omitempty"`
+			CloudCover        *float64          `json:"cloud_cover,omitempty"`
+			Pressure          *float64          `json:"pressure_hpa,omitempty"`
+			UVIndex           *float64          `json:"uv_index,omitempty"`
+			Visibility        *float64          `json:"visibility_m,omitempty"`
+			StationDistance   *float64          `json:"station_distance_m,omitempty"`
+			WindSpeed         *float64          `json:"wind_speed_ms,omitempty"`
+			Beaufort          *int              `json:"beaufort,omitempty"`
+			Humidity          *float64          `json:"humidity,omitempty"`
+			PrecipProbability *float64          `json:"precip_probability,omitempty"`
+			Rain              *float64          `json:"rain_mm,omitempty"`
+			Snow              *float64          `json:"snow_mm,omitempty"`
+			SnowAccumulation  *float64          `json:"snow_accumulation_mm,omitempty"`
+			MoonPhase         *float64          `json:"moon_phase,omitempty"`
+			MoonPhaseName     string            `json:"moon_phase_name,omitempty"`
+			Summary           string            `json:"summary,omitempty"`
+			Summaries         []providerSummary `json:"summaries,omitempty"`
+			Sources           []string          `json:"sources"`
+			Attributions      []string          `json:"attributions,omitempty"`
+		}{
+			City:              q.address(),
+			Temperature:       Temperature(res.Kelvin),
+			FeelsLike:         feelsLike,
+			ReportedFeelsLike: reportedFeelsLike,
+			Sunrise:           res.Sunrise,
+			Sunset:            res.Sunset,
+			TimeZone:          res.timeZone(),
+			CloudCover:        res.CloudCover,
+			Pressure:          res.Pressure,
+			UVIndex:           res.UVIndex,
+			Visibility:        res.Visibility,
+			StationDistance:   res.StationDistance,
+			WindSpeed:         res.WindSpeed,
+			Beaufort:          force,
+			Humidity:          res.Humidity,
+			PrecipProbability: res.PrecipProbability,
+			Rain:              res.Rain,
+			Snow:              res.Snow,
+			SnowAccumulation:  res.SnowAccumulation,
+			MoonPhase:         res.MoonPhase,
+			MoonPhaseName:     moon,
+			Summary:           res.Summary,
+			Summaries:         res.summaries,
+			Sources:           res.sources,
+			Attributions:      attributions(current.providers, res.sources),
+		}, style)
+	}
+}
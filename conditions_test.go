@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSunriseAndSunsetParsed(t *testing.T) {
+	servePayloads(t, map[string]string{
+		"api.openweathermap.org": `{
+			"main": {"temp": 285.15},
+			"sys": {"sunrise": 1560000000, "sunset": 1560057000},
+			"timezone": 3600
+		}`,
+		"api.darksky.net": `{
+			"timezone": "Europe/Paris",
+			"offset": 2,
+			"currently": {"temperature": 12},
+			"daily": {"data": [{"sunriseTime": 1560000000, "sunsetTime": 1560057000}]}
+		}`,
+	})
+	paris := coordinates{48.8566, 2.3522}
+
+	tests := []struct {
+		name            string
+		conditions      func() (Conditions, error)
+		sunrise, sunset string
+	}{
+		{
+			"OpenWeatherMap",
+			func() (Conditions, error) {
+				return openWeatherMap{keys: newKeyRing("KEY")}.conditions(context.Background(), query{city: "Paris"})
+			},
+			"2019-06-08T14:20:00+01:00", "2019-06-09T06:10:00+01:00",
+		},
+		{
+			"Dark Sky",
+			func() (Conditions, error) {
+				return darkSky{keys: newKeyRing("KEY")}.conditions(context.Background(), query{coords: &paris})
+			},
+			"2019-06-08T15:20:00+02:00", "2019-06-09T07:10:00+02:00",
+		},
+	}
+	for _, tt := range tests {
+		c, err := tt.conditions()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if c.Sunrise == nil || c.Sunset == nil {
+			t.Errorf("%s: sunrise %v, sunset %v", tt.name, c.Sunrise, c.Sunset)
+			continue
+		}
+		if got := c.Sunrise.Format(time.RFC3339); got != tt.sunrise {
+			t.Errorf("%s: sunrise %s, want %s", tt.name, got, tt.sunrise)
+		}
+		if got := c.Sunset.Format(time.RFC3339); got != tt.sunset {
+			t.Errorf("%s: sunset %s, want %s", tt.name, got, tt.sunset)
+		}
+	}
+}
+
+func TestUnixTime(t *testing.T) {
+	zone := time.FixedZone("", -5*3600)
+	tests := []struct {
+		sec  int64
+		want string
+	}{
+		{0, ""},
+		{1560000000, "2019-06-08T08:20:00-05:00"},
+		{-3600, "1969-12-31T18:00:00-05:00"},
+	}
+	for _, tt := range tests {
+		got := unixTime(tt.sec, zone)
+		switch {
+		case tt.want == "" && got != nil:
+			t.Errorf("unixTime(%d) = %v, want none", tt.sec, got)
+		case tt.want != "" && (got == nil || got.Format(time.RFC3339) != tt.want):
+			t.Errorf("unixTime(%d) = %v, want %s", tt.sec, got, tt.want)
+		}
+	}
+}
+
+// mergedConditions serves payloads, by host, in place of the upstreams, and
+// merges what providers report of Paris from them.
+func mergedConditions(t *testing.T, payloads map[string]string, providers ...weatherProvider) conditionsResult {
+	t.Helper()
+	servePayloads(t, payloads)
+	paris := coordinates{48.8566, 2.3522}
+	w := multiWeatherProvider{providers: providers}
+	res, err := w.conditions(context.Background(), query{city: "Paris", coords: &paris})
+	if err != nil {
+		t.Fatalf("conditions: %v", err)
+	}
+	return res
+}
+
+// measurementTest is a case of a measurement merged from the providers
+// given, reading the payloads given.
+type measurementTest struct {
+	name      string
+	payloads  map[string]string
+	providers []weatherProvider
+	want      float64
+	missing   bool // if none is reported at all
+}
+
+// testMeasurements checks the merged measurement that field reads.
+func testMeasurements(t *testing.T, field func(Conditions) *float64, tests []measurementTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := field(mergedConditions(t, tt.payloads, tt.providers...).Conditions)
+			switch {
+			case tt.missing && got != nil:
+				t.Errorf("got %v, want none", *got)
+			case !tt.missing && got == nil:
+				t.Errorf("got none, want %v", tt.want)
+			case !tt.missing && math.Abs(*got-tt.want) > 1e-9:
+				t.Errorf("got %v, want %v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloudCoverNormalized(t *testing.T) {
+	owm := `{"main": {"temp": 285}, "clouds": {"all": 60}}`
+	darkSkyCloudy := `{"currently": {"temperature": 12, "cloudCover": 0.4}}`
+
+	testMeasurements(t, func(c Conditions) *float64 { return c.CloudCover }, []measurementTest{
+		{name: "OpenWeatherMap percentage", payloads: map[string]string{"api.openweathermap.org": owm}, providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}}, want: 60},
+		{name: "Dark Sky fraction", payloads: map[string]string{"api.darksky.net": darkSkyCloudy}, providers: []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, want: 40},
+		{
+			name:      "averaged",
+			payloads:  map[string]string{"api.openweathermap.org": owm, "api.darksky.net": darkSkyCloudy},
+			providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}},
+			want:      50,
+		},
+	})
+}
+
+func TestPressureNormalized(t *testing.T) {
+	owm := `{"main": {"temp": 285, "pressure": 1013}}`
+	darkSkyPressure := `{"currently": {"temperature": 12, "pressure": 1015}}`
+	wu := `{"current_observation": {"temp_c": 12, "pressure_in": "29.92"}}`
+
+	testMeasurements(t, func(c Conditions) *float64 { return c.Pressure }, []measurementTest{
+		{name: "OpenWeatherMap hPa", payloads: map[string]string{"api.openweathermap.org": owm}, providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}}, want: 1013},
+		{name: "Dark Sky hPa", payloads: map[string]string{"api.darksky.net": darkSkyPressure}, providers: []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, want: 1015},
+		{name: "Weather Underground inHg", payloads: map[string]string{"api.wunderground.com": wu}, providers: []weatherProvider{weatherUnderground{keys: newKeyRing("KEY")}}, want: 29.92 * 33.8639},
+		{
+			name:      "Weather Underground blank",
+			payloads:  map[string]string{"api.wunderground.com": `{"current_observation": {"temp_c": 12, "pressure_in": ""}}`},
+			providers: []weatherProvider{weatherUnderground{keys: newKeyRing("KEY")}},
+			missing:   true,
+		},
+		{
+			name:      "averaged",
+			payloads:  map[string]string{"api.openweathermap.org": owm, "api.darksky.net": darkSkyPressure, "api.wunderground.com": wu},
+			providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}, weatherUnderground{keys: newKeyRing("KEY")}},
+			want:      (1013 + 1015 + 29.92*33.8639) / 3,
+		},
+	})
+}
+
+func TestUVIndexAveraged(t *testing.T) {
+	owm := `{"main": {"temp": 285}}`
+	darkSkyUV := `{"currently": {"temperature": 12, "uvIndex": 3}}`
+	wb := `{"data": [{"temp": 12, "uv": 5.5}], "count": 1}`
+
+	testMeasurements(t, func(c Conditions) *float64 { return c.UVIndex }, []measurementTest{
+		{name: "Dark Sky", payloads: map[string]string{"api.darksky.net": darkSkyUV}, providers: []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, want: 3},
+		{name: "Weatherbit", payloads: map[string]string{"api.weatherbit.io": wb}, providers: []weatherProvider{weatherbit{keys: newKeyRing("KEY")}}, want: 5.5},
+		{name: "none reported", payloads: map[string]string{"api.openweathermap.org": owm}, providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}}, missing: true},
+		{
+			name:      "averaged over those reporting it",
+			payloads:  map[string]string{"api.openweathermap.org": owm, "api.darksky.net": darkSkyUV, "api.weatherbit.io": wb},
+			providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}, weatherbit{keys: newKeyRing("KEY")}},
+			want:      4.25,
+		},
+	})
+}
+
+func TestFeelsLikeAveraged(t *testing.T) {
+	owm := `{"main": {"temp": 285, "feels_like": 280}}`
+	darkSkyFeels := `{"currently": {"temperature": 12, "apparentTemperature": 10}}`
+	wb := `{"data": [{"temp": 12, "app_temp": 9}], "count": 1}`
+	wu := `{"current_observation": {"temp_c": 12}}`
+
+	testMeasurements(t, func(c Conditions) *float64 { return c.FeelsLike }, []measurementTest{
+		{name: "OpenWeatherMap Kelvin", payloads: map[string]string{"api.openweathermap.org": owm}, providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}}, want: 280},
+		{name: "Dark Sky Celsius", payloads: map[string]string{"api.darksky.net": darkSkyFeels}, providers: []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, want: 283.15},
+		{name: "Weatherbit Celsius", payloads: map[string]string{"api.weatherbit.io": wb}, providers: []weatherProvider{weatherbit{keys: newKeyRing("KEY")}}, want: 282.15},
+		{name: "none reported", payloads: map[string]string{"api.wunderground.com": wu}, providers: []weatherProvider{weatherUnderground{keys: newKeyRing("KEY")}}, missing: true},
+		{
+			name:      "averaged over those reporting it",
+			payloads:  map[string]string{"api.openweathermap.org": owm, "api.darksky.net": darkSkyFeels, "api.weatherbit.io": wb, "api.wunderground.com": wu},
+			providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}, weatherbit{keys: newKeyRing("KEY")}, weatherUnderground{keys: newKeyRing("KEY")}},
+			want:      (280 + 283.15 + 282.15) / 3,
+		},
+	})
+}
+
+func TestVisibilityNormalized(t *testing.T) {
+	owm := `{"main": {"temp": 285}, "visibility": 10000}`
+	darkSkyVis := `{"currently": {"temperature": 12, "visibility": 8.5}}`
+	wu := `{"current_observation": {"temp_c": 12, "visibility_km": "6.2"}}`
+	wb := `{"data": [{"temp": 12, "vis": 5}], "count": 1}`
+
+	testMeasurements(t, func(c Conditions) *float64 { return c.Visibility }, []measurementTest{
+		{name: "OpenWeatherMap meters", payloads: map[string]string{"api.openweathermap.org": owm}, providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}}, want: 10000},
+		{name: "Dark Sky km", payloads: map[string]string{"api.darksky.net": darkSkyVis}, providers: []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, want: 8500},
+		{name: "Weather Underground quoted km", payloads: map[string]string{"api.wunderground.com": wu}, providers: []weatherProvider{weatherUnderground{keys: newKeyRing("KEY")}}, want: 6200},
+		{name: "Weatherbit km", payloads: map[string]string{"api.weatherbit.io": wb}, providers: []weatherProvider{weatherbit{keys: newKeyRing("KEY")}}, want: 5000},
+		{
+			name:      "averaged",
+			payloads:  map[string]string{"api.openweathermap.org": owm, "api.darksky.net": darkSkyVis, "api.wunderground.com": wu, "api.weatherbit.io": wb},
+			providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}, weatherUnderground{keys: newKeyRing("KEY")}, weatherbit{keys: newKeyRing("KEY")}},
+			want:      (10000 + 8500 + 6200 + 5000) / 4.0,
+		},
+	})
+}
+
+func TestPrecipProbabilityNormalized(t *testing.T) {
+	darkSkyPrecip := func(p string) string {
+		return `{"currently": {"temperature": 12, "precipProbability": ` + p + `}}`
+	}
+	owm := `{"main": {"temp": 285}}`
+
+	testMeasurements(t, func(c Conditions) *float64 { return c.PrecipProbability }, []measurementTest{
+		{name: "fraction as percent", payloads: map[string]string{"api.darksky.net": darkSkyPrecip("0.35")}, providers: []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, want: 35},
+		{name: "no chance", payloads: map[string]string{"api.darksky.net": darkSkyPrecip("0")}, providers: []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, want: 0},
+		{name: "certain", payloads: map[string]string{"api.darksky.net": darkSkyPrecip("1")}, providers: []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, want: 100},
+		{name: "not reported", payloads: map[string]string{"api.darksky.net": `{"currently": {"temperature": 12}}`}, providers: []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, missing: true},
+		{
+			name:      "only from those reporting it",
+			payloads:  map[string]string{"api.openweathermap.org": owm, "api.darksky.net": darkSkyPrecip("0.8")},
+			providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}},
+			want:      80,
+		},
+	})
+}
+
+func TestPrecipitationAmounts(t *testing.T) {
+	owm := func(extra string) string { return `{"main": {"temp": 285}` + extra + `}` }
+	darkSkyFalling := func(intensity, kind string) string {
+		return `{"currently": {"temperature": 1, "precipIntensity": ` + intensity + `, "precipType": "` + kind + `"}}`
+	}
+	owmOnly := []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}}
+	darkSkyOnly := []weatherProvider{darkSky{keys: newKeyRing("KEY")}}
+	both := []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}}
+
+	t.Run("rain", func(t *testing.T) {
+		testMeasurements(t, func(c Conditions) *float64 { return c.Rain }, []measurementTest{
+			{name: "OpenWeatherMap last hour", payloads: map[string]string{"api.openweathermap.org": owm(`, "rain": {"1h": 0.5}`)}, providers: owmOnly, want: 0.5},
+			{name: "OpenWeatherMap dry", payloads: map[string]string{"api.openweathermap.org": owm("")}, providers: owmOnly, missing: true},
+			{name: "Dark Sky raining", payloads: map[string]string{"api.darksky.net": darkSkyFalling("1.2", "rain")}, providers: darkSkyOnly, want: 1.2},
+			{name: "Dark Sky snowing", payloads: map[string]string{"api.darksky.net": darkSkyFalling("1.2", "snow")}, providers: darkSkyOnly, want: 0},
+			{
+				name:      "averaged",
+				payloads:  map[string]string{"api.openweathermap.org": owm(`, "rain": {"1h": 0.5}`), "api.darksky.net": darkSkyFalling("1.5", "rain")},
+				providers: both,
+				want:      1,
+			},
+		})
+	})
+
+	t.Run("snow", func(t *testing.T) {
+		testMeasurements(t, func(c Conditions) *float64 { return c.Snow }, []measurementTest{
+			{name: "OpenWeatherMap last hour", payloads: map[string]string{"api.openweathermap.org": owm(`, "snow": {"1h": 0.3}`)}, providers: owmOnly, want: 0.3},
+			{name: "Dark Sky snowing", payloads: map[string]string{"api.darksky.net": darkSkyFalling("2", "snow")}, providers: darkSkyOnly, want: 2},
+			{name: "Dark Sky sleet", payloads: map[string]string{"api.darksky.net": darkSkyFalling("1", "sleet")}, providers: darkSkyOnly, want: 1},
+			{name: "Dark Sky raining", payloads: map[string]string{"api.darksky.net": darkSkyFalling("1", "rain")}, providers: darkSkyOnly, want: 0},
+			{name: "Dark Sky dry", payloads: map[string]string{"api.darksky.net": `{"currently": {"temperature": 1}}`}, providers: darkSkyOnly, missing: true},
+		})
+	})
+
+	t.Run("accumulation", func(t *testing.T) {
+		accumulating := `{"currently": {"temperature": -3}, "daily": {"data": [{"precipAccumulation": 2.5}]}}`
+		testMeasurements(t, func(c Conditions) *float64 { return c.SnowAccumulation }, []measurementTest{
+			{name: "Dark Sky cm as mm", payloads: map[string]string{"api.darksky.net": accumulating}, providers: darkSkyOnly, want: 25},
+			{name: "none expected", payloads: map[string]string{"api.darksky.net": `{"currently": {"temperature": -3}, "daily": {"data": [{}]}}`}, providers: darkSkyOnly, missing: true},
+			{name: "not reported by OpenWeatherMap", payloads: map[string]string{"api.openweathermap.org": owm(`, "snow": {"1h": 0.3}`)}, providers: owmOnly, missing: true},
+		})
+	})
+}
+
+func TestMoonPhaseNames(t *testing.T) {
+	tests := []struct {
+		phase float64
+		want  string
+	}{
+		{0, "new moon"},
+		{0.06, "new moon"},
+		{0.0625, "waxing crescent"},
+		{0.125, "waxing crescent"},
+		{0.25, "first quarter"},
+		{0.4, "waxing gibbous"},
+		{0.5, "full moon"},
+		{0.6, "waning gibbous"},
+		{0.75, "last quarter"},
+		{0.9, "waning crescent"},
+		{0.97, "new moon"},
+		{1, "new moon"},
+	}
+	for _, tt := range tests {
+		if got := moonPhaseName(tt.phase); got != tt.want {
+			t.Errorf("moonPhaseName(%v) = %q, want %q", tt.phase, got, tt.want)
+		}
+	}
+
+	// And /conditions/ gives the name alongside the fraction.
+	payloads := map[string]string{}
+	for host, body := range dryRunResponses {
+		payloads[host] = body
+	}
+	payloads["api.darksky.net"] = `{"currently": {"temperature": 12}, "daily": {"data": [{"moonPhase": 0.5}]}}`
+	servePayloads(t, payloads)
+	// The default client now goes upstream, so the server is asked directly.
+	s, _ := newTestServer(t, testConfig(t), nil, darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}})
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/conditions/Paris", nil))
+
+	var got struct {
+		MoonPhase     *float64 `json:"moon_phase"`
+		MoonPhaseName string   `json:"moon_phase_name"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if got.MoonPhase == nil || *got.MoonPhase != 0.5 || got.MoonPhaseName != "full moon" {
+		t.Errorf("moon phase %v named %q, want 0.5, full moon", got.MoonPhase, got.MoonPhaseName)
+	}
+}
+
+func TestSummariesPerProvider(t *testing.T) {
+	owm := `{"main": {"temp": 285}, "weather": [{"main": "Rain", "description": "light rain"}, {"description": "mist"}]}`
+	darkSkySummary := `{"currently": {"temperature": 12, "summary": "Drizzle"}}`
+	wb := `{"data": [{"temp": 12, "weather": {"description": "Light shower rain"}}], "count": 1}`
+
+	tests := []struct {
+		name      string
+		payloads  map[string]string
+		providers []weatherProvider
+		want      []providerSummary
+	}{
+		{"OpenWeatherMap", map[string]string{"api.openweathermap.org": owm}, []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}}, []providerSummary{{"openWeatherMap", "light rain"}}},
+		{"Dark Sky", map[string]string{"api.darksky.net": darkSkySummary}, []weatherProvider{darkSky{keys: newKeyRing("KEY")}}, []providerSummary{{"darkSky", "Drizzle"}}},
+		{"Weatherbit", map[string]string{"api.weatherbit.io": wb}, []weatherProvider{weatherbit{keys: newKeyRing("KEY")}}, []providerSummary{{"weatherbit", "Light shower rain"}}},
+		{"none given", map[string]string{"api.openweathermap.org": `{"main": {"temp": 285}, "weather": []}`}, []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}}, nil},
+		{
+			"listed, not merged",
+			map[string]string{"api.openweathermap.org": owm, "api.darksky.net": darkSkySummary, "api.weatherbit.io": wb},
+			[]weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}, weatherbit{keys: newKeyRing("KEY")}},
+			[]providerSummary{{"openWeatherMap", "light rain"}, {"darkSky", "Drizzle"}, {"weatherbit", "Light shower rain"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := mergedConditions(t, tt.payloads, tt.providers...)
+			if fmt.Sprint(res.summaries) != fmt.Sprint(tt.want) {
+				t.Errorf("summaries %v, want %v", res.summaries, tt.want)
+			}
+			if len(tt.want) > 0 && res.Summary != tt.want[0].Summary {
+				t.Errorf("summary %q, want the first provider's, %q", res.Summary, tt.want[0].Summary)
+			}
+		})
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	offset := func(sec int) *int { return &sec }
+	tests := []struct {
+		name string
+		c    Conditions
+		want string
+	}{
+		{"name", Conditions{TimeZone: "Europe/Paris", UTCOffset: offset(3600)}, "Europe/Paris"},
+		{"offset east", Conditions{UTCOffset: offset(3600)}, "+01:00"},
+		{"offset west, by half hours", Conditions{UTCOffset: offset(-16200)}, "-04:30"},
+		{"UTC", Conditions{UTCOffset: offset(0)}, "+00:00"},
+		{"unknown", Conditions{}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.c.timeZone(); got != tt.want {
+			t.Errorf("%s: time zone %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTimeZoneMerged(t *testing.T) {
+	const (
+		owmOffset   = `{"main": {"temp": 285}, "timezone": -16200}`
+		owmNone     = `{"main": {"temp": 285}}`
+		darkSkyZone = `{"timezone": "America/Caracas", "offset": -4, "currently": {"temperature": 12}}`
+	)
+	owm, ds := openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}
+
+	tests := []struct {
+		name      string
+		payloads  map[string]string
+		providers []weatherProvider
+		want      string
+	}{
+		{"offset only", map[string]string{"api.openweathermap.org": owmOffset}, []weatherProvider{owm}, "-04:30"},
+		{"name only", map[string]string{"api.darksky.net": darkSkyZone}, []weatherProvider{ds}, "America/Caracas"},
+		{"name preferred", map[string]string{"api.openweathermap.org": owmOffset, "api.darksky.net": darkSkyZone}, []weatherProvider{owm, ds}, "America/Caracas"},
+		{"neither", map[string]string{"api.openweathermap.org": owmNone}, []weatherProvider{owm}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergedConditions(t, tt.payloads, tt.providers...).timeZone(); got != tt.want {
+				t.Errorf("time zone %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApparentTemperature(t *testing.T) {
+	ms := func(mph float64) *float64 { v := mph * 1609.344 / 3600; return &v }
+	pct := func(p float64) *float64 { return &p }
+
+	tests := []struct {
+		name      string
+		f         float64 // air temperature, °F
+		wind      *float64
+		humidity  *float64
+		want      float64 // °F; NaN for none
+		tolerance float64
+	}{
+		{"heat index", 90, nil, pct(70), 106, 1},
+		{"heat index, dry", 100, ms(5), pct(15), 96, 1},
+		{"heat without humidity", 90, ms(5), nil, math.NaN(), 0},
+		{"wind chill", 0, ms(15), nil, -19, 1},
+		{"wind chill near freezing", 30, ms(20), pct(80), 17, 1},
+		{"calm cold", 30, ms(2), nil, 30, 1e-9},
+		{"cold without wind speed", 30, nil, pct(80), math.NaN(), 0},
+		{"mild", 65, ms(20), pct(90), 65, 1e-9},
+		{"nothing to go on", 90, nil, nil, math.NaN(), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := apparentTemperature(fahrenheitToKelvin(tt.f), tt.wind, tt.humidity)
+			switch {
+			case math.IsNaN(tt.want) && got != nil:
+				t.Errorf("feels like %.1f°F, want none", kelvinToFahrenheit(*got))
+			case !math.IsNaN(tt.want) && got == nil:
+				t.Errorf("no apparent temperature, want %v°F", tt.want)
+			case !math.IsNaN(tt.want) && math.Abs(kelvinToFahrenheit(*got)-tt.want) > tt.tolerance:
+				t.Errorf("feels like %.1f°F, want %v°F", kelvinToFahrenheit(*got), tt.want)
+			}
+		})
+	}
+}
+
+func TestBeaufort(t *testing.T) {
+	tests := []struct {
+		speed float64 // m/s
+		want  int
+	}{
+		{0, 0}, {0.4, 0},
+		{0.5, 1}, {1.5, 1},
+		{1.6, 2}, {3.3, 2},
+		{3.4, 3}, {5.4, 3},
+		{5.5, 4}, {7.9, 4},
+		{8.0, 5}, {10.7, 5},
+		{10.8, 6}, {13.8, 6},
+		{13.9, 7}, {17.1, 7},
+		{17.2, 8}, {20.7, 8},
+		{20.8, 9}, {24.4, 9},
+		{24.5, 10}, {28.4, 10},
+		{28.5, 11}, {32.6, 11},
+		{32.7, 12}, {70, 12},
+		{-1, 0},
+	}
+	for _, tt := range tests {
+		if got := beaufort(tt.speed); got != tt.want {
+			t.Errorf("beaufort(%v) = %d, want %d", tt.speed, got, tt.want)
+		}
+	}
+}
+
+func TestBeaufortServed(t *testing.T) {
+	force := func(f int) *int { return &f }
+	tests := []struct {
+		name string
+		wind string // OpenWeatherMap's
+		want *int
+	}{
+		{"gale", `"wind": {"speed": 18}`, force(8)},
+		{"calm", `"wind": {"speed": 0}`, force(0)},
+		{"no wind reported", `"name": "Paris"`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servePayloads(t, map[string]string{"api.openweathermap.org": `{"main": {"temp": 285}, ` + tt.wind + `}`})
+			// The default client now goes upstream, so the server is asked directly.
+			s, _ := newTestServer(t, testConfig(t), nil, openWeatherMap{keys: newKeyRing("KEY")})
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", "/conditions/Paris", nil))
+
+			var got struct {
+				Beaufort *int `json:"beaufort"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.want == nil && got.Beaufort != nil:
+				t.Errorf("force %d, want none", *got.Beaufort)
+			case tt.want != nil && (got.Beaufort == nil || *got.Beaufort != *tt.want):
+				t.Errorf("force %v, want %d", got.Beaufort, *tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionsOnlySuppliedFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		payloads map[string]string
+		want     string // the response's keys
+	}{
+		{
+			"humidity only",
+			map[string]string{"api.openweathermap.org": `{"main": {"temp": 285, "humidity": 60}}`},
+			"[attributions city feels_like humidity sources temperature]",
+		},
+		{
+			"humidity and wind",
+			map[string]string{"api.openweathermap.org": `{"main": {"temp": 285, "humidity": 60}, "wind": {"speed": 4}}`},
+			"[attributions beaufort city feels_like humidity sources temperature wind_speed_ms]",
+		},
+		{
+			"humidity from one provider, pressure from another",
+			map[string]string{
+				"api.openweathermap.org": `{"main": {"temp": 285, "humidity": 60}}`,
+				"api.wunderground.com":   `{"current_observation": {"temp_c": 12, "pressure_in": "30.01"}}`,
+			},
+			"[attributions city feels_like humidity pressure_hpa sources temperature]",
+		},
+		{
+			"temperature only",
+			map[string]string{"api.wunderground.com": `{"current_observation": {"temp_c": 12}}`},
+			"[attributions city sources temperature]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			servePayloads(t, tt.payloads)
+			keys := newKeyRing("KEY")
+			var providers []weatherProvider
+			if _, ok := tt.payloads["api.openweathermap.org"]; ok {
+				providers = append(providers, openWeatherMap{keys: keys})
+			}
+			if _, ok := tt.payloads["api.wunderground.com"]; ok {
+				providers = append(providers, weatherUnderground{keys: keys})
+			}
+			// The default client now goes upstream, so the server is asked directly.
+			s, _ := newTestServer(t, testConfig(t), nil, providers...)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", "/conditions/Paris", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d", rec.Code)
+			}
+
+			var got map[string]json.RawMessage
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if keys := fmt.Sprint(sortedKeys(got)); keys != tt.want {
+				t.Errorf("fields %s, want %s", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeelsLikePrefersReported(t *testing.T) {
+	tests := []struct {
+		name         string
+		main         string // OpenWeatherMap's, besides temp
+		want         float64
+		wantReported bool
+	}{
+		{"reported", `"feels_like": 260, "humidity": 50`, 260, true},
+		{"reckoned from the wind", `"humidity": 50`, fahrenheitToKelvin(-19), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 0°F in a 15 mph wind.
+			owm := fmt.Sprintf(`{"main": {"temp": %v, %s}, "wind": {"speed": %v}}`, fahrenheitToKelvin(0), tt.main, 15*1609.344/3600)
+			servePayloads(t, map[string]string{"api.openweathermap.org": owm})
+			s, _ := newTestServer(t, testConfig(t), nil, openWeatherMap{keys: newKeyRing("KEY")})
+
+			// The default client now goes upstream, so the server is asked directly.
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", "/conditions/Paris", nil))
+			var got struct {
+				FeelsLike         *struct{ K float64 } `json:"feels_like"`
+				ReportedFeelsLike *struct{ K float64 } `json:"feels_like_reported"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.FeelsLike == nil || math.Abs(got.FeelsLike.K-tt.want) > 0.5 {
+				t.Errorf("feels like %+v, want %.2f K", got.FeelsLike, tt.want)
+			}
+			switch {
+			case tt.wantReported && (got.ReportedFeelsLike == nil || got.ReportedFeelsLike.K != tt.want):
+				t.Errorf("reported %+v, want %v K", got.ReportedFeelsLike, tt.want)
+			case !tt.wantReported && got.ReportedFeelsLike != nil:
+				t.Errorf("reported %+v, want none", got.ReportedFeelsLike)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import "fmt"
+
+// Confidence levels reported alongside a temperature.
+const (
+	confidenceHigh   = "high"
+	confidenceMedium = "medium"
+	confidenceLow    = "low"
+)
+
+// confidenceThresholds decide how confident a result is, from how many
+// providers agreed on it and how closely. A result is of high confidence if
+// it meets both high thresholds, of medium if it meets both medium ones, and
+// of low otherwise.
+type confidenceThresholds struct {
+	highReadings int
+	highSpread   float64 // Kelvin
+
+	mediumReadings int
+	mediumSpread   float64 // Kelvin
+}
+
+func (t confidenceThresholds) level(res result) string {
+	switch {
+	case res.readings >= t.highReadings && res.spread <= t.highSpread:
+		return confidenceHigh
+	case res.readings >= t.mediumReadings && res.spread <= t.mediumSpread:
+		return confidenceMedium
+	}
+	return confidenceLow
+}
+
+// warnings lists what a consumer of res should be warned of: that its
+// providers disagree by more than maxSpread, in Kelvin. With no maxSpread,
+// there are no warnings.
+func warnings(res result, maxSpread float64) []string {
+	var w []string
+	if maxSpread > 0 && res.spread > maxSpread {
+		// A difference of temperatures is the same in Kelvin and Celsius.
+		w = append(w, fmt.Sprintf("providers disagree by %.1f°C", res.spread))
+	}
+	return w
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestConfidenceLevels(t *testing.T) {
+	errDown := errors.New("provider down")
+	defaults := confidenceThresholds{highReadings: 3, highSpread: 2, mediumReadings: 2, mediumSpread: 5}
+	lowered, tightened := defaults, defaults
+	lowered.highReadings = 2
+	tightened.mediumSpread = 3
+
+	tests := []struct {
+		name       string
+		kelvins    []float64 // 0 for a provider that fails
+		thresholds confidenceThresholds
+		want       string
+	}{
+		{"three agreeing", []float64{285, 285.5, 286}, defaults, confidenceHigh},
+		{"three disagreeing a little", []float64{283, 285, 287}, defaults, confidenceMedium},
+		{"three disagreeing a lot", []float64{280, 285, 290}, defaults, confidenceLow},
+		{"two of three answering", []float64{285, 286, 0}, defaults, confidenceMedium},
+		{"one of three answering", []float64{285, 0, 0}, defaults, confidenceLow},
+		{"lowered thresholds", []float64{285, 286, 0}, lowered, confidenceHigh},
+		{"tightened spread", []float64{283, 285, 287}, tightened, confidenceLow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []weatherProvider
+			for i, k := range tt.kelvins {
+				f := &fakeProvider{name: fmt.Sprint("p", i), kelvin: k}
+				if k == 0 {
+					f.err = errDown
+				}
+				providers = append(providers, f)
+			}
+			w := multiWeatherProvider{providers: providers, minProviders: 1}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.thresholds.level(res); got != tt.want {
+				t.Errorf("confidence %q from %d readings %v K apart, want %q", got, res.readings, res.spread, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisagreementWarning(t *testing.T) {
+	tests := []struct {
+		name    string
+		kelvins []float64
+		warnAt  float64
+		want    []string
+	}{
+		{"disagreeing", []float64{280, 288.3}, 5, []string{"providers disagree by 8.3°C"}},
+		{"within the threshold", []float64{280, 283}, 5, nil},
+		{"at the threshold", []float64{280, 285}, 5, nil},
+		{"warning off", []float64{280, 300}, 0, nil},
+		{"a single reading", []float64{280}, 0.1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []weatherProvider
+			for i, k := range tt.kelvins {
+				providers = append(providers, &fakeProvider{name: fmt.Sprint("p", i), kelvin: k})
+			}
+			w := multiWeatherProvider{providers: providers}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := warnings(res, tt.warnAt); fmt.Sprint(got) != fmt.Sprint(tt.want) || (tt.want == nil) != (got == nil) {
+				t.Errorf("warnings %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
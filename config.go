@@ -0,0 +1,623 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server's runtime settings, read from the environment.
+type Config struct {
+	// addr is the address to listen on.
+	addr string
+
+	// unixSocket, if set, is the path of a Unix domain socket to listen on
+	// instead of addr.
+	unixSocket string
+
+	// tlsCert and tlsKey are paths to a PEM certificate and key. When set,
+	// the server speaks HTTPS and HTTP/2; otherwise it serves plain HTTP.
+	tlsCert string
+	tlsKey  string
+
+	// corsOrigins lists the origins browsers may call the API from, or "*"
+	// for any. Empty disables CORS.
+	corsOrigins []string
+
+	// workers bounds how many /weather/ requests are served at once, with
+	// queueDepth more waiting. Requests beyond that are shed with 503 and a
+	// Retry-After of shedRetryAfter. No workers means no bound.
+	workers        int
+	queueDepth     int
+	shedRetryAfter time.Duration
+
+	// trustedProxies are the reverse proxies, as CIDR blocks or addresses,
+	// whose X-Forwarded-For is believed about where a request came from.
+	trustedProxies []string
+
+	// apiKeys, when set, are the keys clients must present to use the API
+	// endpoints. Empty leaves the API open.
+	apiKeys []string
+
+	// shutdownTimeout bounds how long in-flight requests may take to finish
+	// once the server is asked to stop.
+	shutdownTimeout time.Duration
+
+	openWeatherMapKey     string
+	weatherUndergroundKey string
+	darkSkyKey            string
+	googleGeocodeKey      string
+	what3wordsKey         string
+
+	// geocoders are the geocoders to resolve addresses with, by name, in
+	// order of preference; see newGeocoders. geocodeTimeout, if set, bounds
+	// each one's lookups.
+	geocoders      []string
+	geocodeTimeout time.Duration
+
+	// weatherbitKey is optional: Weatherbit.io is queried only if it is set.
+	weatherbitKey string
+
+	// providers, if set, are the providers to query, by name. Those left
+	// out aren't queried even if their keys are set, and need none. It is
+	// ignored in mock mode.
+	providers []string
+
+	// streamInterval is how often /stream/ pushes a fresh reading, to at
+	// most maxStreams subscribers at once. No maxStreams means no bound.
+	streamInterval time.Duration
+	maxStreams     int
+
+	// clusterRadius is how close, in meters, points of one /region/ request
+	// must be to share a single lookup. None means every point is looked up.
+	clusterRadius float64
+
+	// retryAttempts, retryBackoff, maxRetryBackoff, retryBudget and
+	// maxRetryAfter configure how failed upstream requests are retried; see
+	// retryPolicy.
+	retryAttempts   int
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	retryBudget     time.Duration
+	maxRetryAfter   time.Duration
+
+	// retryStatuses are the comma-separated HTTP statuses worth retrying.
+	retryStatuses string
+
+	// maxIdleConnsPerHost, idleConnTimeout and tcpKeepAlive tune the pool
+	// of connections to upstream hosts; see poolOptions.
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	tcpKeepAlive        time.Duration
+
+	// connectTimeout, tlsHandshakeTimeout and upstreamTimeout bound
+	// the stages of upstream requests; see poolOptions.
+	connectTimeout      time.Duration
+	tlsHandshakeTimeout time.Duration
+	upstreamTimeout     time.Duration
+
+	// dnsServer, if set, is the host:port of the DNS server upstream host
+	// names are resolved by, instead of the system resolver.
+	dnsServer string
+
+	// maxResponseBytes is the largest upstream response body accepted.
+	maxResponseBytes int
+
+	// logBodies logs each upstream response body, keys redacted, to debug
+	// how it is parsed. Bodies are long, so it is off by default.
+	logBodies bool
+
+	// maxCityLength is the longest city name accepted, in characters.
+	maxCityLength int
+
+	// maxUpstream caps the upstream requests in flight at once, across all
+	// client requests; zero is unlimited. A request waits up to
+	// upstreamQueueTimeout for a free slot before it is shed with 503
+	// Service Unavailable.
+	maxUpstream          int
+	upstreamQueueTimeout time.Duration
+
+	// defaultCity is looked up when a request names no place at all.
+	// Without it, such requests are rejected with 400 Bad Request.
+	defaultCity string
+
+	// cacheTTL is how long a city's temperature is served from cache before
+	// the providers are queried again. Zero disables caching.
+	cacheTTL time.Duration
+
+	// scheduleHorizon is how far ahead /schedule accepts lookups for, and
+	// scheduleRetention how long their results are kept once run.
+	scheduleHorizon   time.Duration
+	scheduleRetention time.Duration
+
+	// slowRequest, if set, is how long a /weather/ request may take before
+	// it is logged as slow, along with the time each provider took.
+	slowRequest time.Duration
+
+	// maxStale is how long past cacheTTL a cached temperature may be served,
+	// marked stale, when the providers fail. Zero never serves stale.
+	maxStale time.Duration
+
+	// cacheFile, if set, is where the cache is saved on shutdown and loaded
+	// from on startup, so that a restart doesn't start cold.
+	cacheFile string
+
+	// minProviders and aggregationTimeout configure multiWeatherProvider:
+	// once aggregationTimeout has passed, the readings that have arrived are
+	// averaged without waiting for the rest. Zero waits for every provider,
+	// up to the bound on any one lookup, maxLookupTime.
+	minProviders       int
+	aggregationTimeout time.Duration
+
+	// providerTimeout bounds each provider's lookup, unless overridden for
+	// that provider, by name, in providerTimeouts. Zero is no bound.
+	providerTimeout  time.Duration
+	providerTimeouts map[string]time.Duration
+
+	// providerOffsets are calibrations, in Kelvin, added to the readings of
+	// the providers they name.
+	providerOffsets map[string]float64
+
+	// providerHeaders are extra headers sent with every request to the
+	// providers they name, such as a key some proxy wants in a header.
+	providerHeaders map[string]http.Header
+
+	// adaptiveWeights weights each provider's reading by its success rate
+	// over its last successWindow lookups.
+	adaptiveWeights bool
+	successWindow   int
+
+	// inverseVariance weights each provider's reading by the inverse of the
+	// variance of its deviation from the consensus, over the same window,
+	// once every provider in a lookup has enough history.
+	inverseVariance bool
+
+	// minKelvin and maxKelvin bound the readings treated as plausible.
+	minKelvin float64
+	maxKelvin float64
+
+	// representative reports the provider reading nearest the median
+	// instead of the average.
+	representative bool
+
+	// modeResolution, if set, reports the most common reading, each rounded
+	// to this many degrees, instead of the average.
+	modeResolution float64
+
+	// trimmedMean drops the highest and lowest reading before averaging.
+	trimmedMean bool
+
+	// confidence sets when a temperature is reported as of high, medium or
+	// low confidence.
+	confidence confidenceThresholds
+
+	// rounding is how temperatures are rounded to whole degrees for "temp".
+	rounding rounding
+
+	// envelope wraps /weather/ responses, errors included, in an envelope of
+	// data and metadata; see envelope.
+	envelope bool
+
+	// defaultUnit is the unit "temp" is in when the client asks for none,
+	// as parseUnit takes it; see defaultUnits.
+	defaultUnit string
+
+	// trendWindow, if set, is how far back a place's temperatures are
+	// compared to report it as rising or falling, by more than
+	// trendThreshold degrees, or steady.
+	trendWindow    time.Duration
+	trendThreshold float64
+
+	// disagreement, if set, is the spread between readings, in degrees,
+	// beyond which a temperature is reported with a warning.
+	disagreement float64
+
+	// sequential queries providers one at a time rather than in parallel.
+	sequential bool
+
+	// primaryProvider, when set, names a provider whose reading is used on
+	// its own whenever it succeeds, with the others averaged as a fallback.
+	primaryProvider string
+
+	// reverseGeocode names the place in responses to queries by latitude
+	// and longitude, which would otherwise have no city.
+	reverseGeocode bool
+
+	// placeIDs geocodes places named in /weather/ requests to a canonical
+	// place ID, which responses include and the cache is keyed on, so that
+	// aliases such as "NYC" and "New York" share an entry.
+	placeIDs bool
+
+	// geocodeRegion, if set, is the country code whose places geocoding
+	// prefers for a city given without a country.
+	geocodeRegion string
+
+	// geohashPrecision, when non-zero, buckets geocoded coordinates by a
+	// geohash of this many characters (5 is roughly 5km).
+	geohashPrecision int
+
+	// alertThresholds, when set, are places whose temperature is polled
+	// every alertInterval, POSTing to alertWebhook when one drops below its
+	// threshold. See parseThresholds for their format.
+	alertThresholds string
+	alertInterval   time.Duration
+
+	// prewarm, when set, are places kept fresh in cache, each refreshed
+	// every prewarmInterval unless it has an interval of its own; see
+	// parsePrewarm.
+	prewarm         string
+	prewarmInterval time.Duration
+	alertWebhook    string
+
+	// configFile, if set, is a file of NAME=value settings that override
+	// the environment's. It is checked every configReload, and the
+	// providers rebuilt from it when it changes.
+	configFile   string
+	configReload time.Duration
+
+	// flags are the names of the flags given on the command line, whose
+	// values a reload of the config file mustn't undo.
+	flags map[string]bool
+
+	// tracing follows the W3C traceparent header of each request, linking
+	// the provider latency histogram to traces with exemplars.
+	tracing bool
+
+	// grpcAddr, if set, is the address to serve the gRPC WeatherService on,
+	// in the clear over HTTP/2.
+	grpcAddr string
+
+	// pprof serves the runtime profiles of net/http/pprof under
+	// /debug/pprof/. They reveal a lot about the server, so are off unless
+	// asked for.
+	pprof bool
+
+	// checkConfig validates the configuration and probes each provider,
+	// then exits instead of serving.
+	checkConfig bool
+
+	// dryRun logs the upstream requests that would be made, instead of
+	// making them, and answers each with a canned reading.
+	dryRun bool
+
+	// mock replaces the real providers with mockProviders, for load testing.
+	mock          bool
+	mockLatency   time.Duration
+	mockJitter    time.Duration
+	mockErrorRate float64
+}
+
+// loadConfig reads the configuration from the environment, the config file
+// named by WEATHER_CONFIG_FILE if there is one, and the command line. Each
+// setting is taken from the first of these that gives it:
+//
+//  1. a flag, such as -timeout
+//  2. the config file, as in WEATHER_AGGREGATION_TIMEOUT=3s
+//  3. the environment variable of the same name
+//  4. its default
+func loadConfig() Config {
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	return cfg
+}
+
+// parseConfig reads the configuration as loadConfig does, with the flags
+// defined on fs and parsed from args.
+func parseConfig(fs *flag.FlagSet, args []string) (Config, error) {
+	path := getenv("WEATHER_CONFIG_FILE")
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		values, err := readConfigFile(data)
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %v", path, err)
+		}
+		useConfigFile(values)
+	}
+
+	cfg := configFromEnv()
+	cfg.configFile = path
+	cfg.configReload = envDuration("WEATHER_CONFIG_RELOAD", 30*time.Second)
+
+	fs.StringVar(&cfg.addr, "addr", envString("WEATHER_ADDR", ":8080"), "address to listen on")
+	fs.StringVar(&cfg.unixSocket, "unix-socket", getenv("WEATHER_UNIX_SOCKET"), "path of a Unix socket to listen on instead of -addr")
+	fs.StringVar(&cfg.tlsCert, "tls-cert", getenv("WEATHER_TLS_CERT"), "path to a PEM TLS certificate")
+	fs.StringVar(&cfg.tlsKey, "tls-key", getenv("WEATHER_TLS_KEY"), "path to the PEM TLS certificate's key")
+	fs.IntVar(&cfg.maxUpstream, "max-upstream", envInt("WEATHER_MAX_UPSTREAM", 0), "most upstream requests in flight at once, or 0 for no limit")
+	fs.DurationVar(&cfg.upstreamQueueTimeout, "upstream-queue-timeout", envDuration("WEATHER_UPSTREAM_QUEUE_TIMEOUT", time.Second), "how long to wait for an upstream request slot before answering 503, or 0 to wait indefinitely")
+	fs.StringVar(&cfg.grpcAddr, "grpc-addr", getenv("WEATHER_GRPC_ADDR"), "address to serve gRPC on, or empty for none")
+	fs.BoolVar(&cfg.pprof, "pprof", envBool("WEATHER_PPROF", false), "serve runtime profiles under /debug/pprof/")
+	fs.StringVar(&cfg.defaultCity, "default-city", cfg.defaultCity, "city to report when a request names none")
+	fs.DurationVar(&cfg.cacheTTL, "cache-ttl", cfg.cacheTTL, "how long to cache a temperature, or 0 not to")
+	fs.DurationVar(&cfg.aggregationTimeout, "timeout", cfg.aggregationTimeout, "how long to wait for the providers before averaging those that have answered, or 0 to wait for them all")
+	fs.DurationVar(&cfg.providerTimeout, "provider-timeout", cfg.providerTimeout, "how long to wait for each provider, or 0 for no bound")
+	fs.IntVar(&cfg.minProviders, "min-providers", cfg.minProviders, "fewest providers that must answer, or 0 for all")
+	fs.Func("providers", "comma-separated providers to query, out of "+strings.Join(providerNames, ", ")+" (default all with keys set)", func(s string) error {
+		cfg.providers = splitList(s)
+		return nil
+	})
+	fs.BoolVar(&cfg.checkConfig, "check-config", false, "validate the configuration, probe each provider, and exit nonzero on failure")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "log upstream requests instead of sending them, and answer with canned readings")
+	fs.BoolVar(&cfg.mock, "mock", false, "serve from mock providers instead of the real APIs")
+	fs.DurationVar(&cfg.mockLatency, "mock-latency", 100*time.Millisecond, "fixed latency of each mock provider call")
+	fs.DurationVar(&cfg.mockJitter, "mock-jitter", 0, "maximum random latency added to each mock provider call")
+	fs.Float64Var(&cfg.mockErrorRate, "mock-error-rate", 0, "fraction of mock provider calls that fail, 0-1")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg.flags = map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { cfg.flags[f.Name] = true })
+	return cfg, nil
+}
+
+// configFromEnv reads the settings that come from the environment, or a
+// config file in its place; see getenv.
+func configFromEnv() Config {
+	return Config{
+		openWeatherMapKey:     getenv("OPEN_WEATHER_MAP_KEY"),
+		weatherUndergroundKey: getenv("WEATHER_UNDERGROUND_KEY"),
+		darkSkyKey:            getenv("DARK_SKY_KEY"),
+		googleGeocodeKey:      getenv("GOOGLE_GEOCODE_KEY"),
+		what3wordsKey:         getenv("WHAT3WORDS_KEY"),
+		weatherbitKey:         getenv("WEATHERBIT_KEY"),
+		providers:             splitList(getenv("WEATHER_PROVIDERS")),
+		geocoders:             splitList(envString("WEATHER_GEOCODERS", "google,openMeteo")),
+		geocodeTimeout:        envDuration("WEATHER_GEOCODE_TIMEOUT", 5*time.Second),
+		streamInterval:        envDuration("WEATHER_STREAM_INTERVAL", 30*time.Second),
+		maxStreams:            envInt("WEATHER_MAX_STREAMS", 1000),
+		clusterRadius:         envFloat("WEATHER_CLUSTER_RADIUS", 0),
+		retryAttempts:         envInt("WEATHER_RETRY_ATTEMPTS", 2),
+		retryBackoff:          envDuration("WEATHER_RETRY_BACKOFF", 200*time.Millisecond),
+		maxRetryBackoff:       envDuration("WEATHER_MAX_RETRY_BACKOFF", 2*time.Second),
+		retryBudget:           envDuration("WEATHER_RETRY_BUDGET", 10*time.Second),
+		maxRetryAfter:         envDuration("WEATHER_MAX_RETRY_AFTER", 5*time.Second),
+		retryStatuses:         envString("WEATHER_RETRY_STATUSES", defaultRetryStatuses),
+		maxIdleConnsPerHost:   envInt("WEATHER_MAX_IDLE_CONNS_PER_HOST", 16),
+		idleConnTimeout:       envDuration("WEATHER_IDLE_CONN_TIMEOUT", 90*time.Second),
+		tcpKeepAlive:          envDuration("WEATHER_TCP_KEEPALIVE", 30*time.Second),
+		dnsServer:             getenv("WEATHER_DNS_SERVER"),
+		connectTimeout:        envDuration("WEATHER_CONNECT_TIMEOUT", 30*time.Second),
+		tlsHandshakeTimeout:   envDuration("WEATHER_TLS_HANDSHAKE_TIMEOUT", 10*time.Second),
+		upstreamTimeout:       envDuration("WEATHER_UPSTREAM_TIMEOUT", 0),
+		maxResponseBytes:      envInt("WEATHER_MAX_RESPONSE_BYTES", 1<<20),
+		logBodies:             envBool("WEATHER_LOG_BODIES", false),
+		maxCityLength:         envInt("WEATHER_MAX_CITY_LENGTH", 128),
+		defaultCity:           getenv("WEATHER_DEFAULT_CITY"),
+		cacheTTL:              envDuration("WEATHER_CACHE_TTL", 5*time.Minute),
+		maxStale:              envDuration("WEATHER_MAX_STALE", 0),
+		cacheFile:             getenv("WEATHER_CACHE_FILE"),
+		slowRequest:           envDuration("WEATHER_SLOW_REQUEST", 2*time.Second),
+		scheduleHorizon:       envDuration("WEATHER_SCHEDULE_HORIZON", 48*time.Hour),
+		scheduleRetention:     envDuration("WEATHER_SCHEDULE_RETENTION", 24*time.Hour),
+		alertThresholds:       getenv("WEATHER_ALERT_THRESHOLDS"),
+		alertInterval:         envDuration("WEATHER_ALERT_INTERVAL", 5*time.Minute),
+		prewarm:               getenv("WEATHER_PREWARM"),
+		prewarmInterval:       envDuration("WEATHER_PREWARM_INTERVAL", 10*time.Minute),
+		alertWebhook:          getenv("WEATHER_ALERT_WEBHOOK"),
+		tracing:               envBool("WEATHER_TRACING", false),
+		reverseGeocode:        envBool("WEATHER_REVERSE_GEOCODE", false),
+		placeIDs:              envBool("WEATHER_PLACE_IDS", false),
+		geohashPrecision:      envInt("WEATHER_GEOHASH_PRECISION", 0),
+		geocodeRegion:         getenv("WEATHER_GEOCODE_REGION"),
+		minProviders:          envInt("WEATHER_MIN_PROVIDERS", 0),
+		aggregationTimeout:    envDuration("WEATHER_AGGREGATION_TIMEOUT", 3*time.Second),
+		providerTimeout:       envDuration("WEATHER_PROVIDER_TIMEOUT", 0),
+		providerTimeouts:      envDurations("WEATHER_PROVIDER_TIMEOUTS"),
+		providerOffsets:       envFloats("WEATHER_PROVIDER_OFFSETS"),
+		providerHeaders:       envHeaders("WEATHER_PROVIDER_HEADERS"),
+		adaptiveWeights:       envBool("WEATHER_ADAPTIVE_WEIGHTS", false),
+		successWindow:         envInt("WEATHER_SUCCESS_WINDOW", 20),
+		inverseVariance:       envBool("WEATHER_INVERSE_VARIANCE", false),
+		minKelvin:             envFloat("WEATHER_MIN_KELVIN", 180),
+		maxKelvin:             envFloat("WEATHER_MAX_KELVIN", 335),
+		representative:        envBool("WEATHER_REPRESENTATIVE", false),
+		modeResolution:        envFloat("WEATHER_MODE_RESOLUTION", 0),
+		trimmedMean:           envBool("WEATHER_TRIMMED_MEAN", false),
+		sequential:            envBool("WEATHER_SEQUENTIAL", false),
+		primaryProvider:       getenv("WEATHER_PRIMARY_PROVIDER"),
+		workers:               envInt("WEATHER_WORKERS", 0),
+		queueDepth:            envInt("WEATHER_QUEUE_DEPTH", 64),
+		shedRetryAfter:        envDuration("WEATHER_SHED_RETRY_AFTER", time.Second),
+		shutdownTimeout:       envDuration("WEATHER_SHUTDOWN_TIMEOUT", 10*time.Second),
+		corsOrigins:           splitList(getenv("WEATHER_CORS_ORIGINS")),
+		apiKeys:               splitList(getenv("WEATHER_API_KEYS")),
+		trustedProxies:        splitList(getenv("WEATHER_TRUSTED_PROXIES")),
+		disagreement:          envFloat("WEATHER_DISAGREEMENT_WARNING", 0),
+		trendWindow:           envDuration("WEATHER_TREND_WINDOW", time.Hour),
+		trendThreshold:        envFloat("WEATHER_TREND_THRESHOLD", 0.5),
+		rounding:              rounding(envString("WEATHER_ROUNDING", string(roundHalfUp))),
+		defaultUnit:           envString("WEATHER_DEFAULT_UNIT", string(fahrenheit)),
+		envelope:              envBool("WEATHER_ENVELOPE", false),
+		confidence: confidenceThresholds{
+			highReadings:   envInt("WEATHER_CONFIDENCE_HIGH_READINGS", 3),
+			highSpread:     envFloat("WEATHER_CONFIDENCE_HIGH_SPREAD", 2),
+			mediumReadings: envInt("WEATHER_CONFIDENCE_MEDIUM_READINGS", 2),
+			mediumSpread:   envFloat("WEATHER_CONFIDENCE_MEDIUM_SPREAD", 5),
+		},
+	}
+}
+
+// getenv looks up a setting by its environment variable's name. Once a
+// config file is in use, its values take precedence over the environment's.
+var getenv = os.Getenv
+
+// envString returns the named environment variable, or def when it is unset.
+func envString(name, def string) string {
+	if v := getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration parses the named environment variable as a time.Duration,
+// falling back to def when it is unset or malformed.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("config: %s: %v; using %s", name, err, def)
+		return def
+	}
+
+	return d
+}
+
+// envFloat parses the named environment variable as a float64, falling back
+// to def when it is unset or malformed.
+func envFloat(name string, def float64) float64 {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("config: %s: %v; using %g", name, err, def)
+		return def
+	}
+
+	return f
+}
+
+// envBool parses the named environment variable as a bool, falling back to
+// def when it is unset or malformed.
+func envBool(name string, def bool) bool {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("config: %s: %v; using %t", name, err, def)
+		return def
+	}
+
+	return b
+}
+
+// envInt parses the named environment variable as an int, falling back to
+// def when it is unset or malformed.
+func envInt(name string, def int) int {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("config: %s: %v; using %d", name, err, def)
+		return def
+	}
+
+	return n
+}
+
+// envDurations parses the named environment variable as a comma-separated
+// list of name=duration pairs, as in "darkSky=5s,openWeatherMap=2s".
+// Malformed pairs are logged and skipped.
+func envDurations(name string) map[string]time.Duration {
+	m := map[string]time.Duration{}
+	for k, v := range envPairs(name) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Printf("config: %s: %v; skipping", name, err)
+			continue
+		}
+		m[k] = d
+	}
+	return m
+}
+
+// envHeaders parses the named environment variable as a semicolon-separated
+// list of provider:Header=value entries, as in
+// "darkSky:X-Proxy-Key=abc;darkSky:Origin=https://example.com". Semicolons
+// separate them because header values may contain commas. Malformed entries
+// are logged and skipped.
+func envHeaders(name string) map[string]http.Header {
+	m := map[string]http.Header{}
+	for _, entry := range strings.Split(getenv(name), ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		colon, eq := strings.Index(entry, ":"), strings.Index(entry, "=")
+		if colon <= 0 || eq < colon+2 {
+			log.Printf("config: %s: %q is not provider:Header=value; skipping", name, entry)
+			continue
+		}
+
+		provider := strings.TrimSpace(entry[:colon])
+		if m[provider] == nil {
+			m[provider] = http.Header{}
+		}
+		m[provider].Add(strings.TrimSpace(entry[colon+1:eq]), strings.TrimSpace(entry[eq+1:]))
+	}
+	return m
+}
+
+// envFloats parses the named environment variable as a comma-separated list
+// of name=number pairs, as in "darkSky=-1.5". Malformed pairs are logged and
+// skipped.
+func envFloats(name string) map[string]float64 {
+	m := map[string]float64{}
+	for k, v := range envPairs(name) {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Printf("config: %s: %v; skipping", name, err)
+			continue
+		}
+		m[k] = f
+	}
+	return m
+}
+
+// envPairs splits the named environment variable into a comma-separated
+// list of name=value pairs. Pairs without an "=" are logged and skipped.
+func envPairs(name string) map[string]string {
+	m := map[string]string{}
+	for _, pair := range splitList(getenv(name)) {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			log.Printf("config: %s: %q is not name=value; skipping", name, pair)
+			continue
+		}
+		m[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+	return m
+}
+
+// defaultUnits is the unit to answer in when the client asks for none:
+// cfg.defaultUnit, or Fahrenheit if that isn't a unit.
+func (cfg Config) defaultUnits() unit {
+	if u, err := parseUnit(cfg.defaultUnit); err == nil {
+		return u
+	}
+	return fahrenheit
+}
+
+// splitList splits a comma-separated list, dropping empty elements and
+// surrounding whitespace.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
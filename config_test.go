@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	prev := getenv
+	t.Cleanup(func() { getenv = prev })
+
+	type settings struct {
+		addr, defaultCity string
+		timeout           time.Duration
+		providers         string
+	}
+	tests := []struct {
+		name  string
+		env   map[string]string
+		file  string
+		flags []string
+		want  settings
+	}{
+		{"defaults", nil, "", nil, settings{":8080", "", 3 * time.Second, "[]"}},
+		{
+			"environment",
+			map[string]string{"WEATHER_ADDR": ":9000", "WEATHER_DEFAULT_CITY": "Oslo", "WEATHER_AGGREGATION_TIMEOUT": "1s", "WEATHER_PROVIDERS": "darkSky"},
+			"", nil,
+			settings{":9000", "Oslo", time.Second, "[darkSky]"},
+		},
+		{
+			"config file over environment",
+			map[string]string{"WEATHER_ADDR": ":9000", "WEATHER_DEFAULT_CITY": "Oslo", "WEATHER_PROVIDERS": "darkSky"},
+			"WEATHER_DEFAULT_CITY=Paris\nWEATHER_AGGREGATION_TIMEOUT=2s\nWEATHER_PROVIDERS=weatherbit,darkSky\n",
+			nil,
+			settings{":9000", "Paris", 2 * time.Second, "[weatherbit darkSky]"},
+		},
+		{
+			"flags over config file",
+			map[string]string{"WEATHER_ADDR": ":9000"},
+			"WEATHER_DEFAULT_CITY=Paris\nWEATHER_AGGREGATION_TIMEOUT=2s\nWEATHER_PROVIDERS=weatherbit\n",
+			[]string{"-addr", ":9001", "-default-city", "Rome", "-timeout", "500ms", "-providers", "openWeatherMap"},
+			settings{":9001", "Rome", 500 * time.Millisecond, "[openWeatherMap]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv = os.Getenv
+			for _, name := range []string{"WEATHER_ADDR", "WEATHER_DEFAULT_CITY", "WEATHER_AGGREGATION_TIMEOUT", "WEATHER_PROVIDERS", "WEATHER_CONFIG_FILE"} {
+				t.Setenv(name, tt.env[name])
+			}
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "weather.conf")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("WEATHER_CONFIG_FILE", path)
+			}
+
+			fs := flag.NewFlagSet("weather", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			cfg, err := parseConfig(fs, tt.flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := settings{cfg.addr, cfg.defaultCity, cfg.aggregationTimeout, fmt.Sprint(cfg.providers)}
+			if got != tt.want {
+				t.Errorf("settings %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadKeepsFlags(t *testing.T) {
+	prev := getenv
+	t.Cleanup(func() { getenv = prev })
+	getenv = func(name string) string {
+		return map[string]string{"WEATHER_DEFAULT_CITY": "Oslo", "WEATHER_CACHE_TTL": "1m", "WEATHER_PROVIDERS": "darkSky"}[name]
+	}
+
+	fs := flag.NewFlagSet("weather", flag.ContinueOnError)
+	cfg, err := parseConfig(fs, []string{"-default-city", "Rome", "-providers", "weatherbit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reload changes every setting; only the one not given as a flag
+	// should follow it.
+	useConfigFile(map[string]string{"WEATHER_DEFAULT_CITY": "Paris", "WEATHER_CACHE_TTL": "2m", "WEATHER_PROVIDERS": "openWeatherMap"})
+	next := cfg.reloaded()
+	if next.defaultCity != "Rome" || fmt.Sprint(next.providers) != "[weatherbit]" {
+		t.Errorf("reload undid the flags: default city %q, providers %v", next.defaultCity, next.providers)
+	}
+	if next.cacheTTL != 2*time.Minute {
+		t.Errorf("cache TTL %v after reloading, want 2m from the file", next.cacheTTL)
+	}
+	if again := next.reloaded(); again.defaultCity != "Rome" {
+		t.Errorf("second reload: default city %q, want the flag's Rome", again.defaultCity)
+	}
+}
+
+func TestProvidersQueried(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers []string
+		want      string
+	}{
+		{"all with keys", nil, "[openWeatherMap weatherUnderground darkSky weatherbit]"},
+		{"one listed", []string{"weatherbit"}, "[weatherbit]"},
+		{"two listed", []string{"darkSky", "openWeatherMap"}, "[openWeatherMap darkSky]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			cfg.weatherbitKey = "wb"
+			cfg.providers = tt.providers
+
+			var names []string
+			for _, p := range newProviders(cfg, nil) {
+				names = append(names, p.Name())
+			}
+			if got := fmt.Sprint(names); got != tt.want {
+				t.Errorf("providers %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		want string
+	}{
+		{"none", "", "map[]"},
+		{"one", "darkSky:X-Token=abc", "map[darkSky:map[X-Token:[abc]]]"},
+		{"several, spaced", " openWeatherMap : Origin = https://example.com ; openWeatherMap:x-proxy=1; weatherbit:Authorization=Bearer t ",
+			"map[openWeatherMap:map[Origin:[https://example.com] X-Proxy:[1]] weatherbit:map[Authorization:[Bearer t]]]"},
+		{"repeated", "darkSky:Via=a;darkSky:Via=b", "map[darkSky:map[Via:[a b]]]"},
+		{"value with an equals sign", "darkSky:X-Sig=a=b", "map[darkSky:map[X-Sig:[a=b]]]"},
+		{"malformed skipped", "darkSky;:X-A=1;darkSky:=1;darkSky:X-B=2", "map[darkSky:map[X-B:[2]]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			cfg := testConfigFromEnv(t, map[string]string{"WEATHER_PROVIDER_HEADERS": tt.env})
+			if got := fmt.Sprint(cfg.providerHeaders); got != tt.want {
+				t.Errorf("headers %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// dryRunTransport is an http.RoundTripper that never touches the network. It
+// logs each request it is given, with the API keys redacted, and answers with
+// a canned response, so that the server can be run to see what it would
+// call without spending any quota.
+type dryRunTransport struct{}
+
+// dryRunResponses are the canned response bodies, by host. Each reads 15°C.
+var dryRunResponses = map[string]string{
+	"api.openweathermap.org":       `{"main":{"temp":288.15,"feels_like":287.15,"pressure":1013,"humidity":70},"visibility":10000,"wind":{"speed":4.1},"rain":{"1h":0.4},"timezone":3600,"weather":[{"description":"light rain"}]}`,
+	"api.wunderground.com":         `{"current_observation":{"temp_c":15,"pressure_in":"29.91","visibility_km":"10.0","wind_kph":14.8,"relative_humidity":"72%","display_location":{"latitude":"48.86","longitude":"2.35"},"observation_location":{"latitude":"48.83","longitude":"2.33"}}}`,
+	"api.darksky.net":              `{"timezone":"Europe/Paris","offset":1,"currently":{"temperature":15,"apparentTemperature":13,"pressure":1013,"uvIndex":3,"visibility":10,"windSpeed":4.2,"humidity":0.71,"precipProbability":0.2,"precipIntensity":0.6,"precipType":"rain","summary":"Drizzle"},"daily":{"data":[{"temperatureHigh":15,"temperatureLow":15,"moonPhase":0.4}]}}`,
+	"api.weatherbit.io":            `{"data":[{"temp":15,"slp":1013,"clouds":40,"uv":3,"vis":10,"weather":{"description":"Scattered clouds"}}],"count":1}`,
+	"api.what3words.com":           `{"coordinates":{"lat":0,"lng":0}}`,
+	"geocoding-api.open-meteo.com": `{"results":[{"latitude":0,"longitude":0,"country":"Dry Run","country_code":"DR"}]}`,
+	"maps.googleapis.com":          `{"results":[{"geometry":{"location":{"lat":0,"lng":0}},"address_components":[{"long_name":"Dry Run","types":["locality"]}]}]}`,
+}
+
+func (dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	log.Printf("dry run: %s %s", req.Method, secrets.redact(req.URL.String()))
+
+	body, ok := dryRunResponses[req.URL.Hostname()]
+	if !ok {
+		body = "{}"
+	}
+
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// refusingTransport fails every request, standing in for the network.
+type refusingTransport struct{}
+
+func (refusingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return nil, errors.New("dry run made a real request to " + r.URL.Host)
+}
+
+func TestDryRunMakesNoRequests(t *testing.T) {
+	prevTransport := http.DefaultTransport
+	http.DefaultTransport = refusingTransport{}
+	t.Cleanup(func() { http.DefaultTransport = prevTransport })
+
+	// As main sets it up for -dry-run.
+	prevUpstream := upstream
+	upstream = &fetcher{client: &http.Client{Transport: dryRunTransport{}}}
+	t.Cleanup(func() { upstream = prevUpstream })
+
+	prevSecrets := secrets
+	secrets = &secretSet{}
+	t.Cleanup(func() { secrets = prevSecrets })
+	secrets.add("owm-secret", "wu-secret", "ds-secret", "google-secret")
+
+	logged := captureLog(t)
+
+	w := multiWeatherProvider{providers: []weatherProvider{
+		openWeatherMap{keys: newKeyRing("owm-secret")},
+		weatherUnderground{keys: newKeyRing("wu-secret")},
+		darkSky{keys: newKeyRing("ds-secret"), geocoder: googleGeocoder{apiKey: "google-secret"}},
+	}}
+	res, err := w.aggregate(context.Background(), query{city: "Paris"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(res.temp.Celsius()-15) > 1e-9 || len(res.sources) != 3 {
+		t.Errorf("%v°C from %v, want the canned 15°C from all 3 providers", res.temp.Celsius(), res.sources)
+	}
+
+	out := logged.String()
+	for _, host := range []string{"api.openweathermap.org", "api.wunderground.com", "api.darksky.net", "maps.googleapis.com"} {
+		if !strings.Contains(out, "dry run: GET https://"+host) && !strings.Contains(out, "dry run: GET http://"+host) {
+			t.Errorf("no planned request to %s logged", host)
+		}
+	}
+	if strings.Contains(out, "-secret") {
+		t.Errorf("keys logged unredacted:\n%s", out)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// envelope is the shape of every /weather/ response in envelope mode: the
+// response proper as data, or an error in its place, with metadata about how
+// it was answered alongside.
+type envelope struct {
+	Data  interface{}  `json:"data"`
+	Error string       `json:"error,omitempty"`
+	Meta  envelopeMeta `json:"meta"`
+}
+
+type envelopeMeta struct {
+	Took    string   `json:"took"`
+	Cached  bool     `json:"cached"`
+	Sources []string `json:"sources"`
+}
+
+// fail answers a /weather/ request that began at begin, and is served from
+// current, with an error, as http.Error does, or, in envelope mode, as an
+// envelope with no data.
+func fail(w http.ResponseWriter, current *serving, msg string, code int, begin time.Time) {
+	if !current.cfg.envelope {
+		http.Error(w, msg, code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	encodeJSON(w, envelope{
+		Error: msg,
+		Meta:  envelopeMeta{Took: time.Since(begin).String(), Sources: []string{}},
+	}, snakeCase)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	tests := []struct {
+		name        string
+		envelope    bool
+		fail        bool
+		path        string
+		wantStatus  int
+		wantKeys    string // the response's top-level keys
+		wantCity    string // in data
+		wantError   string
+		wantSources string
+	}{
+		{"success", true, false, "/weather/Paris", http.StatusOK, "[data meta]", "Paris", "", "[alpha]"},
+		{"every provider failing", true, true, "/weather/Paris", http.StatusInternalServerError, "[data error meta]", "", "provider down", "[]"},
+		{"bad request", true, false, "/weather/Paris?units=rankine", http.StatusBadRequest, "[data error meta]", "", `unknown unit "rankine"`, "[]"},
+		{"off", false, false, "/weather/Paris", http.StatusOK, "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			if alpha := fakes.add("alpha", 285); tt.fail {
+				alpha.err = errors.New("provider down")
+			}
+			cfg := testConfig(t)
+			cfg.envelope = tt.envelope
+			_, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+			var got map[string]json.RawMessage
+			resp := getJSONResponse(t, ts.URL+tt.path, &got)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if !tt.envelope {
+				if _, ok := got["data"]; ok || got["city"] == nil {
+					t.Errorf("keys %v, want the response unwrapped", sortedKeys(got))
+				}
+				return
+			}
+			if keys := fmt.Sprint(sortedKeys(got)); keys != tt.wantKeys {
+				t.Errorf("keys %s, want %s", keys, tt.wantKeys)
+			}
+
+			var data struct{ City string }
+			json.Unmarshal(got["data"], &data)
+			var errMsg string
+			json.Unmarshal(got["error"], &errMsg)
+			var meta struct {
+				Took    string
+				Cached  bool
+				Sources []string
+			}
+			json.Unmarshal(got["meta"], &meta)
+			switch {
+			case data.City != tt.wantCity:
+				t.Errorf("data for %q, want %q", data.City, tt.wantCity)
+			case !strings.Contains(errMsg, tt.wantError) || (tt.wantError == "") != (errMsg == ""):
+				t.Errorf("error %q, want %q", errMsg, tt.wantError)
+			case meta.Took == "" || fmt.Sprint(meta.Sources) != tt.wantSources || meta.Sources == nil:
+				t.Errorf("meta %+v, want a time taken and sources %s", meta, tt.wantSources)
+			}
+		})
+	}
+}
+
+func TestEnvelopeCached(t *testing.T) {
+	fakes := fakeRegistry{}
+	fakes.add("alpha", 285)
+	cfg := testConfig(t)
+	cfg.envelope = true
+	_, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+	for _, want := range []bool{false, true} {
+		var got struct {
+			Data map[string]interface{}
+			Meta struct{ Cached bool }
+		}
+		getJSONResponse(t, ts.URL+"/weather/Paris", &got)
+		if got.Meta.Cached != want {
+			t.Errorf("cached %v, want %v", got.Meta.Cached, want)
+		}
+		for _, moved := range []string{"took", "sources"} {
+			if _, ok := got.Data[moved]; ok {
+				t.Errorf("%s in data; want it only in meta", moved)
+			}
+		}
+	}
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// statusError is returned when a provider responds with a non-2xx status.
+type statusError struct {
+	code       int
+	retryAfter time.Duration // from the Retry-After header, if any
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.code, http.StatusText(e.code))
+}
+
+// decodeError is returned when a provider's response body isn't the JSON we
+// expected.
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string { return "decoding response: " + e.err.Error() }
+func (e *decodeError) Unwrap() error { return e.err }
+
+// truncated reports whether the body ended partway through its JSON, as when
+// an upstream's response is cut off, rather than being malformed throughout.
+func (e *decodeError) truncated() bool { return errors.Is(e.err, io.ErrUnexpectedEOF) }
+
+// geocodeError is returned when a provider can't resolve the city to
+// coordinates, before it has queried for any weather.
+type geocodeError struct {
+	err error
+}
+
+func (e *geocodeError) Error() string { return "geocoding: " + e.err.Error() }
+func (e *geocodeError) Unwrap() error { return e.err }
+
+// schemaError is returned when a provider's response, though valid JSON,
+// lacks a field it has always had: a sign the provider has changed its API,
+// instead of a reading that happens to be zero.
+type schemaError struct {
+	field string
+}
+
+func (e *schemaError) Error() string { return "response has no " + e.field + " field" }
+
+// schemaDrift returns a schemaError for the field missing from provider's
+// response, logging it as a warning, since it likely needs a code change.
+func schemaDrift(provider, field string) error {
+	log.Printf("%s: schema drift: response has no %s field", provider, field)
+	return &schemaError{field}
+}
+
+// implausibleError is returned in place of a reading that can't be real.
+type implausibleError struct {
+	kelvin float64
+}
+
+func (e *implausibleError) Error() string {
+	return fmt.Sprintf("implausible reading %.2f K", e.kelvin)
+}
+
+// rejectedError is returned in place of a reading a provider's validator
+// rejected.
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string { return "reading rejected: " + e.err.Error() }
+func (e *rejectedError) Unwrap() error { return e.err }
+
+// Error categories, used as metric labels.
+const (
+	errTimeout  = "timeout"
+	errCanceled = "canceled"
+	errClient   = "4xx"
+	errServer   = "5xx"
+	errDecode   = "decode"
+	errTruncate = "truncated"
+	errSchema   = "schema_drift"
+	errGeocode  = "geocode"
+	errRange    = "implausible"
+	errRejected = "rejected"
+	errShed     = "overloaded"
+	errOther    = "other"
+)
+
+// classifyError reports which category a provider error belongs to.
+func classifyError(err error) string {
+	var (
+		geo    *geocodeError
+		status *statusError
+		decode *decodeError
+		schema *schemaError
+		bad    *implausibleError
+		reject *rejectedError
+		netErr net.Error
+	)
+
+	switch {
+	case errors.As(err, &geo):
+		return errGeocode
+	case errors.Is(err, context.DeadlineExceeded):
+		return errTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errTimeout
+	case errors.Is(err, context.Canceled):
+		return errCanceled
+	case errors.As(err, &status) && status.code >= 500:
+		return errServer
+	case errors.As(err, &status) && status.code >= 400:
+		return errClient
+	case errors.As(err, &decode) && decode.truncated():
+		return errTruncate
+	case errors.As(err, &decode):
+		return errDecode
+	case errors.As(err, &schema):
+		return errSchema
+	case errors.As(err, &bad):
+		return errRange
+	case errors.As(err, &reject):
+		return errRejected
+	case errors.Is(err, errOverloaded):
+		return errShed
+	}
+
+	return errOther
+}
+
+// requestError is returned when a client's request is malformed.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string { return e.err.Error() }
+func (e *requestError) Unwrap() error { return e.err }
+
+// errorStatus is the HTTP status to answer a failed request with.
+func errorStatus(err error) int {
+	var bad *requestError
+	switch {
+	case errors.As(err, &bad):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrCityNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errOverloaded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	var syntax error = &json.SyntaxError{}
+	timeout := &net.OpError{Op: "dial", Err: &net.DNSError{IsTimeout: true}}
+
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.DeadlineExceeded, errTimeout},
+		{fmt.Errorf("fetching: %w", context.DeadlineExceeded), errTimeout},
+		{timeout, errTimeout},
+		{context.Canceled, errCanceled},
+		{&statusError{code: 404}, errClient},
+		{&statusError{code: 429}, errClient},
+		{&statusError{code: 500}, errServer},
+		{&statusError{code: 503}, errServer},
+		{&decodeError{syntax}, errDecode},
+		{&geocodeError{errNotFound}, errGeocode},
+		{&geocodeError{context.DeadlineExceeded}, errGeocode},
+		{errors.New("something else"), errOther},
+	}
+	for _, tt := range tests {
+		if got := classifyError(tt.err); got != tt.want {
+			t.Errorf("classifyError(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestProviderErrorsCountedByCategory(t *testing.T) {
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Host {
+		case "api.openweathermap.org":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "api.wunderground.com":
+			fmt.Fprint(w, `{"current_observation": ]`)
+		}
+	})
+	m := newProviderMetrics(&metricsRegistry{})
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			openWeatherMap{keys: newKeyRing("KEY")},
+			weatherUnderground{keys: newKeyRing("KEY")},
+			darkSky{keys: newKeyRing("KEY"), geocoder: &stubGeocoder{}},
+		},
+		minProviders: 1,
+		observers:    []Observer{m},
+	}
+	if _, err := w.temperature(context.Background(), "Paris"); err == nil {
+		t.Fatal("every provider failing, but no error")
+	}
+
+	tests := []struct {
+		provider, category string
+		want               uint64
+	}{
+		{"openWeatherMap", errServer, 1},
+		{"weatherUnderground", errDecode, 1},
+		{"darkSky", errGeocode, 1},
+		{"darkSky", errServer, 0},
+	}
+	for _, tt := range tests {
+		if got := m.errors.with(tt.provider, tt.category).get(); got != tt.want {
+			t.Errorf("%s %s errors = %d, want %d", tt.provider, tt.category, got, tt.want)
+		}
+	}
+}
+
+func TestSchemaDrift(t *testing.T) {
+	google := `{"results": [{"geometry": {"location": {"lat": 48.8566, "lng": 2.3522}}}]}`
+
+	tests := []struct {
+		name      string
+		provider  weatherProvider
+		host      string
+		body      string
+		wantField string // missing; empty for a sound reading
+	}{
+		{"OpenWeatherMap missing", openWeatherMap{keys: newKeyRing("KEY")}, "api.openweathermap.org", `{"main": {"pressure": 1013}}`, "main.temp"},
+		{"OpenWeatherMap renamed", openWeatherMap{keys: newKeyRing("KEY")}, "api.openweathermap.org", `{"main": {"temperature": 285}}`, "main.temp"},
+		{"Weather Underground missing", weatherUnderground{keys: newKeyRing("KEY")}, "api.wunderground.com", `{"current_observation": {"temp_f": 50}}`, "current_observation.temp_c"},
+		{"Weather Underground at zero", weatherUnderground{keys: newKeyRing("KEY")}, "api.wunderground.com", `{"current_observation": {"temp_c": 0}}`, ""},
+		{"Dark Sky missing", darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}}, "api.darksky.net", `{"currently": {"summary": "Clear"}}`, "currently.temperature"},
+		{"Dark Sky at zero", darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}}, "api.darksky.net", `{"currently": {"temperature": 0}}`, ""},
+		{"Weatherbit missing", weatherbit{keys: newKeyRing("KEY")}, "api.weatherbit.io", `{"data": [{"rh": 62}], "count": 1}`, "data.temp"},
+		{"Weatherbit at zero", weatherbit{keys: newKeyRing("KEY")}, "api.weatherbit.io", `{"data": [{"temp": 0}], "count": 1}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logged := captureLog(t)
+			servePayloads(t, map[string]string{tt.host: tt.body, "maps.googleapis.com": google})
+
+			k, err := tt.provider.temperature(context.Background(), "Paris")
+			var schema *schemaError
+			if tt.wantField == "" {
+				if err != nil || k != celsiusOffset {
+					t.Errorf("read %v K, %v; want 0°C", k, err)
+				}
+				if strings.Contains(logged.String(), "schema drift") {
+					t.Errorf("a zero reading logged as drift:\n%s", logged)
+				}
+				return
+			}
+			if !errors.As(err, &schema) || schema.field != tt.wantField {
+				t.Fatalf("error %v, want the %s field missing", err, tt.wantField)
+			}
+			if want := tt.provider.Name() + ": schema drift: response has no " + tt.wantField + " field"; !strings.Contains(logged.String(), want) {
+				t.Errorf("log lacks %q:\n%s", want, logged)
+			}
+		})
+	}
+}
+
+func TestSchemaDriftCounted(t *testing.T) {
+	captureLog(t)
+	servePayloads(t, map[string]string{"api.openweathermap.org": `{"main": {}}`})
+	cfg := testConfig(t)
+	cfg.retryAttempts = 0
+	s, _ := newTestServer(t, cfg, nil, openWeatherMap{keys: newKeyRing("KEY")})
+
+	// The default client now goes upstream, so the server is asked directly.
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/weather/Paris", nil))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `weather_provider_errors_total{provider="openWeatherMap",category="schema_drift"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics lack %q:\n%s", want, rec.Body)
+	}
+}
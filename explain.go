@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Aggregation strategies, as an explanation names them.
+const (
+	strategyMean           = "mean"
+	strategyWeightedMean   = "weighted mean"
+	strategyTrimmedMean    = "trimmed mean"
+	strategyMode           = "mode"
+	strategyRepresentative = "representative"
+	strategyPrimary        = "primary"
+)
+
+// explanation says how a result's temperature was arrived at from the
+// readings it was drawn from, for /weather/?explain=true.
+type explanation struct {
+	Strategy    string             `json:"strategy"`
+	Readings    []explainedReading `json:"readings"`
+	Kelvin      float64            `json:"kelvin"`
+	Computation string             `json:"computation"`
+}
+
+// explainedReading is one provider's part in a result: its reading, its
+// weight in the average if it was averaged, or else why it was left out.
+type explainedReading struct {
+	Provider string   `json:"provider"`
+	Kelvin   float64  `json:"kelvin"`
+	Weight   *float64 `json:"weight,omitempty"`
+	Excluded string   `json:"excluded,omitempty"`
+}
+
+// explainMean explains a weighted mean of obs, excluding those of all not
+// kept, with the reason why.
+func explainMean(strategy string, all, kept []observation, weights []float64, kelvin float64, excluded string) *explanation {
+	e := &explanation{Strategy: strategy, Kelvin: kelvin}
+
+	var terms []string
+	total := 0.0
+	k := 0
+	for _, o := range all {
+		r := explainedReading{Provider: o.provider, Kelvin: o.Kelvin}
+		if k < len(kept) && kept[k].provider == o.provider {
+			w := weights[k]
+			r.Weight = &w
+			terms = append(terms, fmt.Sprintf("%g×%.2f", w, o.Kelvin))
+			total += w
+			k++
+		} else {
+			r.Excluded = excluded
+		}
+		e.Readings = append(e.Readings, r)
+	}
+	e.Computation = fmt.Sprintf("(%s) / %g = %.2f K", strings.Join(terms, " + "), total, kelvin)
+	return e
+}
+
+// explainChoice explains a result that is one value chosen from among obs,
+// rather than averaged: those of obs not in chosen are excluded.
+func explainChoice(strategy string, obs, chosen []observation, kelvin float64, computation, excluded string) *explanation {
+	in := map[string]bool{}
+	for _, o := range chosen {
+		in[o.provider] = true
+	}
+
+	e := &explanation{Strategy: strategy, Kelvin: kelvin, Computation: computation}
+	for _, o := range obs {
+		r := explainedReading{Provider: o.provider, Kelvin: o.Kelvin}
+		if !in[o.provider] {
+			r.Excluded = excluded
+		}
+		e.Readings = append(e.Readings, r)
+	}
+	return e
+}
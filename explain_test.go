@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// describe summarizes e's readings as "provider kelvin ×weight" for those
+// averaged and "provider kelvin (reason)" for the rest.
+func describe(e *explanation) string {
+	var parts []string
+	for _, r := range e.Readings {
+		switch {
+		case r.Weight != nil:
+			parts = append(parts, fmt.Sprintf("%s %g ×%g", r.Provider, r.Kelvin, *r.Weight))
+		case r.Excluded != "":
+			parts = append(parts, fmt.Sprintf("%s %g (%s)", r.Provider, r.Kelvin, r.Excluded))
+		default:
+			parts = append(parts, fmt.Sprintf("%s %g", r.Provider, r.Kelvin))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func TestExplanation(t *testing.T) {
+	var obs []observation
+	for i, k := range []float64{280, 284, 287, 290, 330} {
+		obs = append(obs, observation{provider: fmt.Sprint("p", i), Conditions: Conditions{Kelvin: k}})
+	}
+
+	tests := []struct {
+		name            string
+		w               multiWeatherProvider
+		wantStrategy    string
+		wantKelvin      float64
+		wantReadings    string
+		wantComputation string
+	}{
+		{
+			"mean", multiWeatherProvider{}, strategyMean, 294.2,
+			"p0 280 ×1, p1 284 ×1, p2 287 ×1, p3 290 ×1, p4 330 ×1",
+			"(1×280.00 + 1×284.00 + 1×287.00 + 1×290.00 + 1×330.00) / 5 = 294.20 K",
+		},
+		{
+			"trimmed mean", multiWeatherProvider{trimmed: true}, strategyTrimmedMean, 287,
+			"p0 280 (highest or lowest reading), p1 284 ×1, p2 287 ×1, p3 290 ×1, p4 330 (highest or lowest reading)",
+			"(1×284.00 + 1×287.00 + 1×290.00) / 3 = 287.00 K",
+		},
+		{
+			"representative", multiWeatherProvider{representative: true}, strategyRepresentative, 287,
+			"p0 280 (not nearest the median), p1 284 (not nearest the median), p2 287, p3 290 (not nearest the median), p4 330 (not nearest the median)",
+			"p2's 287.00 K is nearest the median, 287.00 K",
+		},
+		{
+			"mode", multiWeatherProvider{modeResolution: 5}, strategyMode, 288.15,
+			"p0 280 (not the most common reading), p1 284 (not the most common reading), p2 287, p3 290, p4 330 (not the most common reading)",
+			"2 of 5 readings round to 288.15 K, to the nearest 5°C",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := tt.w.combine(obs).explanation
+			if e == nil {
+				t.Fatal("no explanation")
+			}
+			if e.Strategy != tt.wantStrategy {
+				t.Errorf("strategy %q, want %q", e.Strategy, tt.wantStrategy)
+			}
+			if fmt.Sprintf("%.2f", e.Kelvin) != fmt.Sprintf("%.2f", tt.wantKelvin) {
+				t.Errorf("kelvin %v, want %v", e.Kelvin, tt.wantKelvin)
+			}
+			if got := describe(e); got != tt.wantReadings {
+				t.Errorf("readings\n%s\nwant\n%s", got, tt.wantReadings)
+			}
+			if e.Computation != tt.wantComputation {
+				t.Errorf("computation %q, want %q", e.Computation, tt.wantComputation)
+			}
+		})
+	}
+}
+
+func TestExplainServed(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"?explain=true", true},
+		{"", false},
+		{"?explain=yes", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			fakes.add("alpha", 280)
+			fakes.add("beta", 290)
+			_, ts := newTestServer(t, testConfig(t), nil, fakes.providers()...)
+
+			var got struct {
+				Explanation *explanation
+			}
+			resp := getJSONResponse(t, ts.URL+"/weather/Paris"+tt.query, &got)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			switch {
+			case !tt.want && got.Explanation != nil:
+				t.Errorf("explanation %+v, want none", got.Explanation)
+			case tt.want && (got.Explanation == nil || got.Explanation.Strategy != strategyMean || describe(got.Explanation) != "alpha 280 ×1, beta 290 ×1"):
+				t.Errorf("explanation %+v, want the mean of alpha's and beta's readings", got.Explanation)
+			}
+		})
+	}
+}
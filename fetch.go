@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetcher performs the upstream HTTP requests of providers and geocoders.
+type fetcher struct {
+	client *http.Client
+	retry  retryPolicy
+
+	// slots, if non-nil, is a semaphore bounding how many upstream requests
+	// are in flight at once, across every client request being served. It
+	// keeps bursts of traffic from exhausting the providers' quotas.
+	slots chan struct{}
+
+	// maxBody, if set, is the largest response body to decode, in bytes, so
+	// that a misbehaving upstream can't exhaust our memory.
+	maxBody int64
+
+	// queueTimeout is how long to wait for a free slot before shedding the
+	// request with errOverloaded. Zero waits for as long as the context
+	// allows.
+	queueTimeout time.Duration
+
+	// logBodies logs every upstream response body, for debugging how
+	// providers' responses are parsed.
+	logBodies bool
+}
+
+// errOverloaded is returned when too many upstream requests are already in
+// flight to make another.
+var errOverloaded = errors.New("too many upstream requests in flight")
+
+// newSlots returns a semaphore of n slots, or nil for no limit.
+func newSlots(n int) chan struct{} {
+	if n <= 0 {
+		return nil
+	}
+	return make(chan struct{}, n)
+}
+
+// retryPolicy says whether and when to try a failed upstream request again.
+type retryPolicy struct {
+	// attempts is the most times a request is tried, counting the first.
+	// One or less means failures aren't retried.
+	attempts int
+
+	// backoff is the wait before the first retry, doubling for each after
+	// up to maxBackoff, if that is set.
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// budget, if set, is the longest to spend on a request, retries
+	// included. A retry that couldn't start within it isn't made, and the
+	// last error is returned instead, so that one pathological provider
+	// can't use up a client request's whole deadline.
+	budget time.Duration
+
+	// maxRetryAfter is the longest a server's Retry-After is honored for.
+	// If a server asks us to wait longer, the request fails instead.
+	maxRetryAfter time.Duration
+
+	// statuses are the HTTP statuses worth retrying. If nil, they are
+	// defaultRetryStatuses.
+	statuses map[int]bool
+}
+
+// defaultRetryStatuses are the statuses a retry might fix: timeouts,
+// throttling and transient server errors. Others, such as 400 or 401, would
+// only fail again, and metered APIs may charge for each attempt.
+const defaultRetryStatuses = "408,429,500,502,503,504"
+
+// parseStatuses parses a comma-separated list of HTTP statuses, such as
+// defaultRetryStatuses.
+func parseStatuses(s string) (map[int]bool, error) {
+	statuses := map[int]bool{}
+	for _, f := range splitList(s) {
+		code, err := strconv.Atoi(f)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("%q is not an HTTP status", f)
+		}
+		statuses[code] = true
+	}
+	return statuses, nil
+}
+
+// upstream is the fetcher getJSON uses.
+var upstream = &fetcher{client: http.DefaultClient}
+
+// poolOptions tune the connections kept open to upstream hosts. Every
+// lookup goes to the same handful of hosts, so reusing connections saves a
+// TCP and TLS handshake on almost every request.
+type poolOptions struct {
+	// maxIdlePerHost is how many idle connections to keep to each host. It
+	// should be about the number of requests in flight to a host at once:
+	// at 5-10 req/s with 100-200ms upstream calls, the default 16 suffices.
+	maxIdlePerHost int
+
+	// idleTimeout is how long an idle connection is kept before closing.
+	idleTimeout time.Duration
+
+	// keepAlive is the interval of TCP keep-alive probes on open
+	// connections. Negative disables them.
+	keepAlive time.Duration
+
+	// resolver, if set, resolves upstream host names in place of the
+	// system resolver.
+	resolver *net.Resolver
+
+	// connectTimeout bounds dialing a connection, DNS included, and
+	// tlsHandshakeTimeout its TLS handshake. requestTimeout, if set, bounds
+	// a whole request, reading its body included, however long its context
+	// allows.
+	connectTimeout      time.Duration
+	tlsHandshakeTimeout time.Duration
+	requestTimeout      time.Duration
+}
+
+// newPooledClient returns an HTTP client whose transport is the default one,
+// with its connection pool tuned by o.
+func newPooledClient(o poolOptions) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = o.maxIdlePerHost
+	t.IdleConnTimeout = o.idleTimeout
+	t.TLSHandshakeTimeout = o.tlsHandshakeTimeout
+	t.DialContext = (&net.Dialer{
+		Timeout:   o.connectTimeout,
+		KeepAlive: o.keepAlive,
+		Resolver:  o.resolver,
+	}).DialContext
+	return &http.Client{Transport: t, Timeout: o.requestTimeout}
+}
+
+// newResolver returns a resolver asking the DNS server at addr, a host:port,
+// rather than those the system is configured with, as split-horizon DNS may
+// need. An empty addr is the system resolver.
+func newResolver(addr string) (*net.Resolver, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, addr)
+		},
+	}, nil
+}
+
+// getJSON fetches url and decodes its JSON body into v. The request is
+// canceled along with ctx. Responses outside the 2xx range are returned as a
+// *statusError and malformed bodies as a *decodeError, so every provider's
+// failures can be classified the same way. Errors never quote the API keys
+// embedded in url.
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	return upstream.getJSON(ctx, url, nil, v)
+}
+
+// getJSONWith is getJSON, sending header with the request besides.
+func getJSONWith(ctx context.Context, url string, header http.Header, v interface{}) error {
+	return upstream.getJSON(ctx, url, header, v)
+}
+
+func (f *fetcher) getJSON(ctx context.Context, url string, header http.Header, v interface{}) error {
+	if data, ok := payloadsFrom(ctx).load(url); ok {
+		if err := json.Unmarshal(data, v); err != nil {
+			return bodyError(err)
+		}
+		return nil
+	}
+
+	begin := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := f.get(ctx, url, header, v)
+		if err == nil || attempt >= f.retry.attempts || !f.retry.retryable(err) {
+			return err
+		}
+
+		wait := f.retry.backoff << (attempt - 1)
+		if max := f.retry.maxBackoff; max > 0 && (wait > max || wait <= 0) {
+			wait = max // wait <= 0 if the shift overflowed
+		}
+
+		// A throttled request may be told how long to back off for. Retrying
+		// any sooner would only make matters worse.
+		var status *statusError
+		if errors.As(err, &status) && status.retryAfter > wait {
+			if status.retryAfter > f.retry.maxRetryAfter {
+				return err
+			}
+			wait = status.retryAfter
+		}
+
+		if f.retry.budget > 0 && time.Since(begin)+wait > f.retry.budget {
+			return err
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+// acquire takes an upstream request slot, waiting for one to free up if need
+// be. The caller must call the returned func to give it back.
+func (f *fetcher) acquire(ctx context.Context) (release func(), err error) {
+	if f.slots == nil {
+		return func() {}, nil
+	}
+
+	// Don't start a timer when a slot is free, as one usually is.
+	select {
+	case f.slots <- struct{}{}:
+		return func() { <-f.slots }, nil
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if f.queueTimeout > 0 {
+		t := time.NewTimer(f.queueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case f.slots <- struct{}{}:
+		return func() { <-f.slots }, nil
+	case <-timeout:
+		return nil, errOverloaded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (f *fetcher) get(ctx context.Context, url string, header http.Header, v interface{}) error {
+	release, err := f.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return redactError(err)
+	}
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return redactError(err)
+	}
+
+	defer resp.Body.Close()
+	statusFrom(ctx).record(resp.StatusCode)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{
+			code:       resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	body := resp.Body
+	if f.maxBody > 0 {
+		body = http.MaxBytesReader(nil, body, f.maxBody)
+	}
+
+	if maxAge, ok := parseMaxAge(resp.Header.Get("Cache-Control")); ok {
+		freshnessFrom(ctx).record(maxAge)
+	}
+
+	// Read the body whole to log or memoize it, and decode the copy, so the
+	// stream is only read once.
+	memo := payloadsFrom(ctx)
+	if !f.logBodies && memo == nil {
+		if err := json.NewDecoder(body).Decode(v); err != nil {
+			return bodyError(err)
+		}
+		return nil
+	}
+
+	data, err := io.ReadAll(body)
+	if f.logBodies {
+		log.Printf("upstream: %s: %d: %s", secrets.redact(url), resp.StatusCode, secrets.redact(string(data)))
+	}
+	if err != nil {
+		return bodyError(err)
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(v); err != nil {
+		return bodyError(err)
+	}
+	memo.store(url, data)
+	return nil
+}
+
+// bodyError is the *decodeError for a response body that couldn't be read or
+// decoded.
+func bodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		err = fmt.Errorf("response body exceeds %d bytes", tooLarge.Limit)
+	}
+	return &decodeError{err}
+}
+
+// retryable reports whether a failed request might succeed if tried again,
+// by the default statuses; see retryPolicy.retryable.
+func retryable(err error) bool { return retryPolicy{}.retryable(err) }
+
+// retryable reports whether a failed request might succeed if tried again:
+// network errors, truncated responses and the policy's statuses might; other
+// statuses and malformed responses won't, and canceled requests aren't
+// wanted any more. Requests shed for overload fail fast rather than adding
+// to the queue.
+func (p retryPolicy) retryable(err error) bool {
+	var (
+		status *statusError
+		decode *decodeError
+	)
+
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, errOverloaded):
+		return false
+	case errors.As(err, &status):
+		statuses := p.statuses
+		if statuses == nil {
+			statuses, _ = parseStatuses(defaultRetryStatuses)
+		}
+		return statuses[status.code]
+	case errors.As(err, &decode):
+		return decode.truncated()
+	}
+	return true
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date, into how long to wait from now. It is zero if the
+// header is absent, malformed or in the past.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// freshness collects how long the upstream responses behind a lookup say
+// they may be cached for, keeping the shortest.
+type freshness struct {
+	mu       sync.Mutex
+	shortest time.Duration
+	known    bool
+}
+
+type freshnessKey struct{}
+
+// withFreshness returns a context in which getJSON records the freshness of
+// the responses it fetches.
+func withFreshness(ctx context.Context) (context.Context, *freshness) {
+	f := &freshness{}
+	return context.WithValue(ctx, freshnessKey{}, f), f
+}
+
+// freshnessFrom returns the freshness recorded in ctx, or nil if none is.
+func freshnessFrom(ctx context.Context) *freshness {
+	f, _ := ctx.Value(freshnessKey{}).(*freshness)
+	return f
+}
+
+func (f *freshness) record(maxAge time.Duration) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.known || maxAge < f.shortest {
+		f.shortest, f.known = maxAge, true
+	}
+}
+
+// maxAge is the shortest max-age recorded, if any was.
+func (f *freshness) maxAge() (time.Duration, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.shortest, f.known
+}
+
+// upstreamStatus keeps the HTTP status of the last upstream response behind
+// a lookup, successful or not, for diagnosing providers.
+type upstreamStatus struct {
+	mu   sync.Mutex
+	last int
+}
+
+type statusKey struct{}
+
+// withStatus returns a context in which getJSON records the status of the
+// responses it fetches.
+func withStatus(ctx context.Context) (context.Context, *upstreamStatus) {
+	s := &upstreamStatus{}
+	return context.WithValue(ctx, statusKey{}, s), s
+}
+
+// statusFrom returns the status recorded in ctx, or nil if none is.
+func statusFrom(ctx context.Context) *upstreamStatus {
+	s, _ := ctx.Value(statusKey{}).(*upstreamStatus)
+	return s
+}
+
+func (s *upstreamStatus) record(code int) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = code
+}
+
+// code is the last status recorded, or zero if no response was received.
+func (s *upstreamStatus) code() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// payloads memoizes the upstream response bodies fetched on behalf of one
+// request, by URL, so that however many of a provider's fields the request
+// needs, each of its URLs is only fetched once. Only bodies that decoded are
+// kept; a failed request is tried again.
+type payloads struct {
+	mu     sync.Mutex
+	bodies map[string][]byte
+}
+
+type payloadsKey struct{}
+
+// withPayloads returns a context in which getJSON memoizes the bodies it
+// fetches.
+func withPayloads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, payloadsKey{}, &payloads{bodies: map[string][]byte{}})
+}
+
+// payloadsFrom returns the payloads memoized in ctx, or nil if none are.
+func payloadsFrom(ctx context.Context) *payloads {
+	p, _ := ctx.Value(payloadsKey{}).(*payloads)
+	return p
+}
+
+func (p *payloads) load(url string) ([]byte, bool) {
+	if p == nil {
+		return nil, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, ok := p.bodies[url]
+	return data, ok
+}
+
+func (p *payloads) store(url string, data []byte) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bodies[url] = data
+}
+
+// parseMaxAge reads how long a response may be cached for from its
+// Cache-Control header. no-store and no-cache mean not at all.
+func parseMaxAge(h string) (time.Duration, bool) {
+	for _, directive := range strings.Split(h, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "no-cache":
+			return 0, true
+		case strings.HasPrefix(directive, "max-age="):
+			secs, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(directive, "max-age="), `"`))
+			if err != nil || secs < 0 {
+				continue
+			}
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	return 0, false
+}
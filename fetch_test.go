@@ -0,0 +1,974 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// redirectTransport sends every request to target instead of the host it
+// names, leaving the Host header as it was, so that a test server can play
+// every upstream at once and tell them apart by r.Host.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme, r.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// serveUpstream answers every upstream request with h until the test ends,
+// in place of the real providers and geocoders.
+func serveUpstream(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	target, _ := url.Parse(ts.URL)
+	prev := http.DefaultClient.Transport
+	http.DefaultClient.Transport = redirectTransport{target}
+	t.Cleanup(func() { http.DefaultClient.Transport = prev })
+	return ts
+}
+
+// upstreamLog records the URLs of the upstream requests a test server was
+// sent.
+type upstreamLog struct {
+	mu   sync.Mutex
+	urls []*url.URL
+}
+
+// requests are the URLs requested so far, their hosts being those of the
+// upstreams asked.
+func (l *upstreamLog) requests() []*url.URL {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*url.URL(nil), l.urls...)
+}
+
+// servePayloads answers upstream requests with the body payloads holds for
+// their host, or 404 for hosts it has none for, and logs each request.
+func servePayloads(t *testing.T, payloads map[string]string) *upstreamLog {
+	t.Helper()
+	l := &upstreamLog{}
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		u := *r.URL
+		u.Host = r.Host
+		l.mu.Lock()
+		l.urls = append(l.urls, &u)
+		l.mu.Unlock()
+
+		body, ok := payloads[r.Host]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	})
+	return l
+}
+
+func TestGetJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string // the category, or empty for success
+	}{
+		{"success", http.StatusOK, `{"temp": 280}`, ""},
+		{"not found", http.StatusNotFound, `{}`, errClient},
+		{"unavailable", http.StatusServiceUnavailable, `{}`, errServer},
+		{"malformed body", http.StatusOK, `{"temp": ]`, errDecode},
+		{"truncated body", http.StatusOK, `{"temp": `, errTruncate},
+		{"not JSON", http.StatusOK, `<html>`, errDecode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			})
+
+			var v struct{ Temp float64 }
+			err := getJSON(context.Background(), "http://api.openweathermap.org/data/2.5/weather", &v)
+			switch {
+			case tt.wantErr == "" && (err != nil || v.Temp != 280):
+				t.Errorf("got %+v, %v; want 280", v, err)
+			case tt.wantErr != "" && (err == nil || classifyError(err) != tt.wantErr):
+				t.Errorf("error %v, want one of category %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("canceled", func(t *testing.T) {
+		serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var v struct{}
+		if err := getJSON(ctx, "http://api.openweathermap.org/", &v); !errors.Is(err, context.Canceled) {
+			t.Errorf("error %v, want %v", err, context.Canceled)
+		}
+	})
+}
+
+// throttlingServer answers its first request with 429 and Retry-After: 2, and
+// the rest with a reading, counting them.
+func throttlingServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "2")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		io.WriteString(w, `{"temp": 285}`)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &requests
+}
+
+func TestRetryAfterHonored(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxRetryAfter time.Duration
+		ctxTimeout    time.Duration
+		wantRequests  int32
+		minWait       time.Duration
+		maxWait       time.Duration
+		wantStatus    int
+	}{
+		{"waited for", 5 * time.Second, 0, 2, 2 * time.Second, 4 * time.Second, 0},
+		{"too long to wait", time.Second, 0, 1, 0, time.Second, http.StatusTooManyRequests},
+		{"context ends first", 5 * time.Second, 100 * time.Millisecond, 1, 0, time.Second, http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, requests := throttlingServer(t)
+			f := &fetcher{
+				client: ts.Client(),
+				retry:  retryPolicy{attempts: 3, backoff: time.Millisecond, maxRetryAfter: tt.maxRetryAfter},
+			}
+
+			ctx := context.Background()
+			if tt.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.ctxTimeout)
+				defer cancel()
+			}
+
+			var v struct{ Temp float64 }
+			begin := time.Now()
+			err := f.getJSON(ctx, ts.URL, nil, &v)
+			took := time.Since(begin)
+
+			var status *statusError
+			switch {
+			case tt.wantStatus == 0 && err != nil:
+				t.Fatalf("error %v", err)
+			case tt.wantStatus == 0 && v.Temp != 285:
+				t.Errorf("temp %v, want 285", v.Temp)
+			case tt.wantStatus != 0 && (!errors.As(err, &status) || status.code != tt.wantStatus):
+				t.Errorf("error %v, want status %d", err, tt.wantStatus)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("%d requests, want %d", n, tt.wantRequests)
+			}
+			if took < tt.minWait || took > tt.maxWait {
+				t.Errorf("took %s, want between %s and %s", took, tt.minWait, tt.maxWait)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		h    string
+		want time.Duration
+	}{
+		{"", 0},
+		{"2", 2 * time.Second},
+		{" 120 ", 2 * time.Minute},
+		{"-1", 0},
+		{"soon", 0},
+		{"Wed, 14 Oct 2026 12:00:30 GMT", 30 * time.Second},
+		{"Wed, 14 Oct 2026 11:59:00 GMT", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.h, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.h, got, tt.want)
+		}
+	}
+}
+
+// holdingServer answers each request once release is closed, or after hold
+// if that is sooner, tracking how many requests it has in hand at once.
+type holdingServer struct {
+	*httptest.Server
+	release  chan struct{}
+	requests atomic.Int32
+	inFlight atomic.Int32
+	peak     atomic.Int32
+}
+
+func newHoldingServer(t *testing.T, hold time.Duration) *holdingServer {
+	t.Helper()
+	s := &holdingServer{release: make(chan struct{})}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		n := s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		for {
+			peak := s.peak.Load()
+			if n <= peak || s.peak.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+
+		select {
+		case <-s.release:
+		case <-time.After(hold):
+		case <-r.Context().Done():
+		}
+		io.WriteString(w, `{"temp": 285}`)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestUpstreamConcurrencyCapped(t *testing.T) {
+	ts := newHoldingServer(t, 50*time.Millisecond)
+	f := &fetcher{client: ts.Client(), slots: newSlots(2)}
+
+	const requests = 6
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			var v struct{ Temp float64 }
+			errs <- f.getJSON(context.Background(), ts.URL, nil, &v)
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("request waiting its turn failed: %v", err)
+		}
+	}
+	if peak := ts.peak.Load(); peak != 2 {
+		t.Errorf("%d upstream requests in flight at once, want the cap of 2", peak)
+	}
+	if n := ts.requests.Load(); n != requests {
+		t.Errorf("%d upstream requests, want %d", n, requests)
+	}
+}
+
+func TestUpstreamQueueRespectsContext(t *testing.T) {
+	ts := newHoldingServer(t, time.Minute)
+	defer close(ts.release)
+	f := &fetcher{client: ts.Client(), slots: newSlots(1)}
+
+	// Take the only slot, and leave it taken.
+	go func() {
+		var v struct{}
+		f.getJSON(context.Background(), ts.URL, nil, &v)
+	}()
+	for ts.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var v struct{}
+	if err := f.getJSON(ctx, ts.URL, nil, &v); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want the deadline passing while queued", err)
+	}
+	if n := ts.requests.Load(); n != 1 {
+		t.Errorf("%d upstream requests, want only the one holding the slot", n)
+	}
+}
+
+func TestUpstreamQueueTimesOut(t *testing.T) {
+	ts := newHoldingServer(t, time.Minute)
+	defer close(ts.release)
+	f := &fetcher{client: ts.Client(), slots: newSlots(1), queueTimeout: 20 * time.Millisecond}
+
+	go func() {
+		var v struct{}
+		f.getJSON(context.Background(), ts.URL, nil, &v)
+	}()
+	for ts.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var v struct{}
+	err := f.getJSON(context.Background(), ts.URL, nil, &v)
+	if !errors.Is(err, errOverloaded) {
+		t.Fatalf("error %v, want %v", err, errOverloaded)
+	}
+	if status := errorStatus(err); status != http.StatusServiceUnavailable {
+		t.Errorf("answered with %d, want %d", status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRetriesBounded(t *testing.T) {
+	tests := []struct {
+		name         string
+		retry        retryPolicy
+		wantRequests int32
+		minTook      time.Duration
+		maxTook      time.Duration
+	}{
+		// Waits of 20ms and 40ms fit in the budget; the next, of 80ms,
+		// would overrun it.
+		{"budget", retryPolicy{attempts: 10, backoff: 20 * time.Millisecond, budget: 100 * time.Millisecond}, 3, 60 * time.Millisecond, 100 * time.Millisecond},
+		{"capped backoff", retryPolicy{attempts: 4, backoff: 20 * time.Millisecond, maxBackoff: 25 * time.Millisecond}, 4, 70 * time.Millisecond, 140 * time.Millisecond},
+		{"attempts", retryPolicy{attempts: 3, backoff: time.Millisecond}, 3, 0, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				http.Error(w, "try later", http.StatusServiceUnavailable)
+			}))
+			defer ts.Close()
+			f := &fetcher{client: ts.Client(), retry: tt.retry}
+
+			var v struct{}
+			begin := time.Now()
+			err := f.getJSON(context.Background(), ts.URL, nil, &v)
+			took := time.Since(begin)
+
+			var status *statusError
+			if !errors.As(err, &status) || status.code != http.StatusServiceUnavailable {
+				t.Errorf("error %v, want the last 503", err)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("%d requests, want %d", n, tt.wantRequests)
+			}
+			if took < tt.minTook || took > tt.maxTook {
+				t.Errorf("took %s, want between %s and %s", took, tt.minTook, tt.maxTook)
+			}
+		})
+	}
+}
+
+func TestPooledClientReusesConnections(t *testing.T) {
+	tests := []struct {
+		name      string
+		idle      time.Duration
+		pause     time.Duration
+		wantConns int32
+	}{
+		{"reused", time.Minute, 0, 1},
+		{"closed once idle too long", 10 * time.Millisecond, 50 * time.Millisecond, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns atomic.Int32
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, `{"temp": 285}`)
+			}))
+			ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			ts.Start()
+			defer ts.Close()
+
+			f := &fetcher{client: newPooledClient(poolOptions{
+				maxIdlePerHost: 4,
+				idleTimeout:    tt.idle,
+				keepAlive:      30 * time.Second,
+			})}
+			for i := 0; i < 3; i++ {
+				if i > 0 {
+					time.Sleep(tt.pause)
+				}
+				var v struct{ Temp float64 }
+				if err := f.getJSON(context.Background(), ts.URL, nil, &v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := conns.Load(); n != tt.wantConns {
+				t.Errorf("%d connections for 3 requests, want %d", n, tt.wantConns)
+			}
+		})
+	}
+}
+
+func TestOversizedBodiesRejected(t *testing.T) {
+	huge := `{"temp": 285, "padding": "` + strings.Repeat("x", 1<<20) + `"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/huge" {
+			io.WriteString(w, huge)
+			return
+		}
+		io.WriteString(w, `{"temp": 285}`)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name      string
+		path      string
+		maxBody   int64
+		logBodies bool
+		wantErr   bool
+	}{
+		{"within the cap", "/small", 1024, false, false},
+		{"over the cap", "/huge", 1024, false, true},
+		{"over the cap, logged", "/huge", 1024, true, true},
+		{"no cap", "/huge", 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.logBodies {
+				captureLog(t)
+			}
+			f := &fetcher{client: ts.Client(), maxBody: tt.maxBody, logBodies: tt.logBodies}
+			var v struct{ Temp float64 }
+			err := f.getJSON(context.Background(), ts.URL+tt.path, nil, &v)
+
+			var decode *decodeError
+			switch {
+			case !tt.wantErr && err != nil:
+				t.Fatalf("error %v", err)
+			case !tt.wantErr && v.Temp != 285:
+				t.Errorf("temp %v, want 285", v.Temp)
+			case tt.wantErr && (!errors.As(err, &decode) || !strings.Contains(err.Error(), "exceeds 1024 bytes")):
+				t.Errorf("error %v, want the body rejected as over 1024 bytes", err)
+			}
+		})
+	}
+}
+
+func TestTruncatedBodies(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		wantTruncated bool
+		wantRequests  int32
+	}{
+		{"cut off", `{"main":{"temp":28`, true, 2},
+		{"cut off in a string", `{"name":"Par`, true, 2},
+		{"malformed throughout", `<html>busy</html>`, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				io.WriteString(w, tt.body)
+			}))
+			t.Cleanup(ts.Close)
+			f := &fetcher{client: ts.Client(), retry: retryPolicy{attempts: 2, backoff: time.Millisecond}}
+
+			var v struct{}
+			err := f.getJSON(context.Background(), ts.URL, nil, &v)
+			var decode *decodeError
+			if !errors.As(err, &decode) {
+				t.Fatalf("error %v, want a decodeError", err)
+			}
+			if decode.truncated() != tt.wantTruncated {
+				t.Errorf("truncated %v, want %v, for %v", decode.truncated(), tt.wantTruncated, err)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("%d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestTruncatedProviderSkipped(t *testing.T) {
+	servePayloads(t, map[string]string{"api.openweathermap.org": `{"main":{"temp":28`})
+	cfg := testConfig(t)
+	cfg.minProviders = 1
+	// The default client now goes upstream, so the server is asked directly.
+	s, _ := newTestServer(t, cfg, nil,
+		openWeatherMap{keys: newKeyRing("KEY")}, &fakeProvider{name: "alpha", kelvin: 285})
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/Paris", nil))
+
+	var got struct {
+		Partial bool
+		Failed  []struct{ Provider, Error string }
+		Sources []string
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200 from the provider left", rec.Code)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Partial || len(got.Failed) != 1 || got.Failed[0].Provider != "openWeatherMap" ||
+		!strings.Contains(got.Failed[0].Error, "unexpected EOF") {
+		t.Errorf("failed %+v, want openWeatherMap's truncated body", got.Failed)
+	}
+	if len(got.Sources) != 1 || got.Sources[0] != "alpha" {
+		t.Errorf("sources %v, want [alpha]", got.Sources)
+	}
+}
+
+func TestProviderHeadersSent(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[string]http.Header{}
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sent[r.Host] = r.Header.Clone()
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"main":{"temp":285},"current_observation":{"temp_c":12}}`)
+	})
+
+	captureLog(t)
+	cfg := testConfigFromEnv(t, map[string]string{
+		"OPEN_WEATHER_MAP_KEY":     "KEY",
+		"WEATHER_UNDERGROUND_KEY":  "KEY",
+		"WEATHER_PROVIDER_HEADERS": "openWeatherMap:X-Proxy-Token=abc; openWeatherMap:Origin=https://example.com",
+	})
+	for _, p := range newProviders(cfg, nil)[:2] {
+		if _, err := p.temperature(context.Background(), "Paris"); err != nil {
+			t.Fatalf("%s: %v", p.Name(), err)
+		}
+	}
+
+	tests := []struct {
+		host, header, want string
+	}{
+		{"api.openweathermap.org", "X-Proxy-Token", "abc"},
+		{"api.openweathermap.org", "Origin", "https://example.com"},
+		{"api.wunderground.com", "X-Proxy-Token", ""},
+		{"api.wunderground.com", "Origin", ""},
+	}
+	for _, tt := range tests {
+		if got := sent[tt.host].Get(tt.header); got != tt.want {
+			t.Errorf("%s: %s %q, want %q", tt.host, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRetriedStatuses(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     string // configured, or empty for the default
+		status       int
+		wantRequests int32
+	}{
+		{"400 not retried", "", http.StatusBadRequest, 1},
+		{"401 not retried", "", http.StatusUnauthorized, 1},
+		{"403 not retried", "", http.StatusForbidden, 1},
+		{"404 not retried", "", http.StatusNotFound, 1},
+		{"408 retried", "", http.StatusRequestTimeout, 3},
+		{"429 retried", "", http.StatusTooManyRequests, 3},
+		{"500 retried", "", http.StatusInternalServerError, 3},
+		{"502 retried", "", http.StatusBadGateway, 3},
+		{"503 retried", "", http.StatusServiceUnavailable, 3},
+		{"504 retried", "", http.StatusGatewayTimeout, 3},
+		{"configured 503 retried", "503", http.StatusServiceUnavailable, 3},
+		{"unconfigured 500 not retried", "503", http.StatusInternalServerError, 1},
+		{"configured 404 retried", "404, 503", http.StatusNotFound, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.WriteHeader(tt.status)
+			}))
+			t.Cleanup(ts.Close)
+
+			retry := retryPolicy{attempts: 3, backoff: time.Millisecond}
+			if tt.statuses != "" {
+				var err error
+				if retry.statuses, err = parseStatuses(tt.statuses); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f := &fetcher{client: ts.Client(), retry: retry}
+
+			var v struct{}
+			err := f.getJSON(context.Background(), ts.URL, nil, &v)
+			var status *statusError
+			if !errors.As(err, &status) || status.code != tt.status {
+				t.Errorf("error %v, want status %d", err, tt.status)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("%d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestNetworkErrorsRetried(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL
+	ts.Close()
+
+	var dials atomic.Int32
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	f := &fetcher{client: client, retry: retryPolicy{attempts: 3, backoff: time.Millisecond}}
+
+	var v struct{}
+	if err := f.getJSON(context.Background(), url, nil, &v); err == nil {
+		t.Fatal("fetched from a closed server")
+	}
+	if n := dials.Load(); n != 3 {
+		t.Errorf("%d dials, want 3", n)
+	}
+}
+
+func TestParseStatuses(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{defaultRetryStatuses, "map[408:true 429:true 500:true 502:true 503:true 504:true]", false},
+		{" 503 , 429 ", "map[429:true 503:true]", false},
+		{"", "map[]", false},
+		{"503,teapot", "", true},
+		{"99", "", true},
+		{"600", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseStatuses(tt.s)
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("parseStatuses(%q) = %v, want an error", tt.s, got)
+		case !tt.wantErr && (err != nil || fmt.Sprint(got) != tt.want):
+			t.Errorf("parseStatuses(%q) = %v, %v; want %s", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+// serveDNS answers DNS queries over UDP until the test ends, resolving every
+// name to 127.0.0.1, and records the names asked after.
+func serveDNS(t *testing.T) (addr string, names func() []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var mu sync.Mutex
+	var asked []string
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := buf[:n]
+
+			// The question follows the 12-byte header: the name as
+			// length-prefixed labels, then its type and class.
+			var labels []string
+			i := 12
+			for i < len(q) && q[i] != 0 {
+				labels = append(labels, string(q[i+1:i+1+int(q[i])]))
+				i += 1 + int(q[i])
+			}
+			if i+5 > len(q) {
+				continue
+			}
+			question := q[12 : i+5]
+			isA := q[i+1] == 0 && q[i+2] == 1
+			if isA {
+				mu.Lock()
+				asked = append(asked, strings.Join(labels, "."))
+				mu.Unlock()
+			}
+
+			resp := append([]byte{q[0], q[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, question...)
+			if isA {
+				resp[7] = 1
+				resp = append(resp,
+					0xc0, 12, // the name, as a pointer to the question's
+					0, 1, 0, 1, // type A, class IN
+					0, 0, 0, 60, // TTL
+					0, 4, 127, 0, 0, 1)
+			}
+			conn.WriteTo(resp, from)
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), asked...)
+	}
+}
+
+func TestCustomResolver(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"temp": 285}`)
+	}))
+	t.Cleanup(ts.Close)
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+
+	dns, asked := serveDNS(t)
+	resolver, err := newResolver(dns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fetcher{client: newPooledClient(poolOptions{resolver: resolver})}
+
+	var v struct{ Temp float64 }
+	if err := f.getJSON(context.Background(), "http://weather.internal.test:"+port+"/", nil, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Temp != 285 {
+		t.Errorf("temp %v, want 285", v.Temp)
+	}
+	if got := fmt.Sprint(asked()); got != "[weather.internal.test]" {
+		t.Errorf("names resolved %s, want [weather.internal.test]", got)
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	tests := []struct {
+		addr       string
+		wantSystem bool
+		wantErr    bool
+	}{
+		{"", true, false},
+		{"10.0.0.53:53", false, false},
+		{"[fd00::53]:5353", false, false},
+		{"10.0.0.53", false, true},
+	}
+	for _, tt := range tests {
+		r, err := newResolver(tt.addr)
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("newResolver(%q) succeeded, want an error", tt.addr)
+		case !tt.wantErr && err != nil:
+			t.Errorf("newResolver(%q): %v", tt.addr, err)
+		case !tt.wantErr && (r == nil) != tt.wantSystem:
+			t.Errorf("newResolver(%q) = %v, want the system resolver: %v", tt.addr, r, tt.wantSystem)
+		}
+	}
+}
+
+func TestBodiesLogged(t *testing.T) {
+	prev := secrets
+	secrets = &secretSet{}
+	t.Cleanup(func() { secrets = prev })
+	secrets.add("s3cr3t-key")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"temp": 285, "echo": "s3cr3t-key"}`)
+	}))
+	t.Cleanup(ts.Close)
+
+	tests := []struct {
+		name      string
+		logBodies bool
+		want      string // logged, or empty for nothing
+	}{
+		{"enabled", true, `upstream: ` + ts.URL + `/weather?APPID=***: 200: {"temp": 285, "echo": "***"}`},
+		{"disabled", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			f := &fetcher{client: ts.Client(), logBodies: tt.logBodies}
+
+			var v struct{ Temp float64 }
+			if err := f.getJSON(context.Background(), ts.URL+"/weather?APPID=s3cr3t-key", nil, &v); err != nil {
+				t.Fatal(err)
+			}
+			if v.Temp != 285 {
+				t.Errorf("temp %v, want 285, from the body as logged", v.Temp)
+			}
+			got := logs.String()
+			switch {
+			case strings.Contains(got, "s3cr3t-key"):
+				t.Errorf("logged %q, quoting the key", got)
+			case tt.want == "" && got != "":
+				t.Errorf("logged %q, want nothing", got)
+			case tt.want != "" && !strings.Contains(got, tt.want):
+				t.Errorf("logged %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPooledClientCarriesTimeouts(t *testing.T) {
+	c := newPooledClient(poolOptions{
+		maxIdlePerHost:      8,
+		idleTimeout:         time.Minute,
+		connectTimeout:      2 * time.Second,
+		tlsHandshakeTimeout: 3 * time.Second,
+		requestTimeout:      4 * time.Second,
+	})
+	transport, ok := c.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transport %T, want an *http.Transport", c.Transport)
+	}
+	if transport == http.DefaultTransport {
+		t.Error("the default transport changed in place, want a clone")
+	}
+	if transport.TLSHandshakeTimeout != 3*time.Second || c.Timeout != 4*time.Second {
+		t.Errorf("TLS handshake timeout %s, request timeout %s; want 3s and 4s", transport.TLSHandshakeTimeout, c.Timeout)
+	}
+	if transport.MaxIdleConnsPerHost != 8 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("%d idle connections per host for %s, want 8 for 1m", transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
+
+func TestUpstreamTimeouts(t *testing.T) {
+	// A server that accepts connections but never completes a TLS
+	// handshake on them.
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { silent.Close() })
+	go func() {
+		for {
+			conn, err := silent.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	// A server that sends its headers, then stalls on its body.
+	stalling := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"temp": `)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(stalling.Close)
+
+	// A resolver whose DNS server never answers.
+	unanswered := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+
+	tests := []struct {
+		name    string
+		url     string
+		o       poolOptions
+		wantErr string
+	}{
+		{"connecting", "http://weather.unresolved.test/", poolOptions{resolver: unanswered, connectTimeout: 50 * time.Millisecond}, "i/o timeout"},
+		{"TLS handshake", "https://" + silent.Addr().String() + "/", poolOptions{tlsHandshakeTimeout: 50 * time.Millisecond}, "TLS handshake timeout"},
+		{"whole request", stalling.URL, poolOptions{requestTimeout: 50 * time.Millisecond}, "Client.Timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fetcher{client: newPooledClient(tt.o)}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			var v struct{ Temp float64 }
+			begin := time.Now()
+			err := f.getJSON(ctx, tt.url, nil, &v)
+			took := time.Since(begin)
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error %v, want one containing %q", err, tt.wantErr)
+			}
+			if took > 2*time.Second {
+				t.Errorf("gave up after %s, want about 50ms: %v", took, err)
+			}
+		})
+	}
+}
+
+func TestPayloadsMemoized(t *testing.T) {
+	tests := []struct {
+		name         string
+		memoized     bool
+		status       int
+		wantRequests int32
+	}{
+		{"memoized", true, http.StatusOK, 1},
+		{"not memoized", false, http.StatusOK, 2},
+		{"failures not memoized", true, http.StatusNotFound, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, `{"temp": 285, "humidity": 60}`)
+			}))
+			t.Cleanup(ts.Close)
+			f := &fetcher{client: ts.Client()}
+
+			ctx := context.Background()
+			if tt.memoized {
+				ctx = withPayloads(ctx)
+			}
+			var temp struct{ Temp float64 }
+			var humidity struct{ Humidity float64 }
+			err1 := f.getJSON(ctx, ts.URL, nil, &temp)
+			err2 := f.getJSON(ctx, ts.URL, nil, &humidity)
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("%d requests, want %d", n, tt.wantRequests)
+			}
+			if tt.status == http.StatusOK && (err1 != nil || err2 != nil || temp.Temp != 285 || humidity.Humidity != 60) {
+				t.Errorf("decoded %v and %v, %v, %v; want 285 and 60 from the one body", temp, humidity, err1, err2)
+			}
+		})
+	}
+}
+
+func TestOneCallPerProvider(t *testing.T) {
+	sent := servePayloads(t, map[string]string{
+		"api.openweathermap.org": `{"main": {"temp": 285, "humidity": 60, "pressure": 1013}, "wind": {"speed": 4}, "clouds": {"all": 40}}`,
+		"api.wunderground.com":   `{"current_observation": {"temp_c": 12, "relative_humidity": "65%", "wind_kph": 14, "pressure_in": "30.01"}}`,
+	})
+	keys := newKeyRing("KEY")
+	// The default client now goes upstream, so the server is asked directly.
+	s, _ := newTestServer(t, testConfig(t), nil, openWeatherMap{keys: keys}, weatherUnderground{keys: keys})
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/conditions/Paris", nil))
+
+	var got struct {
+		Humidity  *float64 `json:"humidity"`
+		WindSpeed *float64 `json:"wind_speed_ms"`
+		Pressure  *float64 `json:"pressure_hpa"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Humidity == nil || got.WindSpeed == nil || got.Pressure == nil {
+		t.Fatalf("conditions %+v, want humidity, wind and pressure", got)
+	}
+
+	calls := map[string]int{}
+	for _, u := range sent.requests() {
+		calls[u.Host]++
+	}
+	if fmt.Sprint(calls) != "map[api.openweathermap.org:1 api.wunderground.com:1]" {
+		t.Errorf("upstream calls %v, want one per provider", calls)
+	}
+}
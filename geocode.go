@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Geocoder resolves a free-form address, such as a city name, to coordinates.
+// If region, a country code, is set, results must be there; if bias is, a
+// result there is preferred, but one elsewhere will do. It also goes the
+// other way, naming the place at a pair of coordinates.
+type Geocoder interface {
+	geocode(ctx context.Context, address, region, bias string) (lat, lon float64, err error)
+	reverse(ctx context.Context, lat, lon float64) (place string, err error)
+}
+
+type googleGeocoder struct {
+	apiKey string
+}
+
+func (g googleGeocoder) geocode(ctx context.Context, address, region, bias string) (float64, float64, error) {
+	params := "address=" + url.QueryEscape(address)
+	switch {
+	case region != "":
+		params += "&components=country:" + url.QueryEscape(region)
+	case bias != "":
+		params += "&region=" + url.QueryEscape(strings.ToLower(bias))
+	}
+
+	var d struct {
+		Results []struct {
+			Geometry struct {
+				Location struct {
+					Lat float64
+					Lng float64
+				}
+			}
+		}
+	}
+
+	if err := getJSON(ctx, "https://maps.googleapis.com/maps/api/geocode/json?"+params+"&key="+g.apiKey, &d); err != nil {
+		return 0, 0, err
+	}
+
+	if len(d.Results) == 0 {
+		return 0, 0, ErrCityNotFound
+	}
+
+	lat := d.Results[0].Geometry.Location.Lat
+	lon := d.Results[0].Geometry.Location.Lng
+
+	return lat, lon, nil
+}
+
+// reverse names the locality at lat and lon, such as "London", falling back
+// to the full address when there is no locality there.
+func (g googleGeocoder) reverse(ctx context.Context, lat, lon float64) (string, error) {
+	params := "latlng=" + url.QueryEscape(coordinates{lat, lon}.String())
+
+	var d struct {
+		Results []struct {
+			FormattedAddress  string `json:"formatted_address"`
+			AddressComponents []struct {
+				LongName string   `json:"long_name"`
+				Types    []string `json:"types"`
+			} `json:"address_components"`
+		}
+	}
+
+	if err := getJSON(ctx, "https://maps.googleapis.com/maps/api/geocode/json?"+params+"&key="+g.apiKey, &d); err != nil {
+		return "", err
+	}
+
+	if len(d.Results) == 0 {
+		return "", ErrCityNotFound
+	}
+
+	for _, r := range d.Results {
+		for _, c := range r.AddressComponents {
+			for _, t := range c.Types {
+				if t == "locality" {
+					return c.LongName, nil
+				}
+			}
+		}
+	}
+
+	return d.Results[0].FormattedAddress, nil
+}
+
+// openMeteoGeocoder resolves addresses with Open-Meteo's geocoding API,
+// which needs no key. It only knows place names, so it can't reverse
+// geocode.
+type openMeteoGeocoder struct{}
+
+// errNoReverse is returned by geocoders that can't name a place from its
+// coordinates.
+var errNoReverse = errors.New("reverse geocoding is not supported")
+
+func (g openMeteoGeocoder) geocode(ctx context.Context, address, region, bias string) (float64, float64, error) {
+	var d struct {
+		Results []struct {
+			Latitude    float64 `json:"latitude"`
+			Longitude   float64 `json:"longitude"`
+			Country     string  `json:"country"`
+			CountryCode string  `json:"country_code"`
+		} `json:"results"`
+	}
+
+	// Open-Meteo matches the name of the place alone, as in "Paris" rather
+	// than "Paris,France". Ask for a few matches, so that one in region can
+	// be chosen; regions may be given by name or code, so both are compared.
+	name := strings.TrimSpace(strings.SplitN(address, ",", 2)[0])
+	params := url.Values{"name": {name}, "count": {"10"}, "format": {"json"}}
+	if err := getJSON(ctx, "https://geocoding-api.open-meteo.com/v1/search?"+params.Encode(), &d); err != nil {
+		return 0, 0, err
+	}
+
+	in := func(country string) int {
+		for i, r := range d.Results {
+			if strings.EqualFold(r.CountryCode, country) || strings.EqualFold(r.Country, country) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	i := 0
+	switch {
+	case region != "":
+		i = in(region)
+	case bias != "":
+		if i = in(bias); i < 0 {
+			i = 0
+		}
+	}
+	if i < 0 || i >= len(d.Results) {
+		return 0, 0, ErrCityNotFound
+	}
+	return d.Results[i].Latitude, d.Results[i].Longitude, nil
+}
+
+func (g openMeteoGeocoder) reverse(ctx context.Context, lat, lon float64) (string, error) {
+	return "", errNoReverse
+}
+
+// fallbackGeocoder tries each of its geocoders in turn, until one succeeds.
+// If none does, the first one's error is returned.
+type fallbackGeocoder []Geocoder
+
+func (f fallbackGeocoder) geocode(ctx context.Context, address, region, bias string) (float64, float64, error) {
+	var firstErr error
+	for _, g := range f {
+		lat, lon, err := g.geocode(ctx, address, region, bias)
+		if err == nil {
+			return lat, lon, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errNoGeocoders
+	}
+	return 0, 0, firstErr
+}
+
+func (f fallbackGeocoder) reverse(ctx context.Context, lat, lon float64) (string, error) {
+	var firstErr error
+	for _, g := range f {
+		place, err := g.reverse(ctx, lat, lon)
+		if err == nil {
+			return place, nil
+		}
+		// A geocoder that can't reverse geocode at all has nothing to say
+		// about why the others failed.
+		if firstErr == nil && !errors.Is(err, errNoReverse) {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errNoReverse
+	}
+	return "", firstErr
+}
+
+// maxGeocodeBatch is how many geocoding lookups geocodeAll makes at once,
+// so that a long list of places doesn't burst past a geocoder's rate limit.
+const maxGeocodeBatch = 4
+
+// geocoded is the outcome of geocoding one place.
+type geocoded struct {
+	coords coordinates
+	err    error
+}
+
+// geocodeAll geocodes several places at once, up to maxGeocodeBatch at a
+// time, and returns each one's outcome in the same order. Given a
+// cachedGeocoder, it leaves them all cached, so that lookups of the places
+// that follow needn't wait on the geocoder in turn. Places with coordinates
+// already are passed through as they are.
+func geocodeAll(ctx context.Context, g Geocoder, places []query) []geocoded {
+	out := make([]geocoded, len(places))
+	slots := make(chan struct{}, maxGeocodeBatch)
+
+	var wg sync.WaitGroup
+	for i, q := range places {
+		if q.coords != nil {
+			out[i].coords = *q.coords
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, q query) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				out[i].err = ctx.Err()
+				return
+			}
+
+			lat, lon, err := g.geocode(ctx, q.address(), q.country, q.regionBias())
+			out[i] = geocoded{coordinates{lat, lon}, err}
+		}(i, q)
+	}
+	wg.Wait()
+	return out
+}
+
+// errNoGeocoders is returned when an address must be geocoded but no
+// geocoder is configured.
+var errNoGeocoders = errors.New("no geocoders configured")
+
+// geocoderNames are the geocoders WEATHER_GEOCODERS may list.
+var geocoderNames = []string{"google", "openMeteo"}
+
+// newGeocoders returns the geocoders named, in order, as a fallbackGeocoder,
+// each bounded by timeout unless it is zero. Google is skipped without an
+// API key, so that the default list falls back to Open-Meteo rather than
+// failing every lookup.
+func newGeocoders(names []string, googleKey string, timeout time.Duration) (fallbackGeocoder, error) {
+	var f fallbackGeocoder
+	for _, name := range names {
+		var g Geocoder
+		switch name {
+		case "google":
+			if googleKey == "" {
+				continue
+			}
+			g = googleGeocoder{apiKey: googleKey}
+		case "openMeteo":
+			g = openMeteoGeocoder{}
+		default:
+			return nil, fmt.Errorf("unknown geocoder %q; want one of %s", name, strings.Join(geocoderNames, ", "))
+		}
+
+		if timeout > 0 {
+			g = timeoutGeocoder{g, timeout}
+		}
+		f = append(f, g)
+	}
+	return f, nil
+}
+
+// timeoutGeocoder bounds each of a geocoder's lookups, on top of whatever
+// deadline the caller's context has, so that a hung geocoder fails in time
+// for the next one to be tried.
+type timeoutGeocoder struct {
+	Geocoder
+	timeout time.Duration
+}
+
+func (g timeoutGeocoder) geocode(ctx context.Context, address, region, bias string) (float64, float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	return g.Geocoder.geocode(ctx, address, region, bias)
+}
+
+func (g timeoutGeocoder) reverse(ctx context.Context, lat, lon float64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	return g.Geocoder.reverse(ctx, lat, lon)
+}
+
+// cachedGeocoder remembers the coordinates of addresses it has resolved.
+// Addresses are normalized before lookup, so "London", "london " and
+// "LONDON" share an entry.
+//
+// When precision is non-zero, results are also bucketed by a geohash of that
+// many characters: every address resolving into the same bucket is answered
+// with the coordinates of the first one, so near-identical inputs agree.
+//
+// It holds at most maxGeocodeEntries addresses, buckets and reverse lookups
+// each, so its memory stays bounded whatever places are asked after.
+type cachedGeocoder struct {
+	geocoder  Geocoder
+	precision int
+
+	mu      sync.Mutex
+	entries map[string]coordinates
+	buckets map[string]coordinates
+	places  map[string]string // reverse lookups, by coordinates
+}
+
+const maxGeocodeEntries = 10000
+
+type coordinates struct {
+	lat, lon float64
+}
+
+func (c coordinates) String() string {
+	return fmt.Sprint(c.lat) + "," + fmt.Sprint(c.lon)
+}
+
+// earthRadius is the Earth's mean radius, in meters.
+const earthRadius = 6371008.8
+
+// distanceTo is the great-circle distance from c to o, in meters, by the
+// haversine formula.
+func (c coordinates) distanceTo(o coordinates) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLon := rad(o.lat-c.lat), rad(o.lon-c.lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(c.lat))*math.Cos(rad(o.lat))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(h, 1)))
+}
+
+func newCachedGeocoder(g Geocoder, precision int) *cachedGeocoder {
+	return &cachedGeocoder{
+		geocoder:  g,
+		precision: precision,
+		entries:   map[string]coordinates{},
+		buckets:   map[string]coordinates{},
+		places:    map[string]string{},
+	}
+}
+
+func (c *cachedGeocoder) geocode(ctx context.Context, address, region, bias string) (float64, float64, error) {
+	key := normalizeAddress(address) + "|" + strings.ToLower(region) + "|" + strings.ToLower(bias)
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return e.lat, e.lon, nil
+	}
+
+	lat, lon, err := c.geocoder.geocode(ctx, address, region, bias)
+	if err != nil {
+		return 0, 0, err
+	}
+	e = coordinates{lat, lon}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.precision > 0 {
+		hash := geohash(lat, lon, c.precision)
+		if b, ok := c.buckets[hash]; ok {
+			e = b
+		} else {
+			makeRoom(c.buckets, hash)
+			c.buckets[hash] = e
+		}
+	}
+	makeRoom(c.entries, key)
+	c.entries[key] = e
+
+	return e.lat, e.lon, nil
+}
+
+// makeRoom evicts an entry of m if it is full and key is a new one, so that
+// key can be added. A geocode never goes stale, so there is no better entry
+// to evict than any. The caller must hold the cache's lock.
+func makeRoom(m map[string]coordinates, key string) {
+	if _, ok := m[key]; ok || len(m) < maxGeocodeEntries {
+		return
+	}
+	for k := range m {
+		delete(m, k)
+		return
+	}
+}
+
+// flush forgets the coordinates of q's address, in any region, or of every
+// address if q is nil, and reports how many entries it forgot. Forgetting
+// every address forgets the reverse lookups and geohash buckets too.
+func (c *cachedGeocoder) flush(q *query) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if q == nil {
+		n := len(c.entries) + len(c.places)
+		c.entries = map[string]coordinates{}
+		c.buckets = map[string]coordinates{}
+		c.places = map[string]string{}
+		return n
+	}
+
+	n := 0
+	prefix := normalizeAddress(q.address()) + "|"
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+			if c.precision > 0 {
+				delete(c.buckets, geohash(e.lat, e.lon, c.precision))
+			}
+			n++
+		}
+	}
+	return n
+}
+
+// reverse names the place at lat and lon. Points within about 10m of one
+// another share an entry.
+func (c *cachedGeocoder) reverse(ctx context.Context, lat, lon float64) (string, error) {
+	key := fmt.Sprintf("%.4f,%.4f", lat, lon)
+
+	c.mu.Lock()
+	place, ok := c.places[key]
+	c.mu.Unlock()
+	if ok {
+		return place, nil
+	}
+
+	place, err := c.geocoder.reverse(ctx, lat, lon)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	if _, ok := c.places[key]; !ok && len(c.places) >= maxGeocodeEntries {
+		for k := range c.places {
+			delete(c.places, k)
+			break
+		}
+	}
+	c.places[key] = place
+	c.mu.Unlock()
+
+	return place, nil
+}
+
+// normalizeAddress lowercases an address and collapses its whitespace.
+func normalizeAddress(address string) string {
+	return strings.Join(strings.Fields(strings.ToLower(address)), " ")
+}
+
+// placeIDPrecision is the length of the geohash a place ID is: 7 characters
+// is a cell of about 150m, so addresses geocoding to the same spot share one,
+// but neighboring towns don't.
+const placeIDPrecision = 7
+
+// placeID is the canonical ID of the place at lat, lon.
+func placeID(lat, lon float64) string { return geohash(lat, lon, placeIDPrecision) }
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohash encodes a coordinate as a geohash string of the given length.
+func geohash(lat, lon float64, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+
+	var b strings.Builder
+	bit, ch, even := 0, 0, true
+	for b.Len() < precision {
+		r, v := &latRange, lat
+		if even {
+			r, v = &lonRange, lon
+		}
+
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+
+		if bit++; bit == 5 {
+			b.WriteByte(geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// errNotFound is what stubGeocoder answers for an address it doesn't know.
+var errNotFound = errors.New("address not found")
+
+// stubGeocoder is a Geocoder for tests. It resolves the addresses in coords,
+// exactly as given, and names the points in places, by their String, and
+// counts its lookups of either kind.
+type stubGeocoder struct {
+	coords map[string]coordinates
+	places map[string]string
+
+	calls atomic.Int32
+}
+
+func (g *stubGeocoder) geocode(ctx context.Context, address, region, bias string) (float64, float64, error) {
+	g.calls.Add(1)
+	c, ok := g.coords[address]
+	if !ok {
+		return 0, 0, errNotFound
+	}
+	return c.lat, c.lon, nil
+}
+
+func (g *stubGeocoder) reverse(ctx context.Context, lat, lon float64) (string, error) {
+	g.calls.Add(1)
+	place, ok := g.places[coordinates{lat, lon}.String()]
+	if !ok {
+		return "", ErrCityNotFound
+	}
+	return place, nil
+}
+
+func TestCachedGeocoderNormalizesAddresses(t *testing.T) {
+	london := coordinates{51.5072, -0.1276}
+	stub := &stubGeocoder{coords: map[string]coordinates{"London": london}}
+	c := newCachedGeocoder(stub, 0)
+
+	for _, address := range []string{"London", "london ", "LONDON", "  London\t"} {
+		lat, lon, err := c.geocode(context.Background(), address, "", "")
+		if err != nil {
+			t.Fatalf("geocode(%q): %v", address, err)
+		}
+		if got := (coordinates{lat, lon}); got != london {
+			t.Errorf("geocode(%q) = %v, want %v", address, got, london)
+		}
+	}
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("geocoder asked %d times, want once", n)
+	}
+	if n := len(c.entries); n != 1 {
+		t.Errorf("%d cache entries, want 1", n)
+	}
+}
+
+func TestCachedGeocoderStaysBounded(t *testing.T) {
+	london := coordinates{51.5072, -0.1276}
+	stub := &stubGeocoder{coords: map[string]coordinates{"London": london}}
+	c := newCachedGeocoder(stub, 6)
+	for i := 0; i < maxGeocodeEntries; i++ {
+		c.entries[strconv.Itoa(i)] = coordinates{}
+		c.buckets[strconv.Itoa(i)] = coordinates{}
+	}
+
+	if _, _, err := c.geocode(context.Background(), "London", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n, m := len(c.entries), len(c.buckets); n != maxGeocodeEntries || m != maxGeocodeEntries {
+		t.Errorf("%d entries and %d buckets, want %d of each", n, m, maxGeocodeEntries)
+	}
+	lat, lon, err := c.geocode(context.Background(), "london", "", "")
+	if err != nil || (coordinates{lat, lon}) != london {
+		t.Errorf("geocode(london) = %v, %v, %v; want %v", lat, lon, err, london)
+	}
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("geocoder asked %d times, want once, London having been cached", n)
+	}
+}
+
+func TestCachedGeocoderBucketsByGeohash(t *testing.T) {
+	tests := []struct {
+		name      string
+		precision int
+		want      coordinates // of the second address
+	}{
+		{"unbucketed", 0, coordinates{51.50721, -0.12761}},
+		{"bucketed", 6, coordinates{51.5072, -0.1276}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubGeocoder{coords: map[string]coordinates{
+				"London":              {51.5072, -0.1276},
+				"London, England, UK": {51.50721, -0.12761},
+			}}
+			c := newCachedGeocoder(stub, tt.precision)
+
+			if _, _, err := c.geocode(context.Background(), "London", "", ""); err != nil {
+				t.Fatal(err)
+			}
+			lat, lon, err := c.geocode(context.Background(), "London, England, UK", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := (coordinates{lat, lon}); got != tt.want {
+				t.Errorf("second address resolved to %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachedGeocoderReverse(t *testing.T) {
+	paris := coordinates{48.8566, 2.3522}
+	stub := &stubGeocoder{places: map[string]string{paris.String(): "Paris"}}
+	c := newCachedGeocoder(stub, 0)
+
+	// The second point is within the same entry, about a meter away.
+	for _, p := range []coordinates{paris, {48.85661, 2.35221}} {
+		place, err := c.reverse(context.Background(), p.lat, p.lon)
+		if err != nil {
+			t.Fatalf("reverse(%v): %v", p, err)
+		}
+		if place != "Paris" {
+			t.Errorf("reverse(%v) = %q, want Paris", p, place)
+		}
+	}
+	if n := stub.calls.Load(); n != 1 {
+		t.Errorf("geocoder asked %d times, want once", n)
+	}
+
+	if _, err := c.reverse(context.Background(), 0, 0); !errors.Is(err, ErrCityNotFound) {
+		t.Errorf("reverse of an unknown point: error %v, want %v", err, ErrCityNotFound)
+	}
+}
+
+func TestGeocoderFallback(t *testing.T) {
+	const (
+		googleParis    = `{"results": [{"geometry": {"location": {"lat": 48.8566, "lng": 2.3522}}}]}`
+		openMeteoParis = `{"results": [{"latitude": 48.85, "longitude": 2.35, "country": "France", "country_code": "FR"}]}`
+	)
+	google := coordinates{48.8566, 2.3522}
+	openMeteo := coordinates{48.85, 2.35}
+
+	tests := []struct {
+		name      string
+		names     []string
+		googleKey string
+		google    func(w http.ResponseWriter) // nil for a hung Google
+		openMeteo string                      // body, or empty for a 503
+		want      coordinates
+		wantErr   error
+		wantHosts []string
+	}{
+		{
+			name: "first answers", names: []string{"google", "openMeteo"}, googleKey: "KEY",
+			google:    func(w http.ResponseWriter) { fmt.Fprint(w, googleParis) },
+			openMeteo: openMeteoParis,
+			want:      google, wantHosts: []string{"maps.googleapis.com"},
+		},
+		{
+			name: "first failing", names: []string{"google", "openMeteo"}, googleKey: "KEY",
+			google:    func(w http.ResponseWriter) { http.Error(w, "denied", http.StatusForbidden) },
+			openMeteo: openMeteoParis,
+			want:      openMeteo, wantHosts: []string{"maps.googleapis.com", "geocoding-api.open-meteo.com"},
+		},
+		{
+			name: "first finding nothing", names: []string{"google", "openMeteo"}, googleKey: "KEY",
+			google:    func(w http.ResponseWriter) { fmt.Fprint(w, `{"results": []}`) },
+			openMeteo: openMeteoParis,
+			want:      openMeteo, wantHosts: []string{"maps.googleapis.com", "geocoding-api.open-meteo.com"},
+		},
+		{
+			name: "first hung", names: []string{"google", "openMeteo"}, googleKey: "KEY",
+			openMeteo: openMeteoParis,
+			want:      openMeteo, wantHosts: []string{"maps.googleapis.com", "geocoding-api.open-meteo.com"},
+		},
+		{
+			name: "google without a key", names: []string{"google", "openMeteo"},
+			openMeteo: openMeteoParis,
+			want:      openMeteo, wantHosts: []string{"geocoding-api.open-meteo.com"},
+		},
+		{
+			name: "order followed", names: []string{"openMeteo", "google"}, googleKey: "KEY",
+			google:    func(w http.ResponseWriter) { fmt.Fprint(w, googleParis) },
+			openMeteo: openMeteoParis,
+			want:      openMeteo, wantHosts: []string{"geocoding-api.open-meteo.com"},
+		},
+		{
+			name: "all failing", names: []string{"google", "openMeteo"}, googleKey: "KEY",
+			google:  func(w http.ResponseWriter) { fmt.Fprint(w, `{"results": []}`) },
+			wantErr: ErrCityNotFound, wantHosts: []string{"maps.googleapis.com", "geocoding-api.open-meteo.com"},
+		},
+		{name: "none usable", names: []string{"google"}, wantErr: errNoGeocoders},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var hosts []string
+			hung := make(chan struct{})
+			defer close(hung)
+			serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				hosts = append(hosts, r.Host)
+				mu.Unlock()
+
+				switch {
+				case r.Host == "maps.googleapis.com" && tt.google == nil:
+					select {
+					case <-hung:
+					case <-r.Context().Done():
+					}
+				case r.Host == "maps.googleapis.com":
+					tt.google(w)
+				case tt.openMeteo == "":
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				default:
+					fmt.Fprint(w, tt.openMeteo)
+				}
+			})
+
+			g, err := newGeocoders(tt.names, tt.googleKey, 50*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lat, lon, err := g.geocode(context.Background(), "Paris", "", "")
+			switch {
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("error %v, want %v", err, tt.wantErr)
+			case tt.wantErr == nil && (err != nil || (coordinates{lat, lon}) != tt.want):
+				t.Errorf("geocoded to %v,%v, %v; want %v", lat, lon, err, tt.want)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if fmt.Sprint(hosts) != fmt.Sprint(tt.wantHosts) {
+				t.Errorf("asked %v, want %v", hosts, tt.wantHosts)
+			}
+		})
+	}
+
+	if _, err := newGeocoders([]string{"google", "bing"}, "KEY", 0); err == nil || !strings.Contains(err.Error(), `"bing"`) {
+		t.Errorf("unknown geocoder: error %v", err)
+	}
+}
+
+func TestRegionBiasReachesGeocoder(t *testing.T) {
+	prev := defaultRegionBias
+	t.Cleanup(func() { defaultRegionBias = prev })
+
+	tests := []struct {
+		name          string
+		defaultRegion string
+		path          string
+		wantParam     string // of the geocode request
+		wantValue     string
+	}{
+		{"no bias", "", "/weather/Springfield", "region", ""},
+		{"configured bias", "US", "/weather/Springfield", "region", "us"},
+		{"request overriding it", "US", "/weather/Springfield?region=gb", "region", "gb"},
+		{"country named outright", "US", "/weather/Springfield,IL,AU", "components", "country:AU"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultRegionBias = tt.defaultRegion
+			upstreams := servePayloads(t, map[string]string{
+				"maps.googleapis.com": `{"results": [{"geometry": {"location": {"lat": 39.8, "lng": -89.65}}}]}`,
+				"api.darksky.net":     `{"currently": {"temperature": 288.15}}`,
+			})
+			ds := darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}}
+			s, _ := newTestServer(t, testConfig(t), nil, ds)
+			s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+
+			var geocoded bool
+			for _, u := range upstreams.requests() {
+				if u.Host != "maps.googleapis.com" {
+					continue
+				}
+				geocoded = true
+				if got := u.Query().Get(tt.wantParam); got != tt.wantValue {
+					t.Errorf("geocoded with %s=%q, want %q: %s", tt.wantParam, got, tt.wantValue, u)
+				}
+			}
+			if !geocoded {
+				t.Error("nothing geocoded")
+			}
+		})
+	}
+}
+
+func TestRegionBiasRejected(t *testing.T) {
+	upstreams := servePayloads(t, nil)
+	s, _ := newTestServer(t, testConfig(t), nil, darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}})
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/Springfield?region=USA", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+	if n := len(upstreams.requests()); n != 0 {
+		t.Errorf("%d upstream requests, want none", n)
+	}
+}
+
+// slowGeocoder takes delay over each lookup of its Geocoder, unless its
+// context ends first, and records the most lookups it has had in flight at
+// once.
+type slowGeocoder struct {
+	Geocoder
+	delay time.Duration
+
+	inFlight, peak atomic.Int32
+}
+
+func (g *slowGeocoder) geocode(ctx context.Context, address, region, bias string) (float64, float64, error) {
+	n := g.inFlight.Add(1)
+	defer g.inFlight.Add(-1)
+	for p := g.peak.Load(); n > p && !g.peak.CompareAndSwap(p, n); p = g.peak.Load() {
+	}
+	select {
+	case <-time.After(g.delay):
+	case <-ctx.Done():
+		return 0, 0, ctx.Err()
+	}
+	return g.Geocoder.geocode(ctx, address, region, bias)
+}
+
+func TestGeocodeAll(t *testing.T) {
+	stub := &stubGeocoder{coords: map[string]coordinates{}}
+	var places []query
+	for i := 0; i < 3*maxGeocodeBatch; i++ {
+		city := fmt.Sprint("City", i)
+		stub.coords[city] = coordinates{float64(i), float64(-i)}
+		places = append(places, query{city: city})
+	}
+	oslo := coordinates{59.91, 10.75}
+	places = append(places, query{city: "Atlantis"}, query{city: "Oslo", coords: &oslo})
+
+	slow := &slowGeocoder{Geocoder: stub, delay: 20 * time.Millisecond}
+	cache := newCachedGeocoder(slow, 0)
+
+	begin := time.Now()
+	got := geocodeAll(context.Background(), cache, places)
+	took := time.Since(begin)
+
+	for i, g := range got[:3*maxGeocodeBatch] {
+		if want := (coordinates{float64(i), float64(-i)}); g.err != nil || g.coords != want {
+			t.Errorf("%s: %v, %v; want %v", places[i].city, g.coords, g.err, want)
+		}
+	}
+	if g := got[len(got)-2]; !errors.Is(g.err, errNotFound) {
+		t.Errorf("Atlantis: error %v, want errNotFound", g.err)
+	}
+	if g := got[len(got)-1]; g.err != nil || g.coords != oslo {
+		t.Errorf("Oslo, with coordinates: %v, %v; want them passed through", g.coords, g.err)
+	}
+
+	if p := slow.peak.Load(); p != maxGeocodeBatch {
+		t.Errorf("%d lookups in flight at most, want %d", p, maxGeocodeBatch)
+	}
+	// Four rounds of lookups, not thirteen one after another.
+	if limit := 8 * slow.delay; took > limit {
+		t.Errorf("took %v, want well under %v", took, limit)
+	}
+
+	// Every place found is cached for the lookups that follow.
+	calls := stub.calls.Load()
+	for _, q := range places[:3*maxGeocodeBatch] {
+		if _, _, err := cache.geocode(context.Background(), q.address(), "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := stub.calls.Load() - calls; n != 0 {
+		t.Errorf("%d lookups after geocoding them all, want none", n)
+	}
+}
+
+func TestGeocodeAllCanceled(t *testing.T) {
+	slow := &slowGeocoder{Geocoder: &stubGeocoder{}, delay: time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	places := make([]query, 2*maxGeocodeBatch)
+	for i := range places {
+		places[i].city = fmt.Sprint("City", i)
+	}
+	begin := time.Now()
+	got := geocodeAll(ctx, slow, places)
+	if took := time.Since(begin); took > slow.delay/2 {
+		t.Errorf("took %v to give up, want about the 20ms deadline", took)
+	}
+	// Lookups in flight and those waiting their turn alike are given up.
+	for i, g := range got {
+		if !errors.Is(g.err, context.DeadlineExceeded) {
+			t.Errorf("lookup %d: error %v, want the deadline", i, g.err)
+		}
+	}
+}
+
+func TestGeocodeCanceled(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration // of the caller's context; 0 to cancel it
+		lookup  func(ctx context.Context) error
+	}{
+		{"Google, canceled", 0, func(ctx context.Context) error {
+			_, _, err := googleGeocoder{apiKey: "KEY"}.geocode(ctx, "Paris", "", "")
+			return err
+		}},
+		{"Google, past its deadline", 20 * time.Millisecond, func(ctx context.Context) error {
+			_, _, err := googleGeocoder{apiKey: "KEY"}.geocode(ctx, "Paris", "", "")
+			return err
+		}},
+		{"Google reverse, canceled", 0, func(ctx context.Context) error {
+			_, err := googleGeocoder{apiKey: "KEY"}.reverse(ctx, 48.8566, 2.3522)
+			return err
+		}},
+		{"Open-Meteo, canceled", 0, func(ctx context.Context) error {
+			_, _, err := openMeteoGeocoder{}.geocode(ctx, "Paris", "", "")
+			return err
+		}},
+		{"geocoder's own timeout", time.Minute, func(ctx context.Context) error {
+			_, _, err := timeoutGeocoder{googleGeocoder{apiKey: "KEY"}, 20 * time.Millisecond}.geocode(ctx, "Paris", "", "")
+			return err
+		}},
+		{"Dark Sky stalled on geocoding", 0, func(ctx context.Context) error {
+			_, err := darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}}.temperature(ctx, "Paris")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The geocoder never answers, until the client gives up.
+			serveUpstream(t, func(w http.ResponseWriter, r *http.Request) { <-r.Context().Done() })
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.timeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			} else {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+
+			done := make(chan error, 1)
+			go func() { done <- tt.lookup(ctx) }()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("error %v, want the context's", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("geocoding still waiting on the hung server")
+			}
+		})
+	}
+}
+
+func TestDistanceTo(t *testing.T) {
+	paris, london := coordinates{48.8566, 2.3522}, coordinates{51.5074, -0.1278}
+
+	tests := []struct {
+		name string
+		a, b coordinates
+		want float64 // meters
+	}{
+		{"same point", paris, paris, 0},
+		{"Paris to London", paris, london, 343.56e3},
+		{"London to Paris", london, paris, 343.56e3},
+		{"a degree of latitude", coordinates{10, 20}, coordinates{11, 20}, 111.195e3},
+		{"across the antimeridian", coordinates{0, 179.5}, coordinates{0, -179.5}, 111.195e3},
+		{"pole to pole", coordinates{90, 0}, coordinates{-90, 0}, 20015.1e3},
+		{"antipodes", coordinates{0, 0}, coordinates{0, 180}, 20015.1e3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.a.distanceTo(tt.b)
+			if math.Abs(got-tt.want) > 0.001*tt.want+1e-6 {
+				t.Errorf("%v to %v: %.0f m, want %.0f m", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStationDistance(t *testing.T) {
+	observation := func(display, station string) string {
+		return `{"current_observation":{"temp_c":12,` +
+			`"display_location":` + display + `,"observation_location":` + station + `}}`
+	}
+	at := func(lat, lon string) string { return `{"latitude":"` + lat + `","longitude":"` + lon + `"}` }
+
+	tests := []struct {
+		name    string
+		payload string
+		coords  *coordinates
+		want    float64 // meters, or -1 for no distance
+	}{
+		{"from where the city is", observation(at("48.85", "2.35"), at("48.86", "2.35")), nil, 1111.95},
+		{"from the coordinates asked for", observation(at("0", "0"), at("48.87", "2.35")), &coordinates{48.85, 2.35}, 2223.9},
+		{"no station", observation(at("48.85", "2.35"), at("", "")), nil, -1},
+		{"city not placed", observation(at("", ""), at("48.86", "2.35")), nil, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			servePayloads(t, map[string]string{"api.wunderground.com": tt.payload})
+
+			c, err := weatherUnderground{keys: newKeyRing("KEY")}.conditions(context.Background(), query{city: "Paris", coords: tt.coords})
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.want < 0 && c.StationDistance != nil:
+				t.Errorf("station %v m away, want no distance", *c.StationDistance)
+			case tt.want >= 0 && (c.StationDistance == nil || math.Abs(*c.StationDistance-tt.want) > 1):
+				t.Errorf("station %v m away, want %v m", c.StationDistance, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeohash(t *testing.T) {
+	tests := []struct {
+		lat, lon  float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{40.7128, -74.0060, placeIDPrecision, "dr5regw"},
+		{-33.8688, 151.2093, 5, "r3gx2"},
+		{0, 0, 4, "s000"},
+	}
+	for _, tt := range tests {
+		if got := geohash(tt.lat, tt.lon, tt.precision); got != tt.want {
+			t.Errorf("geohash(%v, %v, %d) = %q, want %q", tt.lat, tt.lon, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestPlaceIDsShareCache(t *testing.T) {
+	newYork, boston := coordinates{40.7128, -74.0060}, coordinates{42.3601, -71.0589}
+
+	tests := []struct {
+		name        string
+		placeIDs    bool
+		cities      []string
+		wantLookups int32
+		wantIDs     string
+	}{
+		{"aliases sharing an entry", true, []string{"NYC", "New York"}, 1, "[dr5regw dr5regw]"},
+		{"nearby aliases sharing an entry", true, []string{"New York", "Manhattan"}, 1, "[dr5regw dr5regw]"},
+		{"different places", true, []string{"NYC", "Boston"}, 2, "[dr5regw drt2zp2]"},
+		{"a place not geocoded", true, []string{"NYC", "Atlantis"}, 2, "[dr5regw ]"},
+		{"off", false, []string{"NYC", "New York"}, 2, "[ ]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			fakes := fakeRegistry{}
+			alpha := fakes.add("alpha", 285)
+			stub := &stubGeocoder{coords: map[string]coordinates{
+				"NYC": newYork, "New York": newYork, "Manhattan": {40.7129, -74.0061}, "Boston": boston,
+			}}
+			cfg := testConfig(t)
+			cfg.placeIDs = tt.placeIDs
+			_, ts := newTestServer(t, cfg, stub, fakes.providers()...)
+
+			var ids []string
+			for _, city := range tt.cities {
+				var got struct {
+					PlaceID string `json:"place_id"`
+				}
+				if resp := getJSONResponse(t, ts.URL+"/weather/"+city, &got); resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s: status %d", city, resp.StatusCode)
+				}
+				ids = append(ids, got.PlaceID)
+			}
+			if n := alpha.calls.Load(); n != tt.wantLookups {
+				t.Errorf("%d lookups, want %d", n, tt.wantLookups)
+			}
+			if got := fmt.Sprint(ids); got != tt.wantIDs {
+				t.Errorf("place IDs %s, want %s", got, tt.wantIDs)
+			}
+		})
+	}
+}
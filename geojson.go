@@ -0,0 +1,24 @@
+package main
+
+// geoJSONFeature is a GeoJSON Feature (RFC 7946) with a Point geometry.
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"` // longitude, latitude
+}
+
+func geoJSONPoint(lat, lon float64, properties map[string]interface{}) geoJSONFeature {
+	return geoJSONFeature{
+		Type: "Feature",
+		Geometry: geoJSONGeometry{
+			Type:        "Point",
+			Coordinates: [2]float64{lon, lat},
+		},
+		Properties: properties,
+	}
+}
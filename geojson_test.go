@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGeoJSONPoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		lat, lon float64
+		want     string
+	}{
+		{"Paris", 48.8566, 2.3522, `{"type":"Feature","geometry":{"type":"Point","coordinates":[2.3522,48.8566]},"properties":{"city":"Paris","temp":53}}`},
+		{"southwest", -33.8688, -70.6693, `{"type":"Feature","geometry":{"type":"Point","coordinates":[-70.6693,-33.8688]},"properties":{"city":"Paris","temp":53}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			properties := map[string]interface{}{"city": "Paris", "temp": 53}
+			b, err := json.Marshal(geoJSONPoint(tt.lat, tt.lon, properties))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("encoded\n%s\nwant, longitude first,\n%s", b, tt.want)
+			}
+		})
+	}
+}
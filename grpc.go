@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// grpcService serves the WeatherService of weather.proto: gRPC's unary calls
+// over HTTP/2, answered from the same providers as the HTTP API. Only what
+// unary calls need is implemented; messages are decoded and encoded by hand,
+// as in protobuf.go, and compressed messages are refused.
+type grpcService struct {
+	source resultProvider
+	live   *liveProviders
+	trends *trendTracker
+}
+
+// gRPC status codes.
+const (
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcDeadlineExceeded = 4
+	grpcNotFound         = 5
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+)
+
+// grpcError is a failed call's status code and message.
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string { return e.message }
+
+func (s grpcService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 {
+		http.Error(w, "gRPC requires POST over HTTP/2", http.StatusBadRequest)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/grpc" && ct != "application/grpc+proto" {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// Status is sent in trailers, as gRPC requires, so they're declared
+	// before the body is written.
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	reply, err := s.call(r)
+	if err == nil {
+		_, err = w.Write(grpcFrame(reply))
+	}
+
+	code, message := grpcOK, ""
+	if err != nil {
+		code, message = grpcStatus(err), err.Error()
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+}
+
+// call decodes the request message, honoring any grpc-timeout, and calls the
+// method the request's path names.
+func (s grpcService) call(r *http.Request) ([]byte, error) {
+	ctx := r.Context()
+	if t := r.Header.Get("Grpc-Timeout"); t != "" {
+		d, err := parseGRPCTimeout(t)
+		if err != nil {
+			return nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	req, err := readGRPCFrame(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.URL.Path {
+	case "/weather.WeatherService/GetTemperature":
+		return s.getTemperature(ctx, req)
+	case "/weather.WeatherService/GetConditions":
+		return s.getConditions(ctx, req)
+	}
+	return nil, &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path}
+}
+
+// getTemperature answers a TemperatureRequest with a Weather message, as
+// /weather/ would.
+func (s grpcService) getTemperature(ctx context.Context, req []byte) ([]byte, error) {
+	var city, units string
+	err := parseProto(req, func(field int, p []byte) {
+		switch field {
+		case 1:
+			city = string(p)
+		case 2:
+			units = string(p)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	current := s.live.load()
+	cfg := current.cfg
+	u := cfg.defaultUnits()
+	if units != "" {
+		if u, err = parseUnit(units); err != nil {
+			return nil, &grpcError{grpcInvalidArgument, err.Error()}
+		}
+	}
+
+	q, err := s.query(city, cfg.defaultCity)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.source.aggregate(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return weatherMessage{
+		city:        q.address(),
+		temperature: res.temp,
+		sources:     res.sources,
+		confidence:  cfg.confidence.level(res),
+		warnings:    warnings(res, cfg.disagreement),
+		temp:        int32(cfg.rounding.round(res.in(u))),
+		units:       u,
+		trend:       s.trends.record(q.key(), res.temp, res.fetched),
+		credits:     attributions(current.providers, res.sources),
+	}.marshal(), nil
+}
+
+// getConditions answers a ConditionsRequest with a Conditions message, as
+// /conditions/ would.
+func (s grpcService) getConditions(ctx context.Context, req []byte) ([]byte, error) {
+	var city string
+	err := parseProto(req, func(field int, p []byte) {
+		if field == 1 {
+			city = string(p)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	current := s.live.load()
+	q, err := s.query(city, current.cfg.defaultCity)
+	if err != nil {
+		return nil, err
+	}
+	res, err := current.multi.conditions(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	return conditionsMessage{city: q.address(), credits: attributions(current.providers, res.sources), conditionsResult: res}.marshal(), nil
+}
+
+// query parses a request's city, falling back to defaultCity.
+func (s grpcService) query(city, defaultCity string) (query, error) {
+	if city == "" {
+		city = defaultCity
+	}
+	if city == "" {
+		return query{}, &grpcError{grpcInvalidArgument, "no city given"}
+	}
+	return parsePlace(city)
+}
+
+// grpcStatus maps an error to the gRPC status code a client should see.
+func grpcStatus(err error) int {
+	var g *grpcError
+	switch {
+	case errors.As(err, &g):
+		return g.code
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcDeadlineExceeded
+	}
+
+	switch errorStatus(err) {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	return grpcInternal
+}
+
+// maxGRPCMessage is the largest request message accepted. Requests hold a
+// place name, so anything near it is not one.
+const maxGRPCMessage = 64 << 10
+
+// readGRPCFrame reads one length-prefixed message.
+func readGRPCFrame(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "reading message: " + err.Error()}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxGRPCMessage {
+		return nil, &grpcError{grpcInvalidArgument, fmt.Sprintf("message of %d bytes is too large", n)}
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "reading message: " + err.Error()}
+	}
+	return msg, nil
+}
+
+// grpcFrame length-prefixes a message, uncompressed.
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// parseGRPCTimeout parses a grpc-timeout header: an integer of up to eight
+// digits followed by a unit, as in "500m" for 500 milliseconds.
+func parseGRPCTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("malformed grpc-timeout %q", s)
+	}
+
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("malformed grpc-timeout %q", s)
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, fmt.Errorf("malformed grpc-timeout %q", s)
+	}
+	return time.Duration(n) * unit, nil
+}
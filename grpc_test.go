@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newGRPCTestServer serves the gRPC service over providers in process, over
+// unencrypted HTTP/2 as -grpc-addr does, and returns a client that speaks it.
+// Paris is the default city, and callers need one of keys, if any.
+func newGRPCTestServer(t *testing.T, keys []string, providers ...weatherProvider) (*httptest.Server, *http.Client) {
+	t.Helper()
+	mw := multiWeatherProvider{providers: providers, minProviders: 1}
+	live := &liveProviders{}
+	live.store(&serving{cfg: Config{defaultCity: "Paris"}, providers: providers, multi: mw, source: mw})
+	g := grpcService{source: live, live: live}
+	ts := httptest.NewUnstartedServer(requireKey(keys, g))
+	ts.Config.Protocols = new(http.Protocols)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(tr.CloseIdleConnections)
+	return ts, &http.Client{Transport: tr}
+}
+
+// grpcCall makes a unary call to method with the request message req, and
+// returns the reply message, if any, and the call's status code.
+func grpcCall(t *testing.T, ts *httptest.Server, client *http.Client, method string, req []byte, header http.Header) ([]byte, int) {
+	t.Helper()
+	frame := make([]byte, 5, 5+len(req))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(req)))
+	frame = append(frame, req...)
+
+	r, _ := http.NewRequest("POST", ts.URL+"/weather.WeatherService/"+method, bytes.NewReader(frame))
+	r.Header.Set("Content-Type", "application/grpc")
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("answered over %s, want HTTP/2", resp.Proto)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := strconv.Atoi(resp.Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("status %d, trailers %v: no grpc-status", resp.StatusCode, resp.Trailer)
+	}
+	if len(body) == 0 {
+		return nil, code
+	}
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:])) != len(body)-5 {
+		t.Fatalf("malformed reply frame % x", body)
+	}
+	return body[5:], code
+}
+
+func TestGRPCService(t *testing.T) {
+	request := func(city, units string) []byte {
+		var b protoBuilder
+		b.string(1, city)
+		b.string(2, units)
+		return b.buf
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		req      []byte
+		timeout  string
+		delay    time.Duration
+		wantCode int
+		wantTemp int32
+		wantUnit string
+	}{
+		{"temperature", "GetTemperature", request("Paris", ""), "", 0, grpcOK, 54, "fahrenheit"},
+		{"in Celsius", "GetTemperature", request("Paris", "c"), "", 0, grpcOK, 12, "celsius"},
+		{"default city", "GetTemperature", request("", ""), "", 0, grpcOK, 54, "fahrenheit"},
+		{"unknown units", "GetTemperature", request("Paris", "rankine"), "", 0, grpcInvalidArgument, 0, ""},
+		{"malformed place", "GetTemperature", request("Paris,,", ""), "", 0, grpcInvalidArgument, 0, ""},
+		{"unknown city", "GetTemperature", request("Atlantis", ""), "", 0, grpcNotFound, 0, ""},
+		{"deadline exceeded", "GetTemperature", request("Paris", ""), "20m", time.Second, grpcDeadlineExceeded, 0, ""},
+		{"malformed message", "GetTemperature", []byte{0x0a, 0x7f}, "", 0, grpcInvalidArgument, 0, ""},
+		{"unknown method", "GetForecast", request("Paris", ""), "", 0, grpcUnimplemented, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeProvider{name: "alpha", kelvin: 285.15, delay: tt.delay}
+			if tt.name == "unknown city" {
+				f.err = ErrCityNotFound
+			}
+			ts, client := newGRPCTestServer(t, nil, f)
+
+			header := http.Header{}
+			if tt.timeout != "" {
+				header.Set("Grpc-Timeout", tt.timeout)
+			}
+			reply, code := grpcCall(t, ts, client, tt.method, tt.req, header)
+			if code != tt.wantCode {
+				t.Fatalf("status %d, want %d", code, tt.wantCode)
+			}
+			if code != grpcOK {
+				if reply != nil {
+					t.Errorf("failed call replied % x", reply)
+				}
+				return
+			}
+
+			got := decodeWeather(t, reply)
+			if got.city != "Paris" || got.temp != tt.wantTemp || got.units != tt.wantUnit || got.k != 285.15 {
+				t.Errorf("reply %+v, want Paris at %d %s", got, tt.wantTemp, tt.wantUnit)
+			}
+			if len(got.sources) != 1 || got.sources[0] != "alpha" {
+				t.Errorf("sources %q", got.sources)
+			}
+		})
+	}
+}
+
+func TestGRPCNeedsKey(t *testing.T) {
+	ts, client := newGRPCTestServer(t, []string{"secret"}, &fakeProvider{name: "alpha", kelvin: 285})
+
+	var req protoBuilder
+	req.string(1, "Paris")
+	if _, code := grpcCall(t, ts, client, "GetTemperature", req.buf, http.Header{"X-Api-Key": {"secret"}}); code != grpcOK {
+		t.Errorf("with the key: status %d", code)
+	}
+
+	r, _ := http.NewRequest("POST", ts.URL+"/weather.WeatherService/GetTemperature", bytes.NewReader([]byte{0, 0, 0, 0, 0}))
+	r.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without a key: status %d, want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// historyProvider is implemented by providers that can look up the weather
+// on a past day.
+type historyProvider interface {
+	// history is the mean temperature at q's place on day, in Kelvin.
+	history(ctx context.Context, q query, day time.Time) (float64, error)
+}
+
+// historyDateLayout is the form dates are given in: 2024-01-15.
+const historyDateLayout = "2006-01-02"
+
+// parseHistoryDate parses a date for a historical lookup, which must be in
+// the past: before today, in UTC.
+func parseHistoryDate(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("missing date")
+	}
+
+	day, err := time.Parse(historyDateLayout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed date %q: want YYYY-MM-DD", s)
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	if !day.Before(today) {
+		return time.Time{}, fmt.Errorf("date %s is not in the past", s)
+	}
+	return day, nil
+}
+
+// history queries every provider able to look up q's place on day, and
+// combines their readings as aggregate does.
+func (w multiWeatherProvider) history(ctx context.Context, q query, day time.Time) (result, error) {
+	supports := func(p weatherProvider) bool {
+		return capabilitiesOf(p).has(capHistory) && q.supportedBy(p)
+	}
+
+	obs, _, err := w.collect(ctx, supports, func(ctx context.Context, p weatherProvider) (Conditions, error) {
+		k, err := p.(historyProvider).history(ctx, q, day)
+		return Conditions{Kelvin: k}, err
+	})
+	if err != nil {
+		return result{}, err
+	}
+
+	return w.observed(ctx, w.combine(obs)), nil
+}
+
+func historyHandler(live *liveProviders) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := live.load()
+		q, err := queryFromRequest(r, current.cfg.defaultCity)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		day, err := parseHistoryDate(r.URL.Query().Get("date"), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		style, err := keyStyleFromRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res, err := current.multi.history(r.Context(), q, day)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		respond(w, r, struct {
+			City        string      `json:"city"`
+			Date        string      `json:"date"`
+			Temperature Temperature `json:"temperature"`
+			Sources     []string    `json:"sources"`
+		}{
+			City:        q.address(),
+			Date:        day.Format(historyDateLayout),
+			Temperature: res.temp,
+			Sources:     res.sources,
+		}, style)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHistoryDate(t *testing.T) {
+	now := time.Date(2024, 1, 16, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		s       string
+		want    string
+		wantErr string
+	}{
+		{"2024-01-15", "2024-01-15", ""},
+		{"1999-12-31", "1999-12-31", ""},
+		{"2024-01-16", "", "not in the past"},
+		{"2024-02-01", "", "not in the past"},
+		{"", "", "missing date"},
+		{"15/01/2024", "", "malformed date"},
+		{"2024-02-30", "", "malformed date"},
+	}
+	for _, tt := range tests {
+		day, err := parseHistoryDate(tt.s, now)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseHistoryDate(%q): error %v, want one containing %q", tt.s, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseHistoryDate(%q): %v", tt.s, err)
+			continue
+		}
+		if got := day.Format(historyDateLayout); got != tt.want {
+			t.Errorf("parseHistoryDate(%q) = %s", tt.s, got)
+		}
+	}
+}
+
+func TestTimeMachineURL(t *testing.T) {
+	day := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	got := darkSky{}.timeMachineURL(coordinates{48.8566, 2.3522}, day, "KEY")
+	want := "https://api.darksky.net/forecast/KEY/48.8566,2.3522,1705320000?exclude=currently,minutely,hourly,alerts,flags&units=si"
+	if got != want {
+		t.Errorf("URL %s, want %s", got, want)
+	}
+}
+
+func TestHistorySkipsProvidersWithout(t *testing.T) {
+	upstreams := servePayloads(t, map[string]string{
+		"api.darksky.net": `{"daily": {"data": [{"temperatureHigh": 6, "temperatureLow": 2}]}}`,
+	})
+	fake := &fakeProvider{name: "fake", kelvin: 300}
+	paris := coordinates{48.8566, 2.3522}
+	geocoder := &stubGeocoder{coords: map[string]coordinates{"Paris": paris}}
+	h := historyHandler(servingOnly(multiWeatherProvider{providers: []weatherProvider{darkSky{keys: newKeyRing("KEY"), geocoder: geocoder}, fake}}))
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/history/?city=Paris&date=2024-01-15", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		Date        string `json:"date"`
+		Temperature struct {
+			C float64 `json:"c"`
+		} `json:"temperature"`
+		Sources []string `json:"sources"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Date != "2024-01-15" || got.Temperature.C != 4 || strings.Join(got.Sources, ",") != "darkSky" {
+		t.Errorf("got %+v, want 4°C on 2024-01-15 from darkSky", got)
+	}
+	if n := fake.calls.Load(); n != 0 {
+		t.Errorf("provider without history asked %d times", n)
+	}
+
+	requests := upstreams.requests()
+	if len(requests) != 1 || requests[0].Path != "/forecast/KEY/48.8566,2.3522,1705320000" {
+		t.Errorf("upstream requests %v, want Dark Sky's time machine for noon that day", requests)
+	}
+
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/history/?city=Paris&date="+time.Now().UTC().Format(historyDateLayout), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("today: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// hybridProvider prefers a single trusted provider, and only when it fails
+// falls back to averaging the rest.
+type hybridProvider struct {
+	primary     weatherProvider
+	secondaries multiWeatherProvider
+}
+
+func (h hybridProvider) Name() string { return "hybrid" }
+
+func (h hybridProvider) temperature(ctx context.Context, city string) (float64, error) {
+	q, err := parsePlace(city)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := h.aggregate(ctx, q)
+	return res.temp.Kelvin(), err
+}
+
+func (h hybridProvider) aggregate(ctx context.Context, q query) (result, error) {
+	if !q.supportedBy(h.primary) {
+		return h.secondaries.aggregate(ctx, q)
+	}
+
+	name := h.primary.Name()
+	ctx, status := withStatus(ctx)
+	c, err := h.ask(ctx, q)
+	if err == nil {
+		obs := []observation{{name, c, status.code()}}
+		res := result{temp: Temperature(c.Kelvin), sources: []string{name}, readings: 1, celsius: h.secondaries.averageCelsius(obs)}
+		res.statuses = statusesOf(obs, nil)
+		res.explanation = &explanation{
+			Strategy:    strategyPrimary,
+			Readings:    []explainedReading{{Provider: name, Kelvin: c.Kelvin}},
+			Kelvin:      c.Kelvin,
+			Computation: fmt.Sprintf("the primary provider, %s, answered %.2f K", name, c.Kelvin),
+		}
+		return h.secondaries.observed(ctx, res), nil
+	}
+
+	// Don't bother with the secondaries if the request itself is gone.
+	if ctx.Err() != nil {
+		return result{}, ctx.Err()
+	}
+
+	log.Printf("hybrid: primary %s failed, averaging secondaries: %v", name, err)
+
+	res, secondaryErr := h.secondaries.aggregate(ctx, q)
+	switch {
+	case errors.Is(secondaryErr, errNoProviders):
+		// With no secondaries to fall back on, the primary's failure is
+		// the lookup's.
+		return result{}, err
+	case secondaryErr != nil:
+		return result{}, fmt.Errorf("primary %s: %w; secondaries: %w", name, err, secondaryErr)
+	}
+	primary := providerFailure{name, err.Error(), status.code()}
+	res.failed = append([]providerFailure{primary}, res.failed...)
+	res.statuses = append([]providerStatus{{name, primary.status}}, res.statuses...)
+	return res, nil
+}
+
+// ask asks the primary for its reading at q the way the secondaries are asked
+// for theirs: within its own timeout and the aggregation timeout, calibrated
+// and checked, with the observers and the success tracker told how it went.
+func (h hybridProvider) ask(ctx context.Context, q query) (Conditions, error) {
+	if d := h.secondaries.timeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	return h.secondaries.fetchFrom(ctx, h.primary, q.reading)
+}
+
+// newHybridProvider splits mw into hybridProvider's primary, named by
+// primary, and its secondaries. It reports false if no provider has that name.
+func newHybridProvider(mw multiWeatherProvider, primary string) (hybridProvider, bool) {
+	h := hybridProvider{secondaries: mw}
+	h.secondaries.providers = nil
+
+	for _, p := range mw.providers {
+		if h.primary == nil && p.Name() == primary {
+			h.primary = p
+			continue
+		}
+		h.secondaries.providers = append(h.secondaries.providers, p)
+	}
+
+	return h, h.primary != nil
+}
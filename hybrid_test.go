@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHybridProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing []string // the upstream hosts that fail
+		want    Temperature
+		sources []string
+		asked   []string // the upstream hosts asked
+		wantErr bool
+	}{
+		{
+			name:    "primary healthy",
+			want:    280,
+			sources: []string{"openWeatherMap"},
+			asked:   []string{"api.openweathermap.org"},
+		},
+		{
+			name:    "primary down",
+			failing: []string{"api.openweathermap.org"},
+			want:    288.15,
+			sources: []string{"weatherUnderground", "darkSky"},
+			asked:   []string{"api.darksky.net", "api.openweathermap.org", "api.wunderground.com", "maps.googleapis.com"},
+		},
+		{
+			name:    "everything down",
+			failing: []string{"api.openweathermap.org", "api.wunderground.com", "api.darksky.net"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			asked := map[string]bool{}
+			serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				asked[r.Host] = true
+				mu.Unlock()
+				for _, host := range tt.failing {
+					if r.Host == host {
+						w.WriteHeader(http.StatusBadGateway)
+						return
+					}
+				}
+				switch r.Host {
+				case "api.openweathermap.org":
+					fmt.Fprint(w, `{"main": {"temp": 280}}`)
+				case "api.wunderground.com":
+					fmt.Fprint(w, `{"current_observation": {"temp_c": 10}}`)
+				case "maps.googleapis.com":
+					fmt.Fprint(w, `{"results": [{"geometry": {"location": {"lat": 48.85, "lng": 2.35}}}]}`)
+				case "api.darksky.net":
+					fmt.Fprint(w, `{"currently": {"temperature": 20}}`)
+				}
+			})
+
+			// With a minimum, the secondaries are all heard from before the
+			// lookup fails, so none is still calling upstream once the test
+			// has put the default client back.
+			h, ok := newHybridProvider(multiWeatherProvider{providers: []weatherProvider{
+				openWeatherMap{keys: newKeyRing("KEY")},
+				weatherUnderground{keys: newKeyRing("KEY")},
+				darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}},
+			}, minProviders: 1}, "openWeatherMap")
+			if !ok {
+				t.Fatal("no primary")
+			}
+
+			res, err := h.aggregate(context.Background(), query{city: "Paris"})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", res.temp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(float64(res.temp-tt.want)) > 1e-9 {
+				t.Errorf("temp %v, want %v", res.temp, tt.want)
+			}
+			if strings.Join(res.sources, ",") != strings.Join(tt.sources, ",") {
+				t.Errorf("sources %v, want %v", res.sources, tt.sources)
+			}
+			var hosts []string
+			for host := range asked {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			if strings.Join(hosts, ",") != strings.Join(tt.asked, ",") {
+				t.Errorf("asked %v, want %v", hosts, tt.asked)
+			}
+		})
+	}
+}
+
+func TestHybridFallback(t *testing.T) {
+	errDown := errors.New("primary down")
+	errAlsoDown := errors.New("secondary down")
+
+	tests := []struct {
+		name        string
+		primary     *fakeProvider
+		secondaries []float64 // their readings, if there are any
+		failing     bool      // whether the secondaries fail
+		temp        Temperature
+		sources     []string
+		failed      []string
+		wantErr     []error
+	}{
+		{
+			name:        "primary healthy",
+			primary:     &fakeProvider{name: "primary", kelvin: 280},
+			secondaries: []float64{290, 300},
+			temp:        280,
+			sources:     []string{"primary"},
+		},
+		{
+			name:        "primary down",
+			primary:     &fakeProvider{name: "primary", err: errDown},
+			secondaries: []float64{290, 300},
+			temp:        295,
+			sources:     []string{"s1", "s2"},
+			failed:      []string{"primary"},
+		},
+		{
+			name:        "primary too slow",
+			primary:     &fakeProvider{name: "primary", kelvin: 280, delay: time.Minute},
+			secondaries: []float64{290, 300},
+			temp:        295,
+			sources:     []string{"s1", "s2"},
+			failed:      []string{"primary"},
+		},
+		{
+			name:        "primary implausible",
+			primary:     &fakeProvider{name: "primary", kelvin: 0},
+			secondaries: []float64{290, 300},
+			temp:        295,
+			sources:     []string{"s1", "s2"},
+			failed:      []string{"primary"},
+		},
+		{
+			name:        "everything down",
+			primary:     &fakeProvider{name: "primary", err: errDown},
+			secondaries: []float64{290, 300},
+			failing:     true,
+			wantErr:     []error{errDown, errAlsoDown},
+		},
+		{
+			name:    "primary down with no secondaries",
+			primary: &fakeProvider{name: "primary", err: errDown},
+			wantErr: []error{errDown},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providers := []weatherProvider{tt.primary}
+			var secondaries []*fakeProvider
+			for i, k := range tt.secondaries {
+				s := &fakeProvider{name: "s" + string(rune('1'+i)), kelvin: k}
+				if tt.failing {
+					s.err = errAlsoDown
+				}
+				secondaries = append(secondaries, s)
+				providers = append(providers, s)
+			}
+
+			tracker := newSuccessTracker(10)
+			h, ok := newHybridProvider(multiWeatherProvider{
+				providers: providers,
+				timeout:   20 * time.Millisecond,
+				tracker:   tracker,
+				valid:     &kelvinRange{180, 335},
+			}, "primary")
+			if !ok {
+				t.Fatal("no primary")
+			}
+
+			res, err := h.aggregate(context.Background(), query{city: "Paris"})
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("got %v, want an error", res.temp)
+				}
+				for _, want := range tt.wantErr {
+					if !errors.Is(err, want) {
+						t.Errorf("error %q doesn't include %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.temp != tt.temp {
+				t.Errorf("temp %v, want %v", res.temp, tt.temp)
+			}
+			if strings.Join(res.sources, ",") != strings.Join(tt.sources, ",") {
+				t.Errorf("sources %v, want %v", res.sources, tt.sources)
+			}
+			var failed []string
+			for _, f := range res.failed {
+				failed = append(failed, f.Provider)
+			}
+			if strings.Join(failed, ",") != strings.Join(tt.failed, ",") {
+				t.Errorf("failed %v, want %v", res.failed, tt.failed)
+			}
+
+			// The primary's lookups count towards its success rate like
+			// anyone else's.
+			wantRate := 1.0
+			if tt.failed != nil {
+				wantRate = 0
+			}
+			if r := tracker.rate("primary"); r != wantRate {
+				t.Errorf("primary's success rate %v, want %v", r, wantRate)
+			}
+
+			asked := int32(0)
+			if tt.failed != nil {
+				asked = 1
+			}
+			for _, s := range secondaries {
+				if n := s.calls.Load(); n != asked {
+					t.Errorf("%s asked %d times, want %d", s.name, n, asked)
+				}
+			}
+		})
+	}
+}
+
+func TestHybridProviderUnknownPrimary(t *testing.T) {
+	if _, ok := newHybridProvider(multiWeatherProvider{providers: []weatherProvider{openWeatherMap{}}}, "darkSky"); ok {
+		t.Error("darkSky found among just openWeatherMap")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// keyBench is how long a key a provider refused, as invalid or over its
+// quota, is passed over before it is tried again.
+const keyBench = time.Minute
+
+// A keyRing spreads a provider's lookups across several API keys, taking
+// them in turn. A key the provider answers with 401 or 429 is benched for
+// keyBench, while the others carry on.
+type keyRing struct {
+	keys []string
+
+	mu      sync.Mutex
+	next    int
+	benched []time.Time // until when each key is passed over
+}
+
+// newKeyRing returns a keyRing of the comma-separated keys in s.
+func newKeyRing(s string) *keyRing {
+	keys := splitList(s)
+	return &keyRing{keys: keys, benched: make([]time.Time, len(keys))}
+}
+
+// use calls fn with the next key due, noting whether the provider refused
+// it, and returns fn's error. With no keys, fn is called with an empty one.
+func (r *keyRing) use(fn func(key string) error) error {
+	i := r.pick()
+	if i < 0 {
+		return fn("")
+	}
+
+	err := fn(r.keys[i])
+
+	var status *statusError
+	if errors.As(err, &status) && (status.code == http.StatusUnauthorized || status.code == http.StatusTooManyRequests) {
+		r.mu.Lock()
+		r.benched[i] = time.Now().Add(keyBench)
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// pick returns the index of the next key not benched, or, if every key is,
+// of the one due back soonest. It is -1 if there are no keys.
+func (r *keyRing) pick() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.keys) == 0 {
+		return -1
+	}
+
+	now := time.Now()
+	soonest := -1
+	for n := 0; n < len(r.keys); n++ {
+		i := (r.next + n) % len(r.keys)
+		if !now.Before(r.benched[i]) {
+			r.next = i + 1
+			return i
+		}
+		if soonest < 0 || r.benched[i].Before(r.benched[soonest]) {
+			soonest = i
+		}
+	}
+	r.next = soonest + 1
+	return soonest
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyRing(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    string
+		refused map[string]int // the status each refused key is answered with
+		want    string         // the keys used by six lookups in turn
+	}{
+		{"round robin", "A,B,C", nil, "A,B,C,A,B,C"},
+		{"one key", "A", nil, "A,A,A,A,A,A"},
+		{"no keys", "", nil, ",,,,,"},
+		{"unauthorized key skipped", "A,B,C", map[string]int{"B": http.StatusUnauthorized}, "A,B,C,A,C,A"},
+		{"rate-limited key skipped", "A,B,C", map[string]int{"A": http.StatusTooManyRequests}, "A,B,C,B,C,B"},
+		{"other errors not benched", "A,B", map[string]int{"A": http.StatusInternalServerError}, "A,B,A,B,A,B"},
+		{"every key refused", "A,B", map[string]int{"A": http.StatusTooManyRequests, "B": http.StatusTooManyRequests}, "A,B,A,B,A,B"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := newKeyRing(tt.keys)
+			var used []string
+			for i := 0; i < 6; i++ {
+				ring.use(func(key string) error {
+					used = append(used, key)
+					if code, ok := tt.refused[key]; ok {
+						return &statusError{code: code}
+					}
+					return nil
+				})
+			}
+			if got := strings.Join(used, ","); got != tt.want {
+				t.Errorf("keys used %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyBenchEnds(t *testing.T) {
+	ring := newKeyRing("A,B")
+	ring.use(func(string) error { return &statusError{code: http.StatusTooManyRequests} })
+	if i := ring.pick(); ring.keys[i] != "B" {
+		t.Fatalf("picked %s while A is benched, want B", ring.keys[i])
+	}
+
+	ring.benched[0] = time.Now().Add(-time.Second)
+	var used []string
+	for i := 0; i < 2; i++ {
+		ring.use(func(key string) error { used = append(used, key); return nil })
+	}
+	if got := fmt.Sprint(used); got != "[A B]" {
+		t.Errorf("keys used %s once A's bench ended, want [A B]", got)
+	}
+}
+
+func TestKeysRotateAcrossLookups(t *testing.T) {
+	var used []string
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("APPID")
+		used = append(used, key)
+		if key == "B" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"main":{"temp":285}}`)
+	})
+
+	w := openWeatherMap{keys: newKeyRing("A,B,C")}
+	for i := 0; i < 5; i++ {
+		w.temperature(context.Background(), "Paris")
+	}
+	if got := fmt.Sprint(used); got != "[A B C A C]" {
+		t.Errorf("keys sent %s, want [A B C A C], B passed over once refused", got)
+	}
+}
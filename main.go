@@ -1,46 +1,300 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
-	mw := multiWeatherProvider{
-		openWeatherMap{apiKey: os.Getenv("OPEN_WEATHER_MAP_KEY")},
-		weatherUnderground{apiKey: os.Getenv("WEATHER_UNDERGROUND_KEY")},
-		darkSky{
-			apiKey:    os.Getenv("DARK_SKY_KEY"),
-			googleKey: os.Getenv("GOOGLE_GEOCODE_KEY"),
-		},
+	cfg := loadConfig()
+	secrets.add(cfg.openWeatherMapKey, cfg.weatherUndergroundKey, cfg.darkSkyKey, cfg.googleGeocodeKey, cfg.what3wordsKey, cfg.weatherbitKey)
+	resolver, err := newResolver(cfg.dnsServer)
+	if err != nil {
+		log.Fatalf("WEATHER_DNS_SERVER: %v", err)
+	}
+	upstream.client = newPooledClient(poolOptions{
+		maxIdlePerHost: cfg.maxIdleConnsPerHost,
+		idleTimeout:    cfg.idleConnTimeout,
+		keepAlive:      cfg.tcpKeepAlive,
+		resolver:       resolver,
+
+		connectTimeout:      cfg.connectTimeout,
+		tlsHandshakeTimeout: cfg.tlsHandshakeTimeout,
+		requestTimeout:      cfg.upstreamTimeout,
+	})
+	upstream.retry = retryPolicy{
+		attempts:      cfg.retryAttempts,
+		backoff:       cfg.retryBackoff,
+		maxBackoff:    cfg.maxRetryBackoff,
+		budget:        cfg.retryBudget,
+		maxRetryAfter: cfg.maxRetryAfter,
+	}
+	statuses, err := parseStatuses(cfg.retryStatuses)
+	if err != nil {
+		log.Fatalf("WEATHER_RETRY_STATUSES: %v", err)
+	}
+	upstream.retry.statuses = statuses
+	upstream.slots = newSlots(cfg.maxUpstream)
+	upstream.queueTimeout = cfg.upstreamQueueTimeout
+	upstream.maxBody = int64(cfg.maxResponseBytes)
+	upstream.logBodies = cfg.logBodies
+	if cfg.maxCityLength > 0 {
+		maxCityLength = cfg.maxCityLength
+	}
+	if region, err := parseRegion(cfg.geocodeRegion); err == nil {
+		defaultRegionBias = region
+	} else if cfg.geocodeRegion != "" {
+		log.Printf("config: WEATHER_GEOCODE_REGION: %v; not biasing geocoding", err)
+	}
+	if cfg.dryRun {
+		upstream.client = &http.Client{Transport: dryRunTransport{}}
 	}
 
-	http.HandleFunc("/hello", hello)
+	if cfg.what3wordsKey != "" {
+		words = what3words{apiKey: cfg.what3wordsKey}
+	}
 
-	http.HandleFunc("/weather/", func(w http.ResponseWriter, r *http.Request) {
-		begin := time.Now()
-		city := strings.SplitN(r.URL.Path, "/", 3)[2]
+	geocoders, err := newGeocoders(cfg.geocoders, cfg.googleGeocodeKey, cfg.geocodeTimeout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	geocoder := newCachedGeocoder(geocoders, cfg.geohashPrecision)
+
+	providers := newProviders(cfg, geocoder)
+
+	if cfg.checkConfig {
+		if !checkConfig(context.Background(), cfg, providers, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	s, err := newServer(cfg, geocoder, providers...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.cacheFile != "" {
+		// A cache that can't be loaded is only a cold start.
+		if n, err := s.cache.load(cfg.cacheFile); err != nil {
+			log.Printf("cache: loading %s: %v", cfg.cacheFile, err)
+		} else {
+			log.Printf("cache: loaded %d entries from %s", n, cfg.cacheFile)
+		}
+	}
 
-		temp, err := mw.temperature(city)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{Addr: cfg.addr, Handler: s}
+	srv.RegisterOnShutdown(s.shutdown)
+
+	// gRPC runs on a port of its own, as HTTP/2 without TLS, which is how
+	// it is usually spoken within a service mesh.
+	var grpcSrv *http.Server
+	if cfg.grpcAddr != "" {
+		grpcSrv = &http.Server{Addr: cfg.grpcAddr, Handler: s.grpc(), Protocols: new(http.Protocols)}
+		grpcSrv.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	// On a signal, stop accepting connections and let in-flight requests
+	// finish before main returns.
+	idle := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		log.Printf("shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+		if grpcSrv != nil {
+			if err := grpcSrv.Shutdown(ctx); err != nil {
+				log.Printf("gRPC shutdown: %v", err)
+			}
+		}
+		close(idle)
+	}()
+
+	monitoring := make(chan struct{})
+	if cfg.alertThresholds == "" {
+		close(monitoring)
+	} else {
+		thresholds, err := parseThresholds(cfg.alertThresholds)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			log.Fatal(err)
+		}
+		if cfg.alertWebhook == "" {
+			log.Fatal(errNoWebhook)
 		}
 
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"city": city,
-			"temp": int(temp),
-			"took": time.Since(begin).String(),
+		m := newMonitor(s.cache, thresholds, cfg.alertInterval, cfg.alertWebhook)
+		if !cfg.mock {
+			// Dark Sky will want every place geocoded.
+			m.geocoder = geocoder
+		}
+		go func() {
+			m.run(ctx)
+			close(monitoring)
+		}()
+	}
+
+	warming := make(chan struct{})
+	if places, err := parsePrewarm(cfg.prewarm, cfg.prewarmInterval); err != nil {
+		log.Fatalf("WEATHER_PREWARM: %v", err)
+	} else {
+		go func() {
+			prewarm(ctx, s.cache, places)
+			close(warming)
+		}()
+	}
+
+	if cfg.configFile != "" && cfg.configReload > 0 {
+		go watchConfig(ctx, cfg.configFile, cfg.configReload, s.live, func(cfg Config) error {
+			secrets.add(cfg.openWeatherMapKey, cfg.weatherUndergroundKey, cfg.darkSkyKey, cfg.weatherbitKey)
+			return s.reconfigure(cfg, newProviders(cfg, geocoder))
 		})
-	})
+	}
+
+	scheduling := make(chan struct{})
+	go func() {
+		s.sched.run(ctx)
+		close(scheduling)
+	}()
+
+	if grpcSrv != nil {
+		go func() {
+			log.Printf("gRPC listening on %s", cfg.grpcAddr)
+			if err := grpcSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	l, err := listen(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.tlsCert != "" || cfg.tlsKey != "" {
+		// ServeTLS negotiates HTTP/2 automatically.
+		log.Printf("listening on %s (TLS)", l.Addr())
+		err = srv.ServeTLS(l, cfg.tlsCert, cfg.tlsKey)
+	} else {
+		log.Printf("listening on %s", l.Addr())
+		err = srv.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-idle
+	<-monitoring
+	<-warming
+	<-scheduling
+
+	if cfg.cacheFile != "" {
+		if n, err := s.cache.save(cfg.cacheFile); err != nil {
+			log.Printf("cache: saving %s: %v", cfg.cacheFile, err)
+		} else {
+			log.Printf("cache: saved %d entries to %s", n, cfg.cacheFile)
+		}
+	}
+}
 
-	http.ListenAndServe(":8080", nil)
+// providerNames are the providers WEATHER_PROVIDERS may list.
+var providerNames = []string{"openWeatherMap", "weatherUnderground", "darkSky", "weatherbit"}
+
+// queries reports whether cfg has the provider called name queried: it is
+// listed in WEATHER_PROVIDERS, or that lists none.
+func (cfg Config) queries(name string) bool {
+	if len(cfg.providers) == 0 {
+		return true
+	}
+	for _, p := range cfg.providers {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newProviders returns the weather providers cfg configures.
+func newProviders(cfg Config, geocoder Geocoder) []weatherProvider {
+	if cfg.mock {
+		return mockProviders(cfg)
+	}
+
+	providers := []weatherProvider{
+		openWeatherMap{
+			keys:    newKeyRing(cfg.openWeatherMapKey),
+			headers: cfg.providerHeaders["openWeatherMap"],
+		},
+		weatherUnderground{
+			keys:    newKeyRing(cfg.weatherUndergroundKey),
+			headers: cfg.providerHeaders["weatherUnderground"],
+		},
+		darkSky{
+			keys:     newKeyRing(cfg.darkSkyKey),
+			headers:  cfg.providerHeaders["darkSky"],
+			geocoder: geocoder,
+		},
+	}
+	if cfg.weatherbitKey != "" {
+		providers = append(providers, weatherbit{
+			keys:    newKeyRing(cfg.weatherbitKey),
+			headers: cfg.providerHeaders["weatherbit"],
+		})
+	}
+
+	queried := providers[:0]
+	for _, p := range providers {
+		if cfg.queries(p.Name()) {
+			queried = append(queried, p)
+		}
+	}
+	return queried
+}
+
+// newServing combines providers as cfg says to.
+func newServing(cfg Config, providers []weatherProvider, observers []Observer, tracker *successTracker, variances *varianceTracker) (*serving, error) {
+	mw := multiWeatherProvider{
+		providers:        providers,
+		minProviders:     cfg.minProviders,
+		timeout:          cfg.aggregationTimeout,
+		providerTimeout:  cfg.providerTimeout,
+		providerTimeouts: cfg.providerTimeouts,
+		offsets:          cfg.providerOffsets,
+		observers:        observers,
+		tracker:          tracker,
+		adaptive:         cfg.adaptiveWeights,
+		variances:        variances,
+		inverseVariance:  cfg.inverseVariance,
+		sequential:       cfg.sequential,
+		representative:   cfg.representative,
+		modeResolution:   cfg.modeResolution,
+		trimmed:          cfg.trimmedMean,
+		valid:            &kelvinRange{cfg.minKelvin, cfg.maxKelvin},
+	}
+
+	s := &serving{cfg: cfg, providers: providers, multi: mw, source: mw}
+	if cfg.primaryProvider != "" {
+		h, ok := newHybridProvider(mw, cfg.primaryProvider)
+		if !ok {
+			return nil, fmt.Errorf("primary provider %q is not configured", cfg.primaryProvider)
+		}
+		s.source = h
+	}
+	return s, nil
 }
 
 func hello(w http.ResponseWriter, r *http.Request) {
@@ -48,184 +302,510 @@ func hello(w http.ResponseWriter, r *http.Request) {
 }
 
 type weatherProvider interface {
-	temperature(city string) (float64, error) // Kelvin
+	temperature(ctx context.Context, city string) (float64, error) // Kelvin
+
+	// Name is the name the provider is known by everywhere: in logs,
+	// metrics labels, a result's sources, and the configuration that
+	// refers to providers by name, such as WEATHER_PRIMARY_PROVIDER.
+	Name() string
+}
+
+// funcProvider adapts an ordinary function into a weatherProvider, for
+// plugging in a weather source of one's own without defining a type for it.
+// Like any provider, it is given a city and returns Kelvin.
+type funcProvider func(ctx context.Context, city string) (float64, error)
+
+func (f funcProvider) temperature(ctx context.Context, city string) (float64, error) {
+	return f(ctx, city)
 }
 
-type multiWeatherProvider []weatherProvider
+// Name is the same for every funcProvider. A source that needs a name of its
+// own should be a type of its own.
+func (f funcProvider) Name() string { return "funcProvider" }
+
+// errNoProviders is returned when a temperature is requested from an empty
+// set of providers, rather than dividing by zero.
+var errNoProviders = errors.New("no weather providers configured")
 
 type openWeatherMap struct {
-	apiKey string
+	keys    *keyRing
+	headers http.Header
 }
 
 type weatherUnderground struct {
-	apiKey string
+	keys    *keyRing
+	headers http.Header
 }
 
 type darkSky struct {
-	apiKey    string
-	googleKey string
+	keys     *keyRing
+	headers  http.Header
+	geocoder Geocoder
+}
+
+func (w openWeatherMap) Name() string     { return "openWeatherMap" }
+func (w weatherUnderground) Name() string { return "weatherUnderground" }
+func (w darkSky) Name() string            { return "darkSky" }
+
+func (w openWeatherMap) Attribution() string     { return "Weather data provided by OpenWeather" }
+func (w weatherUnderground) Attribution() string { return "Data provided by Weather Underground" }
+func (w darkSky) Attribution() string            { return "Powered by Dark Sky" }
+
+func (w openWeatherMap) capabilities() Capabilities {
+	return capTemperature | capCoordinates | capConditions | capSunTimes | capCloudCover | capPressure | capVisibility | capAccumulation | capWind | capHumidity
 }
 
-func (w openWeatherMap) temperature(city string) (float64, error) {
-	resp, err := http.Get("http://api.openweathermap.org/data/2.5/weather?APPID=" + w.apiKey + "&q=" + city)
+func (w openWeatherMap) temperature(ctx context.Context, city string) (float64, error) {
+	q, err := parsePlace(city)
 	if err != nil {
 		return 0, err
 	}
 
-	defer resp.Body.Close()
+	c, err := w.conditions(ctx, q)
+	return c.Kelvin, err
+}
+
+func (w openWeatherMap) temperatureAt(ctx context.Context, c coordinates) (float64, error) {
+	cond, err := w.conditions(ctx, query{coords: &c})
+	return cond.Kelvin, err
+}
 
+func (w openWeatherMap) conditions(ctx context.Context, q query) (Conditions, error) {
+	// OpenWeatherMap takes the same "city,state,country" form we do.
 	var d struct {
 		Main struct {
-			Kelvin float64 `json:"temp"`
+			Kelvin    *float64 `json:"temp"`
+			FeelsLike *float64 `json:"feels_like"` // Kelvin
+			Pressure  *float64 `json:"pressure"`   // hPa
+			Humidity  *float64 `json:"humidity"`   // percent
 		} `json:"main"`
+		Sys struct {
+			Sunrise int64 `json:"sunrise"`
+			Sunset  int64 `json:"sunset"`
+		} `json:"sys"`
+		Clouds struct {
+			All *float64 `json:"all"` // percent
+		} `json:"clouds"`
+		Weather []struct {
+			Description string `json:"description"`
+		} `json:"weather"`
+		Wind struct {
+			Speed *float64 `json:"speed"` // m/s
+		} `json:"wind"`
+		Visibility *float64 `json:"visibility"` // meters
+		Timezone   *int     `json:"timezone"`   // seconds east of UTC
+
+		// Rain and snow are only reported where some has fallen.
+		Rain struct {
+			LastHour *float64 `json:"1h"` // mm
+		} `json:"rain"`
+		Snow struct {
+			LastHour *float64 `json:"1h"` // mm
+		} `json:"snow"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
-		return 0, err
+	err := w.keys.use(func(key string) error {
+		return getJSONWith(ctx, w.weatherURL(q, key), w.headers, &d)
+	})
+	if err != nil {
+		return Conditions{}, err
+	}
+	if d.Main.Kelvin == nil {
+		return Conditions{}, schemaDrift(w.Name(), "main.temp")
+	}
+
+	log.Printf("%s: %s: %.2f", w.Name(), q, *d.Main.Kelvin)
+
+	summary := ""
+	if len(d.Weather) > 0 {
+		summary = d.Weather[0].Description
+	}
+
+	// Without an offset, times are at least shown in UTC.
+	zone := time.UTC
+	if d.Timezone != nil {
+		zone = time.FixedZone("", *d.Timezone)
 	}
+	return Conditions{
+		Kelvin:     *d.Main.Kelvin,
+		Native:     &nativeReading{*d.Main.Kelvin, kelvin},
+		FeelsLike:  d.Main.FeelsLike,
+		Sunrise:    unixTime(d.Sys.Sunrise, zone),
+		Sunset:     unixTime(d.Sys.Sunset, zone),
+		UTCOffset:  d.Timezone,
+		CloudCover: d.Clouds.All,
+		Pressure:   d.Main.Pressure,
+		Visibility: d.Visibility,
+		WindSpeed:  d.Wind.Speed,
+		Humidity:   d.Main.Humidity,
+		Rain:       d.Rain.LastHour,
+		Snow:       d.Snow.LastHour,
+		Summary:    summary,
+	}, nil
+}
 
-	log.Printf("openWeatherMap: %s: %.2f", city, d.Main.Kelvin)
-	return d.Main.Kelvin, nil
+// weatherURL is the URL of the current weather at q, asked for with key.
+// Everything taken from the query is escaped, so that no place name can
+// alter the request.
+func (w openWeatherMap) weatherURL(q query, key string) string {
+	params := "q=" + url.QueryEscape(q.address())
+	if q.coords != nil {
+		params = "lat=" + fmt.Sprint(q.coords.lat) + "&lon=" + fmt.Sprint(q.coords.lon)
+	}
+	if q.lang != "" {
+		params += "&lang=" + url.QueryEscape(openWeatherMapLang(q.lang))
+	}
+	return "http://api.openweathermap.org/data/2.5/weather?APPID=" + key + "&" + params
 }
 
-func (w weatherUnderground) temperature(city string) (float64, error) {
-	resp, err := http.Get("http://api.wunderground.com/api/" + w.apiKey + "/conditions/q/" + city + ".json")
+// openWeatherMapLang converts a language tag to OpenWeatherMap's form. It
+// knows only a few regional variants, written with an underscore as in
+// "pt_br"; for the rest, the language alone is sent.
+func openWeatherMapLang(lang string) string {
+	switch lang {
+	case "pt-br", "zh-cn", "zh-tw":
+		return strings.Replace(lang, "-", "_", 1)
+	}
+	return strings.SplitN(lang, "-", 2)[0]
+}
+
+func (w weatherUnderground) capabilities() Capabilities {
+	return capTemperature | capCoordinates | capConditions | capPressure | capVisibility | capWind | capHumidity
+}
+
+func (w weatherUnderground) temperature(ctx context.Context, city string) (float64, error) {
+	q, err := parsePlace(city)
 	if err != nil {
 		return 0, err
 	}
 
-	defer resp.Body.Close()
+	c, err := w.conditions(ctx, q)
+	return c.Kelvin, err
+}
+
+func (w weatherUnderground) temperatureAt(ctx context.Context, c coordinates) (float64, error) {
+	cond, err := w.conditions(ctx, query{coords: &c})
+	return cond.Kelvin, err
+}
 
+func (w weatherUnderground) conditions(ctx context.Context, q query) (Conditions, error) {
 	var d struct {
 		Observation struct {
-			Celsius float64 `json:"temp_c"`
+			Celsius *float64 `json:"temp_c"`
+
+			// Weather Underground quotes its measurements, as in
+			// "30.01", and leaves them blank when it has none.
+			Pressure   string `json:"pressure_in"` // inHg
+			Visibility string `json:"visibility_km"`
+
+			Wind     *float64 `json:"wind_kph"`
+			Humidity string   `json:"relative_humidity"` // as in "65%"
+
+			// Where the place asked after is, as Weather Underground
+			// resolved it, and the station that observed it.
+			Display struct {
+				Latitude  string `json:"latitude"`
+				Longitude string `json:"longitude"`
+			} `json:"display_location"`
+			Station struct {
+				Latitude  string `json:"latitude"`
+				Longitude string `json:"longitude"`
+			} `json:"observation_location"`
 		} `json:"current_observation"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
-		return 0, err
+	err := w.keys.use(func(key string) error {
+		return getJSONWith(ctx, w.conditionsURL(q, key), w.headers, &d)
+	})
+	if err != nil {
+		return Conditions{}, err
+	}
+	if d.Observation.Celsius == nil {
+		return Conditions{}, schemaDrift(w.Name(), "current_observation.temp_c")
 	}
 
-	kelvin := d.Observation.Celsius + 273.15
-	log.Printf("weatherUnderground: %s: %.2f", city, kelvin)
-	return kelvin, nil
+	kelvin := celsiusToKelvin(*d.Observation.Celsius)
+	log.Printf("%s: %s: %.2f", w.Name(), q, kelvin)
+
+	cond := Conditions{Kelvin: kelvin, Native: &nativeReading{*d.Observation.Celsius, celsius}}
+	if in, err := strconv.ParseFloat(d.Observation.Pressure, 64); err == nil {
+		hpa := inHgToHPa(in)
+		cond.Pressure = &hpa
+	}
+	if km, err := strconv.ParseFloat(d.Observation.Visibility, 64); err == nil {
+		m := kmToMeters(km)
+		cond.Visibility = &m
+	}
+	if kph := d.Observation.Wind; kph != nil {
+		ms := kphToMS(*kph)
+		cond.WindSpeed = &ms
+	}
+	if rh, err := strconv.ParseFloat(strings.TrimSuffix(d.Observation.Humidity, "%"), 64); err == nil {
+		cond.Humidity = &rh
+	}
+
+	// Measure from the coordinates asked for, or else from where Weather
+	// Underground placed the city. Either may be missing; then so is the
+	// distance.
+	place, err := parseCoordinates(d.Observation.Display.Latitude, d.Observation.Display.Longitude)
+	if q.coords != nil {
+		place, err = *q.coords, nil
+	}
+	station, serr := parseCoordinates(d.Observation.Station.Latitude, d.Observation.Station.Longitude)
+	if err == nil && serr == nil {
+		m := place.distanceTo(station)
+		cond.StationDistance = &m
+	}
+	return cond, nil
+}
+
+// conditionsURL is the URL of the current conditions at q, asked for with
+// key. Each path segment taken from the query is escaped, so that no place
+// name can add segments of its own or a query string.
+func (w weatherUnderground) conditionsURL(q query, key string) string {
+	// The place is "lat,lon", or a city, optionally qualified by state as in
+	// "CA/San Francisco", or else by country as in "France/Paris".
+	place := url.PathEscape(q.city)
+	switch {
+	case q.coords != nil:
+		place = url.PathEscape(q.coords.String())
+	case q.state != "":
+		place = url.PathEscape(q.state) + "/" + place
+	case q.country != "":
+		place = url.PathEscape(q.country) + "/" + place
+	}
+	return "http://api.wunderground.com/api/" + key + "/conditions/q/" + place + ".json"
 }
 
-func (w darkSky) temperature(city string) (float64, error) {
-	lattitude, longitude, err := w.getCoords(city, w.googleKey)
+func (w darkSky) capabilities() Capabilities {
+	return capTemperature | capCoordinates | capConditions | capSunTimes | capCloudCover | capPressure | capUVIndex | capVisibility | capPrecipitation | capAccumulation | capMoonPhase | capWind | capHumidity | capHistory
+}
+
+func (w darkSky) temperature(ctx context.Context, city string) (float64, error) {
+	q, err := parsePlace(city)
 	if err != nil {
 		return 0, err
 	}
 
-	lat := fmt.Sprint(lattitude)
-	lon := fmt.Sprint(longitude)
+	c, err := w.conditions(ctx, q)
+	return c.Kelvin, err
+}
+
+func (w darkSky) temperatureOf(ctx context.Context, q query) (float64, error) {
+	c, err := w.conditions(ctx, q)
+	return c.Kelvin, err
+}
 
-	resp, err := http.Get("https://api.darksky.net/forecast/" + w.apiKey + "/" + lat + "," + lon + "?exclude=minutely,hourly,daily,alerts,flags&units=si")
+func (w darkSky) temperatureAt(ctx context.Context, c coordinates) (float64, error) {
+	cond, err := w.conditions(ctx, query{coords: &c})
+	return cond.Kelvin, err
+}
+
+// locate is where q's place is, geocoding it if need be: Dark Sky only takes
+// coordinates.
+func (w darkSky) locate(ctx context.Context, q query) (coordinates, error) {
+	if q.coords != nil {
+		return *q.coords, nil
+	}
+
+	lat, lon, err := w.geocoder.geocode(ctx, q.address(), q.country, q.regionBias())
 	if err != nil {
-		return 0, err
+		return coordinates{}, &geocodeError{err}
 	}
+	return coordinates{lat, lon}, nil
+}
 
-	defer resp.Body.Close()
+func (w darkSky) conditions(ctx context.Context, q query) (Conditions, error) {
+	c, err := w.locate(ctx, q)
+	if err != nil {
+		return Conditions{}, err
+	}
 
 	var d struct {
+		Timezone  string
+		Offset    float64 // hours east of UTC
 		Currently struct {
-			Temperature float64
+			Temperature         *float64
+			ApparentTemperature *float64 // °C, with units=si
+			CloudCover          *float64 // 0-1
+			Pressure            *float64 // hPa
+			UVIndex             *float64
+			Visibility          *float64 // km, with units=si
+			WindSpeed           *float64 // m/s, with units=si
+			Humidity            *float64 // 0-1
+			Summary             string
+
+			PrecipProbability *float64 // 0-1
+			PrecipIntensity   *float64 // mm an hour, with units=si
+			PrecipType        string   // "rain", "snow" or "sleet"
+		}
+		Daily struct {
+			Data []struct {
+				SunriseTime int64
+				SunsetTime  int64
+
+				PrecipAccumulation *float64 // cm of snow, with units=si
+				MoonPhase          *float64 // 0-1, from the new moon
+			}
 		}
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
-		return 0, err
+	err = w.keys.use(func(key string) error {
+		return getJSONWith(ctx, w.forecastURL(c, q.lang, key), w.headers, &d)
+	})
+	if err != nil {
+		return Conditions{}, err
+	}
+	if d.Currently.Temperature == nil {
+		return Conditions{}, schemaDrift(w.Name(), "currently.temperature")
 	}
 
-	kelvin := d.Currently.Temperature + 273.15
-	log.Printf("darkSky: %s: %.2f", city, kelvin)
-	return kelvin, nil
+	kelvin := celsiusToKelvin(*d.Currently.Temperature)
+	log.Printf("%s: %s: %.2f", w.Name(), q, kelvin)
+
+	cond := Conditions{
+		Kelvin:     kelvin,
+		Native:     &nativeReading{*d.Currently.Temperature, celsius},
+		FeelsLike:  celsiusToKelvinPtr(d.Currently.ApparentTemperature),
+		CloudCover: fractionToPercent(d.Currently.CloudCover),
+		Pressure:   d.Currently.Pressure,
+		UVIndex:    d.Currently.UVIndex,
+		Visibility: kmToMetersPtr(d.Currently.Visibility),
+		WindSpeed:  d.Currently.WindSpeed,
+		Humidity:   fractionToPercent(d.Currently.Humidity),
+		TimeZone:   d.Timezone,
+		Summary:    d.Currently.Summary,
+
+		PrecipProbability: fractionToPercent(d.Currently.PrecipProbability),
+	}
+
+	// Dark Sky reports one intensity, of whatever is falling. Its type is
+	// left out when nothing is, in which case neither rain nor snow is.
+	if i := d.Currently.PrecipIntensity; i != nil {
+		rain, snow := *i, 0.0
+		if t := d.Currently.PrecipType; t == "snow" || t == "sleet" {
+			rain, snow = 0, *i
+		}
+		cond.Rain, cond.Snow = &rain, &snow
+	}
+
+	// Today's forecast is first.
+	if len(d.Daily.Data) > 0 {
+		loc, err := time.LoadLocation(d.Timezone)
+		if err != nil {
+			loc = time.FixedZone(d.Timezone, int(d.Offset*3600))
+		}
+		cond.Sunrise = unixTime(d.Daily.Data[0].SunriseTime, loc)
+		cond.Sunset = unixTime(d.Daily.Data[0].SunsetTime, loc)
+		cond.SnowAccumulation = cmToMMPtr(d.Daily.Data[0].PrecipAccumulation)
+		cond.MoonPhase = d.Daily.Data[0].MoonPhase
+	}
+
+	return cond, nil
 }
 
-func (w darkSky) getCoords(city string, key string) (float64, float64, error) {
-	res, err := http.Get("https://maps.googleapis.com/maps/api/geocode/json?address=" + city + "&key=" + key)
+// history is the mean of the day's high and low at q's place, from Dark
+// Sky's time machine.
+func (w darkSky) history(ctx context.Context, q query, day time.Time) (float64, error) {
+	c, err := w.locate(ctx, q)
 	if err != nil {
-		return 0, 0, err
+		return 0, err
 	}
 
-	defer res.Body.Close()
-
-	var g struct {
-		Results []struct {
-			Geometry struct {
-				Location struct {
-					Lat float64
-					Lng float64
-				}
+	var d struct {
+		Daily struct {
+			Data []struct {
+				TemperatureHigh float64
+				TemperatureLow  float64
 			}
 		}
 	}
 
-	if err := json.NewDecoder(res.Body).Decode(&g); err != nil {
-		return 0, 0, err
+	err = w.keys.use(func(key string) error {
+		return getJSONWith(ctx, w.timeMachineURL(c, day, key), w.headers, &d)
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	lat := g.Results[0].Geometry.Location.Lat
-	lon := g.Results[0].Geometry.Location.Lng
+	if len(d.Daily.Data) == 0 {
+		return 0, &decodeError{errors.New("no daily data")}
+	}
 
-	return lat, lon, err
+	day0 := d.Daily.Data[0]
+	kelvin := celsiusToKelvin((day0.TemperatureHigh + day0.TemperatureLow) / 2)
+	log.Printf("%s: %s on %s: %.2f", w.Name(), q, day.Format(historyDateLayout), kelvin)
+	return kelvin, nil
 }
 
-func (w multiWeatherProvider) temperature(city string) (float64, error) {
+// forecastURL is the URL of the current weather at c, asked for with key and
+// described in lang if that is set. Dark Sky only knows languages, not
+// regional variants.
+func (w darkSky) forecastURL(c coordinates, lang, key string) string {
+	u := "https://api.darksky.net/forecast/" + key + "/" + c.String() + "?exclude=minutely,hourly,alerts,flags&units=si"
+	if lang != "" {
+		u += "&lang=" + url.QueryEscape(strings.SplitN(lang, "-", 2)[0])
+	}
+	return u
+}
 
-	// Make a channel for temperatures, and a channel for errors.
-	// Each provider will push a value into only one.
-	temps := make(chan float64, len(w))
-	errs := make(chan error, len(w))
+// timeMachineURL is the URL of the day's weather at c, asked for with key.
+// The time given is noon UTC, which falls on the same calendar day in most of
+// the world's time zones; Dark Sky answers for the local day containing it.
+func (w darkSky) timeMachineURL(c coordinates, day time.Time, key string) string {
+	noon := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, time.UTC)
+	return "https://api.darksky.net/forecast/" + key + "/" + c.String() + "," + strconv.FormatInt(noon.Unix(), 10) + "?exclude=currently,minutely,hourly,alerts,flags&units=si"
+}
 
-	// For each provider, spawn a goroutine with an anonymous function.
-	// That function will invoke the temperature method, and forward the response.
-	for _, provider := range w {
-		go func(p weatherProvider) {
-			k, err := p.temperature(city)
-			if err != nil {
-				errs <- err
-				return
-			}
-			temps <- k
-		}(provider)
+// temperature queries each provider in turn and returns the average, in
+// Kelvin. It is strict: the first provider error is returned, and the
+// providers after it aren't asked. See temperatureTolerant for an average
+// of whichever succeed.
+func temperature(ctx context.Context, city string, providers ...weatherProvider) (float64, error) {
+	if len(providers) == 0 {
+		return 0, errNoProviders
 	}
 
 	sum := 0.0
 
-	// Collect a temperature or an error from each provider.
-	for i := 0; i < len(w); i++ {
-		select {
-		case temp := <-temps:
-			sum += temp
-		case err := <-errs:
+	for _, provider := range providers {
+		k, err := provider.temperature(ctx, city)
+		if err != nil {
 			return 0, err
 		}
-	}
 
-	// Average the temps
-	avg := sum / float64(len(w))
-
-	// Convert to Celsius
-	c := avg - 273.15
-	// Convert to Fahrenheit
-	f := c*1.8 + 32
+		sum += k
+	}
 
-	// Return the average.
-	return f, nil
+	return sum / float64(len(providers)), nil
 }
 
-func temperature(city string, providers ...weatherProvider) (float64, error) {
-	sum := 0.0
+// temperatureTolerant is temperature for when some providers may fail: it
+// averages those that succeed, and only fails, with the first provider's
+// error, if none do.
+func temperatureTolerant(ctx context.Context, city string, providers ...weatherProvider) (float64, error) {
+	if len(providers) == 0 {
+		return 0, errNoProviders
+	}
+
+	sum, n := 0.0, 0
+	var firstErr error
 
 	for _, provider := range providers {
-		k, err := provider.temperature(city)
+		k, err := provider.temperature(ctx, city)
 		if err != nil {
-			return 0, err
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
 		}
 
 		sum += k
+		n++
 	}
 
-	return sum / float64(len(providers)), nil
+	if n == 0 {
+		return 0, firstErr
+	}
+	return sum / float64(n), nil
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeProvider is a weatherProvider for tests, known by name. It answers with
+// kelvin, or with err if that is set, after delay, and counts how often it is
+// asked.
+type fakeProvider struct {
+	name   string
+	kelvin float64
+	err    error
+	delay  time.Duration
+
+	calls atomic.Int32
+}
+
+func (f *fakeProvider) Name() string { return f.name }
+
+func (f *fakeProvider) temperature(ctx context.Context, city string) (float64, error) {
+	f.calls.Add(1)
+	if f.delay > 0 {
+		t := time.NewTimer(f.delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.kelvin, nil
+}
+
+// logBuffer collects log output, safely for the goroutines serving requests.
+type logBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *logBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// captureLog collects what is logged until the test ends.
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	l := &logBuffer{}
+	prev := log.Writer()
+	log.SetOutput(l)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return l
+}
+
+func TestTemperature(t *testing.T) {
+	errDown := errors.New("provider down")
+	errRejected := errors.New("key rejected")
+
+	// Each case is run through temperature and multiWeatherProvider, which
+	// fail on any provider error, and temperatureTolerant, which fails only
+	// if every provider does.
+	type outcome struct {
+		want    float64
+		wantErr error
+	}
+	tests := []struct {
+		name             string
+		providers        []weatherProvider
+		strict, tolerant outcome
+	}{
+		{"no providers", nil, outcome{0, errNoProviders}, outcome{0, errNoProviders}},
+		{"every provider failing", []weatherProvider{
+			&fakeProvider{name: "a", err: errRejected},
+			// Later, so that multiWeatherProvider, asking both at once,
+			// also hears from a first.
+			&fakeProvider{name: "b", err: errDown, delay: 10 * time.Millisecond},
+		}, outcome{0, errRejected}, outcome{0, errRejected}},
+		{"one provider failing", []weatherProvider{
+			&fakeProvider{name: "a", kelvin: 280},
+			&fakeProvider{name: "b", err: errDown},
+			&fakeProvider{name: "c", kelvin: 290},
+		}, outcome{0, errDown}, outcome{285, nil}},
+		{"every provider answering", []weatherProvider{
+			&fakeProvider{name: "a", kelvin: 280},
+			&fakeProvider{name: "b", kelvin: 290},
+		}, outcome{285, nil}, outcome{285, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, fn := range []struct {
+				name string
+				f    func(context.Context, string) (float64, error)
+				outcome
+			}{
+				{"temperature", func(ctx context.Context, city string) (float64, error) {
+					return temperature(ctx, city, tt.providers...)
+				}, tt.strict},
+				{"multiWeatherProvider", multiWeatherProvider{providers: tt.providers}.temperature, tt.strict},
+				{"temperatureTolerant", func(ctx context.Context, city string) (float64, error) {
+					return temperatureTolerant(ctx, city, tt.providers...)
+				}, tt.tolerant},
+			} {
+				got, err := fn.f(context.Background(), "Paris")
+				if !errors.Is(err, fn.wantErr) {
+					t.Errorf("%s: error %v, want %v", fn.name, err, fn.wantErr)
+				}
+				if got != fn.want {
+					t.Errorf("%s = %v, want %v", fn.name, got, fn.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFuncProvider(t *testing.T) {
+	errDown := errors.New("station offline")
+
+	tests := []struct {
+		name    string
+		reading float64
+		err     error
+		want    float64
+		sources []string
+	}{
+		{"answering", 290, nil, 285, []string{"fake", "funcProvider"}},
+		{"failing", 0, errDown, 280, []string{"fake"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var asked []string
+			own := funcProvider(func(ctx context.Context, city string) (float64, error) {
+				asked = append(asked, city)
+				return tt.reading, tt.err
+			})
+			w := multiWeatherProvider{
+				providers:    []weatherProvider{&fakeProvider{name: "fake", kelvin: 280}, own},
+				minProviders: 1,
+			}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris", country: "FR"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.temp.Kelvin() != tt.want || strings.Join(res.sources, ",") != strings.Join(tt.sources, ",") {
+				t.Errorf("%v K from %v, want %v K from %v", res.temp.Kelvin(), res.sources, tt.want, tt.sources)
+			}
+			if len(asked) != 1 || asked[0] != "Paris,FR" {
+				t.Errorf("closure asked about %q, want Paris,FR once", asked)
+			}
+		})
+	}
+}
+
+func TestCanonicalNames(t *testing.T) {
+	tests := []struct {
+		provider weatherProvider
+		want     string
+	}{
+		{openWeatherMap{keys: newKeyRing("KEY")}, "openWeatherMap"},
+		{weatherUnderground{keys: newKeyRing("KEY")}, "weatherUnderground"},
+		{darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}}, "darkSky"},
+		{multiWeatherProvider{}, "multi"},
+	}
+	var providers []weatherProvider
+	var names []string
+	for _, tt := range tests {
+		if got := tt.provider.Name(); got != tt.want {
+			t.Errorf("%T named %q, want %q", tt.provider, got, tt.want)
+		}
+		if _, ok := tt.provider.(multiWeatherProvider); !ok {
+			providers = append(providers, tt.provider)
+			names = append(names, tt.want)
+		}
+	}
+	for i, m := range mockProviders(Config{}) {
+		if want := fmt.Sprint("mock", i+1); m.Name() != want {
+			t.Errorf("mock %d named %q, want %q", i, m.Name(), want)
+		}
+	}
+
+	// The same names are the sources of a reading, what is logged, and the
+	// metrics labels.
+	servePayloads(t, dryRunResponses)
+	logged := captureLog(t)
+	r := &metricsRegistry{}
+	w := multiWeatherProvider{providers: providers, observers: []Observer{newProviderMetrics(r)}}
+
+	res, err := w.aggregate(context.Background(), query{city: "Paris"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sources := append([]string(nil), res.sources...)
+	sort.Strings(sources)
+	sort.Strings(names)
+	if strings.Join(sources, ",") != strings.Join(names, ",") {
+		t.Errorf("sources %q, want %q", sources, names)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, name := range names {
+		if !strings.Contains(logged.String(), name+": Paris: ") {
+			t.Errorf("no reading from %s logged:\n%s", name, logged)
+		}
+		if !strings.Contains(rec.Body.String(), `provider="`+name+`"`) {
+			t.Errorf("metrics lack provider=%q", name)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsRegistry is a minimal collection of metrics that can be rendered in
+// the Prometheus text exposition format.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+// openMetricsCollector is implemented by collectors whose OpenMetrics
+// rendering differs from their Prometheus one. Others are written the same
+// way in both formats.
+type openMetricsCollector interface {
+	writeOpenMetrics(w io.Writer)
+}
+
+func (r *metricsRegistry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Only OpenMetrics can carry exemplars, so serve it to scrapers that ask.
+	if !strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text") {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, c := range r.collectors {
+			c.writeTo(w)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	for _, c := range r.collectors {
+		if om, ok := c.(openMetricsCollector); ok {
+			om.writeOpenMetrics(w)
+		} else {
+			c.writeTo(w)
+		}
+	}
+	fmt.Fprint(w, "# EOF\n")
+}
+
+// counter is a monotonically increasing value.
+type counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+func (r *metricsRegistry) newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	r.register(c)
+	return c
+}
+
+func (c *counter) inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *counter) get() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *counter) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.get())
+}
+
+// writeOpenMetrics names the family without the _total suffix that
+// OpenMetrics adds to counter samples itself.
+func (c *counter) writeOpenMetrics(w io.Writer) {
+	family := strings.TrimSuffix(c.name, "_total")
+	fmt.Fprintf(w, "# HELP %s %s\n", family, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", family)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.get())
+}
+
+// counterVec is a family of counters partitioned by a fixed set of labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu       sync.Mutex
+	counters map[string]*counter // keyed by rendered label pairs
+}
+
+func (r *metricsRegistry) newCounterVec(name, help string, labels ...string) *counterVec {
+	v := &counterVec{name: name, help: help, labels: labels, counters: map[string]*counter{}}
+	r.register(v)
+	return v
+}
+
+// with returns the counter for the given label values, in the order the
+// labels were declared.
+func (v *counterVec) with(values ...string) *counter {
+	key := labelPairs(v.labels, values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.counters[key]
+	if !ok {
+		c = &counter{name: v.name}
+		v.counters[key] = c
+	}
+	return c
+}
+
+func (v *counterVec) writeTo(w io.Writer) {
+	v.write(w, v.name)
+}
+
+func (v *counterVec) writeOpenMetrics(w io.Writer) {
+	v.write(w, strings.TrimSuffix(v.name, "_total"))
+}
+
+func (v *counterVec) write(w io.Writer, family string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.counters))
+	for k := range v.counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", family, v.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", family)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", v.name, k, v.counters[k].get())
+	}
+}
+
+// labelPairs renders label values, in the order the labels were declared, as
+// in provider="darkSky",category="timeout".
+func labelPairs(labels, values []string) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		pairs[i] = fmt.Sprintf("%s=%q", l, values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+// histogramVec is a family of histograms partitioned by a fixed set of
+// labels. Each bucket remembers an exemplar, the trace behind its latest
+// observation, so that a slow bucket can be followed to a request that fell
+// into it. Exemplars are only rendered in the OpenMetrics format.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds, ascending; +Inf is implied
+
+	mu     sync.Mutex
+	series map[string]*histogram // keyed by rendered label pairs
+}
+
+type histogram struct {
+	counts    []uint64   // per bucket, not cumulative; the last is +Inf
+	exemplars []exemplar // per bucket
+	sum       float64
+	count     uint64
+}
+
+// exemplar is an observation tied to the trace it was made in.
+type exemplar struct {
+	traceID string
+	value   float64
+	at      time.Time
+}
+
+func (r *metricsRegistry) newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	v := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	r.register(v)
+	return v
+}
+
+// observe records value in the histogram for the given label values. If
+// traceID is set, the observation becomes its bucket's exemplar.
+func (v *histogramVec) observe(value float64, traceID string, values ...string) {
+	key := labelPairs(v.labels, values)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	h, ok := v.series[key]
+	if !ok {
+		h = &histogram{
+			counts:    make([]uint64, len(v.buckets)+1),
+			exemplars: make([]exemplar, len(v.buckets)+1),
+		}
+		v.series[key] = h
+	}
+
+	i := sort.SearchFloat64s(v.buckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+	if traceID != "" {
+		h.exemplars[i] = exemplar{traceID, value, time.Now()}
+	}
+}
+
+func (v *histogramVec) writeTo(w io.Writer) {
+	v.write(w, false)
+}
+
+func (v *histogramVec) writeOpenMetrics(w io.Writer) {
+	v.write(w, true)
+}
+
+func (v *histogramVec) write(w io.Writer, exemplars bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", v.name)
+	for _, k := range keys {
+		h := v.series[k]
+
+		cumulative := uint64(0)
+		for i, n := range h.counts {
+			cumulative += n
+
+			le := "+Inf"
+			if i < len(v.buckets) {
+				le = strconv.FormatFloat(v.buckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d", v.name, k, le, cumulative)
+
+			if e := h.exemplars[i]; exemplars && e.traceID != "" {
+				fmt.Fprintf(w, " # {trace_id=%q} %g %.3f", e.traceID, e.value, float64(e.at.UnixNano())/1e9)
+			}
+			fmt.Fprint(w, "\n")
+		}
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", v.name, k, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", v.name, k, h.count)
+	}
+}
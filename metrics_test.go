@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLatencyExemplars(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	const exemplar = `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"}`
+	const openMetrics = "application/openmetrics-text; version=1.0.0"
+
+	tests := []struct {
+		name         string
+		tracing      bool
+		traceparent  string
+		accept       string
+		wantExemplar bool
+	}{
+		{"traced request", true, traceparent, openMetrics, true},
+		{"no trace context", true, "", openMetrics, false},
+		{"tracing disabled", false, traceparent, openMetrics, false},
+		{"Prometheus text format", true, traceparent, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &metricsRegistry{}
+			mw := multiWeatherProvider{
+				providers: []weatherProvider{&fakeProvider{name: "alpha", kelvin: 285}},
+				observers: []Observer{newProviderMetrics(r)},
+			}
+			// As main sets it up, with tracing on or off.
+			var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, err := mw.aggregate(r.Context(), query{city: "Paris"}); err != nil {
+					t.Error(err)
+				}
+			})
+			if tt.tracing {
+				h = traced(h)
+			}
+
+			req := httptest.NewRequest("GET", "/weather/Paris", nil)
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			req = httptest.NewRequest("GET", "/metrics", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			var bucket string
+			for _, line := range strings.Split(rec.Body.String(), "\n") {
+				if strings.HasPrefix(line, `weather_provider_latency_seconds_bucket{provider="alpha",le="0.05"}`) {
+					bucket = line
+				}
+			}
+			if bucket == "" {
+				t.Fatalf("no latency bucket for the provider in:\n%s", rec.Body)
+			}
+			if got := strings.Contains(bucket, exemplar); got != tt.wantExemplar {
+				t.Errorf("bucket %q: exemplar %v, want %v", bucket, got, tt.wantExemplar)
+			}
+		})
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		h, want string
+		ok      bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"", "", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "", false},
+		{"00-4bf92f35-00f067aa0ba902b7-01", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := parseTraceparent(tt.h)
+		if id != tt.want || ok != tt.ok {
+			t.Errorf("parseTraceparent(%q) = %q, %v, want %q, %v", tt.h, id, ok, tt.want, tt.ok)
+		}
+	}
+}
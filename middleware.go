@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cors allows browsers on the given origins to call h. An origin of "*"
+// allows any. With no origins, h is returned unchanged and no CORS headers
+// are sent.
+func cors(origins []string, h http.Handler) http.Handler {
+	if len(origins) == 0 {
+		return h
+	}
+
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[o] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		if origin == "" || !(allowed["*"] || allowed[origin]) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if allowed["*"] {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		// A preflight asks permission for the real request; answer it here
+		// rather than passing it on. The methods are those of every API
+		// endpoint together: POST is for /schedule.
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// readOnly lets through only GET and HEAD requests, answering the rest with
+// 405 Method Not Allowed. Any request body is dropped unread, as h has no use
+// for one.
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "use GET or HEAD", http.StatusMethodNotAllowed)
+			return
+		}
+
+		r.Body = http.NoBody
+		h.ServeHTTP(w, r)
+	})
+}
+
+// memoized has each request to h fetch each upstream URL at most once, so
+// that a request wanting several of a provider's fields, or the same place
+// twice, makes one upstream call per provider; see payloads.
+func memoized(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(withPayloads(r.Context())))
+	})
+}
+
+// shedLoad bounds how many requests h serves at once to workers, with up to
+// depth more queued for a free worker. Requests beyond that are turned away
+// at once with 503 Service Unavailable and a Retry-After of retryAfter,
+// rather than piling more work onto upstream providers that are already
+// struggling. With no workers, h is returned unchanged.
+func shedLoad(workers, depth int, retryAfter time.Duration, h http.Handler) http.Handler {
+	if workers <= 0 {
+		return h
+	}
+
+	// admitted holds a token for each request being served or queued, and
+	// busy one for each being served.
+	admitted := make(chan struct{}, workers+depth)
+	busy := make(chan struct{}, workers)
+	retry := strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case admitted <- struct{}{}:
+			defer func() { <-admitted }()
+		default:
+			w.Header().Set("Retry-After", retry)
+			http.Error(w, "server overloaded; try again later", http.StatusServiceUnavailable)
+			return
+		}
+
+		select {
+		case busy <- struct{}{}:
+			defer func() { <-busy }()
+		case <-r.Context().Done():
+			return // the client gave up while queued
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// recoverPanics answers requests whose handler panics with a 500 and a JSON
+// error, rather than the dropped connection net/http leaves the client with,
+// and logs the panic with its stack so it isn't lost. Panics with
+// http.ErrAbortHandler, which abort a response on purpose, are passed on.
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			slog.Error("panic serving request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "panic", v, "stack", string(debug.Stack()))
+
+			// If the response has begun, it's too late for a clean error,
+			// but the client still sees the connection close.
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requireKey lets through only requests bearing one of keys, in an
+// "Authorization: Bearer <key>" or "X-API-Key: <key>" header, answering the
+// rest with 401 Unauthorized. With no keys, h is returned unchanged.
+func requireKey(keys []string, h http.Handler) http.Handler {
+	if len(keys) == 0 {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+			key = strings.TrimPrefix(auth, "Bearer ")
+		}
+
+		// Compare against every key, in constant time, so that response
+		// timing doesn't reveal how much of a key was right.
+		ok := false
+		for _, k := range keys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+				ok = true
+			}
+		}
+		if key == "" || !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="weather"`)
+			http.Error(w, "missing or invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// parseProxies parses a list of trusted proxies, each a CIDR block such as
+// "10.0.0.0/8" or a single address.
+func parseProxies(list []string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		proxies = append(proxies, p.Masked())
+	}
+	return proxies, nil
+}
+
+// trustProxies sets the RemoteAddr of requests that come through one of
+// proxies to the client's address, as the proxies report it in
+// X-Forwarded-For. Anyone can send that header, so it is honored only from a
+// trusted peer, and only as far back as the chain of trusted proxies goes.
+// With no proxies, h is returned unchanged.
+func trustProxies(proxies []netip.Prefix, h http.Handler) http.Handler {
+	if len(proxies) == 0 {
+		return h
+	}
+
+	trusted := func(addr netip.Addr) bool {
+		for _, p := range proxies {
+			if p.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || !trusted(peer.Addr()) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Each proxy appends the address it was called from, so walk back
+		// from the nearest until an address isn't a trusted proxy's: that
+		// is the client, and anything before it may be forged.
+		var hops []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+
+		client := peer.Addr()
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = addr
+			if !trusted(addr) {
+				break
+			}
+		}
+
+		if client != peer.Addr() {
+			r = r.Clone(r.Context())
+			r.RemoteAddr = netip.AddrPortFrom(client, 0).String()
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name      string
+		origins   []string
+		method    string
+		origin    string
+		status    int
+		allow     string // Access-Control-Allow-Origin
+		preflight bool   // whether the preflight headers are sent
+	}{
+		{"preflight", []string{"https://maps.example"}, http.MethodOptions, "https://maps.example", http.StatusNoContent, "https://maps.example", true},
+		{"cross-origin GET", []string{"https://maps.example"}, http.MethodGet, "https://maps.example", http.StatusOK, "https://maps.example", false},
+		{"any origin", []string{"*"}, http.MethodGet, "https://else.example", http.StatusOK, "*", false},
+		{"origin not allowed", []string{"https://maps.example"}, http.MethodGet, "https://else.example", http.StatusOK, "", false},
+		{"preflight not allowed", []string{"https://maps.example"}, http.MethodOptions, "https://else.example", http.StatusOK, "", false},
+		{"CORS off", nil, http.MethodGet, "https://maps.example", http.StatusOK, "", false},
+		{"same origin", []string{"https://maps.example"}, http.MethodGet, "", http.StatusOK, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(cors(tt.origins, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			defer ts.Close()
+
+			req, _ := http.NewRequest(tt.method, ts.URL+"/weather/Paris", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", "GET")
+				req.Header.Set("Access-Control-Request-Headers", "X-API-Key")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tt.allow {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, tt.allow)
+			}
+			methods, headers := resp.Header.Get("Access-Control-Allow-Methods"), resp.Header.Get("Access-Control-Allow-Headers")
+			if tt.preflight && (methods != "GET, HEAD, POST, OPTIONS" || headers != "X-API-Key") {
+				t.Errorf("preflight allows methods %q and headers %q", methods, headers)
+			}
+			if !tt.preflight && methods != "" {
+				t.Errorf("Access-Control-Allow-Methods %q on a request that isn't a preflight", methods)
+			}
+		})
+	}
+}
+
+func TestCORSPreflightForPOST(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.corsOrigins = []string{"https://maps.example"}
+	s, _ := newTestServer(t, cfg, nil, &fakeProvider{name: "fake", kelvin: 285})
+
+	req := httptest.NewRequest(http.MethodOptions, "/schedule", nil)
+	req.Header.Set("Origin", "https://maps.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if methods := rec.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, http.MethodPost) {
+		t.Errorf("preflight for POST /schedule allows only %q", methods)
+	}
+}
+
+func TestLoadShedding(t *testing.T) {
+	slow := &fakeProvider{name: "slow", kelvin: 285, delay: 300 * time.Millisecond}
+	ts := httptest.NewServer(shedLoad(2, 1, 1500*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slow.temperature(r.Context(), r.URL.Path)
+	})))
+	defer ts.Close()
+
+	get := func(city string) (*http.Response, error) {
+		resp, err := http.Get(ts.URL + "/weather/" + city)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// Two requests are served and one queued, filling the server.
+	admitted := make(chan int, 3)
+	for _, city := range []string{"Paris", "London", "Rome"} {
+		go func(city string) {
+			resp, err := get(city)
+			if err != nil {
+				t.Error(err)
+				admitted <- 0
+				return
+			}
+			admitted <- resp.StatusCode
+		}(city)
+	}
+	for slow.calls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	for _, city := range []string{"Oslo", "Lima", "Cairo"} {
+		begin := time.Now()
+		resp, err := get(city)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "2" {
+			t.Errorf("%s: status %d, Retry-After %q; want 503, 2", city, resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+		if took := time.Since(begin); took > 100*time.Millisecond {
+			t.Errorf("%s: shed after %s, not at once", city, took)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if status := <-admitted; status != http.StatusOK {
+			t.Errorf("admitted request: status %d", status)
+		}
+	}
+}
+
+func TestPanicsRecovered(t *testing.T) {
+	logged := captureLog(t)
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var coords []float64
+		_ = coords[1]
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/boom", nil))
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusInternalServerError || body.Error != "internal server error" {
+		t.Errorf("status %d, error %q; want 500 with a JSON error", rec.Code, body.Error)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	out := logged.String()
+	if !strings.Contains(out, "panic serving request method=GET path=/boom") || !strings.Contains(out, "index out of range") || !strings.Contains(out, "goroutine ") {
+		t.Errorf("panic not logged with its stack:\n%s", out)
+	}
+}
+
+func TestAbortHandlerPanicsPassedOn(t *testing.T) {
+	h := recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on", v)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/abort", nil))
+}
+
+func TestAPIKeys(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := cors([]string{"*"}, requireKey([]string{"old", "new"}, ok))
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		value  string
+		want   int
+	}{
+		{"X-API-Key", "GET", "X-API-Key", "new", http.StatusOK},
+		{"bearer token", "GET", "Authorization", "Bearer old", http.StatusOK},
+		{"no key", "GET", "", "", http.StatusUnauthorized},
+		{"wrong key", "GET", "X-API-Key", "older", http.StatusUnauthorized},
+		{"not a bearer token", "GET", "Authorization", "Basic old", http.StatusUnauthorized},
+		{"preflight", "OPTIONS", "Access-Control-Request-Method", "GET", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/weather/Paris", nil)
+			req.Header.Set("Origin", "https://example.com")
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := parseProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		peer   string
+		header []string // X-Forwarded-For headers
+		want   string
+	}{
+		{"direct client", "203.0.113.7:4711", nil, "203.0.113.7:4711"},
+		{"untrusted peer's header ignored", "203.0.113.7:4711", []string{"198.51.100.1"}, "203.0.113.7:4711"},
+		{"through a trusted proxy", "10.1.2.3:4711", []string{"198.51.100.1"}, "198.51.100.1:0"},
+		{"through a single trusted address", "192.0.2.1:4711", []string{"198.51.100.1"}, "198.51.100.1:0"},
+		{"forged hops before the client", "10.1.2.3:4711", []string{"1.1.1.1, 198.51.100.1, 10.9.9.9"}, "198.51.100.1:0"},
+		{"hops over several headers", "10.1.2.3:4711", []string{"1.1.1.1", "198.51.100.1", "10.9.9.9"}, "198.51.100.1:0"},
+		{"only trusted hops", "10.1.2.3:4711", []string{"10.4.4.4"}, "10.4.4.4:0"},
+		{"malformed hop", "10.1.2.3:4711", []string{"198.51.100.1, not-an-ip"}, "10.1.2.3:4711"},
+		{"IPv4-mapped peer", "[::ffff:10.1.2.3]:4711", []string{"198.51.100.1"}, "198.51.100.1:0"},
+		{"IPv6 proxy", "[2001:db8::1]:4711", []string{"2001:db8:ffff::1, 2606:4700::1"}, "[2606:4700::1]:0"},
+		{"no header from a trusted proxy", "10.1.2.3:4711", nil, "10.1.2.3:4711"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := trustProxies(proxies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+
+			r := httptest.NewRequest("GET", "/weather/Paris", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.header {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("client %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProxies(t *testing.T) {
+	for _, bad := range [][]string{{"10.0.0.0/33"}, {"proxy.example.com"}, {"10.0.0.1", ""}} {
+		if _, err := parseProxies(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+	got, err := parseProxies([]string{"10.1.2.3/8", "::1"})
+	if err != nil || len(got) != 2 || got[0].String() != "10.0.0.0/8" || got[1].String() != "::1/128" {
+		t.Errorf("parsed %v, %v", got, err)
+	}
+}
+
+func TestSlowRequestsLogged(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		delay     time.Duration
+		want      bool
+	}{
+		{"slow", 20 * time.Millisecond, 50 * time.Millisecond, true},
+		{"fast", time.Second, 0, false},
+		{"warning off", 0, 50 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			fakes.add("alpha", 285).delay = tt.delay
+			fakes.add("beta", 0).err = errors.New("provider down")
+			cfg := testConfig(t)
+			cfg.slowRequest, cfg.minProviders = tt.threshold, 1
+			_, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+			logged := captureLog(t)
+
+			resp, err := http.Get(ts.URL + "/weather/Paris")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			out := logged.String()
+			if got := strings.Contains(out, "slow request url=/weather/Paris"); got != tt.want {
+				t.Fatalf("slow request logged %v, want %v:\n%s", got, tt.want, out)
+			}
+			if tt.want && (!strings.Contains(out, "providers=\"") || !strings.Contains(out, "alpha=") || !strings.Contains(out, "beta=") || !strings.Contains(out, "(other)")) {
+				t.Errorf("no per-provider breakdown:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestWeatherReadOnly(t *testing.T) {
+	tests := []struct {
+		method     string
+		body       string
+		wantStatus int
+		wantCalls  int32
+		wantBody   bool
+	}{
+		{"GET", "", http.StatusOK, 1, true},
+		{"GET", "ignored", http.StatusOK, 1, true},
+		{"HEAD", "", http.StatusOK, 1, false},
+		{"POST", `{"city": "Paris"}`, http.StatusMethodNotAllowed, 0, true},
+		{"PUT", "", http.StatusMethodNotAllowed, 0, true},
+		{"DELETE", "", http.StatusMethodNotAllowed, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			alpha := fakes.add("alpha", 285)
+			_, ts := newTestServer(t, testConfig(t), nil, fakes.providers()...)
+
+			req, _ := http.NewRequest(tt.method, ts.URL+"/weather/Paris", strings.NewReader(tt.body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusMethodNotAllowed {
+				if allow := resp.Header.Get("Allow"); allow != "GET, HEAD" {
+					t.Errorf("Allow %q, want GET, HEAD", allow)
+				}
+			} else if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type %q, want JSON", ct)
+			}
+			if got := len(body) > 0; got != tt.wantBody {
+				t.Errorf("body %q; want one: %v", body, tt.wantBody)
+			}
+			if n := alpha.calls.Load(); n != tt.wantCalls {
+				t.Errorf("%d lookups, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// mockProvider is a weatherProvider that never touches the network. It is
+// used to load test the server in isolation from upstream variability.
+type mockProvider struct {
+	name      string
+	kelvin    float64
+	latency   time.Duration
+	jitter    time.Duration // up to this much is added to latency at random
+	errorRate float64       // fraction of calls, 0-1, that fail
+}
+
+var errMockFailure = errors.New("mock provider: simulated failure")
+
+func (m mockProvider) Name() string { return m.name }
+
+func (m mockProvider) temperature(ctx context.Context, city string) (float64, error) {
+	d := m.latency
+	if m.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(m.jitter)))
+	}
+
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	if m.errorRate > 0 && rand.Float64() < m.errorRate {
+		return 0, errMockFailure
+	}
+
+	return m.kelvin, nil
+}
+
+func (m mockProvider) temperatureAt(ctx context.Context, c coordinates) (float64, error) {
+	return m.temperature(ctx, c.String())
+}
+
+// mockProviders returns the same number of mocks as the real provider set,
+// reading slightly different temperatures. They are named mock1, mock2 and
+// so on.
+func mockProviders(cfg Config) []weatherProvider {
+	var providers []weatherProvider
+	for i, k := range []float64{294.15, 295.15, 296.15} {
+		providers = append(providers, mockProvider{
+			name:      "mock" + strconv.Itoa(i+1),
+			kelvin:    k,
+			latency:   cfg.mockLatency,
+			jitter:    cfg.mockJitter,
+			errorRate: cfg.mockErrorRate,
+		})
+	}
+	return providers
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMockProviders(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    float64 // in Kelvin
+		wantErr error
+		minTook time.Duration
+	}{
+		{"no latency", Config{}, 295.15, nil, 0},
+		{"latency", Config{mockLatency: 20 * time.Millisecond}, 295.15, nil, 20 * time.Millisecond},
+		{"always failing", Config{mockErrorRate: 1}, 0, errMockFailure, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mocks := mockProviders(tt.cfg)
+			if len(mocks) != 3 {
+				t.Fatalf("%d mocks, want 3", len(mocks))
+			}
+
+			begin := time.Now()
+			got, err := temperature(context.Background(), "Paris", mocks...)
+			if took := time.Since(begin); took < tt.minTook {
+				t.Errorf("took %s, want at least %s", took, tt.minTook)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("temperature %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkMockWeather measures a lookup from the mock providers, with no
+// latency of their own, so that only the fan-out and cache count: with
+// every lookup answered from cache, and with none.
+func BenchmarkMockWeather(b *testing.B) {
+	for _, bb := range []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{"cached", time.Hour},
+		{"uncached", 0},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			c := newTestCache(multiWeatherProvider{providers: mockProviders(Config{})}, bb.ttl)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.temperature(context.Background(), "Paris"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// threshold is a place to watch and the temperature, in Celsius, below which
+// it is alerted on.
+type threshold struct {
+	place   query
+	celsius float64
+}
+
+// parseThresholds parses a semicolon-separated list of place=celsius pairs,
+// as in "London=0;Paris,TX,US=-2.5". Places may contain commas, so pairs
+// can't be separated by them.
+func parseThresholds(s string) ([]threshold, error) {
+	var thresholds []threshold
+	for _, pair := range strings.Split(s, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		i := strings.LastIndex(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("threshold %q is not place=celsius", pair)
+		}
+
+		q, err := parsePlace(strings.TrimSpace(pair[:i]))
+		if err != nil {
+			return nil, fmt.Errorf("threshold %q: %v", pair, err)
+		}
+		c, err := strconv.ParseFloat(strings.TrimSpace(pair[i+1:]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("threshold %q: %v", pair, err)
+		}
+
+		thresholds = append(thresholds, threshold{q, c})
+	}
+	return thresholds, nil
+}
+
+// monitor polls the temperature of a set of places and POSTs an alert to a
+// webhook when one drops below its threshold. Alerts are debounced: a place
+// is alerted on once when it crosses its threshold, and not again until it
+// has risen back above it.
+type monitor struct {
+	source     resultProvider
+	thresholds []threshold
+	interval   time.Duration
+	webhook    string
+	client     *http.Client
+
+	// attempts and backoff configure how a failed webhook POST is retried.
+	attempts int
+	backoff  time.Duration
+
+	// geocoder, if set, geocodes every place at once before the first
+	// check, rather than one by one as each is looked up.
+	geocoder Geocoder
+
+	below map[string]bool // by place, whether we've alerted and not re-armed
+}
+
+func newMonitor(source resultProvider, thresholds []threshold, interval time.Duration, webhook string) *monitor {
+	return &monitor{
+		source:     source,
+		thresholds: thresholds,
+		interval:   interval,
+		webhook:    webhook,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		attempts:   3,
+		backoff:    time.Second,
+		below:      map[string]bool{},
+	}
+}
+
+// alert is the body POSTed to the webhook.
+type alert struct {
+	City        string      `json:"city"`
+	Threshold   float64     `json:"threshold_c"`
+	Temperature Temperature `json:"temperature"`
+	Time        string      `json:"time"`
+}
+
+// run polls until ctx is canceled.
+func (m *monitor) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	if m.geocoder != nil {
+		places := make([]query, len(m.thresholds))
+		for i, t := range m.thresholds {
+			places[i] = t.place
+		}
+		for i, g := range geocodeAll(ctx, m.geocoder, places) {
+			if g.err != nil && ctx.Err() == nil {
+				log.Printf("monitor: geocoding %s: %v", places[i], g.err)
+			}
+		}
+	}
+
+	for {
+		m.check(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check looks up each place once, alerting on those newly below threshold.
+func (m *monitor) check(ctx context.Context) {
+	for _, t := range m.thresholds {
+		res, err := m.source.aggregate(ctx, t.place)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("monitor: %s: %v", t.place, err)
+			}
+			continue
+		}
+
+		key := t.place.key()
+		if res.temp.Celsius() >= t.celsius {
+			m.below[key] = false
+			continue
+		}
+		if m.below[key] {
+			continue
+		}
+
+		a := alert{
+			City:        t.place.address(),
+			Threshold:   t.celsius,
+			Temperature: res.temp,
+			Time:        time.Now().UTC().Format(time.RFC3339),
+		}
+		if err := m.post(ctx, a); err != nil {
+			// Stay armed, so the alert is tried again next time.
+			if ctx.Err() == nil {
+				log.Printf("monitor: alerting on %s: %v", t.place, err)
+			}
+			continue
+		}
+		m.below[key] = true
+	}
+}
+
+// post sends a to the webhook, retrying failures that may be transient.
+func (m *monitor) post(ctx context.Context, a alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = m.send(ctx, body)
+		if err == nil || attempt >= m.attempts || !retryable(err) {
+			return err
+		}
+
+		t := time.NewTimer(m.backoff << (attempt - 1))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+func (m *monitor) send(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", m.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{code: resp.StatusCode}
+	}
+	return nil
+}
+
+// errNoWebhook is returned when thresholds are configured with nowhere to
+// send their alerts.
+var errNoWebhook = errors.New("alert thresholds are set, but no alert webhook")
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedAlert is an alert as a webhook decodes it.
+type receivedAlert struct {
+	City        string  `json:"city"`
+	Threshold   float64 `json:"threshold_c"`
+	Temperature struct {
+		C float64 `json:"c"`
+	} `json:"temperature"`
+}
+
+// webhookStub is a webhook that fails its first failures POSTs with 503 and
+// records the alerts it accepts after that.
+type webhookStub struct {
+	mu       sync.Mutex
+	failures int
+	posts    int
+	alerts   []receivedAlert
+}
+
+func (s *webhookStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.posts++
+	if s.posts <= s.failures {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var a receivedAlert
+	if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&a) != nil {
+		http.Error(w, "bad alert", http.StatusBadRequest)
+		return
+	}
+	s.alerts = append(s.alerts, a)
+}
+
+func TestMonitorAlerts(t *testing.T) {
+	hook := &webhookStub{failures: 1}
+	ts := httptest.NewServer(hook)
+	defer ts.Close()
+
+	// Each check reads the next of these, in Celsius.
+	readings := []float64{5, -1, -2, 3, -1}
+	var i int
+	source := &resultFunc{fn: func(context.Context, query) (result, error) {
+		c := readings[i]
+		i++
+		return result{temp: Temperature(celsiusToKelvin(c))}, nil
+	}}
+
+	thresholds, err := parseThresholds("Oslo,NO=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMonitor(source, thresholds, time.Hour, ts.URL)
+	m.backoff = time.Millisecond
+	for range readings {
+		m.check(context.Background())
+	}
+
+	// The first crossing is alerted on once, after a retry; the second
+	// dip below waits for the rise back above to re-arm it.
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if hook.posts != 3 {
+		t.Errorf("%d POSTs, want 3: one retried alert and another", hook.posts)
+	}
+	if len(hook.alerts) != 2 {
+		t.Fatalf("alerts %+v, want 2", hook.alerts)
+	}
+	for n, want := range []float64{-1, -1} {
+		a := hook.alerts[n]
+		if a.City != "Oslo,NO" || a.Threshold != 0 || a.Temperature.C != want {
+			t.Errorf("alert %d: %+v, want Oslo,NO at %v°C", n, a, want)
+		}
+	}
+}
+
+func TestMonitorStops(t *testing.T) {
+	m := newMonitor(fixedResult(300), []threshold{{query{city: "Oslo"}, 0}}, time.Millisecond, "http://unused.invalid")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("monitor still running after its context ended")
+	}
+}
+
+func TestParseThresholds(t *testing.T) {
+	got, err := parseThresholds(" London=0; Paris,TX,US=-2.5;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []threshold{
+		{query{city: "London"}, 0},
+		{query{city: "Paris", state: "TX", country: "US"}, -2.5},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("thresholds %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{"London", "London=cold", "London,,UK=0"} {
+		if _, err := parseThresholds(s); err == nil {
+			t.Errorf("parseThresholds(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// multiWeatherProvider queries all of its providers concurrently and averages
+// their readings.
+type multiWeatherProvider struct {
+	providers []weatherProvider
+
+	// minProviders is how many readings an average needs. Zero means every
+	// provider must succeed, so that any provider error fails the lookup;
+	// once timeout has passed, though, a single reading will do.
+	minProviders int
+
+	// timeout, when non-zero, is how long to wait for slow providers before
+	// averaging the readings that have arrived.
+	timeout time.Duration
+
+	// providerTimeout, when non-zero, bounds each provider's lookup, so that
+	// a hung provider fails rather than holding up the average. Providers
+	// named in providerTimeouts get their own bound instead, such as a
+	// longer one for a provider that needs several round trips. Either way,
+	// the overall timeout still applies.
+	providerTimeout  time.Duration
+	providerTimeouts map[string]time.Duration
+
+	// offsets calibrate providers with a known bias: each named provider's
+	// readings have its offset, in Kelvin, added before they are checked
+	// and averaged. For one reading 1.5°C high, the offset is -1.5.
+	offsets map[string]float64
+
+	// observers are told of each provider call and aggregated result.
+	observers []Observer
+
+	// tracker, if set, records each provider's recent success rate. When
+	// adaptive is also set, readings are weighted by it, so that flaky
+	// providers count for less in the average.
+	tracker  *successTracker
+	adaptive bool
+
+	// variances, if set, records how far each provider's readings stray
+	// from the consensus. When inverseVariance is also set, readings are
+	// weighted by the inverse of that variance, so that steady providers
+	// count for more in the average.
+	variances       *varianceTracker
+	inverseVariance bool
+
+	// sequential queries providers one at a time, in order, instead of all
+	// at once. It is slower, but easier to debug and gentler on rate limits.
+	sequential bool
+
+	// representative reports the single provider reading nearest the
+	// median, rather than the average, so that the temperature shown is
+	// one that was actually observed.
+	representative bool
+
+	// modeResolution, if set, reports the most common reading instead of
+	// the average, once each is rounded to the nearest multiple of this
+	// many degrees Celsius. For noisy providers, that ignores a stray
+	// reading without discarding any. It takes precedence over
+	// representative.
+	modeResolution float64
+
+	// trimmed drops the highest and lowest reading before averaging, when
+	// there are at least three, so that one outlier either side can't pull
+	// the average. Both of the above take precedence over it.
+	trimmed bool
+
+	// valid, if set, is the range of plausible readings. Anything outside it,
+	// such as the 0 K a malformed payload decodes to, counts as a failure.
+	valid *kelvinRange
+
+	// validators, if set, check the readings of the providers they are keyed
+	// by, after calibration and the range check. A reading a validator
+	// rejects counts as a failure, the same as an implausible one, so it is
+	// left out of the average.
+	validators map[string]func(kelvin float64) error
+}
+
+// kelvinRange is an inclusive range of temperatures, in Kelvin.
+type kelvinRange struct {
+	min, max float64
+}
+
+func (r kelvinRange) contains(k float64) bool {
+	return k >= r.min && k <= r.max
+}
+
+// result is an aggregated temperature along with the names of the providers
+// whose readings went into it.
+type result struct {
+	temp    Temperature
+	sources []string
+
+	// readings is how many provider readings the result is drawn from, and
+	// spread the difference between the highest and lowest of them, in
+	// Kelvin. Together they say how far the result can be trusted.
+	readings int
+	spread   float64
+
+	// cached is set when the result was answered from cache, rather than
+	// looked up for the request; stale when it is an outdated one, served
+	// because a fresh lookup failed.
+	cached bool
+	stale  bool
+
+	// fetched, if known, is when the result was looked up from the
+	// providers: just now unless it is cached.
+	fetched time.Time
+
+	// failed are the providers asked that didn't contribute, because they
+	// failed or were too slow. A result with any is partial.
+	failed []providerFailure
+
+	// explanation says how temp was arrived at.
+	explanation *explanation
+
+	// statuses are the HTTP statuses the providers asked last answered
+	// with, for /weather/?debug=true.
+	statuses []providerStatus
+
+	// celsius, if set, is temp as averaged from readings given in Celsius,
+	// without the round trip through Kelvin. See in.
+	celsius *float64
+}
+
+// in returns the result's temperature in unit u: from celsius, when it is
+// set and u is Celsius or Fahrenheit, and otherwise from temp.
+func (r result) in(u unit) float64 {
+	if r.celsius != nil {
+		switch u {
+		case celsius:
+			return *r.celsius
+		case fahrenheit:
+			return celsiusToFahrenheit(*r.celsius)
+		}
+	}
+	return r.temp.in(u)
+}
+
+// providerFailure is why one provider didn't contribute to a result.
+type providerFailure struct {
+	Provider string `json:"provider"`
+	Error    string `json:"error"`
+
+	status int // of the provider's last response, if it sent any
+}
+
+// providerStatus is the HTTP status of one provider's last response to a
+// lookup, or zero if it sent none, as for a provider that timed out.
+type providerStatus struct {
+	Provider string `json:"provider"`
+	Status   int    `json:"status,omitempty"`
+}
+
+// statusesOf lists the statuses of the providers behind obs and failed.
+func statusesOf(obs []observation, failed []providerFailure) []providerStatus {
+	statuses := make([]providerStatus, 0, len(obs)+len(failed))
+	for _, o := range obs {
+		statuses = append(statuses, providerStatus{o.provider, o.status})
+	}
+	for _, f := range failed {
+		statuses = append(statuses, providerStatus{f.Provider, f.status})
+	}
+	return statuses
+}
+
+func (w multiWeatherProvider) Name() string { return "multi" }
+
+func (w multiWeatherProvider) temperature(ctx context.Context, city string) (float64, error) {
+	q, err := parsePlace(city)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := w.aggregate(ctx, q)
+	return res.temp.Kelvin(), err
+}
+
+// aggregate queries every provider able to answer q and averages the readings
+// that arrive in time, reporting which providers contributed.
+func (w multiWeatherProvider) aggregate(ctx context.Context, q query) (result, error) {
+	obs, failed, err := w.collect(ctx, q.supportedBy, q.reading)
+	if err != nil {
+		return result{}, err
+	}
+
+	res := w.combine(obs)
+	res.failed = failed
+	res.statuses = statusesOf(obs, failed)
+	w.variances.record(obs, res.temp.Kelvin())
+	return w.observed(ctx, res), nil
+}
+
+// observed tells the observers of res, and returns it.
+func (w multiWeatherProvider) observed(ctx context.Context, res result) result {
+	for _, o := range w.observers {
+		o.onAggregate(ctx, res)
+	}
+	return res
+}
+
+// combine reduces observations to a result: their average, their mode when
+// modeResolution is set, in representative mode the one nearest their
+// median, or their trimmed average.
+func (w multiWeatherProvider) combine(obs []observation) result {
+	res := result{readings: len(obs), spread: spreadOf(obs)}
+	if w.modeResolution > 0 {
+		k, bucket := modeOf(obs, w.modeResolution)
+		res.temp, res.sources = Temperature(k), sourcesOf(bucket)
+		res.explanation = explainChoice(strategyMode, obs, bucket, k,
+			fmt.Sprintf("%d of %d readings round to %.2f K, to the nearest %g°C", len(bucket), len(obs), k, w.modeResolution),
+			"not the most common reading")
+	} else if w.representative {
+		o := nearestMedian(obs)
+		res.temp, res.sources = Temperature(o.Kelvin), []string{o.provider}
+		res.explanation = explainChoice(strategyRepresentative, obs, []observation{o}, o.Kelvin,
+			fmt.Sprintf("%s's %.2f K is nearest the median, %.2f K", o.provider, o.Kelvin, medianOf(obs)),
+			"not nearest the median")
+	} else if w.trimmed {
+		kept := trimExtremes(obs)
+		res.temp, res.sources = w.average(kept), sourcesOf(kept)
+		res.celsius = w.averageCelsius(kept)
+		res.explanation = explainMean(strategyTrimmedMean, obs, kept, w.weights(kept), res.temp.Kelvin(), "highest or lowest reading")
+	} else {
+		res.temp, res.sources = w.average(obs), sourcesOf(obs)
+		res.celsius = w.averageCelsius(obs)
+		strategy := strategyMean
+		if w.adaptive || w.inverseVariance {
+			strategy = strategyWeightedMean
+		}
+		res.explanation = explainMean(strategy, obs, obs, w.weights(obs), res.temp.Kelvin(), "")
+	}
+	return res
+}
+
+// spreadOf is the range of temperatures across obs, in Kelvin.
+func spreadOf(obs []observation) float64 {
+	if len(obs) == 0 {
+		return 0
+	}
+
+	lo, hi := obs[0].Kelvin, obs[0].Kelvin
+	for _, o := range obs[1:] {
+		lo, hi = math.Min(lo, o.Kelvin), math.Max(hi, o.Kelvin)
+	}
+	return hi - lo
+}
+
+// observation is one provider's answer to a lookup.
+type observation struct {
+	provider string
+	Conditions
+
+	status int // of the provider's last response
+}
+
+// collect runs fetch against each provider for which supports reports true,
+// gathering their observations until all have answered or the deadline
+// passes. Observations are returned in provider order, not arrival order,
+// along with why any other providers asked didn't contribute. It fails if
+// fewer than minProviders succeed, or, with minProviders zero, if any fails
+// before the deadline or none has succeeded by it.
+func (w multiWeatherProvider) collect(ctx context.Context, supports func(weatherProvider) bool, fetch func(context.Context, weatherProvider) (Conditions, error)) ([]observation, []providerFailure, error) {
+	providers := supported(w.providers, supports)
+
+	if len(providers) == 0 {
+		return nil, nil, errNoProviders
+	}
+
+	need := w.minProviders
+	if need <= 0 || need > len(providers) {
+		need = len(providers)
+	}
+
+	// Providers still running when we return are abandoned, so cancel them.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// A nil channel never fires, so without a timeout we wait for everyone.
+	var deadline <-chan time.Time
+	if w.timeout > 0 {
+		t := time.NewTimer(w.timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	// Make a channel for answers, each either an observation or an error.
+	type answer struct {
+		provider int
+		c        Conditions
+		status   int
+		err      error
+	}
+	answers := make(chan answer, len(providers))
+
+	// call invokes fetch for a provider, and forwards the response. Each
+	// provider normally gets a goroutine of its own; in sequential mode a
+	// single goroutine calls them in turn.
+	call := func(i int, p weatherProvider) {
+		ctx, status := withStatus(ctx)
+		c, err := w.fetchFrom(ctx, p, fetch)
+		answers <- answer{i, c, status.code(), err}
+	}
+
+	if w.sequential {
+		go func() {
+			for i, provider := range providers {
+				if ctx.Err() != nil {
+					return
+				}
+				call(i, provider)
+			}
+		}()
+	} else {
+		for i, provider := range providers {
+			go call(i, provider)
+		}
+	}
+
+	// Observations and errors are slotted in by provider, and compacted at
+	// the end.
+	n, failed := 0, 0
+	obs := make([]observation, len(providers))
+	errs := make([]error, len(providers))
+	statuses := make([]int, len(providers))
+	var firstErr error
+
+	// Collect an observation or an error from each provider, until the
+	// deadline passes.
+gather:
+	for i := 0; i < len(providers); i++ {
+		select {
+		case a := <-answers:
+			if a.err == nil {
+				obs[a.provider] = observation{providers[a.provider].Name(), a.c, a.status}
+				n++
+				continue
+			}
+			errs[a.provider], statuses[a.provider] = a.err, a.status
+			if firstErr == nil {
+				firstErr = a.err
+			}
+			// Give up as soon as too few providers remain to reach need.
+			if failed++; len(providers)-failed < need {
+				return nil, nil, firstErr
+			}
+		case <-deadline:
+			// The slow providers are left out now, even if every one was
+			// needed, so long as some reading has arrived.
+			if w.minProviders <= 0 {
+				need = 1
+			}
+			break gather
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	if n < need {
+		if firstErr != nil {
+			return nil, nil, firstErr
+		}
+		return nil, nil, fmt.Errorf("only %d of %d providers responded within %s", n, len(providers), w.timeout)
+	}
+
+	// Every observation has a provider name, so unfilled slots are empty.
+	// Providers with neither were still running at the deadline.
+	compact := obs[:0]
+	var failures []providerFailure
+	for i, o := range obs {
+		switch {
+		case o.provider != "":
+			compact = append(compact, o)
+		case errs[i] != nil:
+			failures = append(failures, providerFailure{providers[i].Name(), errs[i].Error(), statuses[i]})
+		default:
+			failures = append(failures, providerFailure{Provider: providers[i].Name(), Error: fmt.Sprintf("no answer within %s", w.timeout)})
+		}
+	}
+	return compact, failures, nil
+}
+
+// fetchFrom invokes fetch for provider p, within p's own timeout, and
+// calibrates and checks the reading. Observers and the success tracker are
+// told how it went.
+func (w multiWeatherProvider) fetchFrom(ctx context.Context, p weatherProvider, fetch func(context.Context, weatherProvider) (Conditions, error)) (Conditions, error) {
+	if d := w.timeoutFor(p); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	name := p.Name()
+	for _, o := range w.observers {
+		o.onProviderStart(ctx, name)
+	}
+
+	begin := time.Now()
+	c, err := fetch(ctx, p)
+	took := time.Since(begin)
+	c.Kelvin = w.calibrate(name, c.Kelvin)
+	if err == nil {
+		err = w.check(name, c.Kelvin)
+	}
+	if w.tracker != nil {
+		w.tracker.record(name, err)
+	}
+	for _, o := range w.observers {
+		if err != nil {
+			o.onProviderError(ctx, name, err, took)
+		} else {
+			o.onProviderSuccess(ctx, name, c.Kelvin, took)
+		}
+	}
+	return c, err
+}
+
+// check reports whether the named provider's reading, once calibrated, is
+// plausible and passes the provider's validator, if it has one.
+func (w multiWeatherProvider) check(provider string, kelvin float64) error {
+	if w.valid != nil && !w.valid.contains(kelvin) {
+		return &implausibleError{kelvin}
+	}
+	if v := w.validators[provider]; v != nil {
+		if err := v(kelvin); err != nil {
+			return &rejectedError{err}
+		}
+	}
+	return nil
+}
+
+// calibrate applies the named provider's offset, if any, to a reading.
+func (w multiWeatherProvider) calibrate(provider string, kelvin float64) float64 {
+	return kelvin + w.offsets[provider]
+}
+
+// timeoutFor is how long provider p may take over a lookup, or zero for as
+// long as the lookup as a whole may.
+func (w multiWeatherProvider) timeoutFor(p weatherProvider) time.Duration {
+	if d, ok := w.providerTimeouts[p.Name()]; ok {
+		return d
+	}
+	return w.providerTimeout
+}
+
+// supported filters providers down to those for which supports reports true.
+// The common case, where all are supported, doesn't allocate.
+func supported(providers []weatherProvider, supports func(weatherProvider) bool) []weatherProvider {
+	for i, p := range providers {
+		if supports(p) {
+			continue
+		}
+
+		// Copy the supported prefix, then filter the rest.
+		filtered := append([]weatherProvider(nil), providers[:i]...)
+		for _, p := range providers[i+1:] {
+			if supports(p) {
+				filtered = append(filtered, p)
+			}
+		}
+		return filtered
+	}
+	return providers
+}
+
+// average is the mean temperature across obs, weighted as weights says.
+func (w multiWeatherProvider) average(obs []observation) Temperature {
+	sum, total := 0.0, 0.0
+	for i, weight := range w.weights(obs) {
+		sum += weight * obs[i].Kelvin
+		total += weight
+	}
+
+	return Temperature(sum / total)
+}
+
+// averageCelsius is average, taken of the readings in Celsius as the
+// providers gave them rather than after converting them to Kelvin. It is nil
+// unless every one of obs was given in Celsius and isn't calibrated.
+func (w multiWeatherProvider) averageCelsius(obs []observation) *float64 {
+	sum, total := 0.0, 0.0
+	for i, weight := range w.weights(obs) {
+		n := obs[i].Native
+		if n == nil || n.Unit != celsius || w.offsets[obs[i].provider] != 0 {
+			return nil
+		}
+		sum += weight * n.Value
+		total += weight
+	}
+
+	c := sum / total
+	return &c
+}
+
+// weights are how much each of obs counts for in an average: by default the
+// same, but weighted by each provider's success rate when adaptive weighting
+// is on, and by the inverse of its variance when that is on.
+func (w multiWeatherProvider) weights(obs []observation) []float64 {
+	var variances map[string]float64
+	if w.inverseVariance {
+		variances = w.variances.weights(obs)
+	}
+
+	weights := make([]float64, len(obs))
+	for i, o := range obs {
+		weights[i] = 1
+		if w.adaptive && w.tracker != nil {
+			weights[i] = w.tracker.weight(o.provider)
+		}
+		if variances != nil {
+			weights[i] *= variances[o.provider]
+		}
+	}
+	return weights
+}
+
+// nearestMedian is the observation whose temperature is nearest the median
+// of obs, which must not be empty. Ties go to the earlier provider.
+func nearestMedian(obs []observation) observation {
+	median := medianOf(obs)
+	best := obs[0]
+	for _, o := range obs[1:] {
+		if math.Abs(o.Kelvin-median) < math.Abs(best.Kelvin-median) {
+			best = o
+		}
+	}
+	return best
+}
+
+// modeOf rounds the temperature of each of obs, which must not be empty, to
+// the nearest multiple of resolution degrees Celsius, and returns the most
+// common rounded value, in Kelvin, along with the observations that round to
+// it. Of values equally common, the one nearest the median of obs wins.
+func modeOf(obs []observation, resolution float64) (float64, []observation) {
+	buckets := map[float64][]observation{}
+	for _, o := range obs {
+		c := math.Round(kelvinToCelsius(o.Kelvin)/resolution) * resolution
+		buckets[c] = append(buckets[c], o)
+	}
+
+	median := kelvinToCelsius(medianOf(obs))
+	best, first := 0.0, true
+	for c, b := range buckets {
+		n := len(buckets[best])
+		switch {
+		case first, len(b) > n:
+		case len(b) == n && math.Abs(c-median) < math.Abs(best-median):
+		case len(b) == n && math.Abs(c-median) == math.Abs(best-median) && c < best:
+			// Settle exact ties the same way every time, whatever the
+			// map's iteration order.
+		default:
+			continue
+		}
+		best, first = c, false
+	}
+	return celsiusToKelvin(best), buckets[best]
+}
+
+// trimExtremes returns obs without its single highest and lowest reading, in
+// the same order, or all of obs if there are fewer than three.
+func trimExtremes(obs []observation) []observation {
+	if len(obs) < 3 {
+		return obs
+	}
+
+	lo, hi := 0, 0
+	for i, o := range obs {
+		if o.Kelvin < obs[lo].Kelvin {
+			lo = i
+		}
+		if o.Kelvin > obs[hi].Kelvin {
+			hi = i
+		}
+	}
+	if lo == hi { // every reading is the same
+		hi = len(obs) - 1
+	}
+
+	kept := make([]observation, 0, len(obs)-2)
+	for i, o := range obs {
+		if i != lo && i != hi {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// medianOf is the median temperature of obs, which must not be empty, in
+// Kelvin.
+func medianOf(obs []observation) float64 {
+	kelvins := make([]float64, len(obs))
+	for i, o := range obs {
+		kelvins[i] = o.Kelvin
+	}
+	sort.Float64s(kelvins)
+
+	median := kelvins[len(kelvins)/2]
+	if len(kelvins)%2 == 0 {
+		median = (kelvins[len(kelvins)/2-1] + median) / 2
+	}
+	return median
+}
+
+// sourcesOf lists the providers behind obs.
+func sourcesOf(obs []observation) []string {
+	sources := make([]string, len(obs))
+	for i, o := range obs {
+		sources[i] = o.provider
+	}
+	return sources
+}
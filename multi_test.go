@@ -0,0 +1,571 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAggregationTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		minProviders int
+		slowErr      error
+		want         float64 // in Kelvin
+		wantErr      string
+	}{
+		{"slow provider excluded", 1, nil, 280, ""},
+		{"every provider needed", 0, nil, 280, ""},
+		{"too few providers answering", 2, nil, 0, "only 1 of 2 providers responded within"},
+		{"failing provider excluded", 1, errors.New("provider down"), 280, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slow := &fakeProvider{name: "slow", kelvin: 300, delay: time.Minute, err: tt.slowErr}
+			if tt.slowErr != nil {
+				slow.delay = 0
+			}
+			w := multiWeatherProvider{
+				providers:    []weatherProvider{&fakeProvider{name: "fast", kelvin: 280}, slow},
+				minProviders: tt.minProviders,
+				timeout:      20 * time.Millisecond,
+			}
+
+			begin := time.Now()
+			got, err := w.temperature(context.Background(), "Paris")
+			if took := time.Since(begin); took > time.Second {
+				t.Errorf("took %s, waiting on the slow provider", took)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("temperature %v, want the fast provider's %v alone", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoAggregationTimeout(t *testing.T) {
+	w := multiWeatherProvider{providers: []weatherProvider{
+		&fakeProvider{name: "fast", kelvin: 280},
+		&fakeProvider{name: "slow", kelvin: 300, delay: 30 * time.Millisecond},
+	}}
+	got, err := w.temperature(context.Background(), "Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 290 {
+		t.Errorf("temperature %v, want the mean of both, 290", got)
+	}
+}
+
+func TestDefaultAggregationTimeout(t *testing.T) {
+	if d := testConfig(t).aggregationTimeout; d <= 0 {
+		t.Errorf("aggregation timeout defaults to %s; a hung provider would hold up every lookup", d)
+	}
+}
+
+func TestSourcesAreTheProvidersThatAnswered(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing string // the upstream host that fails
+		sources []string
+	}{
+		{"all answering", "", []string{"openWeatherMap", "weatherUnderground", "darkSky"}},
+		{"one failing", "api.wunderground.com", []string{"openWeatherMap", "darkSky"}},
+		{"geocoding failing", "maps.googleapis.com", []string{"openWeatherMap", "weatherUnderground"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.Host {
+				case tt.failing:
+					w.WriteHeader(http.StatusInternalServerError)
+				case "api.openweathermap.org":
+					fmt.Fprint(w, `{"main": {"temp": 280}}`)
+				case "api.wunderground.com":
+					fmt.Fprint(w, `{"current_observation": {"temp_c": 10}}`)
+				case "maps.googleapis.com":
+					fmt.Fprint(w, `{"results": [{"geometry": {"location": {"lat": 48.85, "lng": 2.35}}}]}`)
+				case "api.darksky.net":
+					fmt.Fprint(w, `{"currently": {"temperature": 10}}`)
+				}
+			})
+			w := multiWeatherProvider{
+				providers: []weatherProvider{
+					openWeatherMap{keys: newKeyRing("KEY")},
+					weatherUnderground{keys: newKeyRing("KEY")},
+					darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}},
+				},
+				minProviders: 1,
+			}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(res.sources, ",") != strings.Join(tt.sources, ",") {
+				t.Errorf("sources %v, want %v", res.sources, tt.sources)
+			}
+		})
+	}
+}
+
+func TestImplausibleReadingsExcluded(t *testing.T) {
+	tests := []struct {
+		name    string
+		kelvins []float64
+		temp    Temperature
+		failed  uint64
+	}{
+		{"0 K", []float64{0, 280, 290}, 285, 1},
+		{"too hot", []float64{280, 290, 400}, 285, 1},
+		{"at the bounds", []float64{180, 335}, 257.5, 0},
+		{"all plausible", []float64{280, 290}, 285, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []weatherProvider
+			for _, k := range tt.kelvins {
+				providers = append(providers, &fakeProvider{name: "fake", kelvin: k})
+			}
+			m := newProviderMetrics(&metricsRegistry{})
+			w := multiWeatherProvider{
+				providers:    providers,
+				minProviders: 1,
+				observers:    []Observer{m},
+				valid:        &kelvinRange{180, 335},
+			}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.temp != tt.temp {
+				t.Errorf("temp %v, want %v", res.temp, tt.temp)
+			}
+			if got := m.errors.with("fake", errRange).get(); got != tt.failed {
+				t.Errorf("%d implausible readings counted, want %d", got, tt.failed)
+			}
+		})
+	}
+}
+
+func TestValidatorsRejectReadings(t *testing.T) {
+	errTooWarm := errors.New("warmer than this station reads")
+	belowHundredF := func(kelvin float64) error {
+		if kelvin > 310.9 {
+			return errTooWarm
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name       string
+		validators map[string]func(float64) error
+		temp       Temperature
+		failed     []string
+		wantErr    bool
+	}{
+		{"no validators", nil, 300, nil, false},
+		{"a reading rejected", map[string]func(float64) error{"p2": belowHundredF}, 285, []string{"p2"}, false},
+		{"a reading passing", map[string]func(float64) error{"p0": belowHundredF}, 300, nil, false},
+		{"another provider's validator", map[string]func(float64) error{"gamma": belowHundredF}, 300, nil, false},
+		{
+			"every reading rejected",
+			map[string]func(float64) error{
+				"p0": func(float64) error { return errTooWarm },
+				"p1": func(float64) error { return errTooWarm },
+				"p2": func(float64) error { return errTooWarm },
+			},
+			0, nil, true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []weatherProvider
+			for i, k := range []float64{280, 290, 330} {
+				providers = append(providers, &fakeProvider{name: "p" + string(rune('0'+i)), kelvin: k})
+			}
+			w := multiWeatherProvider{providers: providers, minProviders: 1, validators: tt.validators}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("aggregated %v, want an error with every reading rejected", res.temp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.temp != tt.temp {
+				t.Errorf("temp %v, want %v", res.temp, tt.temp)
+			}
+			var failed []string
+			for _, f := range res.failed {
+				failed = append(failed, f.Provider)
+				if f.Error != "reading rejected: "+errTooWarm.Error() {
+					t.Errorf("%s failed with %q", f.Provider, f.Error)
+				}
+			}
+			if strings.Join(failed, ",") != strings.Join(tt.failed, ",") {
+				t.Errorf("failed %v, want %v", failed, tt.failed)
+			}
+		})
+	}
+}
+
+// recording is a log of provider calls, shared by recordingProviders.
+type recording struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recording) add(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+// recordingProvider is a fakeProvider that logs when each of its lookups
+// starts and ends.
+type recordingProvider struct {
+	*fakeProvider
+	log *recording
+}
+
+func (p recordingProvider) temperature(ctx context.Context, city string) (float64, error) {
+	p.log.add(p.name + " start")
+	defer p.log.add(p.name + " end")
+	return p.fakeProvider.temperature(ctx, city)
+}
+
+func TestSequentialMode(t *testing.T) {
+	errDown := errors.New("provider down")
+
+	tests := []struct {
+		name       string
+		sequential bool
+		calls      string
+	}{
+		{"sequential", true, "a start,a end,b start,b end,c start,c end"},
+		{"parallel", false, ""}, // in no particular order, but overlapping
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := &recording{}
+			providers := []weatherProvider{
+				recordingProvider{&fakeProvider{name: "a", kelvin: 280, delay: 20 * time.Millisecond}, log},
+				recordingProvider{&fakeProvider{name: "b", err: errDown, delay: 10 * time.Millisecond}, log},
+				recordingProvider{&fakeProvider{name: "c", kelvin: 290}, log},
+			}
+			w := multiWeatherProvider{providers: providers, minProviders: 2, sequential: tt.sequential}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Either way, the failing provider is left out.
+			if res.temp != 285 || len(res.sources) != 2 {
+				t.Errorf("got %v from %v; want 285 K from a and c", res.temp, res.sources)
+			}
+
+			calls := strings.Join(log.calls, ",")
+			if tt.sequential && calls != tt.calls {
+				t.Errorf("calls %s, want %s", calls, tt.calls)
+			}
+			if !tt.sequential && strings.HasPrefix(calls, "a start,a end") {
+				t.Errorf("calls %s: a ran alone first", calls)
+			}
+		})
+	}
+}
+
+// BenchmarkAggregate measures the fan-out to three in-memory providers. On
+// the same machine, before and after the fan-out was made to share one
+// answer channel and one observation slice:
+//
+//	answering:    before ~4700 ns/op  1368 B/op  23 allocs/op
+//	              after  ~3600 ns/op   960 B/op  12 allocs/op
+//	one failing:  before ~5650 ns/op  1248 B/op  21 allocs/op
+//	              after  ~3600 ns/op   944 B/op  12 allocs/op
+//
+// Results have since grown an explanation of how they were reached, and
+// building it is most of what a lookup now costs on top of that, at about
+// 8200 ns/op, 2630 B/op and 38 allocs/op with every provider answering.
+func BenchmarkAggregate(b *testing.B) {
+	errDown := errors.New("provider down")
+	tests := []struct {
+		name         string
+		minProviders int
+		failing      error
+	}{
+		{"answering", 0, nil},
+		{"one failing", 1, errDown},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			w := multiWeatherProvider{
+				providers: []weatherProvider{
+					&fakeProvider{name: "alpha", kelvin: 280},
+					&fakeProvider{name: "beta", kelvin: 285},
+					&fakeProvider{name: "gamma", kelvin: 290, err: tt.failing},
+				},
+				minProviders: tt.minProviders,
+			}
+			q := query{city: "Paris"}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := w.aggregate(context.Background(), q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestPerProviderTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		temp    Temperature
+	}{
+		{"own timeouts", 0, 285},
+		{"overall timeout still applies", 50 * time.Millisecond, 280},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The patient and the slow provider take as long; only the
+			// patient one may.
+			patient := &fakeProvider{name: "patient", kelvin: 290, delay: 100 * time.Millisecond}
+			slow := &fakeProvider{name: "slow", kelvin: 300, delay: 100 * time.Millisecond}
+			w := multiWeatherProvider{
+				providers:        []weatherProvider{&fakeProvider{name: "fast", kelvin: 280}, patient, slow},
+				minProviders:     1,
+				timeout:          tt.timeout,
+				providerTimeout:  20 * time.Millisecond,
+				providerTimeouts: map[string]time.Duration{"patient": time.Second},
+			}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.temp != tt.temp {
+				t.Errorf("temp %v from %v, want %v", res.temp, res.sources, tt.temp)
+			}
+		})
+	}
+}
+
+func TestRepresentativeReading(t *testing.T) {
+	tests := []struct {
+		name    string
+		kelvins []float64
+		want    float64
+	}{
+		{"one reading", []float64{281}, 281},
+		{"odd count", []float64{300, 280, 285}, 285},
+		{"outlier ignored", []float64{284, 200, 287, 285, 290}, 285},
+		{"tie goes to the first", []float64{280, 284, 290, 300}, 284},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []weatherProvider
+			for i, k := range tt.kelvins {
+				providers = append(providers, &fakeProvider{name: fmt.Sprint("p", i), kelvin: k})
+			}
+			w := multiWeatherProvider{providers: providers, representative: true}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.temp.Kelvin() != tt.want || len(res.sources) != 1 {
+				t.Errorf("%v K from %v, want %v K from one provider", res.temp.Kelvin(), res.sources, tt.want)
+			}
+		})
+	}
+}
+
+func TestProviderOffsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		offsets string
+		want    float64
+	}{
+		{"none", "", 285.75},
+		{"one provider calibrated", "alpha=-1.5", 285},
+		{"both calibrated", "alpha=-1.5, beta=+0.5", 285.25},
+		{"unknown and malformed skipped", "gamma=10, beta=warm, alpha=-1.5", 285},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			t.Setenv("WEATHER_PROVIDER_OFFSETS", tt.offsets)
+			w := multiWeatherProvider{
+				providers: []weatherProvider{
+					&fakeProvider{name: "alpha", kelvin: 281.5},
+					&fakeProvider{name: "beta", kelvin: 290},
+				},
+				offsets: envFloats("WEATHER_PROVIDER_OFFSETS"),
+			}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(res.temp.Kelvin()-tt.want) > 1e-9 {
+				t.Errorf("temperature %v K, want %v K", res.temp.Kelvin(), tt.want)
+			}
+		})
+	}
+}
+
+func TestModeOfRoundedReadings(t *testing.T) {
+	tests := []struct {
+		name       string
+		celsius    []float64
+		resolution float64
+		want       float64 // °C
+		sources    []string
+	}{
+		{"clustered", []float64{10.2, 10.4, 9.8, 15}, 1, 10, []string{"p0", "p1", "p2"}},
+		{"tie toward a low median", []float64{10, 10.2, 20, 20.3, 12}, 1, 10, []string{"p0", "p1"}},
+		{"tie toward a high median", []float64{10, 10.2, 20, 20.3, 18}, 1, 20, []string{"p2", "p3"}},
+		{"exact tie goes lower", []float64{20, 10}, 1, 10, []string{"p1"}},
+		{"half-degree resolution", []float64{10.2, 10.3, 10.6, 10.7, 0.5}, 0.5, 10.5, []string{"p1", "p2", "p3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []weatherProvider
+			for i, c := range tt.celsius {
+				providers = append(providers, &fakeProvider{name: fmt.Sprint("p", i), kelvin: celsiusToKelvin(c)})
+			}
+			w := multiWeatherProvider{providers: providers, modeResolution: tt.resolution}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources := append([]string(nil), res.sources...)
+			sort.Strings(sources)
+			if got := res.temp.Celsius(); math.Abs(got-tt.want) > 1e-9 || strings.Join(sources, ",") != strings.Join(tt.sources, ",") {
+				t.Errorf("%v°C from %v, want %v°C from %v", got, sources, tt.want, tt.sources)
+			}
+			if res.readings != len(tt.celsius) {
+				t.Errorf("%d readings, want all %d considered", res.readings, len(tt.celsius))
+			}
+		})
+	}
+}
+
+func TestTrimmedMean(t *testing.T) {
+	tests := []struct {
+		name    string
+		kelvins []float64
+		want    float64
+		sources []string
+	}{
+		{"three readings", []float64{280, 290, 285}, 285, []string{"p2"}},
+		{"outliers either side", []float64{200, 284, 286, 350, 285}, 285, []string{"p1", "p2", "p4"}},
+		{"tied lowest", []float64{280, 280, 290, 300}, 285, []string{"p1", "p2"}},
+		{"all equal", []float64{285, 285, 285}, 285, []string{"p1"}},
+		{"two readings fall back to the mean", []float64{280, 290}, 285, []string{"p0", "p1"}},
+		{"one reading", []float64{281}, 281, []string{"p0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []weatherProvider
+			for i, k := range tt.kelvins {
+				providers = append(providers, &fakeProvider{name: fmt.Sprintf("p%d", i), kelvin: k})
+			}
+			w := multiWeatherProvider{providers: providers, trimmed: true}
+
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources := append([]string(nil), res.sources...)
+			sort.Strings(sources)
+			if got := res.temp.Kelvin(); math.Abs(got-tt.want) > 1e-9 || strings.Join(sources, ",") != strings.Join(tt.sources, ",") {
+				t.Errorf("%v K from %v, want %v K from %v", got, sources, tt.want, tt.sources)
+			}
+			if res.readings != len(tt.kelvins) {
+				t.Errorf("%d readings, want all %d considered", res.readings, len(tt.kelvins))
+			}
+		})
+	}
+}
+
+func TestCelsiusBypassesKelvin(t *testing.T) {
+	native := func(provider string, v float64, u unit) observation {
+		k := v
+		if u == celsius {
+			k = celsiusToKelvin(v)
+		}
+		return observation{provider: provider, Conditions: Conditions{Kelvin: k, Native: &nativeReading{v, u}}}
+	}
+
+	tests := []struct {
+		name    string
+		w       multiWeatherProvider
+		obs     []observation
+		want    float64 // °C, exactly, where averaged directly
+		direct  bool    // whether the Celsius readings are averaged directly
+		inexact bool    // whether the Kelvin round trip loses precision
+	}{
+		{"one reading", multiWeatherProvider{}, []observation{native("p0", 12.3, celsius)}, 12.3, true, true},
+		{"two readings", multiWeatherProvider{}, []observation{native("p0", 0.1, celsius), native("p1", 0.2, celsius)}, 0.15, true, true},
+		{"a reading in Kelvin", multiWeatherProvider{}, []observation{native("p0", 12.3, celsius), native("p1", 285.45, kelvin)}, 12.3, false, false},
+		{"a calibrated reading", multiWeatherProvider{offsets: map[string]float64{"p0": 1}}, []observation{native("p0", 12.3, celsius)}, 12.3, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := tt.w.combine(tt.obs)
+			if (res.celsius != nil) != tt.direct {
+				t.Fatalf("averaged in Celsius: %v, want %v", res.celsius != nil, tt.direct)
+			}
+
+			roundTrip := kelvinToCelsius(res.temp.Kelvin())
+			got := res.in(celsius)
+			if !tt.direct {
+				if got != roundTrip {
+					t.Errorf("%v °C, want the Kelvin round trip's %v °C", got, roundTrip)
+				}
+				return
+			}
+			if math.Abs(got-tt.want) > math.Abs(roundTrip-tt.want) {
+				t.Errorf("directly %v °C, further from %v °C than the round trip's %v °C", got, tt.want, roundTrip)
+			}
+			if tt.inexact && roundTrip == tt.want {
+				t.Errorf("round trip exact at %v °C; want a case that shows the difference", roundTrip)
+			}
+			if got != *res.celsius {
+				t.Errorf("%v °C, want the Celsius average %v °C", got, *res.celsius)
+			}
+			if f := res.in(fahrenheit); f != celsiusToFahrenheit(*res.celsius) {
+				t.Errorf("%v °F, want %v °F, from the Celsius average", f, celsiusToFahrenheit(*res.celsius))
+			}
+			if k := res.in(kelvin); k != res.temp.Kelvin() {
+				t.Errorf("%v K, want %v K", k, res.temp.Kelvin())
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Observer is told about each provider call multiWeatherProvider makes, and
+// each result it aggregates, so that integrations such as metrics can follow
+// lookups without being wired into the aggregation itself. Observers are
+// called concurrently, from each provider's goroutine, and must not block.
+type Observer interface {
+	// onProviderStart is called as a provider is asked for a reading.
+	onProviderStart(ctx context.Context, provider string)
+
+	// onProviderSuccess is called with a provider's reading, in Kelvin, and
+	// how long it took.
+	onProviderSuccess(ctx context.Context, provider string, kelvin float64, took time.Duration)
+
+	// onProviderError is called when a provider fails, including when its
+	// reading was implausible, with how long it took to fail.
+	onProviderError(ctx context.Context, provider string, err error, took time.Duration)
+
+	// onAggregate is called with each result aggregated from the readings.
+	onAggregate(ctx context.Context, res result)
+}
+
+// noopObserver implements every Observer method by doing nothing. Embed it
+// to implement only the methods of interest.
+type noopObserver struct{}
+
+func (noopObserver) onProviderStart(context.Context, string)                           {}
+func (noopObserver) onProviderSuccess(context.Context, string, float64, time.Duration) {}
+func (noopObserver) onProviderError(context.Context, string, error, time.Duration)     {}
+func (noopObserver) onAggregate(context.Context, result)                               {}
+
+// providerMetrics is the Observer behind the provider metrics on /metrics.
+type providerMetrics struct {
+	noopObserver
+
+	errors  *counterVec
+	latency *histogramVec
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the provider latency
+// histogram's buckets.
+var latencyBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newProviderMetrics(r *metricsRegistry) *providerMetrics {
+	return &providerMetrics{
+		errors:  r.newCounterVec("weather_provider_errors_total", "Provider lookups that failed, by cause.", "provider", "category"),
+		latency: r.newHistogramVec("weather_provider_latency_seconds", "How long provider lookups took, successful or not.", latencyBuckets, "provider"),
+	}
+}
+
+func (m *providerMetrics) onProviderSuccess(ctx context.Context, provider string, _ float64, took time.Duration) {
+	m.latency.observe(took.Seconds(), traceIDFrom(ctx), provider)
+}
+
+func (m *providerMetrics) onProviderError(ctx context.Context, provider string, err error, took time.Duration) {
+	m.latency.observe(took.Seconds(), traceIDFrom(ctx), provider)
+	m.errors.with(provider, classifyError(err)).inc()
+}
+
+// timings collects the provider calls made on behalf of one request, so that
+// a slow request can be logged with where its time went.
+type timings struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+type timingsKey struct{}
+
+// withTimings returns a context in which timingObserver records the provider
+// calls made.
+func withTimings(ctx context.Context) (context.Context, *timings) {
+	t := &timings{}
+	return context.WithValue(ctx, timingsKey{}, t), t
+}
+
+func (t *timings) record(call string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls = append(t.calls, call)
+}
+
+// String lists the calls recorded, as in "darkSky=1.2s openWeatherMap=80ms",
+// or "none" if no provider was called, as when the cache answered.
+func (t *timings) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.calls) == 0 {
+		return "none"
+	}
+	return strings.Join(t.calls, " ")
+}
+
+// timingObserver records each provider call in the timings of its context,
+// if it has any.
+type timingObserver struct {
+	noopObserver
+}
+
+func (timingObserver) onProviderSuccess(ctx context.Context, provider string, _ float64, took time.Duration) {
+	timingsFrom(ctx).record(provider + "=" + took.Round(time.Millisecond).String())
+}
+
+func (timingObserver) onProviderError(ctx context.Context, provider string, err error, took time.Duration) {
+	timingsFrom(ctx).record(provider + "=" + took.Round(time.Millisecond).String() + "(" + classifyError(err) + ")")
+}
+
+func timingsFrom(ctx context.Context) *timings {
+	t, _ := ctx.Value(timingsKey{}).(*timings)
+	return t
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObserver records each event it is told of, as a line of text.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...interface{}) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+}
+
+func (o *recordingObserver) onProviderStart(ctx context.Context, provider string) {
+	o.record("start %s", provider)
+}
+
+func (o *recordingObserver) onProviderSuccess(ctx context.Context, provider string, kelvin float64, took time.Duration) {
+	o.record("success %s %g", provider, kelvin)
+}
+
+func (o *recordingObserver) onProviderError(ctx context.Context, provider string, err error, took time.Duration) {
+	o.record("error %s: %v", provider, err)
+}
+
+func (o *recordingObserver) onAggregate(ctx context.Context, res result) {
+	o.record("aggregate %g from %s", res.temp.Kelvin(), strings.Join(res.sources, ","))
+}
+
+// sorted are the events recorded, sorted, since providers are called
+// concurrently.
+func (o *recordingObserver) sorted() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	events := append([]string(nil), o.events...)
+	sort.Strings(events)
+	return events
+}
+
+func TestObserversToldOfEachCall(t *testing.T) {
+	first, second := &recordingObserver{}, &recordingObserver{}
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			&fakeProvider{name: "alpha", kelvin: 280},
+			&fakeProvider{name: "beta", err: errors.New("provider down")},
+			&fakeProvider{name: "gamma", kelvin: 290},
+		},
+		minProviders: 1,
+		observers:    []Observer{first, second},
+	}
+
+	if _, err := w.aggregate(context.Background(), query{city: "Paris"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"aggregate 285 from alpha,gamma",
+		"error beta: provider down",
+		"start alpha",
+		"start beta",
+		"start gamma",
+		"success alpha 280",
+		"success gamma 290",
+	}
+	for i, o := range []*recordingObserver{first, second} {
+		if got := o.sorted(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("observer %d saw:\n%s\nwant:\n%s", i, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestTimingsBreakdown(t *testing.T) {
+	w := multiWeatherProvider{
+		providers: []weatherProvider{
+			&fakeProvider{name: "alpha", kelvin: 285, delay: 20 * time.Millisecond},
+			&fakeProvider{name: "beta", err: errors.New("provider down")},
+		},
+		minProviders: 1,
+		observers:    []Observer{timingObserver{}},
+	}
+
+	ctx, calls := withTimings(context.Background())
+	if _, err := w.aggregate(ctx, query{city: "Paris"}); err != nil {
+		t.Fatal(err)
+	}
+	out := calls.String()
+	if !strings.Contains(out, "alpha=") || !strings.Contains(out, "beta=") || !strings.Contains(out, "(other)") {
+		t.Errorf("breakdown %q, want both providers, beta's failure categorized", out)
+	}
+
+	// Without timings in its context, a lookup records nothing, and nothing
+	// breaks.
+	if _, err := w.aggregate(context.Background(), query{city: "Paris"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, none := withTimings(context.Background()); none.String() != "none" {
+		t.Errorf("no calls listed as %q, want none", none)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// apiVersion is the prefix the versioned API is served under. The
+// unversioned paths remain as aliases of the same endpoints.
+const apiVersion = "/v1"
+
+// temperatureType is Temperature, which is a number in Go but marshals as an
+// object, so its schema is given by hand.
+var temperatureType = reflect.TypeOf(Temperature(0))
+
+// schemaOf is the JSON schema of values of type t as encoding/json writes
+// them: structs by their json tags, with the fields not omitted when empty
+// required, and pointers as what they point to.
+func schemaOf(t reflect.Type) map[string]interface{} {
+	if t == temperatureType {
+		number := map[string]interface{}{"type": "number"}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"k": number, "c": number, "f": number},
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = schemaOf(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+// weatherFields is the shape of a /weather/ JSON response. The response is
+// put together as a map in server.weather; this lists its keys and their
+// types for weatherSchema, and a field without omitempty is always sent.
+type weatherFields struct {
+	City         string            `json:"city"`
+	Temp         int               `json:"temp"`
+	Units        unit              `json:"units"`
+	Temperature  Temperature       `json:"temperature"`
+	Sources      []string          `json:"sources"`
+	Confidence   string            `json:"confidence"`
+	Took         string            `json:"took"`
+	Warnings     []string          `json:"warnings,omitempty"`
+	Trend        string            `json:"trend,omitempty"`
+	PlaceID      string            `json:"place_id,omitempty"`
+	Partial      bool              `json:"partial,omitempty"`
+	Failed       []providerFailure `json:"failed,omitempty"`
+	Explanation  *explanation      `json:"explanation,omitempty"`
+	Debug        []providerStatus  `json:"debug,omitempty"`
+	Attributions []string          `json:"attributions,omitempty"`
+}
+
+// weatherSchema is the schema of a /weather/ JSON response, or, when
+// enveloped, of the envelope it comes in: took and sources move from the
+// response to meta, and data is null when error is set.
+func weatherSchema(enveloped bool) map[string]interface{} {
+	schema := schemaOf(reflect.TypeOf(weatherFields{}))
+	properties := schema["properties"].(map[string]interface{})
+	properties["temp"] = map[string]interface{}{"type": "integer", "description": "The temperature in units, rounded to whole degrees."}
+	properties["units"] = map[string]interface{}{"type": "string", "enum": []unit{kelvin, celsius, fahrenheit}}
+	properties["trend"] = map[string]interface{}{"type": "string", "enum": []string{trendRising, trendSteady, trendFalling}}
+	if !enveloped {
+		return schema
+	}
+
+	var required []string
+	for _, name := range schema["required"].([]string) {
+		if name != "took" && name != "sources" {
+			required = append(required, name)
+		}
+	}
+	schema["required"] = required
+	delete(properties, "took")
+	delete(properties, "sources")
+	schema["nullable"] = true
+
+	env := schemaOf(reflect.TypeOf(envelope{}))
+	env["properties"].(map[string]interface{})["data"] = schema
+	return env
+}
+
+// openAPISpec describes the versioned /weather/ endpoint as OpenAPI 3, with
+// its responses enveloped or not.
+func openAPISpec(enveloped bool) map[string]interface{} {
+	param := func(name, in, description string, schema map[string]interface{}) map[string]interface{} {
+		p := map[string]interface{}{"name": name, "in": in, "description": description, "schema": schema}
+		if in == "path" {
+			p["required"] = true
+		}
+		return p
+	}
+	str := map[string]interface{}{"type": "string"}
+	number := map[string]interface{}{"type": "number"}
+	text := map[string]interface{}{"text/plain": map[string]interface{}{"schema": str}}
+	body := map[string]interface{}{"application/json": map[string]interface{}{"schema": weatherSchema(enveloped)}}
+
+	// Errors come as plain text, or, in envelope mode, as an envelope; a
+	// request shed when the server is overloaded is refused as plain text
+	// before it reaches the endpoint.
+	failure, overloaded := text, text
+	if enveloped {
+		failure = body
+		overloaded = map[string]interface{}{"application/json": body["application/json"], "text/plain": text["text/plain"]}
+	}
+
+	parameters := []interface{}{
+		param("city", "path", `A place, as in "Paris", "Paris,FR" or "Paris,TX,US". May be empty for the server's default city, or a place given by the parameters below.`, str),
+		param("city", "query", "The place, if not given in the path.", str),
+		param("lat", "query", "The latitude of a point, with lon.", number),
+		param("lon", "query", "The longitude of a point, with lat.", number),
+		param("w3w", "query", "A what3words address.", str),
+		param("iata", "query", "An airport's IATA code.", str),
+		param("region", "query", "A country code whose places are preferred for a city given without one.", str),
+		param("units", "query", "The units of temp.", map[string]interface{}{"type": "string", "enum": []string{"kelvin", "k", "celsius", "c", "fahrenheit", "f"}}),
+		param("format", "query", "geojson for a GeoJSON Feature.", map[string]interface{}{"type": "string", "enum": []string{"geojson"}}),
+		param("style", "query", "The case of field names.", map[string]interface{}{"type": "string", "enum": []keyStyle{snakeCase, camelCase}}),
+		param("explain", "query", "true to explain how the temperature was aggregated.", map[string]interface{}{"type": "boolean"}),
+		param("max_age", "query", "The oldest cached result to serve, in seconds.", map[string]interface{}{"type": "integer", "minimum": 1}),
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "go-weather",
+			"version": version,
+		},
+		"paths": map[string]interface{}{
+			apiVersion + "/weather/{city}": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary":    "The current temperature at a place, aggregated across providers.",
+					"parameters": parameters,
+					"responses": map[string]interface{}{
+						"200": map[string]interface{}{
+							"description": "The temperature.",
+							"content":     body,
+						},
+						"400": map[string]interface{}{"description": "The request is malformed.", "content": failure},
+						"404": map[string]interface{}{"description": "The place wasn't found.", "content": failure},
+						"500": map[string]interface{}{"description": "Too few providers answered.", "content": failure},
+						"503": map[string]interface{}{"description": "The server is overloaded.", "content": overloaded},
+					},
+				},
+			},
+		},
+	}
+}
+
+// openAPIHandler serves the OpenAPI description of the versioned API, as
+// the current configuration shapes its responses.
+func openAPIHandler(live *liveProviders) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(openAPISpec(live.load().cfg.envelope))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	type schema struct {
+		Required   []string
+		Properties map[string]json.RawMessage
+	}
+	tests := []struct {
+		name     string
+		envelope bool
+	}{
+		{"plain", false},
+		{"envelope", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			fakes.add("alpha", 285)
+			cfg := testConfig(t)
+			cfg.envelope = tt.envelope
+			_, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+			var spec struct {
+				OpenAPI string
+				Paths   map[string]struct {
+					Get struct {
+						Responses map[string]struct {
+							Content map[string]struct{ Schema json.RawMessage }
+						}
+					}
+				}
+			}
+			resp := getJSONResponse(t, ts.URL+"/v1/openapi.json", &spec)
+			if resp.StatusCode != http.StatusOK || spec.OpenAPI == "" {
+				t.Fatalf("status %d, spec %+v, want an OpenAPI document", resp.StatusCode, spec)
+			}
+			path, ok := spec.Paths["/v1/weather/{city}"]
+			if !ok {
+				t.Fatalf("paths %v, want /v1/weather/{city}", spec.Paths)
+			}
+			var described schema
+			if err := json.Unmarshal(path.Get.Responses["200"].Content["application/json"].Schema, &described); err != nil {
+				t.Fatal(err)
+			}
+
+			// The schema should describe a response asking for every
+			// optional field it can.
+			var got map[string]json.RawMessage
+			getJSONResponse(t, ts.URL+"/v1/weather/Paris?explain=true&debug=true", &got)
+			if tt.envelope {
+				checkSchemaKeys(t, "envelope", described.Required, described.Properties, got)
+				data, envelope := described.Properties["data"], got
+				described, got = schema{}, nil
+				json.Unmarshal(data, &described)
+				json.Unmarshal(envelope["data"], &got)
+			}
+			checkSchemaKeys(t, "response", described.Required, described.Properties, got)
+		})
+	}
+}
+
+// checkSchemaKeys fails t unless every key of got is a property, and every
+// required property a key.
+func checkSchemaKeys(t *testing.T, what string, required []string, properties, got map[string]json.RawMessage) {
+	t.Helper()
+	for _, key := range sortedKeys(got) {
+		if _, ok := properties[key]; !ok {
+			t.Errorf("%s key %q not in the schema", what, key)
+		}
+	}
+	for _, key := range required {
+		if _, ok := got[key]; !ok {
+			t.Errorf("%s lacks the required %q; keys %v", what, key, sortedKeys(got))
+		}
+	}
+}
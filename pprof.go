@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// handlePprof serves the runtime profiles of net/http/pprof on mux, under
+// /debug/pprof/, to clients with one of keys, if any are set.
+//
+// Importing net/http/pprof registers the same handlers on
+// http.DefaultServeMux, which is why the server has a mux of its own: the
+// profiles are served only if this is called.
+func handlePprof(mux *http.ServeMux, keys []string) {
+	mux.Handle("/debug/pprof/", requireKey(keys, http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", requireKey(keys, http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", requireKey(keys, http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", requireKey(keys, http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", requireKey(keys, http.HandlerFunc(pprof.Trace)))
+}
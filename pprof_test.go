@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofOnlyWhenEnabled(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		keys    []string
+		key     string
+		want    int
+	}{
+		{"disabled", false, nil, "", http.StatusNotFound},
+		{"enabled", true, nil, "", http.StatusOK},
+		{"enabled with a key", true, []string{"secret"}, "secret", http.StatusOK},
+		{"enabled without the key", true, []string{"secret"}, "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// As main sets up its mux: with pprof, if enabled, beside the
+			// routes that are always there.
+			mux := http.NewServeMux()
+			mux.HandleFunc("/hello", hello)
+			if tt.enabled {
+				handlePprof(mux, tt.keys)
+			}
+			ts := httptest.NewServer(mux)
+			defer ts.Close()
+
+			for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline"} {
+				req, _ := http.NewRequest("GET", ts.URL+path, nil)
+				if tt.key != "" {
+					req.Header.Set("X-API-Key", tt.key)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tt.want {
+					t.Errorf("%s: status %d, want %d", path, resp.StatusCode, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// warmPlace is a place to keep cached, and how often to refresh it.
+type warmPlace struct {
+	place    query
+	interval time.Duration
+}
+
+// parsePrewarm parses a semicolon-separated list of places, each optionally
+// followed by =interval, as in "London;Paris,TX,US=1m". Places without an
+// interval of their own are refreshed every interval. As with
+// parseThresholds, places may contain commas, so they can't separate them.
+func parsePrewarm(s string, interval time.Duration) ([]warmPlace, error) {
+	var places []warmPlace
+	for _, entry := range strings.Split(s, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		name, every := entry, interval
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			d, err := time.ParseDuration(strings.TrimSpace(entry[i+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("place %q: %v", entry, err)
+			}
+			name, every = strings.TrimSpace(entry[:i]), d
+		}
+		if every <= 0 {
+			return nil, fmt.Errorf("place %q: interval must be positive", entry)
+		}
+
+		q, err := parsePlace(name)
+		if err != nil {
+			return nil, fmt.Errorf("place %q: %v", entry, err)
+		}
+		places = append(places, warmPlace{q, every})
+	}
+	return places, nil
+}
+
+// prewarm keeps each of places fresh in cache, refreshing it every interval
+// of its own, so that clients asking after them needn't wait on the
+// providers. It returns once ctx is canceled.
+func prewarm(ctx context.Context, cache *cachedProvider, places []warmPlace) {
+	var wg sync.WaitGroup
+	for _, p := range places {
+		wg.Add(1)
+		go func(p warmPlace) {
+			defer wg.Done()
+
+			ticker := time.NewTicker(p.interval)
+			defer ticker.Stop()
+
+			for {
+				if _, err := cache.refresh(ctx, p.place); err != nil && ctx.Err() == nil {
+					log.Printf("prewarm: %s: %v", p.place, err)
+				}
+
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePrewarm(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string // the places and their intervals, or the error expected
+		wantErr bool
+	}{
+		{"", "[]", false},
+		{"London", "[London=10m0s]", false},
+		{"London; Paris,TX,US=1m ;", "[London=10m0s Paris,TX,US=1m0s]", false},
+		{"Oslo = 30s", "[Oslo=30s]", false},
+		{"Oslo=soon", "time: invalid duration", true},
+		{"Oslo=0s", "interval must be positive", true},
+		{"Oslo=-1m", "interval must be positive", true},
+		{"=1m", `place "=1m"`, true},
+	}
+	for _, tt := range tests {
+		places, err := parsePrewarm(tt.s, 10*time.Minute)
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("parsePrewarm(%q): error %v, want one containing %q", tt.s, err, tt.want)
+			}
+			continue
+		}
+		var got []string
+		for _, p := range places {
+			got = append(got, fmt.Sprintf("%s=%s", p.place.address(), p.interval))
+		}
+		if fmt.Sprint(got) != tt.want {
+			t.Errorf("parsePrewarm(%q) = %v, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestPrewarmIntervals(t *testing.T) {
+	var mu sync.Mutex
+	lookups := map[string]int{}
+	source := &resultFunc{fn: func(ctx context.Context, q query) (result, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups[q.city]++
+		return result{temp: 285, sources: []string{"fixed"}, readings: 1}, nil
+	}}
+	cache := newTestCache(source, time.Hour)
+
+	places, err := parsePrewarm("Paris=10ms;Oslo", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		prewarm(ctx, cache, places)
+		close(done)
+	}()
+	time.Sleep(105 * time.Millisecond)
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Each is looked up at once; Paris about ten times more.
+	if n := lookups["Oslo"]; n != 1 {
+		t.Errorf("Oslo, every hour, looked up %d times, want once", n)
+	}
+	if n := lookups["Paris"]; n < 5 || n > 12 {
+		t.Errorf("Paris, every 10ms, looked up %d times in 105ms, want about 10", n)
+	}
+
+	// Both are cached for clients.
+	before := source.calls.Load()
+	for _, city := range []string{"Paris", "Oslo"} {
+		if _, err := cache.aggregate(context.Background(), query{city: city}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := source.calls.Load() - before; n != 0 {
+		t.Errorf("%d lookups of prewarmed places, want none", n)
+	}
+}
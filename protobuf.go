@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// protobufType is the media type of protocol buffer responses.
+const protobufType = "application/x-protobuf"
+
+// wantsProtobuf reports whether r asks for a protocol buffer response.
+func wantsProtobuf(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), protobufType)
+}
+
+// weatherMessage is the Weather message of weather.proto. It is encoded by
+// hand, which for a message this small is less trouble than generated code
+// and the dependency it would bring.
+type weatherMessage struct {
+	city        string
+	temperature Temperature
+	sources     []string
+	confidence  string
+	warnings    []string
+	temp        int32
+	units       unit
+	trend       string
+	credits     []string
+	placeID     string
+}
+
+func (m weatherMessage) marshal() []byte {
+	var b protoBuilder
+	b.string(1, m.city)
+	b.bytes(2, temperatureMessage(m.temperature))
+	for _, s := range m.sources {
+		b.bytes(3, []byte(s))
+	}
+	b.string(4, m.confidence)
+	for _, s := range m.warnings {
+		b.bytes(5, []byte(s))
+	}
+	b.varint(6, uint64(int64(m.temp))) // negative int32s are sign-extended
+	b.string(7, string(m.units))
+	b.string(8, m.trend)
+	for _, s := range m.credits {
+		b.bytes(9, []byte(s))
+	}
+	b.string(10, m.placeID)
+	return b.buf
+}
+
+// temperatureMessage encodes t as a Temperature message, in every unit, to
+// two decimal places as in the JSON.
+func temperatureMessage(t Temperature) []byte {
+	var b protoBuilder
+	b.double(1, round2(t.Kelvin()))
+	b.double(2, round2(t.Celsius()))
+	b.double(3, round2(t.Fahrenheit()))
+	return b.buf
+}
+
+// protoBuilder appends fields in the protocol buffer wire format. As proto3
+// does, the scalar methods leave out fields at their zero value; repeated
+// and message fields are written with bytes, which always writes them.
+type protoBuilder struct {
+	buf []byte
+}
+
+// Wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func (b *protoBuilder) tag(field, wire int) {
+	b.buf = binary.AppendUvarint(b.buf, uint64(field)<<3|uint64(wire))
+}
+
+func (b *protoBuilder) varint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.tag(field, wireVarint)
+	b.buf = binary.AppendUvarint(b.buf, v)
+}
+
+func (b *protoBuilder) double(field int, f float64) {
+	if f == 0 {
+		return
+	}
+	b.tag(field, wireFixed64)
+	b.buf = binary.LittleEndian.AppendUint64(b.buf, math.Float64bits(f))
+}
+
+func (b *protoBuilder) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	b.bytes(field, []byte(s))
+}
+
+func (b *protoBuilder) bytes(field int, p []byte) {
+	b.tag(field, wireBytes)
+	b.buf = binary.AppendUvarint(b.buf, uint64(len(p)))
+	b.buf = append(b.buf, p...)
+}
+
+// optionalDouble writes f if it is set, even if it is zero, as proto3 does
+// for fields declared optional.
+func (b *protoBuilder) optionalDouble(field int, f *float64) {
+	if f == nil {
+		return
+	}
+	b.tag(field, wireFixed64)
+	b.buf = binary.LittleEndian.AppendUint64(b.buf, math.Float64bits(*f))
+}
+
+// conditionsMessage is the Conditions message of weather.proto.
+type conditionsMessage struct {
+	city    string
+	credits []string
+	conditionsResult
+}
+
+func (m conditionsMessage) marshal() []byte {
+	var b protoBuilder
+	b.string(1, m.city)
+	b.bytes(2, temperatureMessage(Temperature(m.Kelvin)))
+	if m.Sunrise != nil {
+		b.varint(3, uint64(m.Sunrise.Unix()))
+	}
+	if m.Sunset != nil {
+		b.varint(4, uint64(m.Sunset.Unix()))
+	}
+	b.optionalDouble(5, m.CloudCover)
+	b.optionalDouble(6, m.Pressure)
+	b.optionalDouble(7, m.UVIndex)
+	b.optionalDouble(8, m.Visibility)
+	b.optionalDouble(9, m.PrecipProbability)
+	b.string(10, m.Summary)
+	for _, s := range m.sources {
+		b.bytes(11, []byte(s))
+	}
+	b.optionalDouble(12, m.Rain)
+	b.optionalDouble(13, m.Snow)
+	b.optionalDouble(14, m.SnowAccumulation)
+	b.optionalDouble(15, m.MoonPhase)
+	if m.MoonPhase != nil {
+		b.string(16, moonPhaseName(*m.MoonPhase))
+	}
+	b.string(19, m.timeZone())
+	for _, s := range m.credits {
+		b.bytes(20, []byte(s))
+	}
+	b.optionalDouble(21, m.StationDistance)
+	b.optionalDouble(22, m.WindSpeed)
+	if m.WindSpeed != nil {
+		b.varint(23, uint64(beaufort(*m.WindSpeed)))
+	}
+	b.optionalDouble(24, m.Humidity)
+	if m.FeelsLike != nil {
+		b.bytes(18, temperatureMessage(Temperature(*m.FeelsLike)))
+	}
+	for _, s := range m.summaries {
+		var p protoBuilder
+		p.string(1, s.Provider)
+		p.string(2, s.Summary)
+		b.bytes(17, p.buf)
+	}
+	return b.buf
+}
+
+// parseProto calls fn with each length-delimited field of the message msg,
+// such as its strings, skipping fields of other wire types.
+func parseProto(msg []byte, fn func(field int, p []byte)) error {
+	malformed := &grpcError{grpcInvalidArgument, "malformed message"}
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return malformed
+		}
+		msg = msg[n:]
+
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return malformed
+			}
+			msg = msg[n:]
+		case wireFixed64:
+			if len(msg) < 8 {
+				return malformed
+			}
+			msg = msg[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return malformed
+			}
+			fn(field, msg[n:n+int(size)])
+			msg = msg[n+int(size):]
+		case wireFixed32:
+			if len(msg) < 4 {
+				return malformed
+			}
+			msg = msg[4:]
+		default:
+			return malformed
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// protoField is one field of a decoded protocol buffer message.
+type protoField struct {
+	num    int
+	varint uint64
+	double float64
+	bytes  []byte
+}
+
+// decodeProto decodes the fields of msg, in order, failing t if it is
+// malformed. It is written independently of the encoder under test.
+func decodeProto(t *testing.T, msg []byte) []protoField {
+	t.Helper()
+	var fields []protoField
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			t.Fatalf("malformed tag in % x", msg)
+		}
+		msg = msg[n:]
+
+		f := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			f.varint, n = binary.Uvarint(msg)
+			if n <= 0 {
+				t.Fatalf("field %d: malformed varint", f.num)
+			}
+			msg = msg[n:]
+		case 1:
+			if len(msg) < 8 {
+				t.Fatalf("field %d: short double", f.num)
+			}
+			f.double = math.Float64frombits(binary.LittleEndian.Uint64(msg))
+			msg = msg[8:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				t.Fatalf("field %d: malformed length", f.num)
+			}
+			f.bytes = msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+		default:
+			t.Fatalf("field %d: unexpected wire type %d", f.num, tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// decodedWeather is a Weather message decoded field by field.
+type decodedWeather struct {
+	city       string
+	k, c, f    float64
+	sources    []string
+	confidence string
+	warnings   []string
+	temp       int32
+	units      string
+}
+
+func decodeWeather(t *testing.T, msg []byte) decodedWeather {
+	t.Helper()
+	var w decodedWeather
+	for _, f := range decodeProto(t, msg) {
+		switch f.num {
+		case 1:
+			w.city = string(f.bytes)
+		case 2:
+			for _, tf := range decodeProto(t, f.bytes) {
+				switch tf.num {
+				case 1:
+					w.k = tf.double
+				case 2:
+					w.c = tf.double
+				case 3:
+					w.f = tf.double
+				}
+			}
+		case 3:
+			w.sources = append(w.sources, string(f.bytes))
+		case 4:
+			w.confidence = string(f.bytes)
+		case 5:
+			w.warnings = append(w.warnings, string(f.bytes))
+		case 6:
+			w.temp = int32(f.varint)
+		case 7:
+			w.units = string(f.bytes)
+		}
+	}
+	return w
+}
+
+func TestWeatherProtobufRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		kelvin   Temperature
+		units    unit
+		warnings []string
+	}{
+		{"mild", 288.15, "c", nil},
+		{"below freezing", 263.15, "c", nil},
+		{"Fahrenheit", 300, "f", nil},
+		{"zero Celsius", 273.15, "c", nil},
+		{"warned", 288.15, "c", []string{"providers disagree by 8.3°C"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := weatherMessage{
+				city:        "Paris",
+				temperature: tt.kelvin,
+				sources:     []string{"alpha", "beta"},
+				confidence:  confidenceHigh,
+				warnings:    tt.warnings,
+				temp:        int32(tt.kelvin.in(tt.units)),
+				units:       tt.units,
+			}
+
+			got := decodeWeather(t, m.marshal())
+			if got.city != m.city || got.temp != m.temp || got.units != string(m.units) || got.confidence != m.confidence {
+				t.Errorf("message %+v, want %+v", got, m)
+			}
+			if got.k != round2(tt.kelvin.Kelvin()) || got.c != round2(tt.kelvin.Celsius()) || got.f != round2(tt.kelvin.Fahrenheit()) {
+				t.Errorf("temperature %v K %v°C %v°F, want %v", got.k, got.c, got.f, tt.kelvin)
+			}
+			if len(got.sources) != 2 || got.sources[0] != "alpha" || got.sources[1] != "beta" {
+				t.Errorf("sources %q", got.sources)
+			}
+			if len(got.warnings) != len(tt.warnings) || (len(got.warnings) > 0 && got.warnings[0] != tt.warnings[0]) {
+				t.Errorf("warnings %q, want %q", got.warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestWantsProtobuf(t *testing.T) {
+	for _, tt := range []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{protobufType, true},
+		{"application/json;q=0.5, " + protobufType, true},
+	} {
+		r := httptest.NewRequest("GET", "/weather/Paris", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := wantsProtobuf(r); got != tt.want {
+			t.Errorf("Accept %q: protobuf %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestWeatherProtobufMatchesJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		kelvin float64
+		units  string
+	}{
+		{"mild", 288.15, "c"},
+		{"below freezing", 263.15, "c"},
+		{"Fahrenheit", 300, "f"},
+		{"zero Celsius", 273.15, "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			fakes.add("alpha", tt.kelvin)
+			cfg := testConfig(t)
+			cfg.minProviders = 1
+			_, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+			u := ts.URL + "/weather/Paris?units=" + tt.units
+
+			var want struct {
+				City        string   `json:"city"`
+				Temp        int32    `json:"temp"`
+				Units       string   `json:"units"`
+				Sources     []string `json:"sources"`
+				Confidence  string   `json:"confidence"`
+				Temperature struct {
+					K, C, F float64
+				} `json:"temperature"`
+			}
+			getJSONResponse(t, u, &want)
+
+			req, _ := http.NewRequest("GET", u, nil)
+			req.Header.Set("Accept", protobufType)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); ct != protobufType {
+				t.Fatalf("Content-Type %q, want %q", ct, protobufType)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := decodeWeather(t, body)
+			if got.city != want.City || got.temp != want.Temp || got.units != want.Units || got.confidence != want.Confidence {
+				t.Errorf("message %+v, want as in JSON %+v", got, want)
+			}
+			if got.k != want.Temperature.K || got.c != want.Temperature.C || got.f != want.Temperature.F {
+				t.Errorf("temperature %v K %v°C %v°F, want %+v", got.k, got.c, got.f, want.Temperature)
+			}
+			if len(got.sources) != 1 || got.sources[0] != "alpha" {
+				t.Errorf("sources %q", got.sources)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrCityNotFound is returned when a place can't be resolved to a location.
+var ErrCityNotFound = errors.New("city not found")
+
+// coordinateProvider is implemented by providers that can look up weather by
+// latitude and longitude as well as by city name.
+type coordinateProvider interface {
+	temperatureAt(ctx context.Context, c coordinates) (float64, error) // Kelvin
+}
+
+// placeProvider is implemented by providers that geocode a city themselves,
+// and so need the whole query, including its region bias, rather than just
+// its address.
+type placeProvider interface {
+	temperatureOf(ctx context.Context, q query) (float64, error) // Kelvin
+}
+
+// query is the place a lookup is for: a city name or, when coords is set,
+// a point on the map. A city may be narrowed down by state and country, to
+// tell Paris, France from Paris, Texas.
+type query struct {
+	city    string
+	state   string
+	country string
+	coords  *coordinates
+
+	// bias, if set, is a country code whose places are preferred when
+	// geocoding a city given without a country, as in "Springfield".
+	// Unlike country, it doesn't rule out places elsewhere.
+	bias string
+
+	// lang, if set, is the language to describe the weather in, such as
+	// "en" or "pt-br". It doesn't change the place, so it isn't part of
+	// the query's key.
+	lang string
+
+	// placeID, if set, is the canonical ID of the place the query geocodes
+	// to. It is the query's key in place of its address, so that every
+	// name for one place shares a cache entry.
+	placeID string
+}
+
+// address is the query's city, state and country as one string, in the
+// "Paris,TX,US" form that it was given in.
+func (q query) address() string {
+	parts := []string{q.city}
+	for _, p := range []string{q.state, q.country} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// key identifies the query's place, for caching.
+func (q query) key() string {
+	if q.placeID != "" {
+		return "#" + q.placeID
+	}
+	if q.coords != nil {
+		return fmt.Sprintf("@%.4f,%.4f", q.coords.lat, q.coords.lon)
+	}
+	if b := q.regionBias(); b != "" {
+		return q.address() + "~" + strings.ToUpper(b)
+	}
+	return q.address()
+}
+
+// defaultRegionBias is the country code whose places are preferred when a
+// query names no country and has no bias of its own.
+var defaultRegionBias string
+
+// regionBias is the country the query's place should be looked for in first,
+// if it doesn't name one outright.
+func (q query) regionBias() string {
+	if q.country != "" {
+		return ""
+	}
+	if q.bias != "" {
+		return q.bias
+	}
+	return defaultRegionBias
+}
+
+// parseRegion checks a region bias is a two-letter country code, as in "US".
+func parseRegion(s string) (string, error) {
+	if len(s) != 2 || !isLetter(s[0]) || !isLetter(s[1]) {
+		return "", fmt.Errorf("region %q is not a two-letter country code", s)
+	}
+	return strings.ToUpper(s), nil
+}
+
+func isLetter(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// String describes the query's place, for logging.
+func (q query) String() string {
+	if q.coords != nil {
+		return q.coords.String()
+	}
+	return q.address()
+}
+
+// supportedBy reports whether p is able to answer q.
+func (q query) supportedBy(p weatherProvider) bool {
+	if q.coords == nil {
+		return true
+	}
+	return capabilitiesOf(p).has(capCoordinates)
+}
+
+// temperature asks p for the temperature at q's place, in Kelvin.
+func (q query) temperature(ctx context.Context, p weatherProvider) (float64, error) {
+	if q.coords != nil {
+		return p.(coordinateProvider).temperatureAt(ctx, *q.coords)
+	}
+	if pp, ok := p.(placeProvider); ok {
+		return pp.temperatureOf(ctx, q)
+	}
+	return p.temperature(ctx, q.address())
+}
+
+// reading asks p for its reading at q's place: its conditions if it reports
+// them, which carry the temperature as the provider gave it, and otherwise
+// just the temperature.
+func (q query) reading(ctx context.Context, p weatherProvider) (Conditions, error) {
+	if cp, ok := p.(conditionsProvider); ok && capabilitiesOf(p).has(capConditions) {
+		return cp.conditions(ctx, q)
+	}
+	k, err := q.temperature(ctx, p)
+	return Conditions{Kelvin: k}, err
+}
+
+// maxCityLength is the longest city name, in characters, that is passed on
+// to providers. Longer ones are rejected as bad requests.
+var maxCityLength = 128
+
+// validateCity rejects city names that are empty, too long, or contain
+// control characters, before they are built into any provider's URL.
+// Providers escape what is left, so that a name like "London&APPID=x" can't
+// add parameters of its own.
+func validateCity(city string) error {
+	switch {
+	case city == "":
+		return errors.New("missing city")
+	case !utf8.ValidString(city):
+		return errors.New("city is not valid UTF-8")
+	case utf8.RuneCountInString(city) > maxCityLength:
+		return fmt.Errorf("city is longer than %d characters", maxCityLength)
+	}
+
+	for _, r := range city {
+		if unicode.IsControl(r) {
+			return errors.New("city contains control characters")
+		}
+	}
+
+	return nil
+}
+
+// queryFromRequest works out which place a request is for: the city named in
+// the path after the endpoint's prefix, as in /weather/London, or in ?city=;
+// failing that a point given by ?lat= and ?lon=, or by a what3words address
+// in ?w3w=; failing that an airport named by ?iata=; failing that
+// defaultCity.
+func queryFromRequest(r *http.Request, defaultCity string) (query, error) {
+	params := r.URL.Query()
+
+	city := cityFromPath(r.URL.Path)
+	if city == "" {
+		city = params.Get("city")
+	}
+
+	if city == "" && (params.Get("lat") != "" || params.Get("lon") != "") {
+		c, err := parseCoordinates(params.Get("lat"), params.Get("lon"))
+		if err != nil {
+			return query{}, &requestError{err}
+		}
+		return query{coords: &c}, nil
+	}
+
+	if w := params.Get("w3w"); w != "" && city == "" {
+		return queryFromWords(r.Context(), w)
+	}
+
+	if code := params.Get("iata"); code != "" && city == "" {
+		a, ok := lookupAirport(code)
+		if !ok {
+			return query{}, ErrCityNotFound
+		}
+		return query{city: a.city, coords: &coordinates{a.lat, a.lon}}, nil
+	}
+
+	if city == "" {
+		city = defaultCity
+	}
+	q, err := parsePlace(city)
+	if err != nil {
+		return query{}, err
+	}
+
+	if r := params.Get("region"); r != "" {
+		if q.bias, err = parseRegion(r); err != nil {
+			return query{}, &requestError{err}
+		}
+	}
+	return q, nil
+}
+
+// cityFromPath is the city named in a request path after the endpoint's
+// prefix: "London" in /weather/London. It is empty if the path names none,
+// including when it is too short to have a prefix at all.
+func cityFromPath(path string) string {
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
+
+// queryFromWords resolves a what3words address to the point it names.
+func queryFromWords(ctx context.Context, s string) (query, error) {
+	w, err := parseWords(s)
+	if err != nil {
+		return query{}, &requestError{err}
+	}
+	if words == nil {
+		return query{}, &requestError{errors.New("what3words addresses are not supported by this server")}
+	}
+
+	c, err := words.resolve(ctx, w)
+	if err != nil {
+		return query{}, err
+	}
+	return query{coords: &c}, nil
+}
+
+// defaultLang is the language weather is described in unless a request asks
+// for another.
+const defaultLang = "en"
+
+// langFromRequest works out which language a request wants the weather
+// described in: the one named by ?lang=, or else the first in its
+// Accept-Language header, or else defaultLang. Malformed tags are ignored.
+func langFromRequest(r *http.Request) string {
+	if l, ok := parseLang(r.URL.Query().Get("lang")); ok {
+		return l
+	}
+
+	accept := strings.Split(r.Header.Get("Accept-Language"), ",")[0]
+	if l, ok := parseLang(strings.Split(accept, ";")[0]); ok {
+		return l
+	}
+	return defaultLang
+}
+
+// parseLang normalizes a language tag, such as "pt-BR", to a lowercased
+// language and optional region: "pt-br".
+func parseLang(tag string) (string, bool) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(tag)), "-")
+	if len(parts) > 2 || len(parts[0]) < 2 || len(parts[0]) > 3 {
+		return "", false
+	}
+	for _, p := range parts {
+		if p == "" || strings.IndexFunc(p, func(r rune) bool { return r < 'a' || r > 'z' }) >= 0 {
+			return "", false
+		}
+	}
+	return strings.Join(parts, "-"), true
+}
+
+// parseCoordinates parses a latitude and longitude in decimal degrees.
+func parseCoordinates(lat, lon string) (coordinates, error) {
+	la, err := strconv.ParseFloat(lat, 64)
+	if err != nil || math.IsNaN(la) || la < -90 || la > 90 {
+		return coordinates{}, fmt.Errorf("malformed latitude %q", lat)
+	}
+	lo, err := strconv.ParseFloat(lon, 64)
+	if err != nil || math.IsNaN(lo) || lo < -180 || lo > 180 {
+		return coordinates{}, fmt.Errorf("malformed longitude %q", lon)
+	}
+	return coordinates{la, lo}, nil
+}
+
+// parsePlace parses a place given as "city", "city,country" or
+// "city,state,country", such as "Paris,FR" or "Paris,TX,US".
+func parsePlace(s string) (query, error) {
+	if err := validateCity(s); err != nil {
+		return query{}, &requestError{err}
+	}
+
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+		if parts[i] == "" {
+			return query{}, &requestError{fmt.Errorf("malformed place %q", s)}
+		}
+	}
+
+	switch len(parts) {
+	case 1:
+		return query{city: parts[0]}, nil
+	case 2:
+		return query{city: parts[0], country: parts[1]}, nil
+	case 3:
+		return query{city: parts[0], state: parts[1], country: parts[2]}, nil
+	}
+	return query{}, &requestError{fmt.Errorf("malformed place %q: want city, city,country or city,state,country", s)}
+}
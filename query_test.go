@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCoordinateQuery(t *testing.T) {
+	var asked []string
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		asked = append(asked, r.Host+"?"+r.URL.RawQuery)
+		fmt.Fprint(w, `{"main": {"temp": 280}}`)
+	})
+	w := multiWeatherProvider{providers: []weatherProvider{
+		openWeatherMap{keys: newKeyRing("KEY")},
+		&fakeProvider{name: "by city only", kelvin: 300},
+	}}
+
+	res, err := w.aggregate(context.Background(), query{coords: &coordinates{lat: 40.6413, lon: -73.7781}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.temp != 280 {
+		t.Errorf("temperature %v, want 280 from the provider taking coordinates alone", res.temp)
+	}
+	if len(asked) != 1 || !strings.Contains(asked[0], "lat=40.6413&lon=-73.7781") {
+		t.Errorf("upstream asked %q, want one lookup by latitude and longitude", asked)
+	}
+}
+
+func TestQueryKey(t *testing.T) {
+	tests := []struct {
+		q    query
+		want string
+	}{
+		{query{city: "Paris"}, "Paris"},
+		{query{coords: &coordinates{lat: 40.64131, lon: -73.77809}}, "@40.6413,-73.7781"},
+	}
+	for _, tt := range tests {
+		if got := tt.q.key(); got != tt.want {
+			t.Errorf("key of %+v = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestValidateCity(t *testing.T) {
+	for _, tt := range []struct {
+		city string
+		ok   bool
+	}{
+		{"London", true},
+		{"São Paulo", true},
+		{"London&APPID=attacker", true},
+		{"", false},
+		{"London\x00", false},
+		{"London\r\nX-Injected: yes", false},
+		{"London\x1b[31m", false},
+		{"\xff\xfe", false},
+		{strings.Repeat("a", maxCityLength), true},
+		{strings.Repeat("a", maxCityLength+1), false},
+	} {
+		if err := validateCity(tt.city); (err == nil) != tt.ok {
+			t.Errorf("validateCity(%q) = %v, want ok %v", tt.city, err, tt.ok)
+		}
+	}
+}
+
+func TestHostileCitiesNeutralized(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		asked = map[string]*http.Request{}
+	)
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		asked[r.Host] = r
+		mu.Unlock()
+		switch r.Host {
+		case "api.openweathermap.org":
+			fmt.Fprint(w, `{"main": {"temp": 280}}`)
+		case "api.wunderground.com":
+			fmt.Fprint(w, `{"current_observation": {"temp_c": 10}}`)
+		case "api.weatherbit.io":
+			fmt.Fprint(w, `{"data": [{"temp": 10}], "count": 1}`)
+		}
+	})
+
+	for _, city := range []string{
+		"London&APPID=attacker",
+		"London?APPID=attacker",
+		"London#APPID=attacker",
+		"London/../../admin",
+		"London%26APPID%3Dattacker",
+	} {
+		for _, p := range []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, weatherUnderground{keys: newKeyRing("KEY")}, weatherbit{keys: newKeyRing("KEY")}} {
+			if _, err := p.temperature(context.Background(), city); err != nil {
+				t.Fatalf("%q: %v", city, err)
+			}
+		}
+
+		owm := asked["api.openweathermap.org"].URL
+		if got := owm.Query(); got.Get("q") != city || len(got["APPID"]) != 1 || got.Get("APPID") != "KEY" {
+			t.Errorf("%q: OpenWeatherMap asked %s", city, owm)
+		}
+		wu := asked["api.wunderground.com"].URL
+		if wu.RawQuery != "" || wu.Path != "/api/KEY/conditions/q/"+city+".json" {
+			t.Errorf("%q: Weather Underground asked %s, path %q", city, wu, wu.Path)
+		}
+		wb := asked["api.weatherbit.io"].URL
+		if got := wb.Query(); got.Get("city") != city || len(got["key"]) != 1 || got.Get("key") != "KEY" {
+			t.Errorf("%q: Weatherbit asked %s", city, wb)
+		}
+	}
+}
+
+func TestQueryFromRequest(t *testing.T) {
+	tests := []struct {
+		name, target, defaultCity string
+		want                      string // the query's key
+		status                    int    // when it fails
+	}{
+		{"city in the path", "/weather/Paris", "", "Paris", 0},
+		{"city parameter", "/weather/?city=Paris", "", "Paris", 0},
+		{"airport", "/weather/?iata=jfk", "", "@40.6413,-73.7781", 0},
+		{"coordinates", "/weather/?lat=48.8566&lon=2.3522", "", "@48.8566,2.3522", 0},
+		{"latitude out of range", "/weather/?lat=91&lon=0", "", "", http.StatusBadRequest},
+		{"longitude missing", "/weather/?lat=48.8566", "", "", http.StatusBadRequest},
+		{"unknown airport", "/weather/?iata=XXX", "", "", http.StatusNotFound},
+		{"default city", "/weather/", "Oslo", "Oslo", 0},
+		{"no city and no default", "/weather/", "", "", http.StatusBadRequest},
+		{"control characters", "/weather/?city=London%00", "", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := queryFromRequest(httptest.NewRequest("GET", tt.target, nil), tt.defaultCity)
+			if tt.status != 0 {
+				if err == nil || errorStatus(err) != tt.status {
+					t.Fatalf("error %v, want one answered with %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if q.key() != tt.want {
+				t.Errorf("query for %s, want %s", q.key(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceComponentsReachProviders(t *testing.T) {
+	tests := []struct {
+		city    string
+		owm     string
+		wbCity  string
+		country string
+		wuPath  string
+		google  string
+	}{
+		{"Paris", "Paris", "Paris", "", "/api/KEY/conditions/q/Paris.json", ""},
+		{"Paris,FR", "Paris,FR", "Paris", "FR", "/api/KEY/conditions/q/FR/Paris.json", "country:FR"},
+		{"Springfield,IL,US", "Springfield,IL,US", "Springfield,IL", "US", "/api/KEY/conditions/q/IL/Springfield.json", "country:US"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.city, func(t *testing.T) {
+			upstreams := servePayloads(t, map[string]string{
+				"api.openweathermap.org": `{"main": {"temp": 280}}`,
+				"api.wunderground.com":   `{"current_observation": {"temp_c": 10}}`,
+				"maps.googleapis.com":    `{"results": [{"geometry": {"location": {"lat": 48.85, "lng": 2.35}}}]}`,
+				"api.darksky.net":        `{"currently": {"temperature": 10}}`,
+				"api.weatherbit.io":      `{"data": [{"temp": 10}], "count": 1}`,
+			})
+			w := multiWeatherProvider{providers: []weatherProvider{
+				openWeatherMap{keys: newKeyRing("KEY")},
+				weatherbit{keys: newKeyRing("KEY")},
+				weatherUnderground{keys: newKeyRing("KEY")},
+				darkSky{keys: newKeyRing("KEY"), geocoder: googleGeocoder{apiKey: "KEY"}},
+			}}
+			q, err := parsePlace(tt.city)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.aggregate(context.Background(), q); err != nil {
+				t.Fatal(err)
+			}
+
+			requested := map[string]*url.URL{}
+			for _, u := range upstreams.requests() {
+				requested[u.Host] = u
+			}
+			if u := requested["api.openweathermap.org"]; u == nil || u.Query().Get("q") != tt.owm {
+				t.Errorf("OpenWeatherMap asked %v, want q=%s", u, tt.owm)
+			}
+			if u := requested["api.weatherbit.io"]; u == nil || u.Query().Get("city") != tt.wbCity || u.Query().Get("country") != tt.country {
+				t.Errorf("Weatherbit asked %v, want city=%s and country=%s", u, tt.wbCity, tt.country)
+			}
+			if u := requested["api.wunderground.com"]; u == nil || u.Path != tt.wuPath {
+				t.Errorf("Weather Underground asked %v, want %s", u, tt.wuPath)
+			}
+			if u := requested["maps.googleapis.com"]; u == nil || u.Query().Get("address") != tt.owm || u.Query().Get("components") != tt.google {
+				t.Errorf("Google asked %v, want address=%s and components=%s", u, tt.owm, tt.google)
+			}
+		})
+	}
+}
+
+func TestParsePlace(t *testing.T) {
+	tests := []struct {
+		place string
+		want  query
+		ok    bool
+	}{
+		{"Paris", query{city: "Paris"}, true},
+		{"Paris, FR", query{city: "Paris", country: "FR"}, true},
+		{"Paris,TX,US", query{city: "Paris", state: "TX", country: "US"}, true},
+		{"London,,UK", query{}, false},
+		{"a,b,c,d", query{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePlace(tt.place)
+		if (err == nil) != tt.ok {
+			t.Errorf("parsePlace(%q): error %v", tt.place, err)
+			continue
+		}
+		if err != nil {
+			if errorStatus(err) != http.StatusBadRequest {
+				t.Errorf("parsePlace(%q): error %v answered with %d", tt.place, err, errorStatus(err))
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePlace(%q) = %+v, want %+v", tt.place, got, tt.want)
+		}
+	}
+}
+
+func TestLangReachesProviders(t *testing.T) {
+	tests := []struct {
+		name           string
+		lang           string
+		acceptLanguage string
+		owm, others    string
+	}{
+		{"default", "", "", "en", "en"},
+		{"query parameter", "fr", "de", "fr", "fr"},
+		{"Accept-Language", "", "pt-BR,en;q=0.8", "pt_br", "pt"},
+		{"malformed ignored", "français", "es-MX", "es", "es"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreams := servePayloads(t, dryRunResponses)
+			h := conditionsHandler(servingOnly(multiWeatherProvider{providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}, darkSky{keys: newKeyRing("KEY")}}}))
+
+			req := httptest.NewRequest("GET", "/conditions/?lat=48.8566&lon=2.3522&lang="+url.QueryEscape(tt.lang), nil)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+
+			for _, u := range upstreams.requests() {
+				want := tt.others
+				if u.Host == "api.openweathermap.org" {
+					want = tt.owm
+				}
+				if got := u.Query().Get("lang"); got != want {
+					t.Errorf("%s asked in %q, want %q", u.Host, got, want)
+				}
+			}
+			if n := len(upstreams.requests()); n != 2 {
+				t.Errorf("%d upstream requests, want one per provider", n)
+			}
+		})
+	}
+}
+
+// FuzzCityURL checks that no city taken from a request path, in any
+// language, can make a provider URL that fails to parse, points elsewhere
+// or carries more than the one key.
+func FuzzCityURL(f *testing.F) {
+	for _, seed := range []struct{ path, lang string }{
+		{"/weather/London", ""},
+		{"/weather/Paris,FR", "fr"},
+		{"/weather/San Francisco,CA,US", "pt-BR"},
+		{"/weather/48.8566,2.3522", "zh-tw"},
+		{"/weather/São Paulo", "pt-br"},
+		{"/weather/a/b", ""},
+		{"/weather/../../admin", ""},
+		{"/weather/London?APPID=stolen#frag", "en"},
+		{"/weather/London&key=stolen", "en&key=stolen"},
+		{"/weather/%2e%2e%2f", ""},
+		{"/weather/", ""},
+		{"/w", ""},
+	} {
+		f.Add(seed.path, seed.lang)
+	}
+
+	f.Fuzz(func(t *testing.T, path, lang string) {
+		q, err := parsePlace(cityFromPath(path))
+		if err != nil {
+			return
+		}
+		if l, ok := parseLang(lang); ok {
+			q.lang = l
+		}
+		if q.country != "" && q.state == "" {
+			if c, err := parseCoordinates(q.city, q.country); err == nil {
+				q = query{coords: &c, lang: q.lang}
+			}
+		}
+
+		check := func(name, raw, host, keyParam string) *url.URL {
+			u, err := url.Parse(raw)
+			if err != nil {
+				t.Fatalf("%s URL %q for %+v: %v", name, raw, q, err)
+			}
+			if u.Host != host || u.Fragment != "" || u.User != nil {
+				t.Fatalf("%s URL %q for %+v goes to %q, fragment %q", name, raw, q, u.Host, u.Fragment)
+			}
+			if keys := u.Query()[keyParam]; keyParam != "" && (len(keys) != 1 || keys[0] != "KEY") {
+				t.Fatalf("%s URL %q for %+v has keys %q", name, raw, q, keys)
+			}
+			return u
+		}
+
+		u := check("OpenWeatherMap", openWeatherMap{}.weatherURL(q, "KEY"), "api.openweathermap.org", "APPID")
+		if q.coords == nil && u.Query().Get("q") != q.address() {
+			t.Errorf("OpenWeatherMap asked after %q, want %q", u.Query().Get("q"), q.address())
+		}
+
+		u = check("Weather Underground", weatherUnderground{}.conditionsURL(q, "KEY"), "api.wunderground.com", "")
+		if u.RawQuery != "" || !strings.HasPrefix(u.Path, "/api/KEY/conditions/q/") || !strings.HasSuffix(u.Path, ".json") {
+			t.Errorf("Weather Underground URL %q for %+v", u, q)
+		}
+
+		u = check("Weatherbit", weatherbit{}.currentURL(q, "KEY"), "api.weatherbit.io", "key")
+		if q.coords == nil && !strings.HasPrefix(u.Query().Get("city"), q.city) {
+			t.Errorf("Weatherbit asked after %q, want %q", u.Query().Get("city"), q.city)
+		}
+
+		if q.coords != nil {
+			u = check("Dark Sky", darkSky{}.forecastURL(*q.coords, q.lang, "KEY"), "api.darksky.net", "")
+			if want := "/forecast/KEY/" + q.coords.String(); u.Path != want {
+				t.Errorf("Dark Sky path %q, want %q", u.Path, want)
+			}
+		}
+	})
+}
+
+func TestCityLengthLimit(t *testing.T) {
+	prev := maxCityLength
+	t.Cleanup(func() { maxCityLength = prev })
+
+	tests := []struct {
+		name  string
+		limit int
+		city  string
+		want  int
+	}{
+		{"at the default limit", 128, strings.Repeat("a", 128), http.StatusOK},
+		{"over the default limit", 128, strings.Repeat("a", 129), http.StatusBadRequest},
+		{"counted in characters, not bytes", 128, strings.Repeat("é", 128), http.StatusOK},
+		{"at a configured limit", 10, "Llanfair P", http.StatusOK},
+		{"over a configured limit", 10, "Llanfairpwllgwyngyll", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxCityLength = tt.limit
+			upstreams := servePayloads(t, dryRunResponses)
+			s, _ := newTestServer(t, testConfig(t), nil, openWeatherMap{keys: newKeyRing("KEY")})
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/?city="+url.QueryEscape(tt.city), nil))
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+			if n := len(upstreams.requests()); tt.want == http.StatusBadRequest && n != 0 {
+				t.Errorf("%d upstream requests for a rejected city", n)
+			}
+		})
+	}
+}
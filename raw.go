@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// errNoNativeReading is reported for a provider that doesn't say how it
+// reported its temperature.
+var errNoNativeReading = errors.New("provider has no native reading")
+
+// nativeReading is a temperature as a provider reported it, in the unit it
+// reported it in.
+type nativeReading struct {
+	Value float64 `json:"value"`
+	Unit  unit    `json:"unit"`
+}
+
+// rawReading is one provider's native reading of a place, or why it has
+// none.
+type rawReading struct {
+	Provider string `json:"provider"`
+	*nativeReading
+	Error string `json:"error,omitempty"`
+}
+
+// raw asks every provider able to report conditions for q for its reading,
+// and reports each as it came, unconverted and unaveraged, in provider
+// order. Like compare, it never fails: a provider that errs just has its
+// error in its row. Calibrations and plausibility checks don't apply, since
+// the point is to see what the providers said.
+func (w multiWeatherProvider) raw(ctx context.Context, q query) []rawReading {
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+
+	rows := make([]rawReading, len(w.providers))
+	var wg sync.WaitGroup
+	for i, p := range w.providers {
+		rows[i].Provider = p.Name()
+		cp, ok := p.(conditionsProvider)
+		if !ok || !capabilitiesOf(p).has(capConditions) {
+			rows[i].Error = errNoNativeReading.Error()
+			continue
+		}
+		if !q.supportedBy(p) {
+			rows[i].Error = errUnsupportedQuery.Error()
+			continue
+		}
+
+		wg.Add(1)
+		go func(row *rawReading, p weatherProvider, cp conditionsProvider) {
+			defer wg.Done()
+			ctx := ctx
+			if d := w.timeoutFor(p); d > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, d)
+				defer cancel()
+			}
+
+			c, err := cp.conditions(ctx, q)
+			switch {
+			case err != nil:
+				row.Error = err.Error()
+			case c.Native == nil:
+				row.Error = errNoNativeReading.Error()
+			default:
+				row.nativeReading = c.Native
+			}
+		}(&rows[i], p, cp)
+	}
+	wg.Wait()
+	return rows
+}
+
+// rawHandler serves /raw/, listing every provider's reading for a place in
+// the unit it reported it in, without conversion or averaging. Like
+// /compare/, it answers 200 whenever the request itself is sound.
+func rawHandler(live *liveProviders) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := live.load()
+		q, err := queryFromRequest(r, current.cfg.defaultCity)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		style, err := keyStyleFromRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		respond(w, r, struct {
+			City      string       `json:"city"`
+			Providers []rawReading `json:"providers"`
+		}{
+			City:      q.address(),
+			Providers: current.multi.raw(r.Context(), q),
+		}, style)
+	}
+}
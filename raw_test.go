@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRawReadingsUnconverted(t *testing.T) {
+	servePayloads(t, map[string]string{
+		"api.openweathermap.org": `{"main": {"temp": 285.37}}`,
+		"api.wunderground.com":   `{"current_observation": {"temp_c": 12.3}}`,
+		"api.darksky.net":        `{"currently": {"temperature": 12.15}}`,
+		"api.weatherbit.io":      `{"data": [{"temp": -0.1}], "count": 1}`,
+		"maps.googleapis.com":    `{"results": [{"geometry": {"location": {"lat": 48.8566, "lng": 2.3522}}}]}`,
+	})
+	keys := newKeyRing("KEY")
+	cfg := testConfig(t)
+	// The default client now goes upstream, so the server is asked directly.
+	s, _ := newTestServer(t, cfg, nil,
+		openWeatherMap{keys: keys},
+		weatherUnderground{keys: keys},
+		darkSky{keys: keys, geocoder: googleGeocoder{apiKey: "KEY"}},
+		weatherbit{keys: keys},
+		&fakeProvider{name: "alpha", kelvin: 285},
+	)
+
+	var got struct {
+		City      string
+		Providers []struct {
+			Provider string
+			Value    json.RawMessage
+			Unit     string
+			Error    string
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/raw/Paris", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		provider, value, unit, error string
+	}{
+		{"openWeatherMap", "285.37", "kelvin", ""},
+		{"weatherUnderground", "12.3", "celsius", ""},
+		{"darkSky", "12.15", "celsius", ""},
+		{"weatherbit", "-0.1", "celsius", ""},
+		{"alpha", "", "", errNoNativeReading.Error()},
+	}
+	if got.City != "Paris" || len(got.Providers) != len(tests) {
+		t.Fatalf("raw readings %+v, want a row for each of %d providers of Paris", got, len(tests))
+	}
+	for i, tt := range tests {
+		row := got.Providers[i]
+		if row.Provider != tt.provider || string(row.Value) != tt.value || row.Unit != tt.unit || row.Error != tt.error {
+			t.Errorf("row %d: %s %s %s %q, want %s %s %s %q",
+				i, row.Provider, row.Value, row.Unit, row.Error, tt.provider, tt.value, tt.unit, tt.error)
+		}
+	}
+}
+
+func TestRawReadingErrors(t *testing.T) {
+	servePayloads(t, map[string]string{"api.openweathermap.org": `{"main": {}}`})
+	s, _ := newTestServer(t, testConfig(t), nil, openWeatherMap{keys: newKeyRing("KEY")}, weatherUnderground{keys: newKeyRing("KEY")})
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/raw/Paris", nil))
+
+	var got struct {
+		Providers []struct {
+			Provider string
+			Value    *float64
+			Error    string
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Providers) != 2 {
+		t.Fatalf("%d rows, want 2", len(got.Providers))
+	}
+	for _, row := range got.Providers {
+		if row.Value != nil || row.Error == "" {
+			t.Errorf("%s: value %v, error %q; want only an error", row.Provider, row.Value, row.Error)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// secrets holds the API keys the server was configured with, so they can be
+// scrubbed from anything that may be logged or returned to a client. Most
+// providers embed their key in the request URL, and the errors net/http
+// returns quote that URL in full.
+var secrets = &secretSet{}
+
+type secretSet struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// minSecretLength keeps short values, which are unlikely to be real keys,
+// from redacting unrelated text.
+const minSecretLength = 4
+
+// add adds values to the set. A value may list several keys separated by
+// commas, as the provider key settings do.
+func (s *secretSet) add(values ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, list := range values {
+		for _, v := range splitList(list) {
+			if len(v) >= minSecretLength {
+				s.values = append(s.values, v)
+			}
+		}
+	}
+}
+
+// redact replaces every known secret in str with "***".
+func (s *secretSet) redact(str string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, v := range s.values {
+		str = strings.ReplaceAll(str, v, "***")
+		// The key may appear escaped, as in a URL.
+		if e := url.QueryEscape(v); e != v {
+			str = strings.ReplaceAll(str, e, "***")
+		}
+	}
+	return str
+}
+
+// redactError strips secrets from the URL quoted by a *url.Error, leaving
+// err's other details intact.
+func redactError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return &url.Error{Op: ue.Op, URL: secrets.redact(ue.URL), Err: ue.Err}
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	s := &secretSet{}
+	s.add("owm-key-1234", "owm-key-5678", "wu key/+", "abc", "")
+
+	tests := []struct {
+		in, want string
+	}{
+		{"http://api.openweathermap.org/data/2.5/weather?APPID=owm-key-1234&q=Paris", "http://api.openweathermap.org/data/2.5/weather?APPID=***&q=Paris"},
+		{"rotated to owm-key-5678", "rotated to ***"},
+		{"http://api.wunderground.com/api/wu key/+/conditions", "http://api.wunderground.com/api/***/conditions"},
+		{"key=wu+key%2F%2B", "key=***"},
+		{"short values like abc are left alone", "short values like abc are left alone"},
+		{"nothing secret", "nothing secret"},
+	}
+	for _, tt := range tests {
+		if got := s.redact(tt.in); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamErrorsRedacted(t *testing.T) {
+	prev := secrets
+	secrets = &secretSet{}
+	t.Cleanup(func() { secrets = prev })
+	secrets.add("s3cr3t-key")
+
+	// A server that has gone away fails the request with an error quoting
+	// its URL.
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+
+	var v struct{}
+	err := getJSON(context.Background(), ts.URL+"/weather?APPID=s3cr3t-key", &v)
+	if err == nil {
+		t.Fatal("no error from a closed server")
+	}
+	if msg := err.Error(); strings.Contains(msg, "s3cr3t-key") || !strings.Contains(msg, "APPID=***") {
+		t.Errorf("error %q, want the key redacted", msg)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxRegionPoints bounds how many points one /region/ request may
+	// sample, so that no box can fan out into a flood of lookups.
+	maxRegionPoints = 100
+
+	// maxRegionFetches bounds how many of a region's points are looked up at
+	// once.
+	maxRegionFetches = 4
+)
+
+// regionPoint is the reading at one point of a region's grid, or why it has
+// none.
+type regionPoint struct {
+	Lat         float64      `json:"lat"`
+	Lon         float64      `json:"lon"`
+	Temperature *Temperature `json:"temperature,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// regionGrid returns the points, step degrees apart, of a grid over the box
+// from (minLat, minLon) to (maxLat, maxLon), starting at its south-west
+// corner. It fails if the box is malformed, or the grid would have more than
+// maxRegionPoints points.
+func regionGrid(bbox string, step float64) ([]coordinates, error) {
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("malformed bbox %q; want minLat,minLon,maxLat,maxLon", bbox)
+	}
+	sw, err := parseCoordinates(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+	ne, err := parseCoordinates(strings.TrimSpace(parts[2]), strings.TrimSpace(parts[3]))
+	if err != nil {
+		return nil, err
+	}
+	if sw.lat > ne.lat || sw.lon > ne.lon {
+		return nil, fmt.Errorf("malformed bbox %q; its minimums exceed its maximums", bbox)
+	}
+	if !(step > 0) || math.IsInf(step, 0) {
+		return nil, fmt.Errorf("step must be a positive number of degrees")
+	}
+
+	// Count the points before making any, so that a tiny step is turned
+	// away however large the grid it would make. The slack allows for a
+	// step that divides the box exactly but for rounding.
+	rows := math.Floor((ne.lat-sw.lat)/step+1e-9) + 1
+	cols := math.Floor((ne.lon-sw.lon)/step+1e-9) + 1
+	if rows*cols > maxRegionPoints {
+		return nil, fmt.Errorf("a step of %g over this bbox makes %g points; at most %d are allowed", step, rows*cols, maxRegionPoints)
+	}
+
+	grid := make([]coordinates, 0, int(rows*cols))
+	for i := 0; i < int(rows); i++ {
+		for j := 0; j < int(cols); j++ {
+			grid = append(grid, coordinates{sw.lat + float64(i)*step, sw.lon + float64(j)*step})
+		}
+	}
+	return grid, nil
+}
+
+// clusters groups the points within radius meters of one another, for them
+// to share a lookup. It returns, for each point, the index of the point whose
+// reading stands for it: the first point, in order, within radius of it, or
+// itself if there is none. No radius means no clustering.
+func clusters(points []coordinates, radius float64) []int {
+	leaders := make([]int, len(points))
+	var heads []int
+	for i, c := range points {
+		leaders[i] = i
+		for _, h := range heads {
+			if radius > 0 && c.distanceTo(points[h]) <= radius {
+				leaders[i] = h
+				break
+			}
+		}
+		if leaders[i] == i {
+			heads = append(heads, i)
+		}
+	}
+	return leaders
+}
+
+// regionTemperatures looks up every point of grid from source, at most
+// maxRegionFetches at once, and reports each, in grid order. Points within
+// radius meters of an earlier one are given its reading rather than looked
+// up themselves.
+func regionTemperatures(ctx context.Context, source resultProvider, grid []coordinates, radius float64) []regionPoint {
+	points := make([]regionPoint, len(grid))
+	slots := make(chan struct{}, maxRegionFetches)
+	leaders := clusters(grid, radius)
+
+	var wg sync.WaitGroup
+	for i, c := range grid {
+		points[i].Lat, points[i].Lon = c.lat, c.lon
+		if leaders[i] != i {
+			continue
+		}
+
+		wg.Add(1)
+		go func(point *regionPoint, c coordinates) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				point.Error = ctx.Err().Error()
+				return
+			}
+
+			res, err := source.aggregate(ctx, query{coords: &c})
+			if err != nil {
+				point.Error = err.Error()
+				return
+			}
+			point.Temperature = &res.temp
+		}(&points[i], c)
+	}
+	wg.Wait()
+
+	for i, l := range leaders {
+		points[i].Temperature, points[i].Error = points[l].Temperature, points[l].Error
+	}
+	return points
+}
+
+// regionHandler serves /region/?bbox=minLat,minLon,maxLat,maxLon&step=1.0,
+// the temperatures over a grid of the box's points, step degrees apart. Like
+// /compare/, it answers 200 whenever the request itself is sound, however
+// many points fail. Points within radius meters of one another share a
+// lookup.
+func regionHandler(source resultProvider, radius float64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		step := 1.0
+		if v := r.URL.Query().Get("step"); v != "" {
+			var err error
+			if step, err = strconv.ParseFloat(v, 64); err != nil {
+				http.Error(w, fmt.Sprintf("malformed step %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+
+		grid, err := regionGrid(r.URL.Query().Get("bbox"), step)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		style, err := keyStyleFromRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		respond(w, r, struct {
+			Step   float64       `json:"step"`
+			Points []regionPoint `json:"points"`
+		}{
+			Step:   step,
+			Points: regionTemperatures(r.Context(), source, grid, radius),
+		}, style)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// pointProvider is a fakeProvider that looks up coordinates too, as every
+// point of a region is.
+type pointProvider struct{ *fakeProvider }
+
+func (p pointProvider) temperatureAt(ctx context.Context, c coordinates) (float64, error) {
+	return p.temperature(ctx, c.String())
+}
+
+func TestRegionGrid(t *testing.T) {
+	tests := []struct {
+		name    string
+		bbox    string
+		step    float64
+		want    string // the points, or the error expected
+		wantErr bool
+	}{
+		{"two by three", "50,0,51,2", 1, "[50,0 50,1 50,2 51,0 51,1 51,2]", false},
+		{"step not dividing the box", "50,0,51.5,0.5", 1, "[50,0 51,0]", false},
+		{"fractional step", "10,20,10.5,20", 0.25, "[10,20 10.25,20 10.5,20]", false},
+		{"a single point", "10,20,10,20", 1, "[10,20]", false},
+		{"spaces", " 50, 0, 51, 0 ", 1, "[50,0 51,0]", false},
+		{"at the cap", "0,0,9,9", 1, "100 points", false},
+		{"over the cap", "0,0,10,9", 1, "makes 110 points; at most 100", true},
+		{"tiny step", "0,0,1,1", 1e-9, "at most 100", true},
+		{"three numbers", "50,0,51", 1, "malformed bbox", true},
+		{"inverted", "51,0,50,1", 1, "minimums exceed", true},
+		{"off the globe", "50,0,91,1", 1, "", true},
+		{"zero step", "50,0,51,1", 0, "positive", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			grid, err := regionGrid(tt.bbox, tt.step)
+			switch {
+			case tt.wantErr && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("error %v, want one containing %q", err, tt.want)
+			case !tt.wantErr && err != nil:
+				t.Errorf("error %v", err)
+			case !tt.wantErr && strings.HasSuffix(tt.want, " points") && fmt.Sprint(len(grid), " points") != tt.want:
+				t.Errorf("%d points, want %s", len(grid), tt.want)
+			case !tt.wantErr && strings.HasPrefix(tt.want, "[") && fmt.Sprint(grid) != tt.want:
+				t.Errorf("points %v, want %s", grid, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegionEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"grid", "?bbox=50,0,51,1&step=1", http.StatusOK, 4},
+		{"too many points", "?bbox=0,0,50,50&step=0.1", http.StatusBadRequest, 0},
+		{"malformed step", "?bbox=50,0,51,1&step=wide", http.StatusBadRequest, 0},
+		{"no bbox", "", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alpha := &fakeProvider{name: "alpha", kelvin: 285}
+			_, ts := newTestServer(t, testConfig(t), nil, pointProvider{alpha})
+
+			resp, err := http.Get(ts.URL + "/region/" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if n := alpha.calls.Load(); n != tt.wantCalls {
+				t.Errorf("%d lookups, want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestClusters(t *testing.T) {
+	points := []coordinates{
+		{48.8566, 2.3522},  // Paris
+		{48.8570, 2.3525},  // some 50 m away
+		{51.5074, -0.1278}, // London
+		{48.8600, 2.3522},  // some 380 m from Paris
+		{51.5075, -0.1279}, // by London
+	}
+	tests := []struct {
+		name   string
+		radius float64
+		want   string
+	}{
+		{"no radius", 0, "[0 1 2 3 4]"},
+		{"within 100 m", 100, "[0 0 2 3 2]"},
+		{"within 1 km", 1000, "[0 0 2 0 2]"},
+		{"within 1000 km", 1e6, "[0 0 0 0 0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fmt.Sprint(clusters(points, tt.radius)); got != tt.want {
+				t.Errorf("leaders %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegionClustered(t *testing.T) {
+	tests := []struct {
+		name      string
+		radius    float64
+		wantCalls int32
+	}{
+		{"off", 0, 4},
+		{"near-identical points sharing a lookup", 1000, 1},
+		{"a radius too small to matter", 10, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alpha := &fakeProvider{name: "alpha", kelvin: 285}
+			cfg := testConfig(t)
+			cfg.clusterRadius = tt.radius
+			_, ts := newTestServer(t, cfg, nil, pointProvider{alpha})
+
+			// Four points about 110 m apart.
+			var got struct {
+				Points []struct {
+					Temperature *struct{ K float64 }
+				}
+			}
+			resp := getJSONResponse(t, ts.URL+"/region/?bbox=50,0,50.001,0.001&step=0.001", &got)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			if n := alpha.calls.Load(); n != tt.wantCalls {
+				t.Errorf("%d lookups, want %d", n, tt.wantCalls)
+			}
+			if len(got.Points) != 4 {
+				t.Fatalf("%d points, want 4", len(got.Points))
+			}
+			for i, p := range got.Points {
+				if p.Temperature == nil || p.Temperature.K != 285 {
+					t.Errorf("point %d: %+v, want 285 K", i, p.Temperature)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// readConfigFile parses a config file of NAME=value lines, each naming an
+// environment variable such as WEATHER_MIN_PROVIDERS. Blank lines, and lines
+// starting with #, are skipped.
+func readConfigFile(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: %q is not NAME=value", n, line)
+		}
+		values[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return values, s.Err()
+}
+
+// useConfigFile makes getenv prefer values, as read from a config file, over
+// the environment.
+func useConfigFile(values map[string]string) {
+	getenv = func(name string) string {
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	}
+}
+
+// reloaded reads the configuration again, from the environment and config
+// file. Settings given as flags, and those that only take effect at startup,
+// such as the listen address, are kept from cfg.
+func (cfg Config) reloaded() Config {
+	next := configFromEnv()
+	next.addr, next.tlsCert, next.tlsKey, next.grpcAddr = cfg.addr, cfg.tlsCert, cfg.tlsKey, cfg.grpcAddr
+	next.unixSocket = cfg.unixSocket
+	next.maxUpstream, next.upstreamQueueTimeout = cfg.maxUpstream, cfg.upstreamQueueTimeout
+	next.checkConfig, next.dryRun = cfg.checkConfig, cfg.dryRun
+	next.mock, next.mockLatency, next.mockJitter, next.mockErrorRate = cfg.mock, cfg.mockLatency, cfg.mockJitter, cfg.mockErrorRate
+	next.configFile, next.configReload = cfg.configFile, cfg.configReload
+	next.cacheFile = cfg.cacheFile
+
+	// Flags override the config file, so a reload mustn't undo them.
+	for name := range cfg.flags {
+		switch name {
+		case "default-city":
+			next.defaultCity = cfg.defaultCity
+		case "cache-ttl":
+			next.cacheTTL = cfg.cacheTTL
+		case "timeout":
+			next.aggregationTimeout = cfg.aggregationTimeout
+		case "provider-timeout":
+			next.providerTimeout = cfg.providerTimeout
+		case "min-providers":
+			next.minProviders = cfg.minProviders
+		case "providers":
+			next.providers = cfg.providers
+		}
+	}
+	next.flags = cfg.flags
+	return next
+}
+
+// serving is the set of providers the server answers from, built from one
+// version of the configuration.
+type serving struct {
+	cfg       Config
+	providers []weatherProvider
+	multi     multiWeatherProvider
+
+	// source is multi, or a hybridProvider around it if a primary provider
+	// is configured.
+	source resultProvider
+}
+
+// liveProviders holds the serving set currently in use. A reload swaps in a
+// new one at once; each lookup uses whichever was current when it began, so
+// that it never sees a mix of old and new settings.
+type liveProviders struct {
+	current atomic.Value // *serving
+}
+
+func (l *liveProviders) load() *serving   { return l.current.Load().(*serving) }
+func (l *liveProviders) store(s *serving) { l.current.Store(s) }
+
+func (l *liveProviders) aggregate(ctx context.Context, q query) (result, error) {
+	return l.load().source.aggregate(ctx, q)
+}
+
+// watchConfig checks the config file at path every interval until ctx is
+// canceled. Whenever its contents change, the configuration is read again,
+// validated, and if it is sound handed to apply to put into use. A
+// configuration that fails is logged, and the old one kept.
+func watchConfig(ctx context.Context, path string, interval time.Duration, live *liveProviders, apply func(Config) error) {
+	last, _ := os.ReadFile(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("config: reading %s: %v", path, err)
+			continue
+		}
+		if bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		if err := reload(data, live, apply); err != nil {
+			log.Printf("config: not reloading %s: %v", path, err)
+			continue
+		}
+		log.Printf("config: reloaded %s", path)
+	}
+}
+
+// reload applies the config file contents data, on top of the configuration
+// live is serving from.
+func reload(data []byte, live *liveProviders, apply func(Config) error) error {
+	values, err := readConfigFile(data)
+	if err != nil {
+		return err
+	}
+
+	// Restore the old values if the new ones are rejected, so that a later
+	// reload of some other setting doesn't pick them up.
+	prev := getenv
+	useConfigFile(values)
+	cfg := live.load().cfg.reloaded()
+
+	if errs := cfg.validate(); len(errs) > 0 {
+		getenv = prev
+		return errors.Join(errs...)
+	}
+
+	if err := apply(cfg); err != nil {
+		getenv = prev
+		return err
+	}
+	return nil
+}
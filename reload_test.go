@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// servingOnly is a liveProviders that always serves mw, for the handlers
+// that take one.
+func servingOnly(mw multiWeatherProvider) *liveProviders {
+	live := &liveProviders{}
+	live.store(&serving{providers: mw.providers, multi: mw, source: mw})
+	return live
+}
+
+// newReloadable is a serving set over providers whose configuration can be
+// reloaded. It is in mock mode so that reloads need no provider keys to
+// validate.
+func newReloadable(t *testing.T, providers ...weatherProvider) (*liveProviders, func(Config) error) {
+	t.Helper()
+	prev := getenv
+	t.Cleanup(func() { getenv = prev })
+
+	build := func(cfg Config) (*serving, error) { return newServing(cfg, providers, nil, nil, nil) }
+	cfg := configFromEnv()
+	cfg.mock = true
+	s, err := build(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := &liveProviders{}
+	live.store(s)
+	return live, func(cfg Config) error {
+		s, err := build(cfg)
+		if err != nil {
+			return err
+		}
+		live.store(s)
+		return nil
+	}
+}
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+		want    float64 // K, from the next lookup
+	}{
+		{"offset added", "WEATHER_PROVIDER_OFFSETS=alpha=10", "", 290},
+		{"comments and blank lines", "# offsets\n\nWEATHER_PROVIDER_OFFSETS = beta=-10\n", "", 280},
+		{"aggregation changed", "WEATHER_REPRESENTATIVE=true\nWEATHER_PROVIDER_OFFSETS=alpha=4", "", 284},
+		{"malformed line", "WEATHER_PROVIDER_OFFSETS", "is not NAME=value", 285},
+		{"invalid setting", "WEATHER_MIN_KELVIN=400", "WEATHER_MIN_KELVIN", 285},
+		{"unknown primary", "WEATHER_PRIMARY_PROVIDER=gamma", "gamma", 285},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live, apply := newReloadable(t,
+				&fakeProvider{name: "alpha", kelvin: 280},
+				&fakeProvider{name: "beta", kelvin: 290},
+			)
+
+			err := reload([]byte(tt.file), live, apply)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("error %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error %v, want one containing %q", err, tt.wantErr)
+			}
+
+			res, err := live.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.temp.Kelvin() != tt.want {
+				t.Errorf("%v K after reloading, want %v K", res.temp.Kelvin(), tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadKeepsInFlightSnapshot(t *testing.T) {
+	alpha := &fakeProvider{name: "alpha", kelvin: 280, delay: 50 * time.Millisecond}
+	live, apply := newReloadable(t, alpha)
+
+	done := make(chan result)
+	go func() {
+		res, _ := live.aggregate(context.Background(), query{city: "Paris"})
+		done <- res
+	}()
+	for alpha.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := reload([]byte("WEATHER_PROVIDER_OFFSETS=alpha=10"), live, apply); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := <-done; res.temp.Kelvin() != 280 {
+		t.Errorf("in-flight lookup read %v K, want 280 K from the old settings", res.temp.Kelvin())
+	}
+	if res, _ := live.aggregate(context.Background(), query{city: "Paris"}); res.temp.Kelvin() != 290 {
+		t.Errorf("next lookup read %v K, want 290 K from the new settings", res.temp.Kelvin())
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	live, apply := newReloadable(t, &fakeProvider{name: "alpha", kelvin: 280})
+
+	path := filepath.Join(t.TempDir(), "weather.conf")
+	if err := os.WriteFile(path, []byte("# nothing yet\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		watchConfig(ctx, path, time.Millisecond, live, apply)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+
+	// The watcher may not have read the file yet, so keep changing it until
+	// the change is seen.
+	deadline := time.Now().Add(5 * time.Second)
+	for n := 0; live.load().cfg.providerOffsets["alpha"] != 5; n++ {
+		if time.Now().After(deadline) {
+			t.Fatal("config file change not picked up")
+		}
+		data := fmt.Sprintf("# edit %d\nWEATHER_PROVIDER_OFFSETS=alpha=5\n", n)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	res, err := live.aggregate(context.Background(), query{city: "Paris"})
+	if err != nil || res.temp.Kelvin() != 285 {
+		t.Errorf("read %v K, %v; want 285 K with the new offset", res.temp.Kelvin(), err)
+	}
+}
+
+func TestReloadReachesHandlers(t *testing.T) {
+	prev := getenv
+	t.Cleanup(func() { getenv = prev })
+	upstreams := servePayloads(t, map[string]string{"api.openweathermap.org": `{"main": {"temp": 285, "humidity": 60}}`})
+
+	owm := openWeatherMap{keys: newKeyRing("KEY")}
+	cfg := testConfig(t)
+	cfg.mock, cfg.cacheTTL = true, 0
+	s, _ := newTestServer(t, cfg, nil, owm)
+	apply := func(cfg Config) error { return s.reconfigure(cfg, []weatherProvider{owm}) }
+
+	if err := reload([]byte("WEATHER_DEFAULT_CITY=Oslo"), s.live, apply); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/weather/", "/conditions/"} {
+		// The default client now goes upstream, so the server is asked directly.
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d, want 200", path, rec.Code)
+		}
+	}
+
+	got := upstreams.requests()
+	if len(got) != 2 {
+		t.Fatalf("%d upstream requests, want one for each path", len(got))
+	}
+	for _, u := range got {
+		if city := u.Query().Get("q"); city != "Oslo" {
+			t.Errorf("upstream asked for %q, want the reloaded default city Oslo", city)
+		}
+	}
+}
+
+func TestReloadChangesCacheTTL(t *testing.T) {
+	prev := getenv
+	t.Cleanup(func() { getenv = prev })
+
+	alpha := &fakeProvider{name: "alpha", kelvin: 280}
+	cfg := testConfig(t)
+	cfg.mock, cfg.cacheTTL = true, 0
+	s, _ := newTestServer(t, cfg, nil, alpha)
+	apply := func(cfg Config) error { return s.reconfigure(cfg, []weatherProvider{alpha}) }
+
+	lookup := func() {
+		t.Helper()
+		if _, err := s.cache.aggregate(context.Background(), query{city: "Paris"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The server starts caching nothing, so each lookup is a call.
+	lookup()
+	lookup()
+	if n := alpha.calls.Load(); n != 2 {
+		t.Fatalf("%d calls before reloading, want 2", n)
+	}
+
+	if err := reload([]byte("WEATHER_CACHE_TTL=1h"), s.live, apply); err != nil {
+		t.Fatal(err)
+	}
+	lookup()
+	lookup()
+	if n := alpha.calls.Load(); n != 3 {
+		t.Errorf("%d calls after reloading, want 3: the second lookup cached", n)
+	}
+}
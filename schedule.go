@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxScheduled is the most lookups that may be scheduled and not yet done,
+// so that scheduling can't be used to exhaust our memory or quotas.
+const maxScheduled = 1024
+
+// maxScheduledRuns is the most scheduled lookups run at once, and
+// maxScheduledRunTime the longest one may take, so that lookups that hang
+// can neither hold up the rest nor pile up.
+const (
+	maxScheduledRuns    = 4
+	maxScheduledRunTime = 30 * time.Second
+)
+
+// errTooManyScheduled is returned when maxScheduled lookups are pending.
+var errTooManyScheduled = errors.New("too many lookups scheduled; try again later")
+
+// scheduler runs one-off lookups at a future time, keeping each result to be
+// collected later by the token it was scheduled under.
+type scheduler struct {
+	source resultProvider
+
+	// horizon is how far ahead a lookup may be scheduled, and retention how
+	// long its result is kept once it has run.
+	horizon   time.Duration
+	retention time.Duration
+
+	// timeout bounds each lookup; it is maxScheduledRunTime but for tests.
+	timeout time.Duration
+
+	mu      sync.Mutex
+	jobs    map[string]*scheduledLookup
+	pending int
+	running int
+	wake    chan struct{} // signaled when a lookup is scheduled or finishes
+
+	runs sync.WaitGroup // of the lookups running
+}
+
+// scheduledLookup is a lookup scheduled for a place at a time, and once it
+// has run, its outcome.
+type scheduledLookup struct {
+	place query
+	at    time.Time
+
+	running  bool
+	done     bool
+	finished time.Time
+	result   result
+	err      error
+}
+
+func newScheduler(source resultProvider, horizon, retention time.Duration) *scheduler {
+	return &scheduler{
+		source:    source,
+		horizon:   horizon,
+		retention: retention,
+		timeout:   maxScheduledRunTime,
+		jobs:      map[string]*scheduledLookup{},
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// schedule arranges for q to be looked up at at, and returns the token its
+// result can be collected by.
+func (s *scheduler) schedule(q query, at, now time.Time) (string, error) {
+	if !at.After(now) {
+		return "", &requestError{errors.New("time must be in the future")}
+	}
+	if s.horizon > 0 && at.Sub(now) > s.horizon {
+		return "", &requestError{fmt.Errorf("time must be within %s from now", s.horizon)}
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending >= maxScheduled {
+		return "", errTooManyScheduled
+	}
+	s.jobs[token] = &scheduledLookup{place: q, at: at}
+	s.pending++
+
+	select {
+	case s.wake <- struct{}{}:
+	default: // already due to wake
+	}
+	return token, nil
+}
+
+// lookup returns a copy of the lookup scheduled under token, if there is one.
+func (s *scheduler) lookup(token string) (scheduledLookup, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[token]
+	if !ok {
+		return scheduledLookup{}, false
+	}
+	return *j, true
+}
+
+// run performs lookups as they fall due, and forgets results past their
+// retention, until ctx is canceled. Lookups still pending then never run, and
+// those running are abandoned; run returns once they have stopped.
+func (s *scheduler) run(ctx context.Context) {
+	t := time.NewTimer(0)
+	defer t.Stop()
+	defer s.runs.Wait()
+
+	for {
+		select {
+		case <-t.C:
+		case <-s.wake:
+		case <-ctx.Done():
+			return
+		}
+
+		next := s.runDue(ctx, time.Now())
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		t.Reset(time.Until(next))
+	}
+}
+
+// runDue starts the lookups due by now, at most maxScheduledRuns at a time
+// and the earliest due first, and returns when the next pending one falls
+// due. With none pending, it returns when the oldest result is to be
+// forgotten, or failing that a time far off. Lookups due but waiting for a
+// turn, like those running, are woken for when a running one finishes.
+func (s *scheduler) runDue(ctx context.Context, now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*scheduledLookup
+	for token, j := range s.jobs {
+		switch {
+		case j.done && now.Sub(j.finished) >= s.retention:
+			delete(s.jobs, token)
+		case !j.done && !j.running && !j.at.After(now):
+			due = append(due, j)
+		}
+	}
+	sort.Slice(due, func(a, b int) bool { return due[a].at.Before(due[b].at) })
+	for _, j := range due {
+		if s.running >= maxScheduledRuns {
+			break
+		}
+		j.running = true
+		s.running++
+		s.runs.Add(1)
+		go s.perform(ctx, j)
+	}
+
+	next := now.Add(time.Hour)
+	for _, j := range s.jobs {
+		when := j.at
+		switch {
+		case j.running:
+			continue
+		case j.done:
+			when = j.finished.Add(s.retention)
+		case !when.After(now):
+			continue // waiting for a turn
+		}
+		if when.Before(next) {
+			next = when
+		}
+	}
+	return next
+}
+
+// perform runs the lookup j, within s.timeout, and records its outcome. If
+// ctx is canceled first, j is left pending rather than recorded as failed.
+func (s *scheduler) perform(ctx context.Context, j *scheduledLookup) {
+	defer s.runs.Done()
+
+	lookupCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	res, err := s.source.aggregate(lookupCtx, j.place)
+	cancel()
+	if err != nil && ctx.Err() == nil {
+		log.Printf("scheduler: %s: %v", j.place, err)
+	}
+
+	s.mu.Lock()
+	j.running = false
+	s.running--
+	if ctx.Err() == nil {
+		j.done, j.finished, j.result, j.err = true, time.Now(), res, err
+		s.pending--
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default: // already due to wake
+	}
+}
+
+// scheduleHandler serves POST /schedule, which takes a city and an RFC 3339
+// time, as form values, and answers with the token to collect the result by
+// from /scheduled/.
+func scheduleHandler(s *scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q, err := parsePlace(r.FormValue("city"))
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		at, err := time.Parse(time.RFC3339, r.FormValue("time"))
+		if err != nil {
+			http.Error(w, "time must be RFC 3339, as in 2006-01-02T07:00:00Z", http.StatusBadRequest)
+			return
+		}
+
+		style, err := keyStyleFromRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		token, err := s.schedule(q, at, time.Now())
+		if errors.Is(err, errTooManyScheduled) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		body := map[string]interface{}{
+			"token": token,
+			"city":  q.address(),
+			"time":  at.UTC().Format(time.RFC3339),
+		}
+		enc := serializerFor(r, body, style)
+		w.Header().Set("Location", "/scheduled/"+token)
+		w.Header().Set("Content-Type", enc.contentType())
+		w.WriteHeader(http.StatusAccepted)
+		enc.encode(w, body)
+	}
+}
+
+// scheduledHandler serves /scheduled/{token}: the outcome of a scheduled
+// lookup, or that it is still pending.
+func scheduledHandler(s *scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, "/scheduled/")
+		j, ok := s.lookup(token)
+		if !ok {
+			http.Error(w, "no lookup is scheduled under that token", http.StatusNotFound)
+			return
+		}
+
+		style, err := keyStyleFromRequest(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		body := map[string]interface{}{
+			"city": j.place.address(),
+			"time": j.at.UTC().Format(time.RFC3339),
+		}
+		switch {
+		case !j.done:
+			body["status"] = "pending"
+		case j.err != nil:
+			body["status"] = "failed"
+			body["error"] = j.err.Error()
+		default:
+			body["status"] = "done"
+			body["temperature"] = j.result.temp
+			body["sources"] = j.result.sources
+		}
+
+		respond(w, r, body, style)
+	}
+}
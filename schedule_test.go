@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	now := time.Date(2019, 6, 8, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		at      time.Time
+		wantErr bool
+	}{
+		{"in an hour", now.Add(time.Hour), false},
+		{"at the horizon", now.Add(48 * time.Hour), false},
+		{"now", now, true},
+		{"in the past", now.Add(-time.Minute), true},
+		{"past the horizon", now.Add(48*time.Hour + time.Second), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(fixedResult(285), 48*time.Hour, time.Hour)
+			token, err := s.schedule(query{city: "Paris"}, tt.at, now)
+
+			var reqErr *requestError
+			switch {
+			case tt.wantErr && !errors.As(err, &reqErr):
+				t.Errorf("error %v, want a request error", err)
+			case !tt.wantErr && err != nil:
+				t.Errorf("error %v", err)
+			case !tt.wantErr:
+				if j, ok := s.lookup(token); !ok || j.done || !j.at.Equal(tt.at) {
+					t.Errorf("lookup %+v, %v; want one pending at %s", j, ok, tt.at)
+				}
+			}
+		})
+	}
+}
+
+func TestScheduledLookupsRun(t *testing.T) {
+	now := time.Date(2019, 6, 8, 12, 0, 0, 0, time.UTC)
+	errDown := errors.New("provider down")
+	source := &resultFunc{fn: func(ctx context.Context, q query) (result, error) {
+		if q.city == "Atlantis" {
+			return result{}, errDown
+		}
+		return result{temp: 285, sources: []string{"fixed"}}, nil
+	}}
+	s := newScheduler(source, 48*time.Hour, time.Hour)
+
+	soon, _ := s.schedule(query{city: "Paris"}, now.Add(time.Minute), now)
+	failing, _ := s.schedule(query{city: "Atlantis"}, now.Add(time.Minute), now)
+	later, _ := s.schedule(query{city: "Oslo"}, now.Add(time.Hour), now)
+
+	// Only the lookups due are run, and the next wake-up is for the one
+	// still pending.
+	ran := now.Add(2 * time.Minute)
+	if next := s.runDue(context.Background(), ran); !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("next due at %s, want %s", next, now.Add(time.Hour))
+	}
+	s.runs.Wait()
+	if n := source.calls.Load(); n != 2 {
+		t.Errorf("%d lookups run, want 2", n)
+	}
+
+	if j, _ := s.lookup(soon); !j.done || j.err != nil || j.result.temp != 285 {
+		t.Errorf("Paris: %+v, want done at 285 K", j)
+	}
+	if j, _ := s.lookup(failing); !j.done || !errors.Is(j.err, errDown) {
+		t.Errorf("Atlantis: %+v, want failed", j)
+	}
+	if j, _ := s.lookup(later); j.done {
+		t.Errorf("Oslo: %+v, want pending", j)
+	}
+
+	// Results are forgotten once their retention is up.
+	s.runDue(context.Background(), time.Now().Add(2*time.Hour))
+	s.runs.Wait()
+	if _, ok := s.lookup(soon); ok {
+		t.Error("Paris still kept past its retention")
+	}
+	if _, ok := s.lookup(later); !ok {
+		t.Error("Oslo forgotten")
+	}
+}
+
+func TestScheduleEndpoints(t *testing.T) {
+	s := newScheduler(fixedResult(285), 48*time.Hour, time.Hour)
+	mux := http.NewServeMux()
+	mux.Handle("/schedule", scheduleHandler(s))
+	mux.Handle("/scheduled/", scheduledHandler(s))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(path string, v interface{}) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name   string
+		method string
+		form   url.Values
+		want   int
+	}{
+		{"scheduled", "POST", url.Values{"city": {"Paris,FR"}, "time": {at}}, http.StatusAccepted},
+		{"not a POST", "GET", nil, http.StatusMethodNotAllowed},
+		{"malformed time", "POST", url.Values{"city": {"Paris"}, "time": {"tomorrow"}}, http.StatusBadRequest},
+		{"in the past", "POST", url.Values{"city": {"Paris"}, "time": {"2019-06-08T12:00:00Z"}}, http.StatusBadRequest},
+		{"no city", "POST", url.Values{"time": {at}}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, ts.URL+"/schedule", strings.NewReader(tt.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want != http.StatusAccepted {
+				return
+			}
+
+			var scheduled struct {
+				Token string `json:"token"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&scheduled); err != nil {
+				t.Fatal(err)
+			}
+			if loc := resp.Header.Get("Location"); loc != "/scheduled/"+scheduled.Token {
+				t.Errorf("Location %q for token %q", loc, scheduled.Token)
+			}
+
+			var status struct {
+				City   string `json:"city"`
+				Status string `json:"status"`
+			}
+			get("/scheduled/"+scheduled.Token, &status)
+			if status.City != "Paris,FR" || status.Status != "pending" {
+				t.Errorf("before it runs: %+v", status)
+			}
+
+			s.runDue(context.Background(), time.Now().Add(2*time.Hour))
+			s.runs.Wait()
+			var done struct {
+				Status      string   `json:"status"`
+				Sources     []string `json:"sources"`
+				Temperature struct {
+					K float64 `json:"k"`
+				} `json:"temperature"`
+			}
+			get("/scheduled/"+scheduled.Token, &done)
+			if done.Status != "done" || done.Temperature.K != 285 || len(done.Sources) != 1 {
+				t.Errorf("after it runs: %+v", done)
+			}
+		})
+	}
+
+	resp, err := http.Get(ts.URL + "/scheduled/unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown token: status %d, want 404", resp.StatusCode)
+	}
+}
+
+// hangingSource answers every lookup but of Paris only when its context
+// ends, and keeps the peak of lookups in flight at once.
+func hangingSource() (*resultFunc, *atomic.Int32) {
+	var inFlight, peak atomic.Int32
+	return &resultFunc{fn: func(ctx context.Context, q query) (result, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		if q.city == "Paris" {
+			return result{temp: 285, sources: []string{"fixed"}, readings: 1}, nil
+		}
+		<-ctx.Done()
+		return result{}, ctx.Err()
+	}}, &peak
+}
+
+func TestScheduledLookupsHang(t *testing.T) {
+	now := time.Now()
+	source, peak := hangingSource()
+	s := newScheduler(source, 48*time.Hour, time.Hour)
+	s.timeout = 100 * time.Millisecond
+
+	var hung []string
+	for i := 0; i < maxScheduledRuns+2; i++ {
+		token, _ := s.schedule(query{city: fmt.Sprint("Atlantis", i)}, now.Add(time.Second), now)
+		hung = append(hung, token)
+	}
+	paris, _ := s.schedule(query{city: "Paris"}, now.Add(time.Second), now)
+
+	// Only maxScheduledRuns are started at once, and as they hang, running
+	// the due lookups again starts none twice.
+	ran := now.Add(2 * time.Second)
+	s.runDue(context.Background(), ran)
+	s.runDue(context.Background(), ran)
+	time.Sleep(20 * time.Millisecond)
+	if n := source.calls.Load(); n != maxScheduledRuns {
+		t.Errorf("%d lookups started, want %d", n, maxScheduledRuns)
+	}
+
+	// Once they give up, the rest get their turn.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.runDue(context.Background(), ran)
+		s.mu.Lock()
+		pending := s.pending
+		s.mu.Unlock()
+		if pending == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.runs.Wait()
+
+	if n := source.calls.Load(); n != int32(len(hung)+1) {
+		t.Errorf("%d lookups run, want each of %d run once", n, len(hung)+1)
+	}
+	if p := peak.Load(); p > maxScheduledRuns {
+		t.Errorf("%d lookups at once, want at most %d", p, maxScheduledRuns)
+	}
+	for i, token := range hung {
+		if j, _ := s.lookup(token); !j.done || !errors.Is(j.err, context.DeadlineExceeded) {
+			t.Errorf("lookup %d: %+v, want it to have given up", i, j)
+		}
+	}
+	if j, _ := s.lookup(paris); !j.done || j.err != nil || j.result.temp != 285 {
+		t.Errorf("Paris: %+v, want done at 285 K", j)
+	}
+}
+
+func TestScheduledLookupsCanceled(t *testing.T) {
+	now := time.Now()
+	source, _ := hangingSource()
+	s := newScheduler(source, 48*time.Hour, time.Hour)
+	token, _ := s.schedule(query{city: "Atlantis"}, now.Add(time.Second), now)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.runDue(ctx, now.Add(2*time.Second))
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	s.runs.Wait()
+
+	// A lookup stopped by the scheduler shutting down didn't fail; it can
+	// still run once the scheduler is back.
+	if j, _ := s.lookup(token); j.done || j.running {
+		t.Errorf("lookup %+v after canceling, want it pending", j)
+	}
+	s.mu.Lock()
+	pending := s.pending
+	s.mu.Unlock()
+	if pending != 1 {
+		t.Errorf("%d pending, want 1", pending)
+	}
+
+	s.timeout = 10 * time.Millisecond
+	s.runDue(context.Background(), now.Add(2*time.Second))
+	s.runs.Wait()
+	if j, _ := s.lookup(token); !j.done {
+		t.Errorf("lookup %+v, want run again and done", j)
+	}
+}
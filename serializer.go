@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A serializer writes response bodies in one format. Handlers build a
+// response value once, and respond writes it in whichever format the client
+// asked for.
+type serializer interface {
+	contentType() string
+	encode(w io.Writer, v interface{}) error
+}
+
+// protoMessage is implemented by response values that have a protocol buffer
+// form, as given in weather.proto.
+type protoMessage interface {
+	marshal() []byte
+}
+
+// msgpackType is the media type of MessagePack responses.
+const msgpackType = "application/msgpack"
+
+// serializerFor picks the serializer for a response of v to r, by its Accept
+// header: a protocol buffer if v has that form, MessagePack, or by default
+// JSON. Field names follow style in JSON and MessagePack alike.
+func serializerFor(r *http.Request, v interface{}, style keyStyle) serializer {
+	accept := r.Header.Get("Accept")
+	if _, ok := v.(protoMessage); ok && wantsProtobuf(r) {
+		return protobufSerializer{}
+	}
+	if strings.Contains(accept, msgpackType) || strings.Contains(accept, "application/x-msgpack") {
+		return msgpackSerializer{style}
+	}
+	return jsonSerializer{style}
+}
+
+// respond writes v to w, as the client that sent r asked for.
+func respond(w http.ResponseWriter, r *http.Request, v interface{}, style keyStyle) error {
+	s := serializerFor(r, v, style)
+	w.Header().Set("Content-Type", s.contentType())
+	return s.encode(w, v)
+}
+
+type jsonSerializer struct{ style keyStyle }
+
+func (s jsonSerializer) contentType() string { return "application/json; charset=utf-8" }
+
+func (s jsonSerializer) encode(w io.Writer, v interface{}) error {
+	return encodeJSON(w, v, s.style)
+}
+
+type protobufSerializer struct{}
+
+func (protobufSerializer) contentType() string { return protobufType }
+
+// errNoProtoForm is returned when a value without a protocol buffer form is
+// encoded as one.
+var errNoProtoForm = errors.New("response has no protocol buffer form")
+
+func (protobufSerializer) encode(w io.Writer, v interface{}) error {
+	m, ok := v.(protoMessage)
+	if !ok {
+		return errNoProtoForm
+	}
+	_, err := w.Write(m.marshal())
+	return err
+}
+
+// msgpackSerializer writes MessagePack. Values are first rendered as JSON,
+// so that they take the same shape in both, field names and all.
+type msgpackSerializer struct{ style keyStyle }
+
+func (s msgpackSerializer) contentType() string { return msgpackType }
+
+func (s msgpackSerializer) encode(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var generic interface{}
+	if err := d.Decode(&generic); err != nil {
+		return err
+	}
+	if s.style == camelCase {
+		generic = camelKeys(generic)
+	}
+
+	_, err = w.Write(appendMsgpack(nil, generic))
+	return err
+}
+
+// appendMsgpack appends the MessagePack encoding of a decoded JSON value to
+// b. Object keys are written in sorted order, so the encoding is stable.
+func appendMsgpack(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, i)
+		}
+		f, _ := v.Float64()
+		b = append(b, 0xcb)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(f))
+	case string:
+		b = appendMsgpackHeader(b, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		return append(b, v...)
+	case []interface{}:
+		b = appendMsgpackHeader(b, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			b = appendMsgpack(b, e)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = appendMsgpackHeader(b, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			b = appendMsgpack(b, k)
+			b = appendMsgpack(b, v[k])
+		}
+		return b
+	}
+	panic("appendMsgpack: not a decoded JSON value")
+}
+
+// appendMsgpackInt appends i as a fixint if it fits in one, and otherwise as
+// a 64-bit integer.
+func appendMsgpackInt(b []byte, i int64) []byte {
+	if -32 <= i && i < 128 {
+		return append(b, byte(i))
+	}
+	b = append(b, 0xd3)
+	return binary.BigEndian.AppendUint64(b, uint64(i))
+}
+
+// appendMsgpackHeader appends the header of a string, array or map of n
+// elements: the fix form, fix|n, if n is below fixMax, and otherwise the
+// 8-, 16- or 32-bit form. A zero tag8 means the type has no 8-bit form.
+func appendMsgpackHeader(b []byte, n int, fix byte, fixMax int, tag8, tag16, tag32 byte) []byte {
+	switch {
+	case n < fixMax:
+		return append(b, fix|byte(n))
+	case tag8 != 0 && n <= math.MaxUint8:
+		return append(b, tag8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, tag16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, tag32), uint32(n))
+}
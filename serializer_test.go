@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSerializerFor(t *testing.T) {
+	message := conditionsMessage{}
+	tests := []struct {
+		name   string
+		accept string
+		v      interface{}
+		want   string // content type
+	}{
+		{"no Accept", "", map[string]int{}, "application/json; charset=utf-8"},
+		{"JSON", "application/json", map[string]int{}, "application/json; charset=utf-8"},
+		{"MessagePack", "application/msgpack", map[string]int{}, msgpackType},
+		{"older MessagePack type", "application/x-msgpack, */*", map[string]int{}, msgpackType},
+		{"protobuf", protobufType, message, protobufType},
+		{"protobuf of a value without that form", protobufType, map[string]int{}, "application/json; charset=utf-8"},
+		{"unknown", "text/csv", map[string]int{}, "application/json; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Accept", tt.accept)
+			if got := serializerFor(r, tt.v, snakeCase).contentType(); got != tt.want {
+				t.Errorf("content type %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSerializers(t *testing.T) {
+	v := struct {
+		City  string   `json:"city_name"`
+		Temp  float64  `json:"temp"`
+		Count int      `json:"count"`
+		Tags  []string `json:"tags"`
+		Gone  *int     `json:"gone"`
+	}{"Oslo", 1.5, 300, []string{"a"}, nil}
+
+	tests := []struct {
+		name  string
+		s     serializer
+		want  string
+		isHex bool
+	}{
+		{"JSON", jsonSerializer{snakeCase}, `{"city_name":"Oslo","temp":1.5,"count":300,"tags":["a"],"gone":null}` + "\n", false},
+		{"JSON in camel case", jsonSerializer{camelCase}, `{"cityName":"Oslo","count":300,"gone":null,"tags":["a"],"temp":1.5}` + "\n", false},
+		{
+			// Keys in sorted order; 1.5 as a float64 and 300 as an int64.
+			"MessagePack", msgpackSerializer{snakeCase},
+			"85" + "a9636974795f6e616d65" + "a44f736c6f" + "a5636f756e74" + "d3000000000000012c" +
+				"a4676f6e65" + "c0" + "a474616773" + "91a161" + "a474656d70" + "cb3ff8000000000000",
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := tt.s.encode(&b, v); err != nil {
+				t.Fatal(err)
+			}
+			got := b.String()
+			if tt.isHex {
+				got = hex.EncodeToString(b.Bytes())
+			}
+			if got != tt.want {
+				t.Errorf("encoded\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRespondByAccept(t *testing.T) {
+	fakes := fakeRegistry{}
+	fakes.add("alpha", 285)
+	_, ts := newTestServer(t, testConfig(t), nil, fakes.providers()...)
+
+	tests := []struct {
+		accept    string
+		wantType  string
+		wantStart string // of the body
+	}{
+		{"", "application/json; charset=utf-8", `{"city":"Paris"`},
+		{"application/msgpack", msgpackType, "\x82\xa4city\xa5Paris"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantType, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", ts.URL+"/compare/Paris", nil)
+			req.Header.Set("Accept", tt.accept)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if got := resp.Header.Get("Content-Type"); got != tt.wantType {
+				t.Errorf("content type %q, want %q", got, tt.wantType)
+			}
+			if !strings.HasPrefix(string(body), tt.wantStart) {
+				t.Errorf("body %q, want it to start %q", body, tt.wantStart)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// server is the HTTP and gRPC API, answered from a set of weather providers.
+// It is built by newServer from any providers at all, so that it doesn't
+// depend on how main configures them.
+type server struct {
+	// cfg is the configuration the server was started with, which fixes its
+	// routes and middleware. Handlers read the settings a reload may change
+	// from live's instead.
+	cfg      Config
+	geocoder Geocoder
+
+	live   *liveProviders
+	cache  *cachedProvider
+	sched  *scheduler
+	trends *trendTracker // nil if trends are off
+
+	// The metrics and success rates outlive any one set of providers, so
+	// that a config reload doesn't reset them. Each server has a registry
+	// of its own, served on its /metrics.
+	metrics   *metricsRegistry
+	observers []Observer
+	tracker   *successTracker
+	variances *varianceTracker
+
+	handler      http.Handler
+	shuttingDown chan struct{}
+}
+
+// newServer returns a server answering from providers, combined and served
+// as cfg says. geocoder names places for the endpoints that need them.
+func newServer(cfg Config, geocoder Geocoder, providers ...weatherProvider) (*server, error) {
+	metrics := &metricsRegistry{}
+	s := &server{
+		cfg:          cfg,
+		geocoder:     geocoder,
+		live:         &liveProviders{},
+		metrics:      metrics,
+		observers:    []Observer{newProviderMetrics(metrics), timingObserver{}},
+		tracker:      newSuccessTracker(cfg.successWindow),
+		variances:    newVarianceTracker(cfg.successWindow),
+		shuttingDown: make(chan struct{}),
+	}
+	metrics.register(s.tracker)
+	metrics.register(s.variances)
+
+	current, err := s.serving(cfg, providers)
+	if err != nil {
+		return nil, err
+	}
+	s.live.store(current)
+
+	s.cache = newCachedProvider(s.live, cfg.cacheTTL, newCacheMetrics(metrics))
+	s.cache.maxStale = cfg.maxStale
+	s.sched = newScheduler(s.cache, cfg.scheduleHorizon, cfg.scheduleRetention)
+	if cfg.trendWindow > 0 {
+		s.trends = newTrendTracker(cfg.trendWindow, cfg.trendThreshold)
+	}
+
+	proxies, err := parseProxies(cfg.trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("WEATHER_TRUSTED_PROXIES: %v", err)
+	}
+
+	var handler http.Handler = s.routes()
+	if cfg.tracing {
+		handler = traced(handler)
+	}
+	s.handler = trustProxies(proxies, recoverPanics(handler))
+	return s, nil
+}
+
+// listen opens the listener the server is to serve on: the Unix socket cfg
+// names, if any, or else its TCP address. A socket file left behind by an
+// earlier run is replaced. The socket is removed again when the listener is
+// closed, as shutting the server down does.
+func listen(cfg Config) (net.Listener, error) {
+	if cfg.unixSocket == "" {
+		return net.Listen("tcp", cfg.addr)
+	}
+
+	// Only ever remove a socket, never some other file at a mistyped path.
+	if fi, err := os.Lstat(cfg.unixSocket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(cfg.unixSocket); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", cfg.unixSocket)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+	return l, nil
+}
+
+// serving combines providers as cfg says to, keeping the server's metrics
+// and success rates.
+func (s *server) serving(cfg Config, providers []weatherProvider) (*serving, error) {
+	return newServing(cfg, providers, s.observers, s.tracker, s.variances)
+}
+
+// reconfigure serves from providers as cfg says to, in place of the current
+// serving set, and caches results for as long as cfg says to from now on.
+func (s *server) reconfigure(cfg Config, providers []weatherProvider) error {
+	next, err := s.serving(cfg, providers)
+	if err != nil {
+		return err
+	}
+	s.cache.setTTL(cfg.cacheTTL, cfg.maxStale)
+	s.live.store(next)
+	return nil
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// shutdown ends the server's streams, so that an http.Server shutting down
+// isn't kept waiting on them.
+func (s *server) shutdown() { close(s.shuttingDown) }
+
+// grpc returns the handler of the gRPC WeatherService.
+func (s *server) grpc() http.Handler {
+	var g http.Handler = requireKey(s.cfg.apiKeys, grpcService{source: s.cache, live: s.live, trends: s.trends})
+	if s.cfg.tracing {
+		g = traced(g)
+	}
+	return recoverPanics(g)
+}
+
+func (s *server) routes() *http.ServeMux {
+	cfg := s.cfg
+
+	// The API endpoints may be called from browsers, and may need a key.
+	// The rest stay open, for health checks and monitoring.
+	api := func(h http.Handler) http.Handler {
+		return cors(cfg.corsOrigins, requireKey(cfg.apiKeys, memoized(h)))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", hello)
+	mux.Handle("/metrics", s.metrics)
+	mux.HandleFunc("/version", versionHandler)
+	mux.Handle(apiVersion+"/openapi.json", openAPIHandler(s.live))
+
+	// The API endpoints are served under apiVersion, and at their original
+	// unversioned paths too, so that existing clients keep working. The
+	// prefix is stripped before the handler sees the path.
+	endpoint := func(pattern string, h http.Handler) {
+		h = api(h)
+		mux.Handle(pattern, h)
+		mux.Handle(apiVersion+pattern, http.StripPrefix(apiVersion, h))
+	}
+	endpoint("/stream/", streamHandler(newStreamHub(s.cache, cfg.streamInterval, cfg.maxStreams, s.shuttingDown)))
+	endpoint("/conditions/", conditionsHandler(s.live))
+	endpoint("/history/", historyHandler(s.live))
+	endpoint("/compare/", compareHandler(s.live))
+	endpoint("/raw/", rawHandler(s.live))
+	endpoint("/region/", regionHandler(s.cache, cfg.clusterRadius))
+	endpoint("/schedule", scheduleHandler(s.sched))
+	endpoint("/scheduled/", scheduledHandler(s.sched))
+
+	if cfg.pprof {
+		handlePprof(mux, cfg.apiKeys)
+	}
+	handleAdmin(mux, cfg.apiKeys, s.cache, s.geocoder)
+
+	endpoint("/weather/", readOnly(shedLoad(cfg.workers, cfg.queueDepth, cfg.shedRetryAfter, http.HandlerFunc(s.weather))))
+	return mux
+}
+
+// weather serves /weather/: the temperature at a place, as JSON, GeoJSON or
+// a protocol buffer.
+func (s *server) weather(w http.ResponseWriter, r *http.Request) {
+	// One serving set answers the whole request, even if a reload swaps in
+	// another meanwhile.
+	current := s.live.load()
+	cfg := current.cfg
+
+	begin := time.Now()
+	if cfg.slowRequest > 0 {
+		ctx, calls := withTimings(r.Context())
+		r = r.WithContext(ctx)
+		defer func() {
+			if took := time.Since(begin); took > cfg.slowRequest {
+				slog.Warn("slow request", "url", r.URL.String(), "remote", r.RemoteAddr, "took", took.Round(time.Millisecond), "providers", calls.String())
+			}
+		}()
+	}
+
+	q, err := queryFromRequest(r, cfg.defaultCity)
+	if err != nil {
+		fail(w, current, err.Error(), errorStatus(err), begin)
+		return
+	}
+	city := q.address()
+	if city == "" && cfg.reverseGeocode {
+		// Name the point, on a best-effort basis: the temperature is
+		// still worth answering with if the geocoder fails.
+		if place, err := s.geocoder.reverse(r.Context(), q.coords.lat, q.coords.lon); err != nil {
+			log.Printf("reverse geocoding %s: %v", q, err)
+		} else {
+			city = place
+		}
+	}
+
+	if cfg.placeIDs && q.coords == nil {
+		// Without an ID, the place is still cached by its name.
+		if lat, lon, err := s.geocoder.geocode(r.Context(), q.address(), q.country, q.regionBias()); err != nil {
+			log.Printf("geocoding %s for its place ID: %v", q, err)
+		} else {
+			q.placeID = placeID(lat, lon)
+		}
+	}
+
+	u := cfg.defaultUnits()
+	if v := r.URL.Query().Get("units"); v != "" {
+		if u, err = parseUnit(v); err != nil {
+			fail(w, current, err.Error(), http.StatusBadRequest, begin)
+			return
+		}
+	}
+
+	style, err := keyStyleFromRequest(r.URL.Query())
+	if err != nil {
+		fail(w, current, err.Error(), http.StatusBadRequest, begin)
+		return
+	}
+
+	// max_age, in seconds, bounds how old a cached result may be served.
+	var maxAge time.Duration
+	if v := r.URL.Query().Get("max_age"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			fail(w, current, fmt.Sprintf("malformed max_age %q; want a positive number of seconds", v), http.StatusBadRequest, begin)
+			return
+		}
+		maxAge = time.Duration(secs) * time.Second
+	}
+
+	res, err := s.cache.aggregateWithin(r.Context(), q, maxAge)
+	if err != nil {
+		fail(w, current, err.Error(), errorStatus(err), begin)
+		return
+	}
+	switch {
+	case res.stale:
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+		w.Header().Set("X-Cache", "stale")
+	case res.cached:
+		w.Header().Set("X-Cache", "hit")
+	default:
+		w.Header().Set("X-Cache", "miss")
+	}
+	if !res.fetched.IsZero() {
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(res.fetched).Seconds())))
+	}
+
+	trend := s.trends.record(q.key(), res.temp, res.fetched)
+
+	properties := map[string]interface{}{
+		"city":        city,
+		"temp":        cfg.rounding.round(res.in(u)),
+		"units":       u,
+		"temperature": res.temp,
+		"sources":     res.sources,
+		"confidence":  cfg.confidence.level(res),
+		"took":        time.Since(begin).String(),
+	}
+	if w := warnings(res, cfg.disagreement); len(w) > 0 {
+		properties["warnings"] = w
+	}
+	if trend != "" {
+		properties["trend"] = trend
+	}
+	if q.placeID != "" {
+		properties["place_id"] = q.placeID
+	}
+	if len(res.failed) > 0 {
+		properties["partial"] = true
+		properties["failed"] = res.failed
+	}
+	if r.URL.Query().Get("explain") == "true" && res.explanation != nil {
+		properties["explanation"] = res.explanation
+	}
+	if r.URL.Query().Get("debug") == "true" {
+		properties["debug"] = res.statuses
+	}
+	credits := attributions(current.providers, res.sources)
+	if len(credits) > 0 {
+		properties["attributions"] = credits
+	}
+
+	// In envelope mode, how the response was answered moves to meta, and
+	// the rest goes in data. Protocol buffers keep their own shape.
+	enveloped := cfg.envelope && !wantsProtobuf(r)
+	var meta envelopeMeta
+	if enveloped {
+		meta = envelopeMeta{Took: properties["took"].(string), Cached: res.cached, Sources: res.sources}
+		delete(properties, "took")
+		delete(properties, "sources")
+	}
+
+	if r.URL.Query().Get("format") == "geojson" && !wantsProtobuf(r) {
+		if q.coords == nil {
+			lat, lon, err := s.geocoder.geocode(r.Context(), q.address(), q.country, q.regionBias())
+			if err != nil {
+				fail(w, current, err.Error(), errorStatus(err), begin)
+				return
+			}
+			q.coords = &coordinates{lat, lon}
+		}
+
+		feature := geoJSONPoint(q.coords.lat, q.coords.lon, properties)
+		if enveloped {
+			respond(w, r, envelope{Data: feature, Meta: meta}, style)
+			return
+		}
+		w.Header().Set("Content-Type", "application/geo+json; charset=utf-8")
+		encodeJSON(w, feature, style)
+		return
+	}
+
+	if enveloped {
+		respond(w, r, envelope{Data: properties, Meta: meta}, style)
+		return
+	}
+
+	respond(w, r, weatherResponse{
+		properties: properties,
+		message: weatherMessage{
+			city:        city,
+			temperature: res.temp,
+			sources:     res.sources,
+			confidence:  cfg.confidence.level(res),
+			warnings:    warnings(res, cfg.disagreement),
+			temp:        int32(cfg.rounding.round(res.in(u))),
+			units:       u,
+			trend:       trend,
+			credits:     credits,
+			placeID:     q.placeID,
+		},
+	}, style)
+}
+
+// weatherResponse is a /weather/ response, in both the shape of its JSON and
+// its protocol buffer form.
+type weatherResponse struct {
+	properties map[string]interface{}
+	message    weatherMessage
+}
+
+func (r weatherResponse) MarshalJSON() ([]byte, error) { return json.Marshal(r.properties) }
+func (r weatherResponse) marshal() []byte              { return r.message.marshal() }
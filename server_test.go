@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRegistry is the set of fake providers a test serves from, by name, so
+// that the test can look each one up again to count its calls or to change
+// how it answers.
+type fakeRegistry map[string]*fakeProvider
+
+// add registers a fake answering with kelvin.
+func (r fakeRegistry) add(name string, kelvin float64) *fakeProvider {
+	f := &fakeProvider{name: name, kelvin: kelvin}
+	r[name] = f
+	return f
+}
+
+// providers are the registered fakes, ordered by name.
+func (r fakeRegistry) providers() []weatherProvider {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	providers := make([]weatherProvider, len(names))
+	for i, name := range names {
+		providers[i] = r[name]
+	}
+	return providers
+}
+
+// testConfig is the configuration as if no setting were given at all.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	return testConfigFromEnv(t, nil)
+}
+
+// testConfigFromEnv is the configuration as if env were the environment.
+func testConfigFromEnv(t *testing.T, env map[string]string) Config {
+	t.Helper()
+	prev := getenv
+	getenv = func(name string) string { return env[name] }
+	defer func() { getenv = prev }()
+	return configFromEnv()
+}
+
+// newTestServer builds a server as cfg says from providers, and serves it
+// over HTTP until the test ends.
+func newTestServer(t *testing.T, cfg Config, geocoder Geocoder, providers ...weatherProvider) (*server, *httptest.Server) {
+	t.Helper()
+	s, err := newServer(cfg, geocoder, providers...)
+	if err != nil {
+		t.Fatalf("newServer: %v", err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// getJSONResponse GETs u and decodes its JSON body into v, returning the
+// response, whose body is closed.
+func getJSONResponse(t *testing.T, u string, v interface{}) *http.Response {
+	t.Helper()
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("GET %s: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: decoding: %v", u, err)
+	}
+	return resp
+}
+
+func TestWeatherIntegration(t *testing.T) {
+	fakes := fakeRegistry{}
+	fakes.add("alpha", 280)
+	fakes.add("beta", 290)
+	_, ts := newTestServer(t, testConfig(t), nil, fakes.providers()...)
+
+	tests := []struct {
+		path   string
+		units  string
+		temp   float64
+		xCache string
+	}{
+		{"/weather/Paris", "fahrenheit", 53, "miss"},
+		{"/weather/Paris?units=c", "celsius", 12, "hit"},
+		{"/weather/Paris?units=kelvin", "kelvin", 285, "hit"},
+		{"/v1/weather/Paris?units=kelvin", "kelvin", 285, "hit"},
+	}
+	for _, tt := range tests {
+		var got struct {
+			City        string  `json:"city"`
+			Temp        float64 `json:"temp"`
+			Units       string  `json:"units"`
+			Temperature struct {
+				K float64 `json:"k"`
+			} `json:"temperature"`
+			Sources []string `json:"sources"`
+			Partial bool     `json:"partial"`
+		}
+		resp := getJSONResponse(t, ts.URL+tt.path, &got)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d", tt.path, resp.StatusCode)
+		}
+		if x := resp.Header.Get("X-Cache"); x != tt.xCache {
+			t.Errorf("%s: X-Cache %q, want %q", tt.path, x, tt.xCache)
+		}
+		if got.City != "Paris" || got.Units != tt.units || got.Temp != tt.temp {
+			t.Errorf("%s: got %s, %v %s; want Paris, %v %s", tt.path, got.City, got.Temp, got.Units, tt.temp, tt.units)
+		}
+		if got.Temperature.K != 285 {
+			t.Errorf("%s: temperature %v K, want the mean, 285 K", tt.path, got.Temperature.K)
+		}
+		if strings.Join(got.Sources, ",") != "alpha,beta" {
+			t.Errorf("%s: sources %v, want [alpha beta]", tt.path, got.Sources)
+		}
+		if got.Partial {
+			t.Errorf("%s: partial, with every provider answering", tt.path)
+		}
+	}
+
+	for name, f := range fakes {
+		if n := f.calls.Load(); n != 1 {
+			t.Errorf("%s asked %d times, want once, the rest being cached", name, n)
+		}
+	}
+}
+
+func TestServersHaveTheirOwnMetrics(t *testing.T) {
+	fakes := fakeRegistry{}
+	fakes.add("alpha", 280)
+	_, first := newTestServer(t, testConfig(t), nil, fakes.providers()...)
+	_, second := newTestServer(t, testConfig(t), nil, fakes.providers()...)
+
+	for _, city := range []string{"Paris", "Rome"} {
+		resp, err := http.Get(first.URL + "/weather/" + city)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	tests := []struct {
+		ts   *httptest.Server
+		want string
+	}{
+		{first, "weather_cache_misses_total 2\n"},
+		{second, "weather_cache_misses_total 0\n"},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(tt.ts.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body strings.Builder
+		_, err = io.Copy(&body, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(body.String(), "# TYPE weather_cache_misses_total "); n != 1 {
+			t.Errorf("weather_cache_misses_total declared %d times, want once", n)
+		}
+		if !strings.Contains(body.String(), tt.want) {
+			t.Errorf("/metrics lacks %q:\n%s", tt.want, body.String())
+		}
+	}
+}
+
+func TestWeatherDefaultCity(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultCity string
+		path        string
+		status      int
+		city        string
+	}{
+		{"empty city with default", "Paris", "/weather/", http.StatusOK, "Paris"},
+		{"empty ?city= with default", "Paris", "/weather/?city=", http.StatusOK, "Paris"},
+		{"city given with default", "Paris", "/weather/Rome", http.StatusOK, "Rome"},
+		{"empty city without default", "", "/weather/", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.defaultCity = tt.defaultCity
+			fakes := fakeRegistry{}
+			fakes.add("alpha", 285)
+			_, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+			resp, err := http.Get(ts.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got struct {
+				City string `json:"city"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.City != tt.city {
+				t.Errorf("city %q, want %q", got.City, tt.city)
+			}
+		})
+	}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  func(path string) error // leaves something at the socket's path
+		wantErr bool
+	}{
+		{"fresh path", func(string) error { return nil }, false},
+		{"socket left behind", func(path string) error {
+			l, err := net.Listen("unix", path)
+			if err != nil {
+				return err
+			}
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			return l.Close()
+		}, false},
+		{"some other file", func(path string) error { return os.WriteFile(path, []byte("keep me"), 0o600) }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.unixSocket = filepath.Join(t.TempDir(), "weather.sock")
+			if err := tt.before(cfg.unixSocket); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := listen(cfg)
+			if tt.wantErr {
+				if err == nil {
+					l.Close()
+					t.Fatal("listened over a file that isn't a socket")
+				}
+				if data, _ := os.ReadFile(cfg.unixSocket); string(data) != "keep me" {
+					t.Errorf("file at the socket's path now holds %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fakes := fakeRegistry{}
+			fakes.add("alpha", 285)
+			s, err := newServer(cfg, nil, fakes.providers()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := &http.Server{Handler: s}
+			served := make(chan error, 1)
+			go func() { served <- srv.Serve(l) }()
+
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", cfg.unixSocket)
+				},
+			}}
+			resp, err := client.Get("http://weather/weather/Paris")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got struct {
+				Temperature struct{ K float64 }
+			}
+			err = json.NewDecoder(resp.Body).Decode(&got)
+			resp.Body.Close()
+			if err != nil || got.Temperature.K != 285 {
+				t.Errorf("read %v K over the socket, %v; want 285 K", got.Temperature.K, err)
+			}
+
+			if err := srv.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-served; err != http.ErrServerClosed {
+				t.Errorf("Serve: %v", err)
+			}
+			if _, err := os.Lstat(cfg.unixSocket); !os.IsNotExist(err) {
+				t.Errorf("socket still there after shutting down: %v", err)
+			}
+		})
+	}
+}
+
+func TestListenOnTCPWithoutSocket(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.addr = "127.0.0.1:0"
+	l, err := listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Addr().Network() != "tcp" {
+		t.Errorf("listening on %s %s, want TCP", l.Addr().Network(), l.Addr())
+	}
+}
+
+func TestPartialResults(t *testing.T) {
+	tests := []struct {
+		name        string
+		edit        func(beta *fakeProvider)
+		wantPartial bool
+		wantFailed  string
+		wantK       float64
+	}{
+		{"every provider answering", func(*fakeProvider) {}, false, "[]", 285},
+		{"one failing", func(b *fakeProvider) { b.err = errors.New("provider down") }, true, "[{beta provider down}]", 280},
+		{"one too slow", func(b *fakeProvider) { b.delay = time.Second }, true, "[{beta no answer within 50ms}]", 280},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			fakes.add("alpha", 280)
+			tt.edit(fakes.add("beta", 290))
+			cfg := testConfig(t)
+			cfg.minProviders, cfg.aggregationTimeout = 1, 50*time.Millisecond
+			_, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+			var got struct {
+				Partial     *bool `json:"partial"`
+				Failed      []struct{ Provider, Error string }
+				Temperature struct{ K float64 }
+			}
+			resp := getJSONResponse(t, ts.URL+"/weather/Paris", &got)
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status %d, want 200", resp.StatusCode)
+			}
+			switch {
+			case tt.wantPartial && (got.Partial == nil || !*got.Partial):
+				t.Errorf("partial %v, want true", got.Partial)
+			case !tt.wantPartial && got.Partial != nil:
+				t.Errorf("partial %v, want it left out", *got.Partial)
+			}
+			if f := fmt.Sprint(got.Failed); f != tt.wantFailed {
+				t.Errorf("failed %s, want %s", f, tt.wantFailed)
+			}
+			if got.Temperature.K != tt.wantK {
+				t.Errorf("%v K, want %v K, the mean of those answering", got.Temperature.K, tt.wantK)
+			}
+		})
+	}
+}
+
+func TestDebugStatuses(t *testing.T) {
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Host {
+		case "api.openweathermap.org":
+			io.WriteString(w, `{"main":{"temp":285}}`)
+		case "api.weatherbit.io":
+			io.WriteString(w, `{"data":[{"temp":12}],"count":1}`)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	keys := newKeyRing("KEY")
+	cfg := testConfig(t)
+	cfg.minProviders = 1
+	s, _ := newTestServer(t, cfg, nil, openWeatherMap{keys: keys}, weatherUnderground{keys: keys}, weatherbit{keys: keys})
+
+	tests := []struct {
+		name  string
+		query string
+		want  string // the statuses shown, or empty for none
+	}{
+		{"debug", "?debug=true", "[{openWeatherMap 200} {weatherbit 200} {weatherUnderground 503}]"},
+		{"debug of a cached result", "?debug=true", "[{openWeatherMap 200} {weatherbit 200} {weatherUnderground 503}]"},
+		{"no debug", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The default client now goes upstream, so the server is asked directly.
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, httptest.NewRequest("GET", "/weather/Paris"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d", rec.Code)
+			}
+			var got struct {
+				Debug []struct {
+					Provider string
+					Status   int
+				}
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.want == "" && got.Debug != nil:
+				t.Errorf("debug %v, want none", got.Debug)
+			case tt.want != "" && fmt.Sprint(got.Debug) != tt.want:
+				t.Errorf("debug %v, want %s", got.Debug, tt.want)
+			}
+		})
+	}
+}
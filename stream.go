@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A streamHub polls for the places /stream/ subscribers follow. Each place
+// has one poller, however many subscribers follow it, and a poller stops once
+// its last subscriber leaves.
+type streamHub struct {
+	source   resultProvider
+	interval time.Duration
+	done     <-chan struct{}
+
+	// max bounds how many subscribers may stream at once. Zero means no
+	// bound.
+	max int
+
+	mu          sync.Mutex
+	subscribers int
+	pollers     map[string]*poller
+}
+
+// A poller looks a place up every interval, and sends each reading, as a
+// server-sent event, to every subscriber of the place.
+type poller struct {
+	subs map[chan string]struct{}
+	last string // the latest event, for subscribers that join later
+	stop context.CancelFunc
+}
+
+// newStreamHub returns a streamHub looking places up from source every
+// interval, for at most max subscribers at once. Its pollers stop when done
+// is closed.
+func newStreamHub(source resultProvider, interval time.Duration, max int, done <-chan struct{}) *streamHub {
+	return &streamHub{source: source, interval: interval, max: max, done: done, pollers: map[string]*poller{}}
+}
+
+// subscribe adds a subscriber to q, starting its poller if it has none. The
+// subscriber receives events on the channel until it calls unsubscribe. If
+// the hub already has as many subscribers as it may, ok is false.
+func (h *streamHub) subscribe(q query) (events <-chan string, unsubscribe func(), ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.max > 0 && h.subscribers >= h.max {
+		return nil, nil, false
+	}
+	h.subscribers++
+
+	key := q.key()
+	p, running := h.pollers[key]
+	if !running {
+		ctx, cancel := context.WithCancel(context.Background())
+		p = &poller{subs: map[chan string]struct{}{}, stop: cancel}
+		h.pollers[key] = p
+		go h.poll(ctx, q, p)
+	}
+
+	// One event is buffered: a subscriber too slow to keep up misses
+	// readings, but never holds up the others.
+	ch := make(chan string, 1)
+	p.subs[ch] = struct{}{}
+	if p.last != "" {
+		ch <- p.last
+	}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		h.subscribers--
+		delete(p.subs, ch)
+		if len(p.subs) == 0 {
+			p.stop()
+			delete(h.pollers, key)
+		}
+	}, true
+}
+
+// poll looks q up every interval until ctx is canceled or the hub is done,
+// sending each reading to p's subscribers.
+func (h *streamHub) poll(ctx context.Context, q query, p *poller) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		var event string
+		res, err := h.source.aggregate(ctx, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			event = fmt.Sprintf("event: error\ndata: %s\n\n", err)
+		} else {
+			data, _ := json.Marshal(map[string]interface{}{
+				"city":        q.address(),
+				"temperature": res.temp,
+				"sources":     res.sources,
+				"time":        time.Now().UTC().Format(time.RFC3339),
+			})
+			event = fmt.Sprintf("event: temperature\ndata: %s\n\n", data)
+		}
+		h.send(p, event)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// send delivers event to each of p's subscribers, in place of any earlier
+// event they have yet to take.
+func (h *streamHub) send(p *poller, event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	p.last = event
+	for ch := range p.subs {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- event
+	}
+}
+
+// streamHandler serves /stream/?city=..., pushing the city's temperature to
+// the client as a server-sent event every interval until it disconnects.
+// Subscribers to one city share a single poller in hub, and those beyond its
+// limit are turned away with 503. Streams end when the hub is done, so they
+// don't hold up a graceful shutdown.
+func streamHandler(hub *streamHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		q, err := parsePlace(r.URL.Query().Get("city"))
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		events, unsubscribe, ok := hub.subscribe(q)
+		if !ok {
+			http.Error(w, "too many streams", http.StatusServiceUnavailable)
+			return
+		}
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		flusher.Flush()
+
+		// The request's context is canceled when the client goes away.
+		for {
+			select {
+			case event := <-events:
+				fmt.Fprint(w, event)
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			case <-hub.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readEvent reads the next server-sent event from r, returning its type and
+// data.
+func readEvent(t *testing.T, r *bufio.Reader) (event, data string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, data
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// subscribers is how many subscribers hub has, and how many places it polls.
+func subscribers(hub *streamHub) (int, int) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return hub.subscribers, len(hub.pollers)
+}
+
+func TestStream(t *testing.T) {
+	p := fixedResult(285)
+	done := make(chan struct{})
+	defer close(done)
+	ts := httptest.NewServer(streamHandler(newStreamHub(p, 10*time.Millisecond, 0, done)))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/stream/?city=Paris", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type %q", ct)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	for i := 0; i < 2; i++ {
+		event, data := readEvent(t, r)
+		if event != "temperature" {
+			t.Fatalf("event %d is %q: %s", i, event, data)
+		}
+		var got struct {
+			City        string `json:"city"`
+			Temperature struct {
+				K float64 `json:"k"`
+			} `json:"temperature"`
+		}
+		if err := json.Unmarshal([]byte(data), &got); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		if got.City != "Paris" || got.Temperature.K != 285 {
+			t.Errorf("event %d: %s", i, data)
+		}
+	}
+
+	// Once the client goes away, the handler stops looking the city up. It
+	// may have had one more lookup under way as it noticed.
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	calls := p.calls.Load()
+	time.Sleep(50 * time.Millisecond)
+	if n := p.calls.Load(); n > calls+1 {
+		t.Errorf("still polling after the client left: %d lookups, then %d", calls, n)
+	}
+}
+
+func TestStreamRejectsBadCities(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	p := fixedResult(285)
+	rec := httptest.NewRecorder()
+	streamHandler(newStreamHub(p, time.Minute, 0, done))(rec, httptest.NewRequest("GET", "/stream/", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if n := p.calls.Load(); n != 0 {
+		t.Errorf("looked up %d times", n)
+	}
+}
+
+// openStream subscribes to the stream at u, returning the response and a
+// func that disconnects.
+func openStream(t *testing.T, u string) (*http.Response, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", u, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	return resp, cancel
+}
+
+func TestStreamCapAndSharedPolling(t *testing.T) {
+	p := fixedResult(285)
+	done := make(chan struct{})
+	// Polling hourly, each poller looks its place up just the once.
+	hub := newStreamHub(p, time.Hour, 3, done)
+	ts := httptest.NewServer(streamHandler(hub))
+	// Cleanups run last first: the streams end before the server closes.
+	t.Cleanup(func() {
+		close(done)
+		ts.Close()
+	})
+
+	var leave []context.CancelFunc
+	for _, city := range []string{"Paris", "Paris", "Oslo"} {
+		resp, cancel := openStream(t, ts.URL+"/stream/?city="+city)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200", city, resp.StatusCode)
+		}
+		if event, data := readEvent(t, bufio.NewReader(resp.Body)); event != "temperature" {
+			t.Fatalf("%s: event %q: %s", city, event, data)
+		}
+		leave = append(leave, cancel)
+	}
+
+	if subs, polled := subscribers(hub); subs != 3 || polled != 2 {
+		t.Errorf("%d subscribers and %d places polled, want 3 sharing 2 pollers", subs, polled)
+	}
+	if n := p.calls.Load(); n != 2 {
+		t.Errorf("%d lookups, want one for each place", n)
+	}
+
+	resp, _ := openStream(t, ts.URL+"/stream/?city=Rome")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("over the cap: status %d, want 503", resp.StatusCode)
+	}
+
+	// Once a subscriber leaves, there is room for another.
+	leave[0]()
+	deadline := time.Now().Add(time.Second)
+	for subs, _ := subscribers(hub); subs != 2; subs, _ = subscribers(hub) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers after one left, want 2", subs)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if resp, _ := openStream(t, ts.URL+"/stream/?city=Rome"); resp.StatusCode != http.StatusOK {
+		t.Errorf("after one left: status %d, want 200", resp.StatusCode)
+	}
+}
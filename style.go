@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// keyStyle is how the field names of a JSON response are spelled. Responses
+// are written in snake_case; frontends that prefer camelCase can ask for it.
+type keyStyle string
+
+const (
+	snakeCase keyStyle = "snake"
+	camelCase keyStyle = "camel"
+)
+
+// parseKeyStyle parses a style query parameter: "snake" or "camel".
+func parseKeyStyle(s string) (keyStyle, error) {
+	switch s {
+	case "snake":
+		return snakeCase, nil
+	case "camel":
+		return camelCase, nil
+	}
+	return "", fmt.Errorf("unknown style %q", s)
+}
+
+// keyStyleFromRequest reads the style query parameter, defaulting to
+// snake_case, the shape responses have always had.
+func keyStyleFromRequest(q url.Values) (keyStyle, error) {
+	if v := q.Get("style"); v != "" {
+		return parseKeyStyle(v)
+	}
+	return snakeCase, nil
+}
+
+// encodeJSON writes v to w as JSON, with its field names in style s.
+func encodeJSON(w io.Writer, v interface{}, s keyStyle) error {
+	if s != camelCase {
+		return json.NewEncoder(w).Encode(v)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// Round-trip through generic values to rename every object's keys,
+	// keeping numbers exactly as they were written.
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var generic interface{}
+	if err := d.Decode(&generic); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(camelKeys(generic))
+}
+
+// camelKeys renames the keys of every object in a decoded JSON value from
+// snake_case to camelCase.
+func camelKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[snakeToCamel(k)] = camelKeys(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = camelKeys(e)
+		}
+	}
+	return v
+}
+
+// snakeToCamel turns "cloud_cover" into "cloudCover".
+func snakeToCamel(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if p := parts[i]; p != "" {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseKeyStyles(t *testing.T) {
+	servePayloads(t, map[string]string{
+		"api.openweathermap.org": `{"main": {"temp": 285}, "clouds": {"all": 60}}`,
+	})
+	h := conditionsHandler(servingOnly(multiWeatherProvider{providers: []weatherProvider{openWeatherMap{keys: newKeyRing("KEY")}}}))
+
+	tests := []struct {
+		query       string
+		present     []string
+		absent      []string
+		wantFailure bool
+	}{
+		{"", []string{"city", "temperature", "cloud_cover"}, []string{"cloudCover"}, false},
+		{"&style=snake", []string{"city", "temperature", "cloud_cover"}, []string{"cloudCover"}, false},
+		{"&style=camel", []string{"city", "temperature", "cloudCover"}, []string{"cloud_cover"}, false},
+		{"&style=kebab", nil, nil, true},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("GET", "/conditions/?city=Paris"+tt.query, nil))
+		if tt.wantFailure {
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: status %d, want %d", tt.query, rec.Code, http.StatusBadRequest)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.query, rec.Code, rec.Body)
+		}
+
+		var got map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range tt.present {
+			if _, ok := got[k]; !ok {
+				t.Errorf("%s: no %q in %v", tt.query, k, got)
+			}
+		}
+		for _, k := range tt.absent {
+			if _, ok := got[k]; ok {
+				t.Errorf("%s: %q in %v", tt.query, k, got)
+			}
+		}
+	}
+}
+
+func TestSnakeToCamel(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"city", "city"},
+		{"place_id", "placeId"},
+		{"snow_accumulation_mm", "snowAccumulationMm"},
+		{"trailing_", "trailing"},
+		{"double__underscore", "doubleUnderscore"},
+	}
+	for _, tt := range tests {
+		if got := snakeToCamel(tt.in); got != tt.want {
+			t.Errorf("snakeToCamel(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCamelCaseRenamesNestedKeys(t *testing.T) {
+	v := map[string]interface{}{
+		"snow_mm": 1.5,
+		"failed":  []map[string]string{{"provider_name": "alpha"}},
+	}
+	var b strings.Builder
+	if err := encodeJSON(&b, v, camelCase); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), `{"failed":[{"providerName":"alpha"}],"snowMm":1.5}`+"\n"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// successTracker keeps each provider's outcomes over its last few lookups.
+type successTracker struct {
+	window int
+
+	mu      sync.Mutex
+	history map[string]*outcomes
+}
+
+// outcomes is a ring buffer of a provider's recent successes and failures.
+type outcomes struct {
+	ok   []bool
+	next int
+}
+
+// minWeight keeps a provider that has failed every recent lookup from being
+// weighted to nothing, should it start answering again.
+const minWeight = 0.05
+
+func newSuccessTracker(window int) *successTracker {
+	if window < 1 {
+		window = 1
+	}
+	return &successTracker{window: window, history: map[string]*outcomes{}}
+}
+
+// record notes the outcome of one lookup by the named provider. Lookups we
+// canceled ourselves, because the provider was no longer needed, say nothing
+// about its health and are ignored.
+func (t *successTracker) record(name string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	o, ok := t.history[name]
+	if !ok {
+		o = &outcomes{}
+		t.history[name] = o
+	}
+
+	if len(o.ok) < t.window {
+		o.ok = append(o.ok, err == nil)
+		return
+	}
+	o.ok[o.next] = err == nil
+	o.next = (o.next + 1) % t.window
+}
+
+// rate is the fraction of the named provider's recent lookups that
+// succeeded. It is 1 for a provider with no history.
+func (t *successTracker) rate(name string) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.history[name].rate()
+}
+
+func (o *outcomes) rate() float64 {
+	if o == nil || len(o.ok) == 0 {
+		return 1
+	}
+
+	n := 0
+	for _, ok := range o.ok {
+		if ok {
+			n++
+		}
+	}
+	return float64(n) / float64(len(o.ok))
+}
+
+// weight is how much the named provider's readings should count for in a
+// weighted average.
+func (t *successTracker) weight(name string) float64 {
+	if r := t.rate(name); r > minWeight {
+		return r
+	}
+	return minWeight
+}
+
+func (t *successTracker) writeTo(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := make([]string, 0, len(t.history))
+	for name := range t.history {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP weather_provider_success_rate Fraction of each provider's last %d lookups that succeeded.\n", t.window)
+	fmt.Fprintf(w, "# TYPE weather_provider_success_rate gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "weather_provider_success_rate{provider=%q} %g\n", name, t.history[name].rate())
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSuccessTrackerWeight(t *testing.T) {
+	errDown := errors.New("provider down")
+
+	tests := []struct {
+		name     string
+		outcomes []error
+		want     float64
+	}{
+		{"no history", nil, 1},
+		{"always answering", []error{nil, nil, nil, nil}, 1},
+		{"failing half the time", []error{nil, errDown, nil, errDown}, 0.5},
+		{"failing every time", []error{errDown, errDown, errDown, errDown}, minWeight},
+		{"failures beyond the window forgotten", []error{errDown, errDown, nil, nil, nil, nil}, 1},
+		{"cancellations ignored", []error{nil, context.Canceled, context.Canceled, nil}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newSuccessTracker(4)
+			for _, err := range tt.outcomes {
+				tracker.record("flaky", err)
+			}
+			if got := tracker.weight("flaky"); got != tt.want {
+				t.Errorf("weight %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveWeightsDropAfterFailures(t *testing.T) {
+	var down atomic.Bool
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"main": {"temp": 290}}`)
+	})
+	w := multiWeatherProvider{
+		providers:    []weatherProvider{&fakeProvider{name: "steady", kelvin: 280}, openWeatherMap{keys: newKeyRing("KEY")}},
+		minProviders: 1,
+		tracker:      newSuccessTracker(4),
+		adaptive:     true,
+	}
+	paris := query{city: "Paris"}
+
+	res, err := w.aggregate(context.Background(), paris)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.temp != 285 {
+		t.Fatalf("temp %v, want an even 285 K while both are healthy", res.temp)
+	}
+
+	down.Store(true)
+	for i := 0; i < 3; i++ {
+		if _, err := w.aggregate(context.Background(), paris); err != nil {
+			t.Fatal(err)
+		}
+	}
+	down.Store(false)
+
+	// openWeatherMap has answered 1 of its last 4 lookups, this one
+	// included, and so counts a quarter as much as the steady provider.
+	res, err = w.aggregate(context.Background(), paris)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.tracker.weight("openWeatherMap"); got != 0.25 {
+		t.Errorf("openWeatherMap weight %v, want 0.25", got)
+	}
+	if got := w.tracker.weight("steady"); got != 1 {
+		t.Errorf("steady weight %v, want 1", got)
+	}
+	if want := (280 + 290*0.25) / 1.25; math.Abs(res.temp.Kelvin()-want) > 1e-9 {
+		t.Errorf("temp %v, want the weighted %v", res.temp, want)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Temperature is a temperature stored in Kelvin, the unit providers report
+// in. Convert it only at the edges, when presenting it to a client.
+type Temperature float64
+
+func (t Temperature) Kelvin() float64     { return float64(t) }
+func (t Temperature) Celsius() float64    { return kelvinToCelsius(float64(t)) }
+func (t Temperature) Fahrenheit() float64 { return kelvinToFahrenheit(float64(t)) }
+
+// All conversions between scales go through these, so that every path
+// through the code does the same arithmetic. Fahrenheit is converted to and
+// from Kelvin directly, rather than by way of Celsius, to avoid compounding
+// rounding error with an extra step. For the same reason, a temperature
+// given in Celsius is converted to Fahrenheit directly, not via Kelvin.
+
+const (
+	celsiusOffset    = 273.15 // 0°C in Kelvin
+	fahrenheitOffset = 459.67 // 0°F in Rankine, the Fahrenheit-sized Kelvin
+)
+
+func celsiusToKelvin(c float64) float64     { return c + celsiusOffset }
+func kelvinToCelsius(k float64) float64     { return k - celsiusOffset }
+func fahrenheitToKelvin(f float64) float64  { return (f + fahrenheitOffset) * 5 / 9 }
+func kelvinToFahrenheit(k float64) float64  { return k*9/5 - fahrenheitOffset }
+func celsiusToFahrenheit(c float64) float64 { return c*9/5 + 32 }
+
+// celsiusToKelvinPtr converts an optional temperature, passing nil through.
+func celsiusToKelvinPtr(c *float64) *float64 {
+	if c == nil {
+		return nil
+	}
+	k := celsiusToKelvin(*c)
+	return &k
+}
+
+// MarshalJSON renders the temperature in every unit, to two decimal places:
+// {"k":295.3,"c":22.15,"f":71.87}.
+func (t Temperature) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		K float64 `json:"k"`
+		C float64 `json:"c"`
+		F float64 `json:"f"`
+	}{round2(t.Kelvin()), round2(t.Celsius()), round2(t.Fahrenheit())})
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+// unit is a temperature scale a client can ask for.
+type unit string
+
+const (
+	kelvin     unit = "kelvin"
+	celsius    unit = "celsius"
+	fahrenheit unit = "fahrenheit"
+)
+
+// parseUnit parses a units query parameter. It accepts full names and their
+// initials, case-sensitively: "celsius" or "c".
+func parseUnit(s string) (unit, error) {
+	switch s {
+	case "kelvin", "k":
+		return kelvin, nil
+	case "celsius", "c":
+		return celsius, nil
+	case "fahrenheit", "f":
+		return fahrenheit, nil
+	}
+	return "", fmt.Errorf("unknown unit %q", s)
+}
+
+// rounding is how a temperature is rounded to the whole degrees reported as
+// "temp".
+type rounding string
+
+const (
+	// truncate drops the fraction, rounding toward zero: -0.6 is 0.
+	truncate rounding = "truncate"
+
+	// roundHalfUp rounds to the nearest degree, halves toward positive
+	// infinity: -0.6 is -1, 2.5 is 3 and -2.5 is -2.
+	roundHalfUp rounding = "half-up"
+
+	// roundHalfEven rounds to the nearest degree, halves to the even one:
+	// 2.5 is 2, 3.5 is 4 and -2.5 is -2.
+	roundHalfEven rounding = "half-even"
+)
+
+// parseRounding parses a WEATHER_ROUNDING setting.
+func parseRounding(s string) (rounding, error) {
+	switch r := rounding(s); r {
+	case truncate, roundHalfUp, roundHalfEven:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown rounding %q; use truncate, half-up or half-even", s)
+}
+
+// round rounds f to a whole number as r says to. An unknown r rounds half up.
+func (r rounding) round(f float64) int {
+	switch r {
+	case truncate:
+		return int(f)
+	case roundHalfEven:
+		return int(math.RoundToEven(f))
+	}
+	return int(math.Floor(f + 0.5))
+}
+
+// in returns the temperature in unit u.
+func (t Temperature) in(u unit) float64 {
+	switch u {
+	case kelvin:
+		return t.Kelvin()
+	case celsius:
+		return t.Celsius()
+	}
+	return t.Fahrenheit()
+}
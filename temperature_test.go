@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestTemperatureMarshalJSON(t *testing.T) {
+	tests := []struct {
+		temp Temperature
+		want string
+	}{
+		{295.3, `{"k":295.3,"c":22.15,"f":71.87}`},
+		{273.15, `{"k":273.15,"c":0,"f":32}`},
+		{0, `{"k":0,"c":-273.15,"f":-459.67}`},
+		{233.15, `{"k":233.15,"c":-40,"f":-40}`},
+		{300.123456, `{"k":300.12,"c":26.97,"f":80.55}`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(tt.temp)
+		if err != nil {
+			t.Fatalf("marshaling %v: %v", float64(tt.temp), err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%v K marshals to %s, want %s", float64(tt.temp), got, tt.want)
+		}
+	}
+}
+
+func TestTemperatureMarshalsWithinStructs(t *testing.T) {
+	got, err := json.Marshal(struct {
+		Temperature Temperature  `json:"temperature"`
+		FeelsLike   *Temperature `json:"feels_like,omitempty"`
+	}{Temperature: 273.15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"temperature":{"k":273.15,"c":0,"f":32}}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestTemperatureIn(t *testing.T) {
+	tests := []struct {
+		units string
+		want  float64
+		err   bool
+	}{
+		{"kelvin", 295.3, false},
+		{"k", 295.3, false},
+		{"celsius", 22.15, false},
+		{"c", 22.15, false},
+		{"fahrenheit", 71.87, false},
+		{"f", 71.87, false},
+		{"C", 0, true},
+		{"rankine", 0, true},
+	}
+	for _, tt := range tests {
+		u, err := parseUnit(tt.units)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseUnit(%q) = %s, want an error", tt.units, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseUnit(%q): %v", tt.units, err)
+			continue
+		}
+		if got := round2(Temperature(295.3).in(u)); got != tt.want {
+			t.Errorf("295.3 K in %s = %v, want %v", u, got, tt.want)
+		}
+	}
+}
+
+func TestConversionsRoundTrip(t *testing.T) {
+	const tolerance = 1e-9
+
+	for _, c := range []float64{-273.15, -40, -17.5, 0, 0.1, 21.7, 36.6, 100, 1e3} {
+		direct := c*1.8 + 32
+		if via := kelvinToFahrenheit(celsiusToKelvin(c)); math.Abs(via-direct) > tolerance {
+			t.Errorf("%g°C: via Kelvin %.12g°F, directly %.12g°F", c, via, direct)
+		}
+		if back := kelvinToCelsius(celsiusToKelvin(c)); math.Abs(back-c) > tolerance {
+			t.Errorf("%g°C: round trip through Kelvin gives %.12g°C", c, back)
+		}
+		if back := kelvinToFahrenheit(fahrenheitToKelvin(direct)); math.Abs(back-direct) > tolerance {
+			t.Errorf("%g°F: round trip through Kelvin gives %.12g°F", direct, back)
+		}
+		if got := Temperature(celsiusToKelvin(c)).Fahrenheit(); math.Abs(got-direct) > tolerance {
+			t.Errorf("%g°C as a Temperature is %.12g°F, want %.12g°F", c, got, direct)
+		}
+	}
+}
+
+func TestRounding(t *testing.T) {
+	tests := []struct {
+		f                         float64
+		truncated, halfUp, toEven int
+	}{
+		{0.4, 0, 0, 0},
+		{0.6, 0, 1, 1},
+		{-0.4, 0, 0, 0},
+		{-0.6, 0, -1, -1},
+		{2.5, 2, 3, 2},
+		{3.5, 3, 4, 4},
+		{-2.5, -2, -2, -2},
+		{-3.5, -3, -3, -4},
+		{-0.5, 0, 0, 0},
+		{-12.7, -12, -13, -13},
+	}
+	for _, tt := range tests {
+		for _, r := range []struct {
+			mode rounding
+			want int
+		}{{truncate, tt.truncated}, {roundHalfUp, tt.halfUp}, {roundHalfEven, tt.toEven}} {
+			if got := r.mode.round(tt.f); got != r.want {
+				t.Errorf("%s rounds %v to %d, want %d", r.mode, tt.f, got, r.want)
+			}
+		}
+	}
+
+	if got := rounding("").round(-0.6); got != -1 {
+		t.Errorf("unset rounding rounds -0.6 to %d, want the default half up to -1", got)
+	}
+	if _, err := parseRounding("half-down"); err == nil {
+		t.Error("half-down parsed")
+	}
+}
+
+func TestRoundingApplied(t *testing.T) {
+	tests := []struct {
+		rounding string
+		want     int
+	}{
+		{"", -1},
+		{"truncate", 0},
+		{"half-up", -1},
+		{"half-even", -1},
+	}
+	for _, tt := range tests {
+		t.Run("rounding "+tt.rounding, func(t *testing.T) {
+			cfg := testConfigFromEnv(t, map[string]string{"WEATHER_ROUNDING": tt.rounding})
+			_, ts := newTestServer(t, cfg, nil, &fakeProvider{name: "alpha", kelvin: celsiusToKelvin(-0.6)})
+
+			var got struct {
+				Temp int `json:"temp"`
+			}
+			getJSONResponse(t, ts.URL+"/weather/Oslo?units=c", &got)
+			if got.Temp != tt.want {
+				t.Errorf("-0.6°C shown as %d, want %d", got.Temp, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultUnit(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultUnit string // WEATHER_DEFAULT_UNIT
+		query       string
+		wantUnits   string
+		wantTemp    int
+	}{
+		{"backward compatible", "", "", "fahrenheit", 54},
+		{"Celsius by default", "celsius", "", "celsius", 12},
+		{"Kelvin by initial", "k", "", "kelvin", 285},
+		{"asked for overriding it", "celsius", "?units=f", "fahrenheit", 54},
+		{"unknown falling back", "rankine", "", "fahrenheit", 54},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakes := fakeRegistry{}
+			fakes.add("alpha", 285.15)
+			cfg := testConfigFromEnv(t, map[string]string{"WEATHER_DEFAULT_UNIT": tt.defaultUnit})
+			_, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+			var got struct {
+				Temp  int    `json:"temp"`
+				Units string `json:"units"`
+			}
+			getJSONResponse(t, ts.URL+"/weather/Oslo"+tt.query, &got)
+			if got.Units != tt.wantUnits || got.Temp != tt.wantTemp {
+				t.Errorf("%d in %s, want %d in %s", got.Temp, got.Units, tt.wantTemp, tt.wantUnits)
+			}
+		})
+	}
+}
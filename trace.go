@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type traceIDKey struct{}
+
+// traced records the trace each request belongs to, as given by its W3C
+// traceparent header, so that the metrics observed while serving it can
+// point back to the trace. Requests without one aren't traced.
+func traced(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			r = r.WithContext(context.WithValue(r.Context(), traceIDKey{}, id))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// traceIDFrom returns the ID of the trace ctx belongs to, or "" if none.
+func traceIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// parseTraceparent extracts the trace ID from a traceparent header, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(h string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", false
+	}
+
+	id := parts[1]
+	if len(id) != 32 || !isLowerHex(id) || id == strings.Repeat("0", 32) {
+		return "", false
+	}
+	return id, true
+}
+
+func isLowerHex(s string) bool {
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Trends a temperature may be reported with.
+const (
+	trendRising  = "rising"
+	trendSteady  = "steady"
+	trendFalling = "falling"
+)
+
+// A trendTracker keeps each place's recent temperatures, to tell whether it
+// is warming or cooling. It holds at most maxTrendPlaces places, and
+// maxTrendReadings readings of each, so its memory stays bounded whatever
+// places are asked after.
+type trendTracker struct {
+	// window is how far back readings are compared, and threshold the
+	// change over it, in degrees Celsius, beyond which a place is rising or
+	// falling rather than steady.
+	window    time.Duration
+	threshold float64
+
+	mu     sync.Mutex
+	places map[string]*readings
+}
+
+const (
+	maxTrendPlaces   = 1024
+	maxTrendReadings = 64
+)
+
+// readings are a place's temperatures, oldest first.
+type readings struct {
+	at      []time.Time
+	kelvins []float64
+}
+
+func newTrendTracker(window time.Duration, threshold float64) *trendTracker {
+	return &trendTracker{window: window, threshold: threshold, places: map[string]*readings{}}
+}
+
+// record notes the temperature at the place with the given key, as fetched
+// at a time, and returns the place's trend since the start of the window: one
+// of trendRising, trendSteady or trendFalling, or empty if no earlier reading
+// in the window has been recorded. A reading fetched no later than the last
+// one recorded, such as the same cached result served again, is not recorded
+// twice, so that a cache hit doesn't count as a fresh reading. A nil
+// trendTracker records nothing.
+func (t *trendTracker) record(key string, temp Temperature, fetched time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.places[key]
+	if !ok {
+		if len(t.places) >= maxTrendPlaces {
+			t.evict()
+		}
+		r = &readings{}
+		t.places[key] = r
+	}
+
+	if n := len(r.at); n == 0 || fetched.After(r.at[n-1]) {
+		// Forget readings from before the window, and the oldest should
+		// there still be too many.
+		drop := 0
+		for drop < len(r.at) && fetched.Sub(r.at[drop]) > t.window {
+			drop++
+		}
+		if n := len(r.at) - drop + 1; n > maxTrendReadings {
+			drop += n - maxTrendReadings
+		}
+		r.at = append(r.at[drop:], fetched)
+		r.kelvins = append(r.kelvins[drop:], temp.Kelvin())
+	}
+
+	if len(r.at) < 2 {
+		return ""
+	}
+	// A difference of Kelvin is the same in degrees Celsius.
+	switch delta := r.kelvins[len(r.kelvins)-1] - r.kelvins[0]; {
+	case delta > t.threshold:
+		return trendRising
+	case delta < -t.threshold:
+		return trendFalling
+	}
+	return trendSteady
+}
+
+// evict forgets the place whose latest reading is oldest, to make room for
+// another. The caller must hold t.mu.
+func (t *trendTracker) evict() {
+	var oldest string
+	var when time.Time
+	for key, r := range t.places {
+		last := r.at[len(r.at)-1]
+		if oldest == "" || last.Before(when) {
+			oldest, when = key, last
+		}
+	}
+	delete(t.places, oldest)
+}
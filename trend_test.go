@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTrends(t *testing.T) {
+	type reading struct {
+		after   time.Duration // since the first reading
+		celsius float64
+	}
+	tests := []struct {
+		name     string
+		readings []reading
+		want     string // after the last reading
+	}{
+		{"single reading", []reading{{0, 10}}, ""},
+		{"rising", []reading{{0, 10}, {10 * time.Minute, 10.4}, {20 * time.Minute, 11}}, trendRising},
+		{"falling", []reading{{0, 10}, {30 * time.Minute, 8}}, trendFalling},
+		{"within the threshold", []reading{{0, 10}, {10 * time.Minute, 10.3}, {20 * time.Minute, 10.5}}, trendSteady},
+		{"up and back down", []reading{{0, 10}, {10 * time.Minute, 14}, {20 * time.Minute, 10}}, trendSteady},
+		{"rise before the window", []reading{{0, 5}, {2 * time.Hour, 10}, {2*time.Hour + 10*time.Minute, 10.2}}, trendSteady},
+		{"only reading in the window", []reading{{0, 5}, {2 * time.Hour, 10}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newTrendTracker(time.Hour, 0.5)
+			start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+			var got string
+			for _, r := range tt.readings {
+				got = tracker.record("Paris", Temperature(celsiusToKelvin(r.celsius)), start.Add(r.after))
+			}
+			if got != tt.want {
+				t.Errorf("trend %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrendTrackerBounded(t *testing.T) {
+	tracker := newTrendTracker(24*time.Hour, 0.5)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2*maxTrendReadings; i++ {
+		tracker.record("Paris", 280, start.Add(time.Duration(i)*time.Second))
+	}
+	if n := len(tracker.places["Paris"].at); n != maxTrendReadings {
+		t.Errorf("%d readings kept, want %d", n, maxTrendReadings)
+	}
+
+	for i := 0; i <= maxTrendPlaces; i++ {
+		tracker.record(fmt.Sprint("place", i), 280, start.Add(time.Hour+time.Duration(i)*time.Second))
+	}
+	if n := len(tracker.places); n != maxTrendPlaces {
+		t.Errorf("%d places kept, want %d", n, maxTrendPlaces)
+	}
+	if _, ok := tracker.places["Paris"]; ok {
+		t.Error("Paris, read longest ago, not evicted")
+	}
+}
+
+func TestWeatherReportsTrend(t *testing.T) {
+	fakes := fakeRegistry{}
+	alpha := fakes.add("alpha", 280)
+	cfg := testConfig(t)
+	cfg.cacheTTL = 0
+	_, ts := newTestServer(t, cfg, nil, fakes.providers()...)
+
+	for i, want := range []string{"", trendRising, trendRising} {
+		alpha.kelvin = 280 + float64(i)
+		var got struct {
+			Trend *string `json:"trend"`
+		}
+		getJSONResponse(t, ts.URL+"/weather/Paris", &got)
+		switch {
+		case want == "" && got.Trend != nil:
+			t.Errorf("reading %d: trend %q, want none yet", i, *got.Trend)
+		case want != "" && (got.Trend == nil || *got.Trend != want):
+			t.Errorf("reading %d: trend %v, want %q", i, got.Trend, want)
+		}
+	}
+}
+
+func TestCachedResultRecordedOnce(t *testing.T) {
+	fakes := fakeRegistry{}
+	fakes.add("alpha", 280)
+	s, ts := newTestServer(t, testConfig(t), nil, fakes.providers()...)
+
+	for i := 0; i < 3; i++ {
+		var got struct {
+			Trend *string `json:"trend"`
+		}
+		getJSONResponse(t, ts.URL+"/weather/Paris", &got)
+		if got.Trend != nil {
+			t.Errorf("request %d: trend %q from one fetch, want none", i, *got.Trend)
+		}
+	}
+	if n := len(s.trends.places[query{city: "Paris"}.key()].at); n != 1 {
+		t.Errorf("%d readings recorded of one cached result, want 1", n)
+	}
+}
+
+func TestEarlierFetchNotRecorded(t *testing.T) {
+	tracker := newTrendTracker(time.Hour, 0.5)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tracker.record("Paris", Temperature(celsiusToKelvin(10)), start.Add(10*time.Minute))
+	// A stale result, fetched before the one already recorded.
+	if got := tracker.record("Paris", Temperature(celsiusToKelvin(5)), start); got != "" {
+		t.Errorf("trend %q, want none: the earlier fetch isn't a new reading", got)
+	}
+	if got := tracker.record("Paris", Temperature(celsiusToKelvin(11)), start.Add(20*time.Minute)); got != trendRising {
+		t.Errorf("trend %q, want %q", got, trendRising)
+	}
+}
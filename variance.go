@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// varianceTracker keeps how far each provider's recent readings were from
+// the consensus of the lookups they went into, so that providers that agree
+// with the others consistently can be trusted more than erratic ones. It is
+// deviations from the consensus that are tracked, not readings themselves,
+// since readings of different places vary for reasons of their own.
+type varianceTracker struct {
+	window int
+
+	mu         sync.Mutex
+	deviations map[string]*deviations
+}
+
+// deviations is a ring buffer of a provider's recent deviations, in Kelvin.
+type deviations struct {
+	kelvins []float64
+	next    int
+}
+
+const (
+	// minVarianceHistory is how many deviations a provider needs before its
+	// variance is trusted to weight it by.
+	minVarianceHistory = 5
+
+	// minVariance keeps a provider that has agreed exactly with every
+	// consensus from being weighted infinitely, in Kelvin squared.
+	minVariance = 0.01
+)
+
+func newVarianceTracker(window int) *varianceTracker {
+	if window < 1 {
+		window = 1
+	}
+	return &varianceTracker{window: window, deviations: map[string]*deviations{}}
+}
+
+// record notes how far each of obs was from consensus, in Kelvin. A single
+// reading is its own consensus, and says nothing, so is ignored. A nil
+// varianceTracker records nothing.
+func (t *varianceTracker) record(obs []observation, consensus float64) {
+	if t == nil || len(obs) < 2 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, o := range obs {
+		d, ok := t.deviations[o.provider]
+		if !ok {
+			d = &deviations{}
+			t.deviations[o.provider] = d
+		}
+
+		if len(d.kelvins) < t.window {
+			d.kelvins = append(d.kelvins, o.Kelvin-consensus)
+			continue
+		}
+		d.kelvins[d.next] = o.Kelvin - consensus
+		d.next = (d.next + 1) % t.window
+	}
+}
+
+// weights are the inverse variances of the deviations of the providers of
+// obs, by name, for a weighted average. Until every one of them has
+// minVarianceHistory deviations, weights is nil, and all count the same.
+func (t *varianceTracker) weights(obs []observation) map[string]float64 {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	weights := map[string]float64{}
+	for _, o := range obs {
+		v, ok := t.deviations[o.provider].variance()
+		if !ok {
+			return nil
+		}
+		weights[o.provider] = 1 / v
+	}
+	return weights
+}
+
+// variance is the variance of d, at least minVariance. It isn't known until
+// d has minVarianceHistory deviations.
+func (d *deviations) variance() (float64, bool) {
+	if d == nil || len(d.kelvins) < minVarianceHistory {
+		return 0, false
+	}
+
+	mean := 0.0
+	for _, k := range d.kelvins {
+		mean += k
+	}
+	mean /= float64(len(d.kelvins))
+
+	v := 0.0
+	for _, k := range d.kelvins {
+		v += (k - mean) * (k - mean)
+	}
+	v /= float64(len(d.kelvins))
+
+	if v < minVariance {
+		v = minVariance
+	}
+	return v, true
+}
+
+// writeTo reports the weight each provider with enough history would have in
+// a blend, as weather_provider_blend_weight.
+func (t *varianceTracker) writeTo(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := make([]string, 0, len(t.deviations))
+	for name := range t.deviations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# HELP weather_provider_blend_weight Inverse variance of each provider's deviation from consensus over its last %d readings.\n", t.window)
+	fmt.Fprintf(w, "# TYPE weather_provider_blend_weight gauge\n")
+	for _, name := range names {
+		if v, ok := t.deviations[name].variance(); ok {
+			fmt.Fprintf(w, "weather_provider_blend_weight{provider=%q} %g\n", name, 1/v)
+		}
+	}
+}
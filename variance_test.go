@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+)
+
+// seedDeviations records rounds lookups in which each provider strayed from
+// a consensus of 280 K by alternately plus and minus its spread, in Kelvin.
+func seedDeviations(tracker *varianceTracker, rounds int, spreads map[string]float64) {
+	for i := 0; i < rounds; i++ {
+		sign := float64(1 - 2*(i%2))
+		var obs []observation
+		for name, spread := range spreads {
+			obs = append(obs, observation{provider: name, Conditions: Conditions{Kelvin: 280 + sign*spread}})
+		}
+		tracker.record(obs, 280)
+	}
+}
+
+func TestInverseVarianceBlend(t *testing.T) {
+	tests := []struct {
+		name        string
+		rounds      int // of history seeded
+		want        float64
+		wantWeights map[string]float64 // nil for equal weights
+	}{
+		// alpha's variance is 0.1², floored at minVariance, for a weight of
+		// 100; beta's is 1, for a weight of 1.
+		{"enough history", 10, (100*280 + 1*290) / 101.0, map[string]float64{"alpha": 100, "beta": 1}},
+		{"too little history", minVarianceHistory - 1, 285, nil},
+		{"no history", 0, 285, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newVarianceTracker(20)
+			seedDeviations(tracker, tt.rounds, map[string]float64{"alpha": 0.1, "beta": 1})
+
+			// The weights the history gives, before the lookup adds to it.
+			weights := tracker.weights([]observation{{provider: "alpha"}, {provider: "beta"}})
+			if tt.wantWeights == nil && weights != nil {
+				t.Errorf("weights %v, want equal weights", weights)
+			}
+			for name, want := range tt.wantWeights {
+				if math.Abs(weights[name]-want) > 1e-6 {
+					t.Errorf("%s weighted %v, want %v", name, weights[name], want)
+				}
+			}
+
+			fakes := fakeRegistry{}
+			fakes.add("alpha", 280)
+			fakes.add("beta", 290)
+			w := multiWeatherProvider{providers: fakes.providers(), variances: tracker, inverseVariance: true}
+			res, err := w.aggregate(context.Background(), query{city: "Paris"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(res.temp.Kelvin()-tt.want) > 1e-9 {
+				t.Errorf("blended %v K, want %v K", res.temp.Kelvin(), tt.want)
+			}
+
+			// The explanation shows the weights each reading had.
+			for _, r := range res.explanation.Readings {
+				want := 1.0
+				if tt.wantWeights != nil {
+					want = tt.wantWeights[r.Provider]
+				}
+				if r.Weight == nil || math.Abs(*r.Weight-want) > 1e-6 {
+					t.Errorf("%s weighted %v, want %v", r.Provider, r.Weight, want)
+				}
+			}
+		})
+	}
+}
+
+func TestVarianceTrackerWindow(t *testing.T) {
+	tracker := newVarianceTracker(minVarianceHistory)
+	// An erratic past, then steady agreement filling the window.
+	seedDeviations(tracker, 10, map[string]float64{"alpha": 5, "beta": 5})
+	seedDeviations(tracker, minVarianceHistory, map[string]float64{"alpha": 0, "beta": 1})
+
+	weights := tracker.weights([]observation{{provider: "alpha"}, {provider: "beta"}})
+	if weights["alpha"] != 1/minVariance || math.Abs(weights["beta"]-1/0.96) > 1e-9 {
+		t.Errorf("weights %v, want only the window's deviations counted", weights)
+	}
+	if weights := tracker.weights([]observation{{provider: "alpha"}, {provider: "gamma"}}); weights != nil {
+		t.Errorf("weights %v with gamma unseen, want none", weights)
+	}
+
+	var metrics strings.Builder
+	tracker.writeTo(&metrics)
+	if !strings.Contains(metrics.String(), `weather_provider_blend_weight{provider="alpha"} 100`) {
+		t.Errorf("metrics lack alpha's weight:\n%s", metrics.String())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// weatherbit queries Weatherbit.io's current weather API.
+type weatherbit struct {
+	keys    *keyRing
+	headers http.Header
+}
+
+func (w weatherbit) Name() string        { return "weatherbit" }
+func (w weatherbit) Attribution() string { return "Weather data by Weatherbit.io" }
+
+func (w weatherbit) capabilities() Capabilities {
+	return capTemperature | capCoordinates | capConditions | capCloudCover | capPressure | capUVIndex | capVisibility | capWind | capHumidity
+}
+
+func (w weatherbit) temperature(ctx context.Context, city string) (float64, error) {
+	q, err := parsePlace(city)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := w.conditions(ctx, q)
+	return c.Kelvin, err
+}
+
+func (w weatherbit) temperatureAt(ctx context.Context, c coordinates) (float64, error) {
+	cond, err := w.conditions(ctx, query{coords: &c})
+	return cond.Kelvin, err
+}
+
+func (w weatherbit) conditions(ctx context.Context, q query) (Conditions, error) {
+	// Weatherbit wraps its observations in an array, even though a query
+	// for the current weather yields exactly one.
+	var d struct {
+		Data []struct {
+			Celsius    *float64 `json:"temp"`
+			FeelsLike  *float64 `json:"app_temp"` // °C
+			Pressure   *float64 `json:"slp"`      // sea-level, mb
+			CloudCover *float64 `json:"clouds"`   // percent
+			UVIndex    *float64 `json:"uv"`
+			Visibility *float64 `json:"vis"`      // km
+			WindSpeed  *float64 `json:"wind_spd"` // m/s
+			Humidity   *float64 `json:"rh"`       // percent
+			TimeZone   string   `json:"timezone"`
+			Weather    struct {
+				Description string `json:"description"`
+			} `json:"weather"`
+		} `json:"data"`
+	}
+
+	// Weatherbit answers 204 No Content, with no body at all, for a place it
+	// doesn't know.
+	err := w.keys.use(func(key string) error {
+		return getJSONWith(ctx, w.currentURL(q, key), w.headers, &d)
+	})
+	if errors.Is(err, io.EOF) {
+		return Conditions{}, ErrCityNotFound
+	}
+	if err != nil {
+		return Conditions{}, err
+	}
+	if len(d.Data) == 0 {
+		return Conditions{}, ErrCityNotFound
+	}
+
+	obs := d.Data[0]
+	if obs.Celsius == nil {
+		return Conditions{}, schemaDrift(w.Name(), "data.temp")
+	}
+	kelvin := celsiusToKelvin(*obs.Celsius)
+	log.Printf("%s: %s: %.2f", w.Name(), q, kelvin)
+
+	return Conditions{
+		Kelvin:     kelvin,
+		Native:     &nativeReading{*obs.Celsius, celsius},
+		FeelsLike:  celsiusToKelvinPtr(obs.FeelsLike),
+		CloudCover: obs.CloudCover,
+		Pressure:   obs.Pressure,
+		UVIndex:    obs.UVIndex,
+		Visibility: kmToMetersPtr(obs.Visibility),
+		WindSpeed:  obs.WindSpeed,
+		Humidity:   obs.Humidity,
+		TimeZone:   obs.TimeZone,
+		Summary:    obs.Weather.Description,
+	}, nil
+}
+
+// currentURL is the URL of the current weather at q, asked for with key. A
+// state or country is passed as Weatherbit's own parameter, rather than run
+// into the city name.
+func (w weatherbit) currentURL(q query, key string) string {
+	params := url.Values{"key": {key}}
+	switch {
+	case q.coords != nil:
+		params.Set("lat", fmt.Sprint(q.coords.lat))
+		params.Set("lon", fmt.Sprint(q.coords.lon))
+	default:
+		city := q.city
+		if q.state != "" {
+			city += "," + q.state
+		}
+		params.Set("city", city)
+		if q.country != "" {
+			params.Set("country", q.country)
+		}
+	}
+	if q.lang != "" {
+		params.Set("lang", strings.SplitN(q.lang, "-", 2)[0])
+	}
+	return "https://api.weatherbit.io/v2.0/current?" + params.Encode()
+}
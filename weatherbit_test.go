@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"testing"
+)
+
+// weatherbitParis is a Weatherbit current weather response, trimmed of the
+// fields nothing reads.
+const weatherbitParis = `{
+	"data": [{
+		"city_name": "Paris",
+		"country_code": "FR",
+		"lat": 48.8566,
+		"lon": 2.3522,
+		"ob_time": "2019-06-08 12:20",
+		"temp": 18.5,
+		"slp": 1016.2,
+		"clouds": 75,
+		"uv": 3.2,
+		"vis": 10,
+		"weather": {"icon": "c03d", "code": 803, "description": "Broken clouds"}
+	}],
+	"count": 1
+}`
+
+func TestWeatherbit(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    float64
+		wantErr error
+	}{
+		{"representative payload", http.StatusOK, weatherbitParis, 291.65, nil},
+		{"unknown place", http.StatusNoContent, "", 0, ErrCityNotFound},
+		{"no observations", http.StatusOK, `{"data": [], "count": 0}`, 0, ErrCityNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("city") != "Paris" || r.URL.Query().Get("key") != "KEY" {
+					http.Error(w, "bad query", http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+			got, err := weatherbit{keys: newKeyRing("KEY")}.temperature(context.Background(), "Paris")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("temperature %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeatherbitConditions(t *testing.T) {
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(weatherbitParis))
+	})
+	c, err := weatherbit{keys: newKeyRing("KEY")}.conditions(context.Background(), query{city: "Paris"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []struct {
+		name string
+		got  *float64
+		want float64
+	}{
+		{"pressure", c.Pressure, 1016.2},
+		{"cloud cover", c.CloudCover, 75},
+		{"UV index", c.UVIndex, 3.2},
+		{"visibility", c.Visibility, 10000},
+	} {
+		if f.got == nil || math.Abs(*f.got-f.want) > 1e-9 {
+			t.Errorf("%s %v, want %v", f.name, f.got, f.want)
+		}
+	}
+	if c.Summary != "Broken clouds" {
+		t.Errorf("summary %q, want Broken clouds", c.Summary)
+	}
+}
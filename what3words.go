@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// wordsResolver resolves what3words addresses, such as "filled.count.soap",
+// to the coordinates of the 3m square they name.
+type wordsResolver interface {
+	resolve(ctx context.Context, words string) (coordinates, error)
+}
+
+// words resolves the ?w3w= addresses of requests. It is nil, and such
+// requests are rejected, unless a what3words API key is configured.
+var words wordsResolver
+
+type what3words struct {
+	apiKey string
+}
+
+func (w what3words) resolve(ctx context.Context, words string) (coordinates, error) {
+	var d struct {
+		Coordinates struct {
+			Lat float64
+			Lng float64
+		}
+	}
+
+	err := getJSON(ctx, "https://api.what3words.com/v3/convert-to-coordinates?words="+url.QueryEscape(words)+"&key="+w.apiKey, &d)
+
+	// what3words answers 400 Bad Request for addresses that don't exist.
+	var status *statusError
+	if errors.As(err, &status) && status.code == http.StatusBadRequest {
+		return coordinates{}, &requestError{fmt.Errorf("unknown what3words address %q", words)}
+	}
+	if err != nil {
+		return coordinates{}, err
+	}
+
+	return coordinates{d.Coordinates.Lat, d.Coordinates.Lng}, nil
+}
+
+// parseWords validates a what3words address: three words of letters,
+// separated by dots, optionally prefixed with "///" as they are often
+// written. It returns the address without the prefix.
+func parseWords(s string) (string, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "///")
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed what3words address %q: want three words, as in filled.count.soap", s)
+	}
+	for _, p := range parts {
+		if p == "" || strings.IndexFunc(p, func(r rune) bool { return !unicode.IsLetter(r) }) >= 0 {
+			return "", fmt.Errorf("malformed what3words address %q: want three words, as in filled.count.soap", s)
+		}
+	}
+	return strings.ToLower(s), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubResolver resolves the what3words addresses it holds, and rejects the
+// rest as what3words does.
+type stubResolver map[string]coordinates
+
+func (s stubResolver) resolve(ctx context.Context, words string) (coordinates, error) {
+	c, ok := s[words]
+	if !ok {
+		return coordinates{}, &requestError{fmt.Errorf("unknown what3words address %q", words)}
+	}
+	return c, nil
+}
+
+func TestQueryByWords(t *testing.T) {
+	prev := words
+	t.Cleanup(func() { words = prev })
+	london := coordinates{51.520847, -0.195521}
+
+	tests := []struct {
+		name     string
+		resolver wordsResolver
+		w3w      string
+		want     coordinates
+		wantErr  bool
+	}{
+		{"resolved", stubResolver{"filled.count.soap": london}, "filled.count.soap", london, false},
+		{"prefixed and capitalized", stubResolver{"filled.count.soap": london}, "///Filled.Count.Soap", london, false},
+		{"unknown address", stubResolver{}, "filled.count.soup", coordinates{}, true},
+		{"two words", stubResolver{}, "filled.count", coordinates{}, true},
+		{"not words", stubResolver{}, "filled.c0unt.soap", coordinates{}, true},
+		{"not configured", nil, "filled.count.soap", coordinates{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			words = tt.resolver
+			r := httptest.NewRequest("GET", "/weather/?w3w="+tt.w3w, nil)
+			q, err := queryFromRequest(r, "")
+
+			var reqErr *requestError
+			switch {
+			case tt.wantErr && !errors.As(err, &reqErr):
+				t.Errorf("error %v, want a request error", err)
+			case tt.wantErr && errorStatus(err) != http.StatusBadRequest:
+				t.Errorf("error %v has status %d, want 400", err, errorStatus(err))
+			case !tt.wantErr && err != nil:
+				t.Errorf("error %v", err)
+			case !tt.wantErr && (q.coords == nil || *q.coords != tt.want):
+				t.Errorf("query at %v, want %v", q.coords, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhat3wordsClient(t *testing.T) {
+	serveUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("words") != "filled.count.soap" {
+			http.Error(w, `{"error": {"code": "BadWords"}}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"coordinates": {"lat": 51.520847, "lng": -0.195521}}`)
+	})
+
+	c, err := what3words{apiKey: "KEY"}.resolve(context.Background(), "filled.count.soap")
+	if err != nil || c != (coordinates{51.520847, -0.195521}) {
+		t.Errorf("resolved to %v, %v", c, err)
+	}
+
+	var reqErr *requestError
+	if _, err := (what3words{apiKey: "KEY"}).resolve(context.Background(), "filled.count.soup"); !errors.As(err, &reqErr) {
+		t.Errorf("unknown address: error %v, want a request error", err)
+	}
+}